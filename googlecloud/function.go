@@ -1,28 +1,30 @@
 package function
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/xfated/golistbot/services"
 	"github.com/xfated/golistbot/services/utils"
-
-	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
+var webhook http.Handler
+
 func init() {
 	utils.InitTelegram()
-	utils.InitFirebase()
+	store := utils.InitStore()
+	// The function's URL is public, so without a secret anyone could post updates as any user
+	if utils.WEBHOOK_SECRET == "" {
+		log.Fatal("WEBHOOK_SECRET must be set, and given to setWebhook as secret_token")
+	}
+	// clear abandoned sessions and processed updates in the background, as the server does
+	go utils.RunSessionSweeper(store, utils.SESSION_TIMEOUT, utils.SESSION_TIMEOUT, services.NotifyExpired, nil)
+	go utils.RunUpdateSweeper(store, time.Hour, nil)
+	utils.SetGeocoder(utils.InitGeocoder())
+	webhook = services.WebhookHandler(store, services.NewDispatcher(store, utils.UPDATE_WORKERS))
 }
 
 func TelegramHandler(w http.ResponseWriter, r *http.Request) {
-
-	var update tgbotapi.Update
-	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-		log.Printf("could not decode incoming update %s", err.Error())
-		return
-	}
-
-	go services.HandleUserInput(&update)
+	webhook.ServeHTTP(w, r)
 }
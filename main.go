@@ -2,41 +2,15 @@
 package main
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/xfated/golistbot/services"
 	"github.com/xfated/golistbot/services/utils"
-	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
-func webhookHandler(c *gin.Context) {
-	defer c.Request.Body.Close()
-
-	bytes, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	var update tgbotapi.Update
-	err = json.Unmarshal(bytes, &update)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	if update.Message != nil {
-		log.Printf("From: %+v Text: %+v\n", update.Message.From, update.Message.Text)
-	}
-
-	// Handle user input
-	go services.HandleUserInput(&update)
-}
-
 func main() {
 	port := os.Getenv("PORT")
 
@@ -48,12 +22,25 @@ func main() {
 	router := gin.New()
 	router.Use(gin.Logger())
 
+	// storage
+	store := utils.InitStore()
+	// clear abandoned sessions and processed updates in the background
+	go utils.RunSessionSweeper(store, utils.SESSION_TIMEOUT, utils.SESSION_TIMEOUT, services.NotifyExpired, nil)
+	go utils.RunUpdateSweeper(store, time.Hour, nil)
+	// places item addresses on the map, if configured
+	utils.SetGeocoder(utils.InitGeocoder())
+
 	// telegram
 	utils.InitTelegram()
-	router.POST("/"+utils.TELEGRAM_BOT_TOKEN, webhookHandler)
-
-	// firebase
-	utils.InitFirebase()
+	webhookPath := "/webhook"
+	if utils.WEBHOOK_SECRET == "" {
+		// Only the bot token in the path keeps others from posting updates
+		log.Print("WARNING: WEBHOOK_SECRET is not set, so deliveries aren't checked. Serving the webhook at the bot token instead; " +
+			"set WEBHOOK_SECRET and give it to setWebhook as secret_token")
+		webhookPath = "/" + utils.TELEGRAM_BOT_TOKEN
+	}
+	dispatcher := services.NewDispatcher(store, utils.UPDATE_WORKERS)
+	router.POST(webhookPath, gin.WrapH(services.WebhookHandler(store, dispatcher)))
 
 	err := router.Run(":" + port)
 	if err != nil {
@@ -0,0 +1,19 @@
+// Command migrate re-keys the items of a Firebase database by generated item IDs.
+// Items used to be keyed by their name. Run once after upgrading, with the same
+// DATABASE_URL and SERVICE_ACCOUNT_JSON as the bot.
+package main
+
+import (
+	"log"
+
+	"github.com/xfated/golistbot/services/utils"
+)
+
+func main() {
+	store := utils.InitFirebase()
+	migrated, err := store.MigrateItemIDs()
+	if err != nil {
+		log.Fatalln("Error migrating items:", err)
+	}
+	log.Printf("Migrated %d item(s)", migrated)
+}
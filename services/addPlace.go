@@ -3,7 +3,6 @@ package services
 import (
 	"fmt"
 	"log"
-	"strconv"
 
 	"github.com/xfated/golistbot/services/constants"
 	"github.com/xfated/golistbot/services/utils"
@@ -11,9 +10,11 @@ import (
 )
 
 /* Create and send template reply keyboard */
-func sendTemplateReplies(update *tgbotapi.Update, text string) {
+func sendTemplateReplies(store utils.Store, update *tgbotapi.Update, text string) {
 	// Create buttons
+	setNameButton := tgbotapi.NewKeyboardButton("/setName")
 	setAddressButton := tgbotapi.NewKeyboardButton("/setAddress")
+	setLocationButton := tgbotapi.NewKeyboardButton("/setLocation")
 	setNotesButton := tgbotapi.NewKeyboardButton("/setNotes")
 	setURLButton := tgbotapi.NewKeyboardButton("/setURL")
 	addImageButton := tgbotapi.NewKeyboardButton("/addImage")
@@ -23,429 +24,420 @@ func sendTemplateReplies(update *tgbotapi.Update, text string) {
 	submitButton := tgbotapi.NewKeyboardButton("/submit")
 	cancelButton := tgbotapi.NewKeyboardButton("/cancel")
 	// Create rows
-	row1 := tgbotapi.NewKeyboardButtonRow(setAddressButton, setURLButton, setNotesButton)
-	row2 := tgbotapi.NewKeyboardButtonRow(addImageButton, addTagButton, removeTagButton)
+	row1 := tgbotapi.NewKeyboardButtonRow(setNameButton, setAddressButton, setURLButton, setNotesButton)
+	row2 := tgbotapi.NewKeyboardButtonRow(setLocationButton, addImageButton, addTagButton, removeTagButton)
 	row3 := tgbotapi.NewKeyboardButtonRow(cancelButton, previewButton, submitButton)
 
 	replyKeyboard := tgbotapi.NewReplyKeyboard(row1, row2, row3)
 	replyKeyboard.ResizeKeyboard = true
 	replyKeyboard.OneTimeKeyboard = true
 	replyKeyboard.Selective = false
-	utils.SetReplyMarkupKeyboard(update, text, replyKeyboard, true)
+	utils.SetReplyMarkupKeyboard(store, update, text, replyKeyboard, true)
 }
 
-func sendExistingTagsResponse(update *tgbotapi.Update, text string) {
-	chatID, err := utils.GetChatTarget(update)
-	if err != nil {
-		log.Printf("Error GetChatTarget: %+v", err)
+func sendExistingTagsResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	if err := addTagPicker.show(store, update, text); err != nil {
+		log.Printf("error showing tags: %+v", err)
 		utils.SendMessage(update, "Sorry, an error occured!", false)
-		return
 	}
-	chatIDString := strconv.FormatInt(chatID, 10)
+}
 
-	tagsMap, err := utils.GetTags(update, chatIDString)
-	if err != nil {
-		log.Printf("error GetTags: %+v", err)
+func sendAddedTagsResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	if err := removeTagPicker.show(store, update, text); err != nil {
+		log.Printf("error showing tags: %+v", err)
 		utils.SendMessage(update, "Sorry, an error occured!", false)
-		return
 	}
+}
 
-	/* No tags, just send done */
-	if len(tagsMap) == 0 {
-		utils.CreateAndSendInlineKeyboard(update, "No tags found. Just click this button when you're done!", 1, "/done")
-		return
+/* unaddedTags are the tags of the target list the item doesn't have yet */
+func unaddedTags(store utils.Store, update *tgbotapi.Update) ([]utils.Choice, error) {
+	list, err := utils.GetTargetList(store, update)
+	if err != nil {
+		return nil, err
 	}
-
-	/* Get already added tags */
-	curTempTags, err := utils.GetTempItemTags(update)
+	tagsMap, err := utils.GetTags(store, list.ID())
 	if err != nil {
-		log.Printf("error GetTags: %+v", err)
-		utils.SendMessage(update, "Sorry, an error occured!", false)
-		return
-	}
-	tags := make([]string, 0)
-	i := 0
-	for tag := range tagsMap {
-		// if not inside current temp tags
-		if !curTempTags[tag] {
-			tags = append(tags, tag)
-			i++
-		}
+		return nil, err
 	}
-
-	tags = append(tags, "/done")
-	utils.CreateAndSendInlineKeyboard(update, text, 1, tags...)
+	curTempTags, err := utils.GetTempItemTags(store, update)
+	if err != nil {
+		return nil, err
+	}
+	for tag := range curTempTags {
+		delete(tagsMap, tag)
+	}
+	return utils.TagChoices(tagsMap), nil
 }
 
-func sendAddedTagsResponse(update *tgbotapi.Update, text string) {
-	tagsMap, err := utils.GetTempItemTags(update)
+func addedTags(store utils.Store, update *tgbotapi.Update) ([]utils.Choice, error) {
+	tagsMap, err := utils.GetTempItemTags(store, update)
 	if err != nil {
-		log.Printf("error GetTags: %+v", err)
-		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return nil, err
 	}
+	return utils.TagChoices(tagsMap), nil
+}
 
-	/* No tags, just send done */
-	if len(tagsMap) == 0 {
-		utils.CreateAndSendInlineKeyboard(update, "No tags found. Just help me click that done button thanks", 1, "/done")
-		return
+var (
+	// New tags are typed, so the existing ones can't be filtered
+	addTagPicker = picker{
+		choices: unaddedTags,
+		extra:   []string{"/done"},
+		prompt:  "Existing tags:",
+		empty:   "No tags found. Just click this button when you're done!",
+	}
+	removeTagPicker = picker{
+		choices: addedTags,
+		extra:   []string{"/done"},
+		prompt:  "Existing tags:",
+		empty:   "No tags found. Just help me click that done button thanks",
+		filter:  true,
 	}
+)
 
-	tags := make([]string, len(tagsMap)+1)
-	i := 0
-	for tag := range tagsMap {
-		tags[i] = tag
-		i++
-	}
-	tags[len(tagsMap)] = "/done"
-	utils.CreateAndSendInlineKeyboard(update, text, 1, tags...)
+func sendConfirmSubmitResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	utils.CreateAndSendInlineKeyboard(store, update, text, 2, "yes", "no")
 }
 
-// func sendDoneResponse(update *tgbotapi.Update, text string) {
-// 	utils.CreateAndSendInlineKeyboard(update, text, 1, "/done", "/done")
-// }
+/* nextAction prompts for the next action on the item */
+func nextAction(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	sendTemplateReplies(store, update, "What do you want to do next?")
+	return constants.ReadyForNextAction, nil
+}
 
-func sendConfirmSubmitResponse(update *tgbotapi.Update, text string) {
-	utils.CreateAndSendInlineKeyboard(update, text, 2, "yes", "no")
-	// // Create buttons
-	// yesButton := tgbotapi.NewInlineKeyboardButtonData("yes", "yes")
-	// noButton := tgbotapi.NewInlineKeyboardButtonData("no", "no")
-	// // Create rows
-	// row := tgbotapi.NewInlineKeyboardRow(yesButton, noButton)
+/* closeKeyboard removes the buttons of a pressed keyboard, then prompts for the next action */
+func closeKeyboard(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	utils.EndInlineKeyboard(update, "")
+	return nextAction(store, update, input)
+}
 
-	// inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(row)
-	// utils.SendInlineKeyboard(update, text, inlineKeyboard)
+/* promptFor returns a handler that asks for a field of the item */
+func promptFor(next constants.State, text string) stateHandler {
+	return func(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+		utils.RemoveMarkupKeyboard(store, update, text, false)
+		return next, nil
+	}
 }
 
-func addItemHandler(update *tgbotapi.Update, userState constants.State) {
-	switch userState {
-	case constants.AddNewSetName:
-		// Expect user to send a text message (name of item)
-		// Check for slash (affect firebase query)
-		if err := utils.CheckForSlash(update); err != nil {
-			return
+/* setItemField returns a handler that stores a text field of the item */
+func setItemField(field string, set func(store utils.Store, update *tgbotapi.Update) error) stateHandler {
+	return func(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+		if err := set(store, update); err != nil {
+			return stay, err
 		}
+		utils.SendMessage(update, fmt.Sprintf("%s set to: %s", field, input), false)
+		return nextAction(store, update, input)
+	}
+}
 
-		if err := utils.InitItem(update); err != nil {
-			log.Printf("Error creating new item: %+v", err)
-			utils.SendMessage(update, "Message should be a text", false)
-			break
-		}
-		if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			break
-		}
-		utils.SendMessage(update, "You may start adding the details for the item", false)
-	case constants.ReadyForNextAction:
-		// Expect user to select reply markup (pick next action)
-		message, _, err := utils.GetMessage(update)
+func setItemName(store utils.Store, update *tgbotapi.Update, name string) (constants.State, error) {
+	if err := utils.InitItem(store, update, name); err != nil {
+		return stay, err
+	}
+	utils.SendMessage(update, "You may start adding the details for the item", false)
+	return nextAction(store, update, name)
+}
+
+/* setItemLocation stores the location or venue sent. A venue's address is taken too, if the item has none */
+func setItemLocation(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	location, address, err := utils.SetTempItemLocation(store, update)
+	if err != nil {
+		return stay, err
+	}
+	utils.SendMessage(update, fmt.Sprintf("Location set to: %s", utils.FormatLocation(location)), false)
+	if address != "" {
+		itemData, err := utils.GetTempItem(store, update)
 		if err != nil {
-			log.Printf("error setting message: %+v", err)
+			return stay, err
 		}
-		switch message {
-		case "/setAddress":
-			if err := utils.SetUserState(update, constants.AddNewSetAddress); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.RemoveMarkupKeyboard(update, "Send an address to be added", false)
-		case "/setNotes":
-			if err := utils.SetUserState(update, constants.AddNewSetNotes); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
+		if itemData.Address == "" {
+			if err := utils.SetTempItemAddressTo(store, update, address); err != nil {
+				return stay, err
 			}
-			utils.RemoveMarkupKeyboard(update, "Give some additional details as notes", false)
-		case "/setURL":
-			if err := utils.SetUserState(update, constants.AddNewSetURL); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.RemoveMarkupKeyboard(update, "Send a URL to be added", false)
-		case "/addImage":
-			if err := utils.SetUserState(update, constants.AddNewSetImages); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.RemoveMarkupKeyboard(update, "Send an image to be added", false)
-		case "/addTag":
-			if err := utils.SetUserState(update, constants.AddNewSetTags); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			/* Get message ID for targeted reply afterward */
-			_, messageID, err := utils.GetMessage(update)
-			if err != nil {
-				log.Printf("error GetMessage: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.SetMessageTarget(update, messageID)
+			utils.SendMessage(update, fmt.Sprintf("Address set to: %s", address), false)
+		}
+	}
+	return nextAction(store, update, input)
+}
 
-			utils.RemoveMarkupKeyboard(update, "Send a tag to be added. (Can be used to query your record of items)\n"+
-				"Type new or pick from existing\n\nPress \"/done\" once done!", false)
-			sendExistingTagsResponse(update, "Existing tags:")
-		case "/removeTag":
-			if err := utils.SetUserState(update, constants.AddNewRemoveTags); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			/* Get message ID for targeted reply afterward */
-			_, messageID, err := utils.GetMessage(update)
-			if err != nil {
-				log.Printf("error GetMessage: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.SetMessageTarget(update, messageID)
+func addItemImage(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	if err := utils.AddTempItemImage(store, update); err != nil {
+		return stay, withReply(err, "Error occured. Did you send an image? Try it again")
+	}
+	utils.SendMessage(update, "Image added", false)
+	return nextAction(store, update, input)
+}
 
-			utils.RemoveMarkupKeyboard(update, "Select a tag to remove\n\nPress \"/done\" once done!", false)
-			sendAddedTagsResponse(update, "Existing tags:")
-		case "/preview":
-			itemData, err := utils.GetTempItem(update)
-			if err != nil {
-				log.Printf("error getting temp item: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.SendItemDetails(update, itemData, true)
-			sendTemplateReplies(update, "Select your next action")
-		case "/submit":
-			_, messageID, err := utils.GetMessage(update)
-			if err != nil {
-				log.Printf("error GetMessage: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			if err := utils.SetUserState(update, constants.ConfirmAddItemSubmit); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.SetMessageTarget(update, messageID)
-			sendConfirmSubmitResponse(update, "Are you really ready to submit?")
-		case "/cancel":
-			if err := utils.SetUserState(update, constants.Idle); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				break
-			}
-			utils.RemoveMarkupKeyboard(update, "/additem process cancelled", false)
-		default:
-			sendTemplateReplies(update, "Please select a response from the provided options")
-		}
-		return
-	case constants.AddNewSetAddress:
-		// Expect user to send a text message (address of item)
-		if err := utils.SetTempItemAddress(update); err != nil {
-			log.Printf("Error adding address: %+v", err)
-			utils.SendMessage(update, "Address should be a text", false)
-			return
-		}
-		utils.SendMessage(update, fmt.Sprintf("Address set to: %s", update.Message.Text), false)
+func promptAddTag(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	/* Get message ID for targeted reply afterward */
+	_, messageID, err := utils.GetMessage(update)
+	if err != nil {
+		return stay, err
+	}
+	if err := utils.SetMessageTarget(store, update, messageID); err != nil {
+		return stay, err
+	}
 
-		if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-	case constants.AddNewSetNotes:
-		// Expect user to send a text message (notes for the item)
-		if err := utils.SetTempItemNotes(update); err != nil {
-			log.Printf("Error adding notes: %+v", err)
-			utils.SendMessage(update, "Notes should be a text", false)
-			return
-		}
-		utils.SendMessage(update, fmt.Sprintf("Notes set to: %s", update.Message.Text), false)
+	utils.RemoveMarkupKeyboard(store, update, "Send a tag to be added. (Can be used to query your record of items)\n"+
+		"Type new or pick from existing\n\nPress \"/done\" once done!", false)
+	sendExistingTagsResponse(store, update, "Existing tags:")
+	return constants.AddNewSetTags, nil
+}
 
-		if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-	case constants.AddNewSetURL:
-		// Expect user to send a text message (URL for the item)
-		if err := utils.SetTempItemURL(update); err != nil {
-			log.Printf("Error adding url: %+v", err)
-			utils.SendMessage(update, "URL should be a text", false)
-			return
-		}
-		utils.SendMessage(update, fmt.Sprintf("URL set to: %s", update.Message.Text), false)
+func promptRemoveTag(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	/* Get message ID for targeted reply afterward */
+	_, messageID, err := utils.GetMessage(update)
+	if err != nil {
+		return stay, err
+	}
+	if err := utils.SetMessageTarget(store, update, messageID); err != nil {
+		return stay, err
+	}
 
-		if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-	case constants.AddNewSetImages:
-		// Expect user to send a photo
-		// should be an image input
-		if err := utils.AddTempItemImage(update); err != nil {
-			log.Printf("Error adding image: %+v", err)
-			utils.SendMessage(update, "Error occured. Did you send an image? Try it again", false)
-			return
-		}
-		utils.SendMessage(update, "Image added", false)
+	utils.RemoveMarkupKeyboard(store, update, "Select a tag to remove\n\nPress \"/done\" once done!", false)
+	sendAddedTagsResponse(store, update, "Existing tags:")
+	return constants.AddNewRemoveTags, nil
+}
 
-		if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-	case constants.AddNewSetTags:
-		// Expect user to send a text message or Select from inline keyboard markup (set as tag for the item)
-		// Check for slash (affect firebase query)
-		if err := utils.CheckForSlash(update); err != nil {
-			return
-		}
+func previewItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	itemData, err := utils.GetTempItem(store, update)
+	if err != nil {
+		return stay, err
+	}
+	utils.SendItemDetails(update, itemData, true)
+	geocodeError, err := utils.GetTempItemGeocodeError(store, update)
+	if err != nil {
+		return stay, err
+	}
+	if geocodeError != "" {
+		utils.SendMessage(update, fmt.Sprintf("Couldn't place \"%s\" on the map, %s. Send its location with /setLocation", itemData.Address, geocodeError), false)
+	}
+	sendTemplateReplies(store, update, "Select your next action")
+	return stay, nil
+}
 
-		if update.Message != nil {
-			tag, _, err := utils.GetMessage(update)
-			if err != nil {
-				log.Printf("error GetMessage: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			switch tag {
-			case "/done",
-				"done",
-				"Done":
-				if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-					log.Printf("error SetUserState: %+v", err)
-					utils.SendMessage(update, "Sorry, an error occured!", false)
-					return
-				}
-				// Only continue if /done is pressed
-			default:
-				if err := utils.AddTempItemTag(update, tag); err != nil {
-					log.Printf("Error adding tag: %+v", err)
-					utils.SendMessage(update, "Tag should be a text", false)
-					return
-				}
-				utils.SendMessage(update, fmt.Sprintf("Tag \"%s\" added", tag), false)
-				return
-			}
-		} else {
-			// Then check if its a keyboard reply
-			tag, err := utils.GetCallbackQueryMessage(update)
-			if err != nil {
-				log.Printf("error GetCallbackQueryMessage: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			if len(tag) > 0 {
-				switch tag {
-				case "/done":
-					if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-						log.Printf("error SetUserState: %+v", err)
-						utils.SendMessage(update, "Sorry, an error occured!", false)
-						return
-					}
-				default:
-					if err := utils.AddTempItemTag(update, tag); err != nil {
-						log.Printf("Error adding tag: %+v", err)
-						utils.SendMessage(update, "Sorry, an error occured!", false)
-						return
-					}
-					utils.SendMessage(update, fmt.Sprintf("Tag \"%s\" added", tag), false)
-					// Don't continue to next action if adding tag through inline
-					return
-				}
-			}
-		}
-	case constants.AddNewRemoveTags:
-		// Expect user to select from inline keyboard markup (set as tag for the item)
-		/* If user send a message instead */
-		if update.Message != nil {
-			utils.SendMessage(update, "Please select from the above options", false)
-			return
-		}
+func promptSubmit(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	_, messageID, err := utils.GetMessage(update)
+	if err != nil {
+		return stay, err
+	}
+	if err := utils.SetMessageTarget(store, update, messageID); err != nil {
+		return stay, err
+	}
+	sendConfirmSubmitResponse(store, update, "Are you really ready to submit?")
+	return constants.ConfirmAddItemSubmit, nil
+}
 
-		tag, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error getting message from callback: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
+func cancelAddItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	utils.RemoveMarkupKeyboard(store, update, "/additem process cancelled", false)
+	return constants.Idle, nil
+}
 
-		switch tag {
-		case "/done":
-			if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-		default:
-			// remove tag
-			if err := utils.DeleteTempItemTag(update, tag); err != nil {
-				log.Printf("Error adding tag: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			utils.SendMessage(update, fmt.Sprintf("Tag \"%s\" removed", tag), false)
-			sendAddedTagsResponse(update, "Existing tags:")
-			// Don't continue to next action if removing tag through inline
-			return
-		}
-	case constants.ConfirmAddItemSubmit:
-		// Expect user to select from inline query (yes or no to submit)
-		/* If user send a message instead */
-		if update.Message != nil {
-			utils.SendMessage(update, "Please select from the above options", false)
-			return
-		}
+func addItemTag(store utils.Store, update *tgbotapi.Update, tag string) (constants.State, error) {
+	if err := utils.CheckTag(tag); err != nil {
+		utils.SendMessage(update, fmt.Sprintf("Sorry, %v. Please send another", err), false)
+		return stay, nil
+	}
+	if err := utils.AddTempItemTag(store, update, tag); err != nil {
+		return stay, err
+	}
+	if update.CallbackQuery != nil {
+		// Picked from the existing tags, which are shown again without it
+		sendExistingTagsResponse(store, update, fmt.Sprintf("Tag \"%s\" added\n\nExisting tags:", tag))
+		return stay, nil
+	}
+	utils.SendMessage(update, fmt.Sprintf("Tag \"%s\" added", tag), false)
+	return stay, nil
+}
 
-		confirm, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error getting message from callback: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		if confirm == "yes" {
-			// Get target chat, where additem was initiated
-			chatID, err := utils.GetChatTarget(update)
-			chatIDString := strconv.FormatInt(chatID, 10)
-			if err != nil {
-				log.Printf("error getting message from callback: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
+func removeItemTag(store utils.Store, update *tgbotapi.Update, tag string) (constants.State, error) {
+	if err := utils.DeleteTempItemTag(store, update, tag); err != nil {
+		return stay, err
+	}
+	sendAddedTagsResponse(store, update, fmt.Sprintf("Tag \"%s\" removed\n\nExisting tags:", tag))
+	return stay, nil
+}
 
-			// Submit
-			name, err := utils.AddItemFromTemp(update, chatIDString)
-			if err != nil {
-				log.Printf("error adding item from temp: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			if err := utils.SetUserState(update, constants.Idle); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			utils.RemoveMarkupKeyboard(update, fmt.Sprintf("%s has been added/edited!", name), false)
-			utils.SendMessage(update, "To add/edit a new item to any chat, please initiate /additem or /edititem in that chat", false)
-			err = utils.SetChatTarget(update, 0)
-			if err != nil {
-				log.Printf("error SetChatTarget: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			return
-		} else if confirm == "no" {
-			if err := utils.SetUserState(update, constants.ReadyForNextAction); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-		}
+func submitItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	// Get target list, of the chat where additem was initiated
+	list, err := utils.GetTargetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+
+	// Submit
+	name, err := utils.AddItemFromTemp(store, update, list)
+	if err != nil {
+		return stay, err
+	}
+	utils.ReplaceMessage(update, fmt.Sprintf("%s has been added/edited!", name))
+	utils.RemoveMarkupKeyboard(store, update, "To add/edit a new item to any chat, please initiate /additem or /edititem in that chat", false)
+	if err := utils.SetChatTarget(store, update, 0); err != nil {
+		return constants.Idle, err
+	}
+	return constants.Idle, nil
+}
+
+/* /add with the whole item in one message, skipping the wizard */
+func addItemInline(store utils.Store, update *tgbotapi.Update, args string) (constants.State, error) {
+	if args == "" {
+		utils.SendMessage(update, fmt.Sprintf("Add an item in one message with\n/add %s\n\ne.g. /add Ramen Keisuke | 1 Tras St | #ramen #dinner", utils.ItemSyntax), false)
+		return stay, nil
+	}
+	itemData, err := utils.ParseItem(args)
+	if err != nil {
+		utils.SendMessage(update, fmt.Sprintf("Could not add the item: %s\n\nUse /add %s", err, utils.ItemSyntax), false)
+		return stay, nil
 	}
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+	// Announced to the chat by AddItem
+	if err := utils.AddItem(store, itemData, list); err != nil {
+		return stay, withReply(err, "Sorry, could not add the item. Please try again")
+	}
+	return stay, nil
+}
 
-	/* Create and send keyboard for targeted response */
-	sendTemplateReplies(update, "What do you want to do next?")
+var addItemFlow = flow{
+	title:   "Add Item States",
+	command: "/additem or /edititem",
+	states: []stateDef{
+		{
+			state:   constants.AddNewSetName,
+			name:    "AddNewSetName",
+			expects: expectText,
+			handle:  setItemName,
+			doc:     []string{"Store item name", "Prompt for next action"},
+			next:    []constants.State{constants.ReadyForNextAction},
+			invalid: "Message should be a text",
+		},
+		{
+			state:   constants.ReadyForNextAction,
+			name:    "ReadyForNextAction",
+			expects: expectReplyKeyboard,
+			options: []option{
+				{inputs: []string{"/setName"}, doc: []string{"Prompt for new name"}, next: []constants.State{constants.AddNewChangeName},
+					handle: promptFor(constants.AddNewChangeName, "Send the new name of the item")},
+				{inputs: []string{"/setAddress"}, doc: []string{"Prompt for Address"}, next: []constants.State{constants.AddNewSetAddress},
+					handle: promptFor(constants.AddNewSetAddress, "Send an address to be added")},
+				{inputs: []string{"/setLocation"}, doc: []string{"Prompt for location"}, next: []constants.State{constants.AddNewSetLocation},
+					handle: promptFor(constants.AddNewSetLocation, "Send a location or venue to pin the item on a map (Attach it with 📎 → Location)")},
+				{inputs: []string{"/setNotes"}, doc: []string{"Prompt for Notes"}, next: []constants.State{constants.AddNewSetNotes},
+					handle: promptFor(constants.AddNewSetNotes, "Give some additional details as notes")},
+				{inputs: []string{"/setURL"}, doc: []string{"Prompt for URL"}, next: []constants.State{constants.AddNewSetURL},
+					handle: promptFor(constants.AddNewSetURL, "Send a URL to be added")},
+				{inputs: []string{"/addImage"}, doc: []string{"Prompt for image"}, next: []constants.State{constants.AddNewSetImages},
+					handle: promptFor(constants.AddNewSetImages, "Send an image to be added")},
+				{inputs: []string{"/addTag"}, doc: []string{"Send existing tags to add"}, next: []constants.State{constants.AddNewSetTags},
+					handle: promptAddTag},
+				{inputs: []string{"/removeTag"}, doc: []string{"Send existing tags available to remove"}, next: []constants.State{constants.AddNewRemoveTags},
+					handle: promptRemoveTag},
+				{inputs: []string{"/preview"}, doc: []string{"Send existing item data, and why its address couldn't be placed on the map", "Prompt for next action"},
+					handle: previewItem},
+				{inputs: []string{"/submit"}, doc: []string{"Prompt submission confirmation"}, next: []constants.State{constants.ConfirmAddItemSubmit},
+					handle: promptSubmit},
+				{inputs: []string{"/cancel"}, next: []constants.State{constants.Idle},
+					handle: cancelAddItem},
+			},
+			invalid:  "Please select a response from the provided options",
+			reprompt: sendTemplateReplies,
+		},
+		{
+			state:   constants.AddNewChangeName,
+			name:    "AddNewChangeName",
+			expects: expectText,
+			handle:  setItemField("Name", utils.SetTempItemName),
+			doc:     []string{"Store new name", "Prompt for next action"},
+			next:    []constants.State{constants.ReadyForNextAction},
+			invalid: "Name should be a text",
+		},
+		{
+			state:   constants.AddNewSetAddress,
+			name:    "AddNewSetAddress",
+			expects: expectText,
+			handle:  setItemField("Address", utils.SetTempItemAddress),
+			doc:     []string{"Store address, and the location geocoded from it unless one was sent", "Prompt for next action"},
+			next:    []constants.State{constants.ReadyForNextAction},
+			invalid: "Address should be a text",
+		},
+		{
+			state:   constants.AddNewSetLocation,
+			name:    "AddNewSetLocation",
+			expects: expectLocation,
+			handle:  setItemLocation,
+			doc:     []string{"Store location, and a venue's address if there is none", "Prompt for next action"},
+			next:    []constants.State{constants.ReadyForNextAction},
+			invalid: "Send a location or venue, with 📎 → Location",
+		},
+		{
+			state:   constants.AddNewSetNotes,
+			name:    "AddNewSetNotes",
+			expects: expectText,
+			handle:  setItemField("Notes", utils.SetTempItemNotes),
+			doc:     []string{"Store notes", "Prompt for next action"},
+			next:    []constants.State{constants.ReadyForNextAction},
+			invalid: "Notes should be a text",
+		},
+		{
+			state:   constants.AddNewSetURL,
+			name:    "AddNewSetURL",
+			expects: expectText,
+			handle:  setItemField("URL", utils.SetTempItemURL),
+			doc:     []string{"Store URL", "Prompt for next action"},
+			next:    []constants.State{constants.ReadyForNextAction},
+			invalid: "URL should be a text",
+		},
+		{
+			state:   constants.AddNewSetImages,
+			name:    "AddNewSetImages",
+			expects: expectImage,
+			handle:  addItemImage,
+			doc:     []string{"Store image ID", "Prompt for next action"},
+			next:    []constants.State{constants.ReadyForNextAction},
+			invalid: "Did you send an image? Try it again",
+		},
+		{
+			state:   constants.AddNewSetTags,
+			name:    "AddNewSetTags",
+			expects: expectTextOrInlineKeyboard,
+			picker:  &addTagPicker,
+			options: []option{
+				{inputs: []string{"/done", "done", "Done"}, doc: []string{"Prompt for next action"}, next: []constants.State{constants.ReadyForNextAction},
+					handle: closeKeyboard},
+			},
+			handle:  addItemTag,
+			label:   "text message OR selected existing tag",
+			doc:     []string{"Store tag"},
+			toast:   "Tag added",
+			invalid: "Tag should be a text",
+		},
+		{
+			state:   constants.AddNewRemoveTags,
+			name:    "AddNewRemoveTags",
+			expects: expectInlineKeyboard,
+			picker:  &removeTagPicker,
+			options: []option{
+				{inputs: []string{"/done"}, doc: []string{"Prompt for next action"}, next: []constants.State{constants.ReadyForNextAction},
+					handle: closeKeyboard},
+			},
+			handle:  removeItemTag,
+			label:   "Selected existing tag",
+			doc:     []string{"Remove tag", "Show remaining tags"},
+			toast:   "Tag removed",
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.ConfirmAddItemSubmit,
+			name:    "ConfirmAddItemSubmit",
+			expects: expectInlineKeyboard,
+			options: []option{
+				{inputs: []string{"yes"}, doc: []string{"Store item in chat's list"}, next: []constants.State{constants.Idle},
+					handle: submitItem, toast: "Saved"},
+				{inputs: []string{"no"}, doc: []string{"Prompt for next action"}, next: []constants.State{constants.ReadyForNextAction},
+					handle: closeKeyboard},
+			},
+			invalid: "Please select from the above options",
+		},
+	},
 }
@@ -3,6 +3,7 @@ package constants
 // Finite state machine for handling adding items
 type State int
 
+/* States are saved by value in sessions, so new ones are added at the end, before StateCount */
 const (
 	Idle State = iota
 
@@ -41,86 +42,99 @@ const (
 	/* #### Feedback #### */
 	Feedback
 	/* ######## */
+
+	/* #### Import #### */
+	ImportSetItems
+	ImportConfirm
+	/* ######## */
+
+	/* #### Export #### */
+	ExportSelectFormat
+	/* ######## */
+
+	/* #### Lists #### */
+	NewListSetName
+	SelectList
+	/* ######## */
+
+	/* #### Adding Item, continued #### */
+	AddNewChangeName
+	/* ######## */
+
+	/* #### Query, continued #### */
+	QueryExcludeTags
+	QuerySearch
+	/* ######## */
+
+	/* #### Locations #### */
+	AddNewSetLocation
+	QueryNearMe
+	/* ######## */
+
+	// Number of states, kept last
+	StateCount
 )
 
 type ItemDetails struct {
+	ID      string          `json:"id"`
 	Name    string          `json:"name"`
 	Address string          `json:"address"`
 	Notes   string          `json:"notes"`
 	URL     string          `json:"url"`
 	Images  map[string]bool `json:"images"`
 	Tags    map[string]bool `json:"tags"`
+	// Optional, set from a location or venue sent for the item
+	Location *Location `json:"location,omitempty"`
 }
 
-func (itemData *ItemDetails) GetImageIDs() []string {
-	if itemData.Images == nil {
-		return []string{}
-	}
-	imageIDs := make([]string, 0)
-	for id := range itemData.Images {
-		imageIDs = append(imageIDs, id)
-	}
-	return imageIDs
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Found from the address, rather than sent. Replaced when the address changes
+	Geocoded bool `json:"geocoded,omitempty"`
 }
 
-func IsAddingNewItem(state State) bool {
-	switch state {
-	case ReadyForNextAction,
-		AddNewSetName,
-		AddNewSetAddress,
-		AddNewSetNotes,
-		AddNewSetURL,
-		AddNewSetImages,
-		AddNewSetTags,
-		AddNewRemoveTags,
-		ConfirmAddItemSubmit:
-		return true
-	default:
-		return false
-	}
+/* TagFilter selects items with all (or any) of Tags, and none of Excluded. Without Tags, any item can match */
+type TagFilter struct {
+	MatchAll bool
+	Tags     map[string]bool
+	Excluded map[string]bool
 }
 
-func IsQuery(state State) bool {
-	switch state {
-	case QuerySelectType,
-
-		QueryOneTagOrName,
-		QueryOneSetName,
-
-		QueryFewSetNum,
+/* Keyboard is the callback data of the buttons last sent to a session, which the buttons' tokens index */
+type Keyboard struct {
+	Nonce  string   `json:"nonce"`
+	Values []string `json:"values"`
+}
 
-		QuerySetTags,
-		QueryRetrieve:
-		return true
-	default:
-		return false
-	}
+/* PendingCommand is a command waiting for a list to be picked, with the document it was the caption of */
+type PendingCommand struct {
+	Text     string    `json:"text"`
+	Document *Document `json:"document,omitempty"`
 }
 
-func IsDeleteItem(state State) bool {
-	switch state {
-	case DeleteSelect,
-		DeleteConfirm:
-		return true
-	default:
-		return false
-	}
+/* Document is a file sent to the bot, by its Telegram file ID */
+type Document struct {
+	FileID   string `json:"fileID"`
+	FileName string `json:"fileName"`
+	FileSize int    `json:"fileSize"`
 }
 
-func IsEditItem(state State) bool {
-	switch state {
-	case GetItemToEdit:
-		return true
-	default:
-		return false
-	}
+type FeedbackDetails struct {
+	Date     string `json:"-"`
+	Username string `json:"username"`
+	UserID   int    `json:"userid"`
+	ChatID   int64  `json:"chatid"`
+	Feedback string `json:"feedback"`
 }
 
-func IsFeedback(state State) bool {
-	switch state {
-	case Feedback:
-		return true
-	default:
-		return false
+func (itemData *ItemDetails) GetImageIDs() []string {
+	if itemData.Images == nil {
+		return []string{}
 	}
+	imageIDs := make([]string, 0)
+	for id := range itemData.Images {
+		imageIDs = append(imageIDs, id)
+	}
+	return imageIDs
 }
@@ -9,95 +9,91 @@ import (
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
-func sendItemsToDeleteResponse(update *tgbotapi.Update, text string) {
-	chatID, _, err := utils.GetChatUserIDString(update)
-	if err != nil {
-		log.Printf("error GetChatUserIDString: %+v", err)
+func sendItemsToDeleteResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	if err := deleteItemPicker.show(store, update, text); err != nil {
+		log.Printf("error showing items: %+v", err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
 	}
+}
+
+var deleteItemPicker = picker{choices: chatItemChoices, prompt: "Which item do you want to delete?", filter: true}
+
+/* Asks in place of the list of items */
+func sendConfirmDeleteResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	utils.ReplaceInlineKeyboard(store, update, text, utils.NewInlineKeyboard(2, "yes", "no"))
+}
 
-	itemNames, err := utils.GetItemNames(update, chatID)
+func selectItemToDelete(store utils.Store, update *tgbotapi.Update, itemID string) (constants.State, error) {
+	list, err := utils.GetList(store, update)
 	if err != nil {
-		log.Printf("error GetItemNames: %+v", err)
-		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return stay, err
 	}
-
-	/* Set each name as its own inline row */
-	var nameButtons = make([][]tgbotapi.InlineKeyboardButton, len(itemNames))
-	i := 0
-	for name := range itemNames {
-		nameButtons[i] = tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData(name, name),
-		)
-		i++
+	itemData, err := utils.GetItem(store, itemID, list.ID())
+	if err != nil {
+		return stay, err
 	}
-	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(nameButtons...)
-	msg := utils.SendInlineKeyboard(update, text, inlineKeyboard, false)
-	utils.AddMessageToDelete(update, msg)
+	if err := utils.SetItemTarget(store, update, itemID); err != nil {
+		return stay, err
+	}
+	sendConfirmDeleteResponse(store, update, fmt.Sprintf("Are you sure you want to delete %s?", itemData.Name))
+	return constants.DeleteConfirm, nil
 }
 
-func sendConfirmDeleteResponse(update *tgbotapi.Update, text string) {
-	// Create buttons
-	yesButton := tgbotapi.NewInlineKeyboardButtonData("yes", "yes")
-	noButton := tgbotapi.NewInlineKeyboardButtonData("no", "no")
-	// Create rows
-	row := tgbotapi.NewInlineKeyboardRow(yesButton, noButton)
-
-	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(row)
-	utils.SendInlineKeyboard(update, text, inlineKeyboard, false)
+func deleteItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	target, err := utils.GetItemTarget(store, update)
+	if err != nil {
+		return stay, err
+	}
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+	itemData, err := utils.GetItem(store, target, list.ID())
+	if err != nil {
+		return stay, err
+	}
+	// Deleted meanwhile, or the target was lost
+	if target == "" || itemData.Name == "" {
+		utils.ReplaceMessage(update, "The item was not found, it may have been deleted already")
+		return constants.Idle, nil
+	}
+	if err := utils.DeleteItem(store, update, target); err != nil {
+		return constants.Idle, withReply(err, "Sorry, could not delete the item. Please try again")
+	}
+	utils.ReplaceMessage(update, fmt.Sprintf("%s has been deleted", itemData.Name))
+	return constants.Idle, nil
 }
 
-func deleteItemHandler(update *tgbotapi.Update, userState constants.State) {
-	switch userState {
-	case constants.DeleteSelect:
-		// Expect user to select from inline keyboard markup. (name of items to delete)
-		/* If user send a message instead */
-		if update.Message != nil {
-			utils.SendMessage(update, "Please select from the above options", false)
-			return
-		}
-
-		name, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error getting message from callback: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		utils.SetItemTarget(update, name)
-		sendConfirmDeleteResponse(update, "Are you sure?")
-		if err := utils.SetUserState(update, constants.DeleteConfirm); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-	case constants.DeleteConfirm:
-		/* If user send a message instead */
-		if update.Message != nil {
-			utils.SendMessage(update, "Please select from the above options", false)
-			return
-		}
+func cancelDeleteItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	utils.ReplaceMessage(update, "Deletion process cancelled")
+	return constants.Idle, nil
+}
 
-		confirm, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error getting message from callback: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		if confirm == "yes" {
-			target, err := utils.GetItemTarget(update)
-			if err != nil {
-				log.Printf("error GetItemTarget: %+v", err)
-				utils.SendMessage(update, "Sorry an error occured", false)
-				return
-			}
-			utils.DeleteItem(update, target)
-			utils.SendMessage(update, fmt.Sprintf("%s has been deleted", target), false)
-		} else if confirm == "no" {
-			utils.SendMessage(update, "Deletion process cancelled", false)
-		}
-		if err := utils.SetUserState(update, constants.Idle); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-	}
+var deleteItemFlow = flow{
+	title:   "Delete Item States",
+	command: "/deleteitem",
+	states: []stateDef{
+		{
+			state:   constants.DeleteSelect,
+			name:    "DeleteSelect",
+			expects: expectInlineKeyboard,
+			picker:  &deleteItemPicker,
+			handle:  selectItemToDelete,
+			doc:     []string{"Get item to delete", "Prompt delete confirmation"},
+			next:    []constants.State{constants.DeleteConfirm},
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.DeleteConfirm,
+			name:    "DeleteConfirm",
+			expects: expectInlineKeyboard,
+			options: []option{
+				{inputs: []string{"yes"}, doc: []string{"Delete item"}, next: []constants.State{constants.Idle}, handle: deleteItem,
+					toast: "Deleted"},
+				{inputs: []string{"no"}, doc: []string{"Cancel process"}, next: []constants.State{constants.Idle}, handle: cancelDeleteItem,
+					toast: "Cancelled"},
+			},
+			invalid: "Please select from the above options",
+		},
+	},
 }
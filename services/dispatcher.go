@@ -0,0 +1,131 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"sync"
+
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	// Updates a session can have waiting. Beyond it, a flood of a session is dropped
+	maxSessionUpdates = 32
+	// Sessions that can wait for a worker, per worker
+	readySessionsPerWorker = 64
+)
+
+/* ErrQueueFull is returned by Submit for an update that can't be queued */
+var ErrQueueFull = errors.New("update queue full")
+
+/*
+Dispatcher handles updates on a fixed number of workers. Updates of one session (a user in a chat)
+are handled one at a time, in the order they were submitted, so they don't race on the session's state.
+Different sessions are handled concurrently
+*/
+type Dispatcher struct {
+	store  utils.Store
+	handle func(store utils.Store, update *tgbotapi.Update)
+
+	mu sync.Mutex
+	// Updates waiting, by session. A session is in the map while a worker has it or it is in ready
+	queues map[string][]*tgbotapi.Update
+	// Sessions with updates waiting for a worker
+	ready chan string
+	wg    sync.WaitGroup
+}
+
+func NewDispatcher(store utils.Store, workers int) *Dispatcher {
+	return newDispatcher(store, workers, HandleUserInput)
+}
+
+func newDispatcher(store utils.Store, workers int, handle func(store utils.Store, update *tgbotapi.Update)) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &Dispatcher{
+		store:  store,
+		handle: handle,
+		queues: make(map[string][]*tgbotapi.Update),
+		ready:  make(chan string, workers*readySessionsPerWorker),
+	}
+	d.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+/*
+Submit queues the update behind the waiting ones of its session, without waiting for a worker.
+It returns ErrQueueFull if the session has too many updates waiting, or too many sessions are waiting
+*/
+func (d *Dispatcher) Submit(update *tgbotapi.Update) error {
+	key := queueKey(update)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queue, scheduled := d.queues[key]
+	if len(queue) >= maxSessionUpdates {
+		return ErrQueueFull
+	}
+	if !scheduled {
+		// Under the lock, so a worker taking the session finds the update queued
+		select {
+		case d.ready <- key:
+		default:
+			return ErrQueueFull
+		}
+	}
+	d.queues[key] = append(queue, update)
+	return nil
+}
+
+/* Close waits for the submitted updates to be handled, and stops the workers. Nothing can be submitted after */
+func (d *Dispatcher) Close() {
+	close(d.ready)
+	d.wg.Wait()
+}
+
+/* work handles the updates of a ready session until it has none waiting, then takes the next session */
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for key := range d.ready {
+		for {
+			d.mu.Lock()
+			queue := d.queues[key]
+			if len(queue) == 0 {
+				delete(d.queues, key)
+				d.mu.Unlock()
+				break
+			}
+			update := queue[0]
+			d.queues[key] = queue[1:]
+			d.mu.Unlock()
+			d.run(update)
+		}
+	}
+}
+
+/* run handles an update, keeping the worker alive if the handler panics */
+func (d *Dispatcher) run(update *tgbotapi.Update) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic handling update %d: %v\n%s", update.UpdateID, r, debug.Stack())
+		}
+	}()
+	d.handle(d.store, update)
+}
+
+/* queueKey is the session of the update. Inline queries queue by user, and updates of no session on their own */
+func queueKey(update *tgbotapi.Update) string {
+	if update.InlineQuery != nil && update.InlineQuery.From != nil {
+		return "inline_" + strconv.Itoa(update.InlineQuery.From.ID)
+	}
+	if sessionID, err := utils.GetSessionID(update); err == nil {
+		return sessionID
+	}
+	return "update_" + strconv.Itoa(update.UpdateID)
+}
@@ -0,0 +1,164 @@
+package services
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func TestDispatcher(t *testing.T) {
+	const workers = 3
+	chats := []int64{testPrivateID, testGroupID, testOtherGroupID, -400, -500}
+	const perChat = 20
+
+	var mu sync.Mutex
+	handled := make(map[int64][]int)
+	running := make(map[int64]bool)
+	var concurrent, maxConcurrent int
+	handle := func(store utils.Store, update *tgbotapi.Update) {
+		chatID := update.Message.Chat.ID
+		mu.Lock()
+		if running[chatID] {
+			t.Errorf("chat %d: two updates handled at once", chatID)
+		}
+		running[chatID] = true
+		concurrent++
+		if concurrent > maxConcurrent {
+			maxConcurrent = concurrent
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		handled[chatID] = append(handled[chatID], update.UpdateID)
+		running[chatID] = false
+		concurrent--
+		mu.Unlock()
+	}
+
+	dispatcher := newDispatcher(utils.NewMemoryStore(), workers, handle)
+	for i := 0; i < perChat; i++ {
+		for _, chatID := range chats {
+			update := textUpdate(chatID, "hi")
+			update.UpdateID = i
+			dispatcher.Submit(&update)
+		}
+	}
+	dispatcher.Close()
+
+	for _, chatID := range chats {
+		if len(handled[chatID]) != perChat {
+			t.Fatalf("chat %d: handled %d updates, want %d", chatID, len(handled[chatID]), perChat)
+		}
+		for i, updateID := range handled[chatID] {
+			if updateID != i {
+				t.Errorf("chat %d: handled %v, want them in order", chatID, handled[chatID])
+				break
+			}
+		}
+	}
+	if maxConcurrent > workers {
+		t.Errorf("%d updates handled at once, want at most %d", maxConcurrent, workers)
+	}
+	if maxConcurrent < 2 {
+		t.Errorf("chats were handled one at a time, want them handled concurrently")
+	}
+}
+
+func TestDispatcherPanic(t *testing.T) {
+	var handled []int
+	dispatcher := newDispatcher(utils.NewMemoryStore(), 1, func(store utils.Store, update *tgbotapi.Update) {
+		if update.UpdateID == 1 {
+			panic("handler failed")
+		}
+		handled = append(handled, update.UpdateID)
+	})
+	for i := 1; i <= 2; i++ {
+		update := textUpdate(testPrivateID, "hi")
+		update.UpdateID = i
+		dispatcher.Submit(&update)
+	}
+	dispatcher.Close()
+	if len(handled) != 1 || handled[0] != 2 {
+		t.Errorf("handled %v, want [2] after the panic", handled)
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	var mu sync.Mutex
+	handled := 0
+	dispatcher := newDispatcher(utils.NewMemoryStore(), 1, func(store utils.Store, update *tgbotapi.Update) {
+		if update.UpdateID == 0 {
+			started <- true
+			<-release
+		}
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+	// Keeps the only worker busy
+	busy := textUpdate(testPrivateID, "hi")
+	if err := dispatcher.Submit(&busy); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	<-started
+
+	submit := func(chatID int64, updateID int) error {
+		update := textUpdate(chatID, "hi")
+		update.UpdateID = updateID
+		done := make(chan error)
+		go func() { done <- dispatcher.Submit(&update) }()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("Submit blocked on a busy dispatcher")
+			return nil
+		}
+	}
+	for i := 1; i <= maxSessionUpdates; i++ {
+		if err := submit(testGroupID, i); err != nil {
+			t.Fatalf("update %d of the session: %v", i, err)
+		}
+	}
+	if err := submit(testGroupID, maxSessionUpdates+1); err != ErrQueueFull {
+		t.Errorf("update beyond the session's cap: err = %v, want ErrQueueFull", err)
+	}
+	// The group waits for the worker already
+	for i := 1; i < readySessionsPerWorker; i++ {
+		if err := submit(int64(-1000-i), 100+i); err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+	}
+	if err := submit(-2000, 200); err != ErrQueueFull {
+		t.Errorf("session beyond the waiting cap: err = %v, want ErrQueueFull", err)
+	}
+
+	close(release)
+	dispatcher.Close()
+	if want := 1 + maxSessionUpdates + readySessionsPerWorker - 1; handled != want {
+		t.Errorf("handled %d updates, want %d", handled, want)
+	}
+}
+
+func TestQueueKey(t *testing.T) {
+	private := textUpdate(testPrivateID, "hi")
+	group := textUpdate(testGroupID, "hi")
+	inline := tgbotapi.Update{UpdateID: 7, InlineQuery: &tgbotapi.InlineQuery{From: testUser}}
+	other := tgbotapi.Update{UpdateID: 8}
+	if queueKey(&private) == queueKey(&group) {
+		t.Errorf("private chat and group share the queue %q", queueKey(&private))
+	}
+	if key := queueKey(&inline); key != "inline_100" {
+		t.Errorf("inline query queue = %q, want inline_100", key)
+	}
+	if key := queueKey(&other); key != "update_8" {
+		t.Errorf("update without a session queue = %q, want update_8", key)
+	}
+}
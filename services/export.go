@@ -0,0 +1,89 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* /export, optionally with the format */
+func exportCommand(store utils.Store, update *tgbotapi.Update, format string) (constants.State, error) {
+	// End export if no item
+	if ok, err := checkAnyItem(store, update); !ok {
+		return stay, err
+	}
+	if format != "" {
+		return exportItems(store, update, format)
+	}
+	utils.CreateAndSendInlineKeyboard(store, update, "Which format would you like?", len(utils.ExportFormats), utils.ExportFormats...)
+	return constants.ExportSelectFormat, nil
+}
+
+/* exportItems sends all items of the chat as a document */
+func exportItems(store utils.Store, update *tgbotapi.Update, format string) (constants.State, error) {
+	format = strings.ToLower(strings.TrimPrefix(format, "."))
+	if !isExportFormat(format) {
+		utils.SendMessage(update, fmt.Sprintf("Usage: /export [%s]", strings.Join(utils.ExportFormats, "|")), false)
+		return stay, nil
+	}
+	items, err := utils.GetItems(store, update, constants.TagFilter{})
+	if err != nil {
+		return stay, err
+	}
+	title := "My list"
+	if chat := chatOf(update); chat != nil && chat.Title != "" {
+		title = chat.Title
+	}
+	content, err := utils.ExportItems(format, title, items)
+	if err != nil {
+		return stay, err
+	}
+	if update.CallbackQuery != nil {
+		utils.EndInlineKeyboard(update, fmt.Sprintf("Exported as %s", strings.ToUpper(format)))
+	}
+	fileName := fmt.Sprintf("golistbot-%s.%s", time.Now().Format("2006-01-02"), format)
+	if err := utils.SendDocument(update, fileName, content, fmt.Sprintf("%d item(s) exported", len(items))); err != nil {
+		return constants.Idle, withReply(err, "Sorry, could not send the export. Please try again")
+	}
+	return constants.Idle, nil
+}
+
+func isExportFormat(format string) bool {
+	for _, exportFormat := range utils.ExportFormats {
+		if format == exportFormat {
+			return true
+		}
+	}
+	return false
+}
+
+/* chatOf returns the chat of a message or a callback */
+func chatOf(update *tgbotapi.Update) *tgbotapi.Chat {
+	if update.Message != nil {
+		return update.Message.Chat
+	}
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		return update.CallbackQuery.Message.Chat
+	}
+	return nil
+}
+
+var exportFlow = flow{
+	title:   "Export States",
+	command: "/export",
+	states: []stateDef{
+		{
+			state:   constants.ExportSelectFormat,
+			name:    "ExportSelectFormat",
+			expects: expectInlineKeyboard,
+			handle:  exportItems,
+			doc:     []string{"Send chat's items as a document in the selected format (csv, json or md)"},
+			next:    []constants.State{constants.Idle},
+			invalid: "Please select from the above options",
+		},
+	},
+}
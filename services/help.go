@@ -1,20 +1,24 @@
 package services
 
 import (
-	"log"
-
 	"github.com/xfated/golistbot/services/constants"
 	"github.com/xfated/golistbot/services/utils"
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
-func helpHandler(update *tgbotapi.Update) {
+func helpHandler(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
 	helpText := "/start or /reset: To reset the bot's status. (in case there are errors somehow) \n" +
 		"\n" +
-		"/additem: To add a new item to this chat's list (where this command was sent). Can be any item basically. You will be redirected to the bot's chat to add the item. \n" +
+		"/additem [name]: To add a new item to this chat's list (where this command was sent). Can be any item basically. You will be redirected to the bot's chat to add the item. \n" +
 		"    /setXX: Adds (or overwrites) the field \n" +
 		"    /addXX: Tag or Image. You can add multiple \n" +
 		"\n" +
+		"/add name | address | #tag #tag | URL | notes: To add an item to this chat's list in one message. Only the name is needed \n" +
+		"\n" +
+		"/import: To add many items at once, from a CSV or JSON file or one item per line as with /add. Duplicates are skipped \n" +
+		"\n" +
+		"/export [csv|json|md]: To download this chat's list as a file. CSV and JSON files can be imported again \n" +
+		"\n" +
 		"/deleteitem: To delete an item. Forever. \n" +
 		"\n" +
 		"/edititem: To edit an item. Similar process to /additem \n" +
@@ -22,16 +26,27 @@ func helpHandler(update *tgbotapi.Update) {
 		"/query: To fetch an item from this chat's list.\n" +
 		"    /getOne: Returns one at random \n" +
 		"        /withTag: Select multiple tags (or none). Filters for items with at least one matching tag \n" +
+		"            /all: Filters for items with every selected tag instead \n" +
+		"            /not: Select tags to leave out \n" +
 		"        /withName: Returns your selection \n" +
 		"    /getFew: Returns a few (your choice) at random \n" +
 		"        /withTag: Same as above \n" +
 		"    /getAll: Returns all\n" +
+		"    /search: Returns the best matches of the words you send \n" +
+		"    /nearMe: Returns the items closest to the location you send \n" +
+		"    Or skip the questions, e.g. /query tag:dinner tag:cheap all not:spicy 3 images \n" +
+		"\n" +
+		"/search <words>: To find items by name, address, notes or tags, even with typos. e.g. /search ramen tras \n" +
+		"\n" +
+		"@" + utils.BOT_USERNAME + " <words>: In any chat, to search and share the items of your lists \n" +
+		"\n" +
+		"/newlist <name>: To start another list in this chat, e.g. /newlist movies. The commands above then work on it \n" +
+		"\n" +
+		"/uselist [name]: To switch to another of this chat's lists (main holds the items from before). If a chat has several and you haven't picked one, you are asked first \n" +
+		"\n" +
+		"/rebuildindex: To rebuild this chat's list of names and tags from its items. (in case they are out of sync) \n" +
 		"\n" +
 		"/feedback: To send my creator any suggestions/queries/problems!"
-	if err := utils.SetUserState(update, constants.Idle); err != nil {
-		log.Printf("error setting state: %+v", err)
-		utils.SendMessage(update, "Sorry, an error occured!", false)
-		return
-	}
 	utils.SendMessage(update, helpText, false)
+	return constants.Idle, nil
 }
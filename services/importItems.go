@@ -0,0 +1,193 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	maxImportItems = 500
+	// Duplicate and invalid rows listed in the summary, the rest are counted
+	maxImportListed = 10
+)
+
+/* /import, with items pasted after the command or a document sent with it as caption */
+func importCommand(store utils.Store, update *tgbotapi.Update, args string) (constants.State, error) {
+	if args != "" || update.Message.Document != nil {
+		return readImport(store, update, args)
+	}
+	// Force reply, so the bot gets the document in group chats as well
+	utils.SendMessageForceReply(update, "Send a CSV or JSON file with the columns name, address, notes, url, tags, latitude and longitude.\n"+
+		fmt.Sprintf("Or paste one item per line as\n%s", utils.ItemSyntax), update.Message.MessageID, false)
+	return constants.ImportSetItems, nil
+}
+
+/* readImport parses the document or pasted text, and asks to confirm the items that can be added */
+func readImport(store utils.Store, update *tgbotapi.Update, text string) (constants.State, error) {
+	var rows []utils.ImportRow
+	if update.Message.Document != nil {
+		fileName, content, err := utils.DownloadDocument(update)
+		if err != nil {
+			return stay, withReply(err, fmt.Sprintf("Sorry, could not read the file: %v", err))
+		}
+		switch strings.ToLower(filepath.Ext(fileName)) {
+		case ".csv":
+			rows, err = utils.ParseImportCSV(content)
+		case ".json":
+			rows, err = utils.ParseImportJSON(content)
+		default:
+			err = errors.New("only .csv and .json files can be imported")
+		}
+		if err != nil {
+			utils.SendMessage(update, fmt.Sprintf("Could not import %s: %v", fileName, err), false)
+			return stay, nil
+		}
+	} else {
+		rows = utils.ParseImportText(text)
+	}
+	if len(rows) == 0 {
+		utils.SendMessage(update, "There are no items to import", false)
+		return stay, nil
+	}
+	if len(rows) > maxImportItems {
+		utils.SendMessage(update, fmt.Sprintf("That's %d items, I can import up to %d at a time", len(rows), maxImportItems), false)
+		return stay, nil
+	}
+
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+	itemNames, err := utils.GetItemNames(store, list.ID())
+	if err != nil {
+		return stay, err
+	}
+	items, summary := summarizeImport(rows, itemNames)
+	if len(items) == 0 {
+		utils.SendMessage(update, summary+"\nNothing to import", false)
+		return constants.Idle, nil
+	}
+	if err := utils.SetImportItems(store, update, items); err != nil {
+		return stay, err
+	}
+	utils.CreateAndSendInlineKeyboard(store, update, summary+fmt.Sprintf("\nAdd the %d new item(s)?", len(items)), 2, "yes", "no")
+	return constants.ImportConfirm, nil
+}
+
+/* summarizeImport picks the rows to add, skipping invalid rows and names already in the list or import */
+func summarizeImport(rows []utils.ImportRow, itemNames map[string]string) ([]constants.ItemDetails, string) {
+	existing := make(map[string]bool)
+	for _, name := range itemNames {
+		existing[strings.ToLower(name)] = true
+	}
+	firstLine := make(map[string]int)
+
+	items := make([]constants.ItemDetails, 0, len(rows))
+	duplicates := make([]string, 0)
+	invalid := make([]string, 0)
+	for _, row := range rows {
+		name := strings.ToLower(row.ItemData.Name)
+		switch {
+		case row.Err != nil:
+			invalid = append(invalid, fmt.Sprintf("%d: %v", row.Line, row.Err))
+		case existing[name]:
+			duplicates = append(duplicates, fmt.Sprintf("%d: %s is already in the list", row.Line, row.ItemData.Name))
+		case firstLine[name] > 0:
+			duplicates = append(duplicates, fmt.Sprintf("%d: %s is also on %d", row.Line, row.ItemData.Name, firstLine[name]))
+		default:
+			firstLine[name] = row.Line
+			items = append(items, row.ItemData)
+		}
+	}
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "Read %d item(s): %d new, %d duplicate, %d invalid\n", len(rows), len(items), len(duplicates), len(invalid))
+	writeImportList(&summary, "Duplicates (skipped), by line:", duplicates)
+	writeImportList(&summary, "Invalid (skipped), by line:", invalid)
+	return items, summary.String()
+}
+
+func writeImportList(summary *strings.Builder, title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	summary.WriteString("\n" + title + "\n")
+	for i, line := range lines {
+		if i == maxImportListed {
+			fmt.Fprintf(summary, "...and %d more\n", len(lines)-maxImportListed)
+			break
+		}
+		summary.WriteString(line + "\n")
+	}
+}
+
+func confirmImport(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	items, err := utils.GetImportItems(store, update)
+	if err != nil {
+		return stay, err
+	}
+	if len(items) == 0 {
+		utils.SendMessage(update, "There is nothing to import, please send /import again", false)
+		return constants.Idle, nil
+	}
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+	// Announced to the chat by AddItems
+	if err := utils.AddItems(store, items, list); err != nil {
+		return constants.Idle, withReply(err, "Sorry, could not import the items. Nothing was added, please try again")
+	}
+	utils.EndInlineKeyboard(update, "")
+	// Added already, so only the rows staged are left
+	if err := utils.SetImportItems(store, update, nil); err != nil {
+		return constants.Idle, err
+	}
+	return constants.Idle, nil
+}
+
+func cancelImport(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	if err := utils.SetImportItems(store, update, nil); err != nil {
+		return stay, err
+	}
+	utils.ReplaceMessage(update, "Import cancelled")
+	return constants.Idle, nil
+}
+
+var importFlow = flow{
+	title:   "Import States",
+	command: "/import",
+	states: []stateDef{
+		{
+			state:   constants.ImportSetItems,
+			name:    "ImportSetItems",
+			expects: expectTextOrDocument,
+			handle:  readImport,
+			doc: []string{
+				"Read items from a CSV or JSON document, or one per line of the message",
+				"Send summary of new, duplicate and invalid items",
+				"Prompt import confirmation",
+			},
+			next:    []constants.State{constants.ImportConfirm, constants.Idle},
+			invalid: "Please send a CSV or JSON file, or paste the items as text",
+		},
+		{
+			state:   constants.ImportConfirm,
+			name:    "ImportConfirm",
+			expects: expectInlineKeyboard,
+			options: []option{
+				{inputs: []string{"yes"}, doc: []string{"Store the new items in chat's list in one batch"}, next: []constants.State{constants.Idle},
+					handle: confirmImport, toast: "Imported"},
+				{inputs: []string{"no"}, doc: []string{"Cancel import"}, next: []constants.State{constants.Idle},
+					handle: cancelImport},
+			},
+			invalid: "Please select from the above options",
+		},
+	},
+}
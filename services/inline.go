@@ -0,0 +1,128 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* Telegram's limit on the results of an inline query */
+const maxInlineResults = 50
+
+type inlineMatch struct {
+	list      utils.ItemList
+	chatTitle string
+	itemData  constants.ItemDetails
+	rank      int
+}
+
+/* handleInlineQuery answers "@bot words" sent in any chat with the matching items of every list the user has used the bot in */
+func handleInlineQuery(store utils.Store, update *tgbotapi.Update) {
+	query := update.InlineQuery
+	if query.From == nil {
+		return
+	}
+	chats, err := store.GetUserChats(strconv.Itoa(query.From.ID))
+	if err != nil {
+		log.Printf("error GetUserChats: %+v", err)
+		return
+	}
+
+	words := strings.Fields(strings.ToLower(query.Query))
+	matches := make([]inlineMatch, 0)
+	for chatID, chatTitle := range chats {
+		for _, list := range chatLists(store, chatID) {
+			items, err := store.GetItems(list.ID())
+			if err != nil {
+				log.Printf("error GetItems: %+v", err)
+				continue
+			}
+			for _, itemData := range items {
+				if rank, ok := matchItem(itemData, words); ok {
+					matches = append(matches, inlineMatch{list, chatTitle, itemData, rank})
+				}
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].rank != matches[j].rank {
+			return matches[i].rank < matches[j].rank
+		}
+		if nameI, nameJ := strings.ToLower(matches[i].itemData.Name), strings.ToLower(matches[j].itemData.Name); nameI != nameJ {
+			return nameI < nameJ
+		}
+		return matches[i].list.ID() < matches[j].list.ID()
+	})
+	if len(matches) > maxInlineResults {
+		matches = matches[:maxInlineResults]
+	}
+
+	results := make([]interface{}, len(matches))
+	for i, match := range matches {
+		description := match.chatTitle
+		if description == "" {
+			description = "Private list"
+		}
+		if match.list.Name != utils.MainList {
+			description += " · " + match.list.Name
+		}
+		if match.itemData.Address != "" {
+			description += " · " + match.itemData.Address
+		}
+		results[i] = utils.ItemInlineResult(utils.InlineResultID(match.list.ID(), match.itemData.ID), match.itemData, description)
+	}
+	if err := utils.AnswerInlineQuery(update, results); err != nil {
+		log.Printf("error AnswerInlineQuery: %+v", err)
+	}
+}
+
+/* chatLists are the lists of a chat the user has used the bot in, the main one only if they can't be read */
+func chatLists(store utils.Store, chatID string) []utils.ItemList {
+	id, err := strconv.ParseInt(chatID, 10, 64)
+	if err != nil {
+		log.Printf("error parsing chat ID %q: %+v", chatID, err)
+		return nil
+	}
+	names, err := utils.ListNames(store, id)
+	if err != nil {
+		log.Printf("error ListNames: %+v", err)
+		names = []string{utils.MainList}
+	}
+	lists := make([]utils.ItemList, len(names))
+	for i, name := range names {
+		lists[i] = utils.ItemList{ChatID: id, Name: name}
+	}
+	return lists
+}
+
+/*
+matchItem checks that every word is in the item's name, address, notes or tags.
+Lower ranks match better: 0 when the name starts with the query, 1 when the name has every word
+*/
+func matchItem(itemData constants.ItemDetails, words []string) (int, bool) {
+	name := strings.ToLower(itemData.Name)
+	other := strings.ToLower(itemData.Address + "\n" + itemData.Notes)
+	for tag := range itemData.Tags {
+		other += "\n" + strings.ToLower(tag)
+	}
+
+	rank := 1
+	for _, word := range words {
+		if strings.Contains(name, word) {
+			continue
+		}
+		if !strings.Contains(other, word) {
+			return 0, false
+		}
+		rank = 2
+	}
+	if len(words) > 0 && strings.HasPrefix(name, strings.Join(words, " ")) {
+		rank = 0
+	}
+	return rank, true
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+var listPicker = picker{choices: chatListChoices, prompt: "Which list?", filter: true}
+
+/* chatListChoices are the lists of the chat the update is from */
+func chatListChoices(store utils.Store, update *tgbotapi.Update) ([]utils.Choice, error) {
+	chatID, _, err := utils.GetChatUserID(update)
+	if err != nil {
+		return nil, err
+	}
+	return utils.ListChoices(store, chatID)
+}
+
+/* promptList asks which list to use, for the command waiting for it (or none, for /uselist) */
+func promptList(store utils.Store, update *tgbotapi.Update, command constants.PendingCommand) (constants.State, error) {
+	if err := utils.SetPendingCommand(store, update, command); err != nil {
+		return stay, err
+	}
+	text := "Which list do you want to use?"
+	if command.Text != "" {
+		text = "This chat has several lists. Which one is it for?"
+	}
+	if err := listPicker.show(store, update, text); err != nil {
+		return stay, err
+	}
+	return constants.SelectList, nil
+}
+
+/* /newlist, optionally with the name of the list */
+func newListCommand(store utils.Store, update *tgbotapi.Update, name string) (constants.State, error) {
+	if name == "" {
+		utils.SendMessage(update, "What should the new list be called? e.g. movies", false)
+		return constants.NewListSetName, nil
+	}
+	return createList(store, update, name)
+}
+
+func createList(store utils.Store, update *tgbotapi.Update, name string) (constants.State, error) {
+	list, err := utils.NewList(store, update, name)
+	switch {
+	case err == utils.ErrInvalidListName:
+		utils.SendMessage(update, fmt.Sprintf("List names are up to %d letters, digits, - or _, like movies or weekend-hikes. Try another", utils.MaxListName), false)
+		return stay, nil
+	case err == utils.ErrListExists:
+		utils.SendMessage(update, fmt.Sprintf("There already is a list named %s. Use it with /uselist %s", list.Name, list.Name), false)
+		return constants.Idle, nil
+	case err != nil:
+		return stay, err
+	}
+	utils.SendMessage(update, fmt.Sprintf("Created the list %s, and switched to it. /additem, /query, /edititem and /deleteitem work on it until you /uselist another", list.Name), false)
+	return constants.Idle, nil
+}
+
+/* /uselist, optionally with the name of the list */
+func useListCommand(store utils.Store, update *tgbotapi.Update, name string) (constants.State, error) {
+	if name == "" {
+		return promptList(store, update, constants.PendingCommand{})
+	}
+	list, err := utils.UseList(store, update, name)
+	if err == utils.ErrListNotFound {
+		chatID, _, err := utils.GetChatUserID(update)
+		if err != nil {
+			return stay, err
+		}
+		names, err := utils.ListNames(store, chatID)
+		if err != nil {
+			return stay, err
+		}
+		utils.SendMessage(update, fmt.Sprintf("There is no list named %s. The lists of this chat are: %s", strings.TrimSpace(name), strings.Join(names, ", ")), false)
+		return stay, nil
+	}
+	if err != nil {
+		return stay, err
+	}
+	utils.SendMessage(update, fmt.Sprintf("Now using the list %s", list.Name), false)
+	return constants.Idle, nil
+}
+
+/* pickList uses the pressed list, then runs the command waiting for it */
+func pickList(store utils.Store, update *tgbotapi.Update, name string) (constants.State, error) {
+	list, err := utils.UseList(store, update, name)
+	if err == utils.ErrListNotFound {
+		utils.SendMessage(update, "That list is gone, please pick another", false)
+		return stay, nil
+	}
+	if err != nil {
+		return stay, err
+	}
+	command, err := utils.GetPendingCommand(store, update)
+	if err != nil {
+		return stay, err
+	}
+	if command.Text == "" {
+		utils.EndInlineKeyboard(update, fmt.Sprintf("Now using the list %s", list.Name))
+		return constants.Idle, nil
+	}
+	utils.EndInlineKeyboard(update, fmt.Sprintf("Using the list %s", list.Name))
+	return resume, nil
+}
+
+var listsFlow = flow{
+	title:   "List States",
+	command: "/newlist or /uselist",
+	states: []stateDef{
+		{
+			state:   constants.NewListSetName,
+			name:    "NewListSetName",
+			expects: expectText,
+			handle:  createList,
+			doc:     []string{"Create the list, and use it"},
+			next:    []constants.State{constants.Idle},
+			invalid: "List name should be a text",
+		},
+		{
+			state:   constants.SelectList,
+			name:    "SelectList",
+			expects: expectInlineKeyboard,
+			handle:  pickList,
+			picker:  &listPicker,
+			doc:     []string{"Use the list", "Run the command that waited for it, if any"},
+			next:    []constants.State{constants.Idle},
+			invalid: "Please pick a list from the options",
+		},
+	},
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* picker shows the choices of a selection step as a paged keyboard. The stateDef with it handles the page buttons */
+type picker struct {
+	choices func(store utils.Store, update *tgbotapi.Update) ([]utils.Choice, error)
+	// Buttons after the choices on every page, like /done
+	extra []string
+	// Prompt when the filter is cleared, and in place of the one shown if there are no choices
+	prompt string
+	empty  string
+	// Typed text filters the choices. Only for steps not taking text
+	filter bool
+}
+
+/* show sends the first page of the choices with text, in place of the pressed message. Clears the filter */
+func (p *picker) show(store utils.Store, update *tgbotapi.Update, text string) error {
+	if err := utils.SetKeyboardFilter(store, update, ""); err != nil {
+		return err
+	}
+	choices, err := p.choices(store, update)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(choices) == 0 && p.empty != "":
+		text = p.empty
+	case len(choices) > utils.PageSize && p.filter:
+		text += "\n\n(Type part of a name to filter)"
+	}
+	utils.ReplaceInlineKeyboard(store, update, text, utils.NewPagedKeyboard(choices, 0, false, p.extra...))
+	return nil
+}
+
+/* turn shows a page of the choices matching the filter, on the pressed message */
+func (p *picker) turn(store utils.Store, update *tgbotapi.Update, page int) error {
+	filter, err := utils.GetKeyboardFilter(store, update)
+	if err != nil {
+		return err
+	}
+	choices, err := p.choices(store, update)
+	if err != nil {
+		return err
+	}
+	utils.ReplaceKeyboard(store, update, utils.NewPagedKeyboard(utils.FilterChoices(choices, filter), page, filter != "", p.extra...))
+	return nil
+}
+
+/* filterBy sends the first page of the choices matching the typed filter */
+func (p *picker) filterBy(store utils.Store, update *tgbotapi.Update, filter string) error {
+	if err := utils.SetKeyboardFilter(store, update, filter); err != nil {
+		return err
+	}
+	choices, err := p.choices(store, update)
+	if err != nil {
+		return err
+	}
+	choices = utils.FilterChoices(choices, filter)
+	text := fmt.Sprintf("%d matching \"%s\":", len(choices), filter)
+	if len(choices) == 0 {
+		text = fmt.Sprintf("Nothing matches \"%s\". Type something else, or show all", filter)
+	}
+	utils.ReplaceInlineKeyboard(store, update, text, utils.NewPagedKeyboard(choices, 0, true, p.extra...))
+	return nil
+}
+
+/* clearFilter shows the first page of all choices, on the pressed message */
+func (p *picker) clearFilter(store utils.Store, update *tgbotapi.Update) error {
+	return p.show(store, update, p.prompt)
+}
+
+/* ########## Choices ##########*/
+/* chatItemChoices are the items of the user's list of the chat the update is from */
+func chatItemChoices(store utils.Store, update *tgbotapi.Update) ([]utils.Choice, error) {
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return nil, err
+	}
+	itemNames, err := utils.GetItemNames(store, list.ID())
+	if err != nil {
+		return nil, err
+	}
+	return utils.ItemChoices(itemNames), nil
+}
+
+/* targetItemChoices are the items of the user's list of the chat the flow was started in */
+func targetItemChoices(store utils.Store, update *tgbotapi.Update) ([]utils.Choice, error) {
+	list, err := utils.GetTargetList(store, update)
+	if err != nil {
+		return nil, err
+	}
+	itemNames, err := utils.GetItemNames(store, list.ID())
+	if err != nil {
+		return nil, err
+	}
+	return utils.ItemChoices(itemNames), nil
+}
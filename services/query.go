@@ -1,7 +1,6 @@
 package services
 
 import (
-	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,507 +11,526 @@ import (
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
-func sendQuerySelectType(update *tgbotapi.Update, text string) {
-	msg := utils.CreateAndSendInlineKeyboard(update, text, 3, "/getOne", "/getFew", "/getAll")
-	utils.AddMessageToDelete(update, msg)
+func sendQuerySelectType(store utils.Store, update *tgbotapi.Update, text string) {
+	utils.CreateAndSendInlineKeyboard(store, update, text, 3, "/getOne", "/getFew", "/getAll", "/search", "/nearMe")
 }
 
-func sendQueryOneTagOrNameResponse(update *tgbotapi.Update, text string) {
-	msg := utils.CreateAndSendInlineKeyboard(update, text, 2, "/withTag", "/withName", "/random")
-	utils.AddMessageToDelete(update, msg)
+func sendQueryOneTagOrNameResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	utils.ReplaceInlineKeyboard(store, update, text, utils.NewInlineKeyboard(2, "/withTag", "/withName", "/random"))
 }
 
-func sendQueryGetImagesResponse(update *tgbotapi.Update, text string) {
-	msg := utils.CreateAndSendInlineKeyboard(update, text, 2, "yes", "no")
-	utils.AddMessageToDelete(update, msg)
+func sendQueryGetImagesResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	utils.ReplaceInlineKeyboard(store, update, text, utils.NewInlineKeyboard(2, "yes", "no"))
 }
 
-func checkAnyItem(update *tgbotapi.Update) error {
-	/* Check if there are any items registed */
-	chatID, _, err := utils.GetChatUserIDString(update)
+/* checkAnyItem tells the user when no items are registered yet, returning whether there are any */
+func checkAnyItem(store utils.Store, update *tgbotapi.Update) (bool, error) {
+	list, err := utils.GetList(store, update)
 	if err != nil {
-		log.Printf("error GetChatUserIDString: %+v", err)
+		return false, err
 	}
-
-	itemNames, err := utils.GetItemNames(update, chatID)
+	itemNames, err := utils.GetItemNames(store, list.ID())
 	if err != nil {
-		log.Printf("error GetItemNames: %+v", err)
-		utils.SendMessage(update, "Sorry an error occured", false)
-		return err
+		return false, err
 	}
 	if len(itemNames) == 0 {
 		utils.SendMessage(update, "No items registered :( add some", false)
-		return errors.New("no item registered")
+		return false, nil
 	}
-	return nil
+	return true, nil
 }
 
 /* Search from available tags to get */
-func addAndSendSelectedTags(update *tgbotapi.Update, tag string) {
-	/* Extract tags */
-	queryTagsMap, err := utils.GetQueryTags(update)
-	if err != nil {
-		log.Printf("error getting query tags: %+v", err)
+func addAndSendSelectedTags(store utils.Store, update *tgbotapi.Update, tag string) {
+	if err := utils.AddQueryTag(store, update, tag); err != nil {
+		log.Printf("error AddQueryTag: %+v", err)
 		utils.SendMessage(update, "Sorry, an error occured!", false)
 		return
 	}
+	sendSelectedTags(store, update, &queryTagPicker)
+}
 
-	/* if already selected */
-	if queryTagsMap[tag] {
+/* sendSelectedTags shows the tags picked so far as an expression, with the tags left to pick */
+func sendSelectedTags(store utils.Store, update *tgbotapi.Update, tagPicker *picker) {
+	filter, err := utils.GetQueryFilter(store, update)
+	if err != nil {
+		log.Printf("error getting query filter: %+v", err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
 		return
 	}
-	go utils.AddQueryTag(update, tag)
+	text := tagPicker.prompt
+	if expression := utils.FormatTagFilter(filter); expression != "" {
+		text = fmt.Sprintf("%s\n\nSelected tags: %s", text, expression)
+	}
+	if err := tagPicker.show(store, update, text); err != nil {
+		log.Printf("error showing tags: %+v", err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+	}
+}
 
-	/* Send current tags */
-	var queryTags = make([]string, len(queryTagsMap)+1)
-	i := 0
-	for tag := range queryTagsMap {
-		queryTags[i] = tag
-		i++
+/* sendAvailableTagsResponse shows the tags that aren't selected yet, with the match buttons and "/done" */
+func sendAvailableTagsResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	if err := queryTagPicker.show(store, update, text); err != nil {
+		log.Printf("error showing tags: %+v", err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
 	}
-	queryTags[len(queryTagsMap)] = tag
-	curTags := strings.Join(queryTags, ", ")
-	msg := utils.SendMessage(update, fmt.Sprintf("Selected tags: %s", curTags), false)
-	utils.AddMessageToDelete(update, msg)
 }
 
-func sendAvailableTagsResponse(update *tgbotapi.Update, text string) {
-	chatID, _, err := utils.GetChatUserIDString(update)
-	if err != nil {
-		log.Printf("error GetChatUserID: %+v", chatID)
+/* Search from name of items */
+func sendAvailableItemNamesResponse(store utils.Store, update *tgbotapi.Update, text string) {
+	if err := queryItemPicker.show(store, update, text); err != nil {
+		log.Printf("error showing items: %+v", err)
 		utils.SendMessage(update, "Sorry, an error occured!", false)
-		return
 	}
+}
 
-	tagsMap, err := utils.GetTags(update, chatID)
+/* unselectedQueryTags are the chat's tags not yet selected or excluded for the query */
+func unselectedQueryTags(store utils.Store, update *tgbotapi.Update) ([]utils.Choice, error) {
+	list, err := utils.GetList(store, update)
 	if err != nil {
-		log.Printf("error GetTags: %+v", err)
-		utils.SendMessage(update, "Sorry, an error occured!", false)
-		return
+		return nil, err
+	}
+	tagsMap, err := utils.GetTags(store, list.ID())
+	if err != nil {
+		return nil, err
+	}
+	filter, err := utils.GetQueryFilter(store, update)
+	if err != nil {
+		return nil, err
+	}
+	for tag := range filter.Tags {
+		delete(tagsMap, tag)
+	}
+	for tag := range filter.Excluded {
+		delete(tagsMap, tag)
 	}
+	return utils.TagChoices(tagsMap), nil
+}
 
-	/* No tags, just send done */
-	if len(tagsMap) == 0 {
-		utils.CreateAndSendInlineKeyboard(update, "No tags found. Just help me click that done button thanks", 1, "/done")
-		return
+var (
+	queryTagPicker = picker{
+		choices: unselectedQueryTags,
+		extra:   []string{"/all", "/any", "/not", "/done"},
+		prompt:  queryTagsPrompt,
+		filter:  true,
 	}
+	queryExcludedTagPicker = picker{
+		choices: unselectedQueryTags,
+		extra:   []string{"/done"},
+		prompt:  queryExcludedTagsPrompt,
+		filter:  true,
+	}
+	queryItemPicker = picker{choices: chatItemChoices, prompt: "Which item do you want?", filter: true}
+)
 
-	tags := make([]string, len(tagsMap)+1)
-	i := 0
-	for tag := range tagsMap {
-		tags[i] = tag
-		i++
+const (
+	queryTagsPrompt = "Add the tags you'd like to search with! (Don't add any to consider all items)\n\n" +
+		"Items with any of them are found. Press \"/all\" to find only items with all of them, " +
+		"\"/not\" to leave out items with some tags, and \"/done\" once finished"
+	queryExcludedTagsPrompt = "Add the tags of items to leave out\n\nPress \"/done\" once finished"
+)
+
+func promptTags(store utils.Store, update *tgbotapi.Update) {
+	sendAvailableTagsResponse(store, update, queryTagsPrompt)
+}
+
+func promptImages(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	sendQueryGetImagesResponse(store, update, "Do you want the images too? (if there is)")
+	return constants.QueryRetrieve, nil
+}
+
+/* Ask to get one using tag or name */
+func queryOne(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	sendQueryOneTagOrNameResponse(store, update, "How do you want to search?")
+	if err := utils.SetQueryNum(store, update, 1); err != nil {
+		return stay, err
 	}
-	tags[len(tagsMap)] = "/done"
-	msg := utils.CreateAndSendInlineKeyboard(update, text, 1, tags...)
-	utils.AddMessageToDelete(update, msg)
+	return constants.QueryOneTagOrName, nil
 }
 
-/* Search from name of items */
-func sendAvailableItemNamesResponse(update *tgbotapi.Update, text string) {
-	chatID, _, err := utils.GetChatUserIDString(update)
+/* Ask how many records to get */
+func queryFew(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	list, err := utils.GetList(store, update)
 	if err != nil {
-		log.Printf("error GetChatUserIDString: %+v", err)
+		return stay, err
+	}
+	itemNames, err := utils.GetItemNames(store, list.ID())
+	if err != nil {
+		return stay, err
 	}
 
-	itemNamesMap, err := utils.GetItemNames(update, chatID)
+	utils.ReplaceMessage(update, fmt.Sprintf("You have %v recorded", len(itemNames)))
+	messageID, err := utils.GetMessageTarget(store, update)
 	if err != nil {
-		log.Printf("error GetItemNames: %+v", err)
-		utils.SendMessage(update, "Sorry, an error occured!", false)
-		return
+		return stay, err
 	}
+	// Force reply, as the number is typed
+	utils.SendMessageForceReply(update, "How many items do you want?", messageID, false)
+	return constants.QueryFewSetNum, nil
+}
 
-	/* Set each name as its own inline row */
-	itemNames := make([]string, len(itemNamesMap))
-	i := 0
-	for itemName := range itemNamesMap {
-		itemNames[i] = itemName
-		i++
+func queryAll(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+	itemNames, err := utils.GetItemNames(store, list.ID())
+	if err != nil {
+		return stay, err
 	}
-	msg := utils.CreateAndSendInlineKeyboard(update, text, 1, itemNames...)
-	utils.AddMessageToDelete(update, msg)
+	if err := utils.SetQueryNum(store, update, len(itemNames)); err != nil {
+		return stay, err
+	}
+	promptTags(store, update)
+	return constants.QuerySetTags, nil
 }
 
-func queryHandler(update *tgbotapi.Update, userState constants.State) {
-	switch userState {
-	case constants.QuerySelectType:
-		// Expect user to select from inline markup keyboard
-		/* If user send a message instead */
-		if update.Message != nil {
-			msg := utils.SendMessage(update, "Please select from the above options", false)
-			utils.AddMessageToDelete(update, msg)
-			return
-		}
-		// Get message
-		message, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error GetCallbackQueryMessage: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		// Delete messages
-		if err := utils.DeleteRecentMessages(update); err != nil {
-			log.Printf("error DeleteRecentMessages: %+v", err)
-			// utils.SendMessage(update, "Sorry, an error occured!", false)
-			// return
-		}
-		switch message {
-		case "/getOne":
-			// getOne markup (/withTag, /withName), GoTo QueryOneTagOrName
-			sendQueryOneTagOrNameResponse(update, "How do you want to search?")
-			utils.SetQueryNum(update, 1)
-			if err := utils.SetUserState(update, constants.QueryOneTagOrName); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-		case "/getFew":
-			// getFew GoTo QueryFewSetNum. Message how many they want?
-			chatID, _, err := utils.GetChatUserIDString(update)
-			if err != nil {
-				log.Printf("error GetChatUserIDString: %+v", err)
-			}
+func queryWithTag(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	promptTags(store, update)
+	return constants.QuerySetTags, nil
+}
 
-			itemNames, err := utils.GetItemNames(update, chatID)
-			if err != nil {
-				log.Printf("error GetItemNames: %+v", err)
-				utils.SendMessage(update, "Sorry an error occured", false)
-				return
-			}
+func queryWithName(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	sendAvailableItemNamesResponse(store, update, "Which item do you want?")
+	return constants.QueryOneSetName, nil
+}
 
-			// Store to delete
-			msg := utils.RemoveMarkupKeyboard(update, fmt.Sprintf("You have %v recorded", len(itemNames)), false)
-			utils.AddMessageToDelete(update, msg)
-			// Get message
-			messageID, err := utils.GetMessageTarget(update)
-			if err != nil {
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			// Store to delete
-			utils.SendMessageForceReply(update, "How many items do you want?", messageID, false)
-			// if err != nil {
-			// 	log.Printf("error SetMessageForceReply: %+v", err)
-			// 	utils.SendMessage(update, "Sorry, an error occured!", false)
-			// }
-			// utils.AddMessageToDelete(update, msg)
-			// Set state
-			if err := utils.SetUserState(update, constants.QueryFewSetNum); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-		case "/getAll":
-			// getAll GoTo QuerySetTags
-			chatID, _, err := utils.GetChatUserIDString(update)
-			if err != nil {
-				log.Printf("error GetChatUserIDString: %+v", err)
-			}
+func selectQueryItem(store utils.Store, update *tgbotapi.Update, itemID string) (constants.State, error) {
+	if err := utils.SetQueryItem(store, update, itemID); err != nil {
+		return stay, err
+	}
+	return promptImages(store, update, itemID)
+}
 
-			itemNames, err := utils.GetItemNames(update, chatID)
-			if err != nil {
-				log.Printf("error GetItemNames: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			utils.SetQueryNum(update, len(itemNames))
-			// Store to delete
-			msg := utils.RemoveMarkupKeyboard(update, "All in I see.", false)
-			utils.AddMessageToDelete(update, msg)
-
-			sendAvailableTagsResponse(update, "Add the tags you'd like to search with! \n\nPress \"/done\" once finished")
-			msg = utils.SendMessage(update, "(Don't add any to consider all items)", false)
-			utils.AddMessageToDelete(update, msg)
-			if err := utils.SetUserState(update, constants.QuerySetTags); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			// sendQueryGetImagesResponse(update, "Do you want the images as well?")
-			// if err := utils.SetUserState(update, constants.QueryRetrieve); err != nil {
-			// 	log.Printf("error SetUserState: %+v", err)
-			// 	utils.SendMessage(update, "Sorry, an error occured!", false)
-			// 	return
-			// }
-		}
-	/* Ask to get one using tag or name */
-	case constants.QueryOneTagOrName:
-		// Expect user to select from inline markup keyboard (use tag or name to search)
-		/* If user send a message instead */
-		if update.Message != nil {
-			msg := utils.SendMessage(update, "Please select from the above options", false)
-			utils.AddMessageToDelete(update, msg)
-			return
-		}
-		// Delete messages
-		if err := utils.DeleteRecentMessages(update); err != nil {
-			log.Printf("error DeleteRecentMessages: %+v", err)
-			// utils.SendMessage(update, "Sorry, an error occured!", false)
-			// return
-		}
+func setQueryNum(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	numQuery, err := strconv.Atoi(input)
+	if err != nil || numQuery < 0 {
+		utils.SendMessage(update, "comeon, send a proper number", false)
+		return stay, nil
+	}
 
-		message, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error GetCallbackQueryMessage: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		switch message {
-		case "/random":
-			if err := utils.DeleteRecentMessages(update); err != nil {
-				log.Printf("error DeleteRecentMessages: %+v", err)
-				// utils.SendMessage(update, "Sorry, an error occured!", false)
-				// return
-			}
-			sendQueryGetImagesResponse(update, "Do you want the images too? (if there is)")
-			if err := utils.SetUserState(update, constants.QueryRetrieve); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-		case "/withTag":
-			// Send responses
-			msg := utils.RemoveMarkupKeyboard(update, "Searching for tags", false)
-			utils.AddMessageToDelete(update, msg)
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+	itemNames, err := utils.GetItemNames(store, list.ID())
+	if err != nil {
+		return stay, err
+	}
+	if numQuery > len(itemNames) {
+		utils.SendMessage(update, fmt.Sprintf("thats too many. I'll just assume you want %v", len(itemNames)), false)
+		numQuery = len(itemNames)
+	}
+	if err := utils.SetQueryNum(store, update, numQuery); err != nil {
+		return stay, err
+	}
 
-			sendAvailableTagsResponse(update, "Add the tags you'd like to search with! \n\nPress \"/done\" once finished")
+	promptTags(store, update)
+	return constants.QuerySetTags, nil
+}
 
-			msg = utils.SendMessage(update, "(Don't add any to consider all items)", false)
-			utils.AddMessageToDelete(update, msg)
+func addQueryTag(store utils.Store, update *tgbotapi.Update, tag string) (constants.State, error) {
+	addAndSendSelectedTags(store, update, tag)
+	return stay, nil
+}
 
-			if err := utils.SetUserState(update, constants.QuerySetTags); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-		case "/withName":
-			msg := utils.RemoveMarkupKeyboard(update, "Searching for items", false)
-			utils.AddMessageToDelete(update, msg)
-			sendAvailableItemNamesResponse(update, "Which item do you want?")
-			if err := utils.SetUserState(update, constants.QueryOneSetName); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-		}
+/* setQueryMatch matches all of the selected tags for "/all", and any of them for "/any" */
+func setQueryMatch(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	if err := utils.SetQueryMatchAll(store, update, input == "/all"); err != nil {
+		return stay, err
+	}
+	sendSelectedTags(store, update, &queryTagPicker)
+	return stay, nil
+}
 
-	/* Ask for name to search with */
-	case constants.QueryOneSetName:
-		// Expect user to select from inline markup keyboard (select name of item)
-		/* If user send a message instead */
-		if update.Message != nil {
-			msg := utils.SendMessage(update, "Please select from the above options", false)
-			utils.AddMessageToDelete(update, msg)
-			return
-		}
+func excludeQueryTags(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	sendSelectedTags(store, update, &queryExcludedTagPicker)
+	return constants.QueryExcludeTags, nil
+}
 
-		if err := utils.DeleteRecentMessages(update); err != nil {
-			log.Printf("error DeleteRecentMessages: %+v", err)
-			// utils.SendMessage(update, "Sorry, an error occured!", false)
-			// return
-		}
-		name, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error GetCallbackQueryMessage: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		utils.SetQueryName(update, name)
-		sendQueryGetImagesResponse(update, "Do you want the images too? (if there is)")
-		if err := utils.SetUserState(update, constants.QueryRetrieve); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
+func addExcludedQueryTag(store utils.Store, update *tgbotapi.Update, tag string) (constants.State, error) {
+	if err := utils.ExcludeQueryTag(store, update, tag); err != nil {
+		return stay, err
+	}
+	sendSelectedTags(store, update, &queryExcludedTagPicker)
+	return stay, nil
+}
 
-	/* Ask how many records to get */
-	case constants.QueryFewSetNum:
-		// Expect user to send a number (number of records to query)
-		// Get queryNum
-		message, _, err := utils.GetMessage(update)
-		if err != nil {
-			log.Printf("error GetMessage: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		numQuery, err := strconv.Atoi(message)
-		if err != nil || numQuery < 0 {
-			msg := utils.SendMessage(update, "comeon, send a proper number", false)
-			utils.AddMessageToDelete(update, msg)
-			return
-		}
-		// By here, proper number received
-		// Delete messages
-		if err := utils.DeleteRecentMessages(update); err != nil {
-			log.Printf("error DeleteRecentMessages: %+v", err)
-			// utils.SendMessage(update, "Sorry, an error occured!", false)
-			// return
-		}
+func doneWithQueryTags(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	return promptImages(store, update, input)
+}
 
-		// Add queryNum
-		chatID, _, err := utils.GetChatUserIDString(update)
-		if err != nil {
-			log.Printf("error GetChatUserIDString: %+v", err)
-		}
+/* Retrieve the queried items, with images if sendImage is "yes" */
+func retrieveItems(store utils.Store, update *tgbotapi.Update, sendImage string) (constants.State, error) {
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
 
-		itemNames, err := utils.GetItemNames(update, chatID)
+	// if item != "", get and show item data. (one result)
+	queryItem, _ := utils.GetQueryItem(store, update)
+	if len(queryItem) > 0 {
+		itemData, err := utils.GetItem(store, queryItem, list.ID())
 		if err != nil {
-			log.Printf("error GetItemNames: %+v", err)
-			utils.SendMessage(update, "Sorry an error occured", false)
-			return
+			return constants.Idle, withReply(err, "Sorry, error with getting data on the item.")
 		}
+		utils.EndInlineKeyboard(update, "Here you go!")
+		utils.SendItemDetails(update, itemData, sendImage == "yes")
+		return constants.Idle, nil
+	}
 
-		if numQuery > len(itemNames) {
-			msg := utils.SendMessage(update, fmt.Sprintf("thats too many. I'll just assume you want %v", len(itemNames)), false)
-			utils.AddMessageToDelete(update, msg)
-			utils.SetQueryNum(update, len(itemNames))
-		} else {
-			utils.SetQueryNum(update, numQuery)
-		}
+	// Get number of queries to return
+	queryNum, err := utils.GetQueryNum(store, update)
+	if err != nil {
+		return stay, err
+	}
+	// Get tags for filter
+	filter, err := utils.GetQueryFilter(store, update)
+	if err != nil {
+		return stay, err
+	}
 
-		sendAvailableTagsResponse(update, "Add the tags you'd like to search with! \n\nPress \"/done\" once finished")
-		msg := utils.SendMessage(update, "(Don't add any to consider all items)", false)
-		utils.AddMessageToDelete(update, msg)
-		if err := utils.SetUserState(update, constants.QuerySetTags); err != nil {
-			log.Printf("error SetUserState: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
+	header := "Here you go!"
+	if expression := utils.FormatTagFilter(filter); expression != "" {
+		header = fmt.Sprintf("Searching with tags: %s", expression)
+		if update.CallbackQuery == nil {
+			utils.SendMessage(update, header, false)
 		}
+	}
+	utils.EndInlineKeyboard(update, header)
+	// Get matching items, shuffled. Sends the first queryNum
+	items, err := utils.GetItems(store, update, filter)
+	if err != nil {
+		return stay, err
+	}
+	// less than queryNum found
+	if len(items) < queryNum {
+		utils.SendMessage(update, fmt.Sprintf("Found %v result(s) with matching tags", len(items)), false)
+		queryNum = len(items)
+	}
+	for _, itemData := range items[:queryNum] {
+		utils.SendItemDetails(update, itemData, sendImage == "yes")
+	}
+	return constants.Idle, nil
+}
 
-	/* Ask for tags to search with */
-	case constants.QuerySetTags:
-		// Expect user to select from inline keyboard markup (tags to include)
-		/* If user send a message instead */
-		if update.Message != nil {
-			msg := utils.SendMessage(update, "Please select from the above options", false)
-			utils.AddMessageToDelete(update, msg)
-			return
-		}
+/* queryUsage documents the arguments of /query */
+const queryUsage = "Usage: /query [tag:<tag>]... [not:<tag>]... [all] [<number>] [images]\ne.g. /query tag:dinner tag:cheap all not:spicy 3"
 
-		// preview current, inline (show tags not yet added, /done)
-		tag, err := utils.GetCallbackQueryMessage(update)
-		if err != nil {
-			log.Printf("error getting message from callback: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
-		}
-		// done GoTo QueryRetrieve. Markup("yes, no"), ask with pic
-		switch tag {
-		case "/done":
-			// Delete messages
-			if err := utils.DeleteRecentMessages(update); err != nil {
-				log.Printf("error DeleteRecentMessages: %+v", err)
-				// utils.SendMessage(update, "Sorry, an error occured!", false)
-				// return
-			}
-			sendQueryGetImagesResponse(update, "Do you want the images too? (if there is)")
-			if err := utils.SetUserState(update, constants.QueryRetrieve); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
+/* Prompt for the user's location, to send the closest items */
+func queryNearMe(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	utils.EndInlineKeyboard(update, "Searching near you")
+	utils.SendLocationRequest(store, update, "Send your location (or share your live location) to get the closest items")
+	return constants.QueryNearMe, nil
+}
+
+/* Send the items closest to the location sent, with their distance */
+func sendNearbyItems(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	location, _, err := utils.GetLocation(update)
+	if err != nil {
+		return stay, err
+	}
+	items, err := utils.GetItems(store, update, constants.TagFilter{})
+	if err != nil {
+		return stay, err
+	}
+	nearby := utils.NearestItems(items, location, utils.NearbyLimit)
+	if len(nearby) == 0 {
+		utils.RemoveMarkupKeyboard(store, update, "None of the items have a location yet. Add one with /setLocation when adding or editing an item", false)
+		return constants.Idle, nil
+	}
+	lines := make([]string, len(nearby))
+	for i, item := range nearby {
+		lines[i] = fmt.Sprintf("%d. %s, %s", i+1, item.ItemData.Name, utils.FormatDistance(item.Distance))
+	}
+	utils.RemoveMarkupKeyboard(store, update, "Closest to you:\n"+strings.Join(lines, "\n"), false)
+	for _, item := range nearby {
+		utils.SendItemDetails(update, item.ItemData, false)
+	}
+	return constants.Idle, nil
+}
+
+/* parseQueryArgs parses "[tag:<tag>]... [not:<tag>]... [all] [<number>] [images]". all matches all of the tags instead of any */
+func parseQueryArgs(args string) (filter constants.TagFilter, num int, images bool, err error) {
+	filter = constants.TagFilter{Tags: make(map[string]bool), Excluded: make(map[string]bool)}
+	for _, arg := range strings.Fields(args) {
+		switch {
+		case strings.HasPrefix(arg, "tag:") && utils.CheckTag(strings.TrimPrefix(arg, "tag:")) == nil:
+			filter.Tags[strings.TrimPrefix(arg, "tag:")] = true
+		case strings.HasPrefix(arg, "not:") && utils.CheckTag(strings.TrimPrefix(arg, "not:")) == nil:
+			filter.Excluded[strings.TrimPrefix(arg, "not:")] = true
+		case arg == "all":
+			filter.MatchAll = true
+		case arg == "images":
+			images = true
 		default:
-			addAndSendSelectedTags(update, tag)
+			num, err = strconv.Atoi(arg)
+			if err != nil || num <= 0 {
+				return constants.TagFilter{}, 0, false, fmt.Errorf("invalid query argument %q", arg)
+			}
 		}
-	/* Ask whether want pics, and retrieve */
-	case constants.QueryRetrieve:
-		/* If user send a message instead */
-		if update.Message != nil {
-			msg := utils.SendMessage(update, "Please select from the above options", false)
-			utils.AddMessageToDelete(update, msg)
-			return
+	}
+	return filter, num, images, nil
+}
+
+/* Retrieve items for /query with arguments, without the wizard */
+func queryWithArgs(store utils.Store, update *tgbotapi.Update, args string) (constants.State, error) {
+	filter, num, images, err := parseQueryArgs(args)
+	if err != nil {
+		utils.SendMessage(update, queryUsage, false)
+		return stay, nil
+	}
+	for tag := range filter.Tags {
+		if err := utils.AddQueryTag(store, update, tag); err != nil {
+			return stay, err
 		}
-		// Delete messages
-		if err := utils.DeleteRecentMessages(update); err != nil {
-			log.Printf("error DeleteRecentMessages: %+v", err)
-			// utils.SendMessage(update, "Sorry, an error occured!", false)
-			// return
+	}
+	for tag := range filter.Excluded {
+		if err := utils.ExcludeQueryTag(store, update, tag); err != nil {
+			return stay, err
 		}
-
-		// Expect user to select from inline keyboard markup (yes or no to image)
-		sendImage, err := utils.GetCallbackQueryMessage(update)
+	}
+	if err := utils.SetQueryMatchAll(store, update, filter.MatchAll); err != nil {
+		return stay, err
+	}
+	if num == 0 {
+		list, err := utils.GetList(store, update)
 		if err != nil {
-			log.Printf("error GetCallbackQueryMessage: %+v", err)
-			utils.SendMessage(update, "Sorry, an error occured!", false)
-			return
+			return stay, err
 		}
-		if len(sendImage) > 0 {
-			queryName, _ := utils.GetQueryName(update)
-
-			// if name != "", get and show item data. (one result)
-			if len(queryName) > 0 {
-				chatID, _, err := utils.GetChatUserIDString(update)
-				if err != nil {
-					log.Printf("error GetChatUserID: %+v", err)
-					utils.SendMessage(update, "Sorry, an error occured!", false)
-					return
-				}
-				itemData, err := utils.GetItem(update, queryName, chatID)
-				if err != nil {
-					log.Printf("error GetItem: %+v", err)
-					if err := utils.SetUserState(update, constants.Idle); err != nil {
-						log.Printf("error SetUserState: %+v", err)
-						utils.SendMessage(update, "Sorry, an error occured!", false)
-						return
-					}
-					utils.SendMessage(update, "Sorry, error with getting data on the item.", false)
-					return
-				}
-				utils.SendItemDetails(update, itemData, sendImage == "yes")
-				if err := utils.SetUserState(update, constants.Idle); err != nil {
-					log.Printf("error SetUserState: %+v", err)
-					utils.SendMessage(update, "Sorry, an error occured!", false)
-					return
-				}
-				return
-			}
-
-			// Get number of queries to return
-			queryNum, err := utils.GetQueryNum(update)
-			if err != nil {
-				log.Printf("error GetQueryNum: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			// Get tags for filter
-			queryTags, err := utils.GetQueryTags(update)
-			if err != nil {
-				log.Printf("error GetQueryTags: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-
-			if len(queryTags) > 0 {
-				tagList := make([]string, len(queryTags))
-				i := 0
-				for tag := range queryTags {
-					tagList[i] = tag
-					i++
-				}
-				utils.SendMessage(update, fmt.Sprintf("Searching with tag(s): %+s", strings.Join(tagList, ", ")), false)
-			}
-			// Get matching items
-			// if len(tags) == 0, get all, randomly choose QueryNum
-			// if len(tags) > 0, get all, extract with matching tags. randomly select queryNum
-			items, err := utils.GetItems(update, queryTags)
-			if err != nil {
-				log.Printf("error GetItems: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			// less than queryNum found
-			if len(items) < queryNum {
-				utils.SendMessage(update, fmt.Sprintf("Found %v result(s) with matching tags", len(items)), false)
-				queryNum = len(items)
-			}
-			for _, itemData := range items[:queryNum] {
-				utils.SendItemDetails(update, itemData, sendImage == "yes")
-			}
-			if err := utils.SetUserState(update, constants.Idle); err != nil {
-				log.Printf("error SetUserState: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
+		itemNames, err := utils.GetItemNames(store, list.ID())
+		if err != nil {
+			return stay, err
 		}
+		num = len(itemNames)
 	}
+	if err := utils.SetQueryNum(store, update, num); err != nil {
+		return stay, err
+	}
+	if images {
+		return retrieveItems(store, update, "yes")
+	}
+	return retrieveItems(store, update, "no")
+}
+
+var queryFlow = flow{
+	title:   "Query States",
+	command: "/query",
+	states: []stateDef{
+		{
+			state:   constants.QuerySelectType,
+			name:    "QuerySelectType",
+			expects: expectInlineKeyboard,
+			options: []option{
+				{inputs: []string{"/getOne"}, doc: []string{"Set QueryNum to 1", "Prompt for search method. (random/tags/name)"}, next: []constants.State{constants.QueryOneTagOrName},
+					handle: queryOne},
+				{inputs: []string{"/getFew"}, doc: []string{"Prompt for number of items to get"}, next: []constants.State{constants.QueryFewSetNum},
+					handle: queryFew},
+				{inputs: []string{"/getAll"}, doc: []string{"Set QueryNum to total number of items", "Send existing tags for selection"}, next: []constants.State{constants.QuerySetTags},
+					handle: queryAll},
+				{inputs: []string{"/search"}, doc: []string{"Prompt for text to search for"}, next: []constants.State{constants.QuerySearch},
+					handle: querySearch},
+				{inputs: []string{"/nearMe"}, doc: []string{"Prompt for user's location"}, next: []constants.State{constants.QueryNearMe},
+					handle: queryNearMe},
+			},
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.QueryOneTagOrName,
+			name:    "QueryOneTagOrName",
+			expects: expectInlineKeyboard,
+			options: []option{
+				{inputs: []string{"/random"}, doc: []string{"Prompt if want images"}, next: []constants.State{constants.QueryRetrieve},
+					handle: promptImages},
+				{inputs: []string{"/withTag"}, doc: []string{"Send existing tags for selection"}, next: []constants.State{constants.QuerySetTags},
+					handle: queryWithTag},
+				{inputs: []string{"/withName"}, doc: []string{"Send names of existing items for selection"}, next: []constants.State{constants.QueryOneSetName},
+					handle: queryWithName},
+			},
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.QueryOneSetName,
+			name:    "QueryOneSetName",
+			expects: expectInlineKeyboard,
+			picker:  &queryItemPicker,
+			handle:  selectQueryItem,
+			doc:     []string{"Get item to retrieve", "Prompt if want images"},
+			next:    []constants.State{constants.QueryRetrieve},
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.QueryFewSetNum,
+			name:    "QueryFewSetNum",
+			expects: expectNumber,
+			handle:  setQueryNum,
+			doc:     []string{"Set QueryNum to input number", "Send existing tags for selection"},
+			next:    []constants.State{constants.QuerySetTags},
+			invalid: "comeon, send a proper number",
+		},
+		{
+			state:   constants.QuerySetTags,
+			name:    "QuerySetTags",
+			expects: expectInlineKeyboard,
+			picker:  &queryTagPicker,
+			options: []option{
+				{inputs: []string{"/all"}, doc: []string{"Find items with all of the selected tags"},
+					handle: setQueryMatch, toast: "Matching all tags"},
+				{inputs: []string{"/any"}, doc: []string{"Find items with any of the selected tags (default)"},
+					handle: setQueryMatch, toast: "Matching any tag"},
+				{inputs: []string{"/not"}, doc: []string{"Send existing tags for exclusion"}, next: []constants.State{constants.QueryExcludeTags},
+					handle: excludeQueryTags},
+				{inputs: []string{"/done"}, doc: []string{"Prompt if want images"}, next: []constants.State{constants.QueryRetrieve},
+					handle: doneWithQueryTags},
+			},
+			handle:  addQueryTag,
+			label:   "Existing Tag",
+			doc:     []string{"Add selected tag for query"},
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.QueryExcludeTags,
+			name:    "QueryExcludeTags",
+			expects: expectInlineKeyboard,
+			picker:  &queryExcludedTagPicker,
+			options: []option{
+				{inputs: []string{"/done"}, doc: []string{"Prompt if want images"}, next: []constants.State{constants.QueryRetrieve},
+					handle: doneWithQueryTags},
+			},
+			handle:  addExcludedQueryTag,
+			label:   "Existing Tag",
+			doc:     []string{"Leave out items with selected tag"},
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.QueryRetrieve,
+			name:    "QueryRetrieve",
+			expects: expectInlineKeyboard,
+			options: []option{
+				{inputs: []string{"yes"}, doc: []string{"Send items with images"}, next: []constants.State{constants.Idle},
+					handle: retrieveItems},
+				{inputs: []string{"no"}, doc: []string{"Send items without images"}, next: []constants.State{constants.Idle},
+					handle: retrieveItems},
+			},
+			invalid: "Please select from the above options",
+		},
+		{
+			state:   constants.QuerySearch,
+			name:    "QuerySearch",
+			expects: expectText,
+			handle:  searchItems,
+			doc:     []string{"Send items best matching the text by name, address, notes and tags, allowing for typos"},
+			next:    []constants.State{constants.Idle},
+			invalid: "Send the words to search for",
+		},
+		{
+			state:   constants.QueryNearMe,
+			name:    "QueryNearMe",
+			expects: expectLocation,
+			handle:  sendNearbyItems,
+			doc:     []string{fmt.Sprintf("Send the %d items closest to the location, with their distance and a map pin", utils.NearbyLimit)},
+			next:    []constants.State{constants.Idle},
+			invalid: "Send your location, with 📎 → Location",
+		},
+	},
 }
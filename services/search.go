@@ -0,0 +1,63 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const searchPrompt = "What are you looking for? (words of a name, address, notes or tags)"
+
+/* /search, optionally with the text to search for */
+func searchCommand(store utils.Store, update *tgbotapi.Update, text string) (constants.State, error) {
+	if err := utils.ResetQuery(store, update); err != nil {
+		return stay, err
+	}
+	if ok, err := checkAnyItem(store, update); !ok {
+		return stay, err
+	}
+	if text != "" {
+		return searchItems(store, update, text)
+	}
+	_, messageID, err := utils.GetMessage(update)
+	if err != nil {
+		return stay, err
+	}
+	// Force reply, as the text is typed
+	utils.SendMessageForceReply(update, searchPrompt, messageID, false)
+	return constants.QuerySearch, nil
+}
+
+/* Prompt for the text to search for, from the query type */
+func querySearch(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	utils.EndInlineKeyboard(update, "Searching by name, address, notes and tags")
+	messageID, err := utils.GetMessageTarget(store, update)
+	if err != nil {
+		return stay, err
+	}
+	utils.SendMessageForceReply(update, searchPrompt, messageID, false)
+	return constants.QuerySearch, nil
+}
+
+/* Send the items best matching the text */
+func searchItems(store utils.Store, update *tgbotapi.Update, text string) (constants.State, error) {
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return stay, err
+	}
+	hits, err := utils.SearchItems(store, list.ID(), text, utils.SearchLimit)
+	if err != nil {
+		return stay, err
+	}
+	if len(hits) == 0 {
+		utils.SendMessage(update, fmt.Sprintf("Nothing matches \"%s\". Try other words, or /query to browse", text), false)
+		return constants.Idle, nil
+	}
+	utils.SendMessage(update, fmt.Sprintf("Best %d match(es) for \"%s\":", len(hits), text), false)
+	for _, hit := range hits {
+		utils.SendItemDetails(update, hit.ItemData, false)
+	}
+	return constants.Idle, nil
+}
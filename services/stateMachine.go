@@ -0,0 +1,389 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* ########## Input ##########*/
+type inputKind int
+
+const (
+	textInput inputKind = 1 << iota
+	photoInput
+	callbackInput
+	documentInput
+	locationInput
+)
+
+/* input is what a state expects from the user, with how the README describes it */
+type input struct {
+	kinds inputKind
+	doc   string
+}
+
+var (
+	expectText                 = input{textInput, "text message"}
+	expectNumber               = input{textInput, "a number"}
+	expectImage                = input{photoInput, "image"}
+	expectReplyKeyboard        = input{textInput, "response from reply markup keyboard"}
+	expectInlineKeyboard       = input{callbackInput, "callback from inline keyboard"}
+	expectTextOrInlineKeyboard = input{textInput | callbackInput, "text message or callback from inline keyboard"}
+	expectTextOrDocument       = input{textInput | documentInput, "text message or document"}
+	expectLocation             = input{locationInput, "location or venue"}
+)
+
+/* readInput returns the kind of input in the update, and its text, caption or callback data. A location has no text */
+func readInput(update *tgbotapi.Update) (inputKind, string) {
+	switch {
+	case update.CallbackQuery != nil:
+		return callbackInput, update.CallbackQuery.Data
+	case update.Message == nil:
+		return 0, ""
+	case update.Message.Photo != nil && len(*update.Message.Photo) > 0:
+		return photoInput, ""
+	case update.Message.Document != nil:
+		return documentInput, update.Message.Caption
+	case update.Message.Location != nil || update.Message.Venue != nil:
+		return locationInput, ""
+	case update.Message.Text != "":
+		return textInput, update.Message.Text
+	}
+	return 0, ""
+}
+
+/* ########## Definition ##########*/
+/* stay is returned by a handler to remain in the current state */
+const stay constants.State = -1
+
+/* resume is returned by a handler to run the command that waited for it, in place of moving to a state */
+const resume constants.State = -2
+
+/* stateHandler handles valid input and returns the next state, or stay */
+type stateHandler func(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error)
+
+/* command can be sent in any state, as "/name@bot args" */
+type command struct {
+	name string
+	// Documents the arguments the command takes
+	args   string
+	doc    []string
+	next   []constants.State
+	handle stateHandler
+	// Works on the user's list of the chat, which is picked first if the chat has several and none was
+	list bool
+}
+
+/* option is an input with a handler of its own, like a keyboard button. The first of inputs is documented */
+type option struct {
+	inputs []string
+	doc    []string
+	next   []constants.State
+	handle stateHandler
+	// Shown when the handler succeeds, if the input was a pressed button
+	toast string
+}
+
+type stateDef struct {
+	state   constants.State
+	name    string
+	expects input
+	options []option
+	// Handles input matching none of the options. Without it, such input is invalid
+	handle stateHandler
+	// Describes the input handle takes, when there are options as well
+	label string
+	// Shows the choices of the step in pages, handling the page buttons
+	picker *picker
+	doc    []string
+	next   []constants.State
+	// Shown when handle succeeds, if the input was a pressed button
+	toast string
+	// Reply to invalid input, sent with reprompt if set. A pressed button gets it as a toast instead
+	invalid  string
+	reprompt func(store utils.Store, update *tgbotapi.Update, text string)
+}
+
+type flow struct {
+	title string
+	// Commands starting the flow
+	command string
+	states  []stateDef
+}
+
+type stateMachine struct {
+	commands []command
+	flows    []flow
+}
+
+/* replyError is an error with its own reply to the user, in place of the generic one */
+type replyError struct {
+	err   error
+	reply string
+}
+
+func (e *replyError) Error() string {
+	return e.err.Error()
+}
+
+func withReply(err error, reply string) error {
+	return &replyError{err, reply}
+}
+
+/* ########## Lookup ##########*/
+func (m *stateMachine) command(name string) *command {
+	for i := range m.commands {
+		if m.commands[i].name == name {
+			return &m.commands[i]
+		}
+	}
+	return nil
+}
+
+/* lookup returns the definition of the state and its flow, or nil for a state without input like Idle */
+func (m *stateMachine) lookup(state constants.State) (*flow, *stateDef) {
+	for i := range m.flows {
+		for j := range m.flows[i].states {
+			if m.flows[i].states[j].state == state {
+				return &m.flows[i], &m.flows[i].states[j]
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (m *stateMachine) stateName(state constants.State) string {
+	if state == constants.Idle {
+		return "Idle"
+	}
+	if _, def := m.lookup(state); def != nil {
+		return def.name
+	}
+	return "unknown state"
+}
+
+func (def *stateDef) option(input string) *option {
+	for i := range def.options {
+		for _, optionInput := range def.options[i].inputs {
+			if optionInput == input {
+				return &def.options[i]
+			}
+		}
+	}
+	return nil
+}
+
+/* ########## Handling ##########*/
+/* handle dispatches the update, and answers a pressed button so the client stops loading */
+func (m *stateMachine) handle(store utils.Store, update *tgbotapi.Update) {
+	toast := m.dispatch(store, update)
+	if update.CallbackQuery == nil {
+		return
+	}
+	if err := utils.AnswerCallback(update, toast); err != nil {
+		log.Printf("error AnswerCallback: %+v", err)
+	}
+}
+
+/* dispatch runs the command or state handler of the update, returning the toast for a pressed button */
+func (m *stateMachine) dispatch(store utils.Store, update *tgbotapi.Update) string {
+	kind, text := readInput(update)
+
+	/* Buttons carry tokens in place of their value */
+	if kind == callbackInput {
+		value, err := utils.ResolveCallback(store, update)
+		switch {
+		case err == utils.ErrForeignButton:
+			return "This button is for someone else"
+		case err == utils.ErrStaleButton:
+			return "This button is no longer active"
+		case err != nil:
+			log.Printf("error resolving callback: %+v", err)
+			return "Sorry, an error occured!"
+		}
+		text = value
+	}
+
+	/* Commands, also as the caption of a document */
+	if kind&(textInput|documentInput) != 0 && strings.HasPrefix(text, "/") {
+		name, args, ok := utils.ParseCommand(text)
+		if !ok {
+			// For another bot in the chat
+			return ""
+		}
+		if cmd := m.command(name); cmd != nil {
+			if cmd.list && m.pickListFirst(store, update, cmd, args) {
+				return ""
+			}
+			m.run(store, update, cmd.name, cmd.handle, args, cmd.next)
+			return ""
+		}
+		// Options like /done can be addressed to the bot as well
+		if args == "" {
+			text = name
+		}
+	}
+
+	/* Targeted handling by state */
+	state, err := utils.GetUserState(store, update)
+	if err != nil {
+		log.Printf("error getting user state: %+v", err)
+		return "Sorry, an error occured!"
+	}
+	_, def := m.lookup(state)
+	if def == nil {
+		// A button of a finished flow
+		return "This button is no longer active"
+	}
+	if def.picker != nil && m.page(store, update, kind, text, def) {
+		return ""
+	}
+	// Text goes to a picker filtering by it, so one of the options typed chooses it as well
+	typedOption := kind == textInput && def.picker != nil && def.picker.filter && def.option(text) != nil
+	if kind&def.expects.kinds == 0 && !typedOption {
+		return m.sendInvalid(store, update, kind, def)
+	}
+
+	if opt := def.option(text); opt != nil {
+		if m.run(store, update, def.name, opt.handle, text, opt.next) {
+			return opt.toast
+		}
+		return ""
+	}
+	if def.handle == nil {
+		return m.sendInvalid(store, update, kind, def)
+	}
+	if m.run(store, update, def.name, def.handle, text, def.next) {
+		return def.toast
+	}
+	return ""
+}
+
+/* run calls a handler and moves to the state it returns, if that is one of next. Reports whether it succeeded */
+func (m *stateMachine) run(store utils.Store, update *tgbotapi.Update, name string, handle stateHandler, input string, next []constants.State) bool {
+	nextState, err := handle(store, update, input)
+	if err != nil {
+		log.Printf("error in %s: %+v", name, err)
+		var reply *replyError
+		if errors.As(err, &reply) {
+			utils.SendMessage(update, reply.reply, false)
+		} else {
+			utils.SendMessage(update, "Sorry, an error occured!", false)
+		}
+	}
+	if nextState == stay {
+		return err == nil
+	}
+	if nextState == resume && err == nil {
+		return m.resume(store, update)
+	}
+	if !allowed(next, nextState) {
+		log.Printf("error in %s: transition to %s is not defined", name, m.stateName(nextState))
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return false
+	}
+	if err := utils.SetUserState(store, update, nextState); err != nil {
+		log.Printf("error SetUserState: %+v", err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return false
+	}
+	return err == nil
+}
+
+/*
+pickListFirst asks for the list a command works on when the chat has several and none was picked,
+keeping the command to resume once one is. Reports whether it asked
+*/
+func (m *stateMachine) pickListFirst(store utils.Store, update *tgbotapi.Update, cmd *command, args string) bool {
+	ambiguous, err := utils.ListAmbiguous(store, update)
+	if err != nil {
+		log.Printf("error in %s: %+v", cmd.name, err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return true
+	}
+	if !ambiguous {
+		return false
+	}
+	askList := func(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+		return promptList(store, update, utils.PendingCommandOf(update, strings.TrimSpace(cmd.name+" "+args)))
+	}
+	m.run(store, update, cmd.name, askList, args, []constants.State{constants.SelectList})
+	return true
+}
+
+/* resume runs the command that waited for a list to be picked, as if the user sent it again */
+func (m *stateMachine) resume(store utils.Store, update *tgbotapi.Update) bool {
+	pending, err := utils.GetPendingCommand(store, update)
+	if err == nil {
+		err = utils.SetPendingCommand(store, update, constants.PendingCommand{})
+	}
+	if err != nil {
+		log.Printf("error resuming command: %+v", err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return false
+	}
+	name, args, _ := utils.ParseCommand(pending.Text)
+	cmd := m.command(name)
+	if cmd == nil {
+		log.Printf("error resuming command: %q is not a command", pending.Text)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return false
+	}
+	if err := utils.SetUserState(store, update, constants.Idle); err != nil {
+		log.Printf("error SetUserState: %+v", err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+		return false
+	}
+	return m.run(store, utils.CommandUpdate(update, pending), cmd.name, cmd.handle, args, cmd.next)
+}
+
+/*
+page handles the page buttons and typed filter of the state's picker, reporting whether the input was one of them.
+Text typed as one of the state's options is left to choose it
+*/
+func (m *stateMachine) page(store utils.Store, update *tgbotapi.Update, kind inputKind, text string, def *stateDef) bool {
+	var err error
+	page, isPage := utils.ParsePageData(text)
+	switch {
+	case kind == callbackInput && isPage:
+		err = def.picker.turn(store, update, page)
+	case kind == callbackInput && text == utils.ClearFilterData:
+		err = def.picker.clearFilter(store, update)
+	case kind == textInput && def.picker.filter && def.option(text) == nil:
+		err = def.picker.filterBy(store, update, text)
+	default:
+		return false
+	}
+	if err != nil {
+		log.Printf("error in %s: %+v", def.name, err)
+		utils.SendMessage(update, "Sorry, an error occured!", false)
+	}
+	return true
+}
+
+/* sendInvalid replies to invalid input. A pressed button is only answered, with the returned toast */
+func (m *stateMachine) sendInvalid(store utils.Store, update *tgbotapi.Update, kind inputKind, def *stateDef) string {
+	if kind == callbackInput {
+		return def.invalid
+	}
+	if def.reprompt != nil {
+		def.reprompt(store, update, def.invalid)
+		return ""
+	}
+	utils.SendMessage(update, def.invalid, false)
+	return ""
+}
+
+func allowed(next []constants.State, state constants.State) bool {
+	for _, nextState := range next {
+		if nextState == state {
+			return true
+		}
+	}
+	return false
+}
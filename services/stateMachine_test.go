@@ -0,0 +1,106 @@
+package services
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+func TestWorkflowDefinition(t *testing.T) {
+	defined := map[constants.State]bool{constants.Idle: true}
+	for _, flow := range workflow.flows {
+		for _, def := range flow.states {
+			if defined[def.state] {
+				t.Errorf("%s defined twice", def.name)
+			}
+			defined[def.state] = true
+			if def.invalid == "" {
+				t.Errorf("%s has no reply to invalid input", def.name)
+			}
+			if def.handle == nil && len(def.options) == 0 {
+				t.Errorf("%s handles no input", def.name)
+			}
+		}
+	}
+	for state := constants.Idle; state < constants.StateCount; state++ {
+		if !defined[state] {
+			t.Errorf("state %d is not defined", state)
+		}
+	}
+
+	checkNext := func(name string, next []constants.State) {
+		for _, state := range next {
+			if !defined[state] {
+				t.Errorf("%s goes to undefined state %d", name, state)
+			}
+		}
+	}
+	for _, cmd := range workflow.commands {
+		checkNext(cmd.name, cmd.next)
+	}
+	for _, flow := range workflow.flows {
+		for _, def := range flow.states {
+			checkNext(def.name, def.next)
+			for _, opt := range def.options {
+				checkNext(def.name+" "+opt.inputs[0], opt.next)
+			}
+		}
+	}
+}
+
+func TestStateValues(t *testing.T) {
+	// Saved in sessions, so a session saved before an upgrade resumes in the same state
+	saved := []constants.State{
+		constants.Idle,
+		constants.ReadyForNextAction,
+		constants.AddNewSetName,
+		constants.AddNewSetAddress,
+		constants.AddNewSetNotes,
+		constants.AddNewSetURL,
+		constants.AddNewSetImages,
+		constants.AddNewSetTags,
+		constants.AddNewRemoveTags,
+		constants.ConfirmAddItemSubmit,
+		constants.QuerySelectType,
+		constants.QueryOneTagOrName,
+		constants.QueryOneSetName,
+		constants.QuerySetTags,
+		constants.QueryFewSetNum,
+		constants.QueryRetrieve,
+		constants.DeleteSelect,
+		constants.DeleteConfirm,
+		constants.GetItemToEdit,
+		constants.Feedback,
+		constants.ImportSetItems,
+		constants.ImportConfirm,
+		constants.ExportSelectFormat,
+		constants.NewListSetName,
+		constants.SelectList,
+		constants.AddNewChangeName,
+		constants.QueryExcludeTags,
+		constants.QuerySearch,
+		constants.AddNewSetLocation,
+		constants.QueryNearMe,
+		constants.StateCount,
+	}
+	for value, state := range saved {
+		if int(state) != value {
+			t.Errorf("state saved as %d is now %d", value, state)
+		}
+	}
+}
+
+func TestWorkflowDoc(t *testing.T) {
+	readme, err := ioutil.ReadFile("../README.md")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	updated, err := ReplaceWorkflowDoc(string(readme))
+	if err != nil {
+		t.Fatalf("ReplaceWorkflowDoc: %v", err)
+	}
+	if updated != string(readme) {
+		t.Error("README workflow is out of date, run go generate ./services")
+	}
+}
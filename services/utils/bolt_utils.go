@@ -0,0 +1,898 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket layout (mirrors the firebase tree):
+//
+//	sessions/<sessionID>           -> boltSession as json
+//	userChats/<userID>/<chatID>    -> chat title
+//	lists/<chatID>/<name>          -> "1"
+//	items/<chatID>/<itemID>        -> constants.ItemDetails as json
+//	itemNames/<chatID>/<itemID>    -> item name
+//	tags/<chatID>/<tag>            -> number of items with the tag
+//	feedback/<date>/<seq>          -> constants.FeedbackDetails as json
+//	updates/<updateID>             -> unix time it was processed
+//	meta/schemaVersion             -> boltSchemaVersion
+//
+// Schema versions:
+//
+//	1: items and itemNames keyed by item name
+//	2: items and itemNames keyed by item ID
+//	3: tags count the items using them
+//	4: delete records keep their messages in a nested bucket, with updatedAt
+//	5: no delete records, flows edit their messages instead
+const boltSchemaVersion = "5"
+
+var (
+	bucketSessions  = []byte("sessions")
+	bucketUserChats = []byte("userChats")
+	bucketLists     = []byte("lists")
+	bucketItems     = []byte("items")
+	bucketItemNames = []byte("itemNames")
+	bucketTags      = []byte("tags")
+	bucketFeedback  = []byte("feedback")
+	bucketUpdates   = []byte("updates")
+	bucketMeta      = []byte("meta")
+
+	boltTrue = []byte("1")
+)
+
+/* BoltStore keeps the bot's data in a local embedded database file */
+type BoltStore struct {
+	db *bolt.DB
+}
+
+type boltSession struct {
+	State     constants.State       `json:"state"`
+	ItemToAdd constants.ItemDetails `json:"itemToAdd"`
+	// Why the address of ItemToAdd wasn't placed on a map
+	GeocodeError string                   `json:"geocodeError"`
+	Target       boltTarget               `json:"target"`
+	Query        boltQuery                `json:"query"`
+	Import       []constants.ItemDetails  `json:"import"`
+	Keyboard     constants.Keyboard       `json:"keyboard"`
+	List         string                   `json:"list"`
+	Pending      constants.PendingCommand `json:"pending"`
+	LastActive   time.Time                `json:"lastActive"`
+}
+
+type boltTarget struct {
+	Chat    int64  `json:"chat"`
+	Message int    `json:"message"`
+	Item    string `json:"item"`
+	Filter  string `json:"filter"`
+}
+
+type boltQuery struct {
+	Item     string          `json:"item"`
+	QueryNum int             `json:"queryNum"`
+	Tags     map[string]bool `json:"tags"`
+	Excluded map[string]bool `json:"excluded"`
+	MatchAll bool            `json:"matchAll"`
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	/* Create schema */
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			bucketSessions, bucketUserChats, bucketLists, bucketItems, bucketItemNames, bucketTags,
+			bucketFeedback, bucketUpdates, bucketMeta,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(bucketMeta)
+		switch string(meta.Get([]byte("schemaVersion"))) {
+		case "1":
+			if err := migrateBoltItemIDs(tx); err != nil {
+				return err
+			}
+			fallthrough
+		case "2":
+			if err := tx.Bucket(bucketItems).ForEach(func(chatID, _ []byte) error {
+				return rebuildBoltIndex(tx, string(chatID))
+			}); err != nil {
+				return err
+			}
+			fallthrough
+		case "3", "4":
+			/* Delete records only held recent bot messages, drop them */
+			if err := tx.DeleteBucket([]byte("deleteRecord")); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return meta.Put([]byte("schemaVersion"), []byte(boltSchemaVersion))
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func InitBolt() *BoltStore {
+	path := os.Getenv("BOLT_PATH")
+	if path == "" {
+		path = "golistbot.db"
+	}
+	store, err := NewBoltStore(path)
+	if err != nil {
+		log.Fatalln("Error opening bolt database:", err)
+	}
+	log.Println("Loaded bolt database at", path)
+	return store
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+/* migrateBoltItemIDs re-keys the items of a version 1 database by a generated ID */
+func migrateBoltItemIDs(tx *bolt.Tx) error {
+	/* Buckets can't be replaced while iterating over them */
+	chatIDs := make([][]byte, 0)
+	if err := tx.Bucket(bucketItems).ForEach(func(chatID, _ []byte) error {
+		chatIDs = append(chatIDs, append([]byte{}, chatID...))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, chatID := range chatIDs {
+		items := tx.Bucket(bucketItems).Bucket(chatID)
+		if items == nil {
+			continue
+		}
+		migrated := make(map[string]constants.ItemDetails)
+		if err := items.ForEach(func(name, data []byte) error {
+			var itemData constants.ItemDetails
+			if err := json.Unmarshal(data, &itemData); err != nil {
+				return err
+			}
+			if itemData.Name == "" {
+				itemData.Name = string(name)
+			}
+			itemData.ID = NewItemID()
+			migrated[string(name)] = itemData
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		/* Replace both buckets of the chat */
+		for _, bucket := range [][]byte{bucketItems, bucketItemNames} {
+			if err := tx.Bucket(bucket).DeleteBucket(chatID); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		newItems, err := tx.Bucket(bucketItems).CreateBucket(chatID)
+		if err != nil {
+			return err
+		}
+		itemNames, err := tx.Bucket(bucketItemNames).CreateBucket(chatID)
+		if err != nil {
+			return err
+		}
+		for _, itemData := range migrated {
+			data, err := json.Marshal(itemData)
+			if err != nil {
+				return err
+			}
+			if err := newItems.Put([]byte(itemData.ID), data); err != nil {
+				return err
+			}
+			if err := itemNames.Put([]byte(itemData.ID), []byte(itemData.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* rebuildBoltIndex recomputes the tags and itemNames buckets of a chat from its items */
+func rebuildBoltIndex(tx *bolt.Tx, chatID string) error {
+	items := make(map[string]constants.ItemDetails)
+	if b, _ := subBucket(tx, bucketItems, chatID, false); b != nil {
+		if err := b.ForEach(func(k, v []byte) error {
+			var itemData constants.ItemDetails
+			if err := json.Unmarshal(v, &itemData); err != nil {
+				return err
+			}
+			items[string(k)] = itemData
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	for _, bucket := range [][]byte{bucketTags, bucketItemNames} {
+		if err := tx.Bucket(bucket).DeleteBucket([]byte(chatID)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	itemNames, err := subBucket(tx, bucketItemNames, chatID, true)
+	if err != nil {
+		return err
+	}
+	for itemID, itemData := range items {
+		if err := itemNames.Put([]byte(itemID), []byte(itemData.Name)); err != nil {
+			return err
+		}
+	}
+	return adjustBoltTags(tx, chatID, countTags(items))
+}
+
+/* adjustBoltTags applies tag count changes, dropping tags no longer used */
+func adjustBoltTags(tx *bolt.Tx, chatID string, deltas map[string]int) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	tags, err := subBucket(tx, bucketTags, chatID, true)
+	if err != nil {
+		return err
+	}
+	for tag, delta := range deltas {
+		count, _ := strconv.Atoi(string(tags.Get([]byte(tag))))
+		count += delta
+		if count <= 0 {
+			err = tags.Delete([]byte(tag))
+		} else {
+			err = tags.Put([]byte(tag), []byte(strconv.Itoa(count)))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ########## Helpers ##########*/
+/* viewSession reads a session record. Missing sessions are read as empty records */
+func (s *BoltStore) viewSession(sessionID string, read func(session *boltSession)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		var session boltSession
+		if data := tx.Bucket(bucketSessions).Get([]byte(sessionID)); data != nil {
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+		}
+		read(&session)
+		return nil
+	})
+}
+
+/* updateSession applies change to a session record and writes it back */
+func (s *BoltStore) updateSession(sessionID string, change func(session *boltSession)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(bucketSessions)
+		var session boltSession
+		if data := sessions.Get([]byte(sessionID)); data != nil {
+			if err := json.Unmarshal(data, &session); err != nil {
+				return err
+			}
+		}
+		change(&session)
+		data, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		return sessions.Put([]byte(sessionID), data)
+	})
+}
+
+/* subBucket returns bucket/<key>, or nil if it doesn't exist and create is false */
+func subBucket(tx *bolt.Tx, bucket []byte, key string, create bool) (*bolt.Bucket, error) {
+	parent := tx.Bucket(bucket)
+	if !create {
+		return parent.Bucket([]byte(key)), nil
+	}
+	return parent.CreateBucketIfNotExists([]byte(key))
+}
+
+/* keySet reads the keys of bucket/<chatID> as a set */
+func (s *BoltStore) keySet(bucket []byte, chatID string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, _ := subBucket(tx, bucket, chatID, false)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			set[string(k)] = true
+			return nil
+		})
+	})
+	return set, err
+}
+
+/* ########## Session State ##########*/
+func (s *BoltStore) SetUserState(sessionID string, state constants.State) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.State = state
+	})
+}
+
+func (s *BoltStore) GetUserState(sessionID string) (state constants.State, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		state = session.State
+	})
+	return
+}
+
+/* ########## Session activity ##########*/
+func (s *BoltStore) TouchSession(sessionID string, at time.Time) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.LastActive = at
+	})
+}
+
+func (s *BoltStore) GetSessionActivity(sessionID string) (lastActive time.Time, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		lastActive = session.LastActive
+	})
+	return
+}
+
+func (s *BoltStore) ClearSession(sessionID string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.State = constants.Idle
+		session.ItemToAdd = constants.ItemDetails{}
+		session.GeocodeError = ""
+		session.Query = boltQuery{}
+		session.Import = nil
+		session.Pending = constants.PendingCommand{}
+		session.LastActive = time.Time{}
+	})
+}
+
+func (s *BoltStore) StaleSessions(before time.Time) ([]string, error) {
+	sessionIDs := make([]string, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).ForEach(func(k, v []byte) error {
+			var session boltSession
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if !session.LastActive.IsZero() && session.LastActive.Before(before) {
+				sessionIDs = append(sessionIDs, string(k))
+			}
+			return nil
+		})
+	})
+	return sessionIDs, err
+}
+
+/* ########## User chats ##########*/
+func (s *BoltStore) AddUserChat(userID, chatID, title string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, bucketUserChats, userID, true)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(chatID), []byte(title))
+	})
+}
+
+func (s *BoltStore) GetUserChats(userID string) (map[string]string, error) {
+	chats := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, _ := subBucket(tx, bucketUserChats, userID, false)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			chats[string(k)] = string(v)
+			return nil
+		})
+	})
+	return chats, err
+}
+
+/* ########## Lists ##########*/
+func (s *BoltStore) AddList(chatID, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := subBucket(tx, bucketLists, chatID, true)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(name), boltTrue)
+	})
+}
+
+func (s *BoltStore) GetLists(chatID string) (map[string]bool, error) {
+	return s.keySet(bucketLists, chatID)
+}
+
+func (s *BoltStore) SetActiveList(sessionID, name string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.List = name
+	})
+}
+
+func (s *BoltStore) GetActiveList(sessionID string) (name string, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		name = session.List
+	})
+	return
+}
+
+func (s *BoltStore) SetPendingCommand(sessionID string, command constants.PendingCommand) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Pending = command
+	})
+}
+
+func (s *BoltStore) GetPendingCommand(sessionID string) (command constants.PendingCommand, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		command = session.Pending
+	})
+	return
+}
+
+/* ########## Targets ##########*/
+func (s *BoltStore) SetChatTarget(sessionID string, chatID int64) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Target.Chat = chatID
+	})
+}
+
+func (s *BoltStore) GetChatTarget(sessionID string) (target int64, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		target = session.Target.Chat
+	})
+	return
+}
+
+func (s *BoltStore) SetMessageTarget(sessionID string, messageID int) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Target.Message = messageID
+	})
+}
+
+func (s *BoltStore) GetMessageTarget(sessionID string) (target int, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		target = session.Target.Message
+	})
+	return
+}
+
+func (s *BoltStore) SetItemTarget(sessionID, itemID string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Target.Item = itemID
+	})
+}
+
+func (s *BoltStore) GetItemTarget(sessionID string) (target string, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		target = session.Target.Item
+	})
+	return
+}
+
+func (s *BoltStore) SetKeyboardFilter(sessionID, filter string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Target.Filter = filter
+	})
+}
+
+func (s *BoltStore) GetKeyboardFilter(sessionID string) (filter string, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		filter = session.Target.Filter
+	})
+	return
+}
+
+func (s *BoltStore) SetKeyboard(sessionID string, keyboard constants.Keyboard) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Keyboard = keyboard
+	})
+}
+
+func (s *BoltStore) GetKeyboard(sessionID string) (keyboard constants.Keyboard, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		keyboard = session.Keyboard
+	})
+	return
+}
+
+/* ########## Temp item ##########*/
+func (s *BoltStore) SetTempItem(sessionID string, itemData constants.ItemDetails) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.ItemToAdd = itemData
+		session.GeocodeError = ""
+	})
+}
+
+func (s *BoltStore) GetTempItem(sessionID string) (itemData constants.ItemDetails, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		itemData = session.ItemToAdd
+	})
+	return
+}
+
+func (s *BoltStore) SetTempItemName(sessionID, name string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.ItemToAdd.Name = name
+	})
+}
+
+func (s *BoltStore) SetTempItemAddress(sessionID, address string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.ItemToAdd.Address = address
+	})
+}
+
+func (s *BoltStore) SetTempItemLocation(sessionID string, location *constants.Location) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.ItemToAdd.Location = location
+	})
+}
+
+func (s *BoltStore) SetTempItemGeocodeError(sessionID, reason string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.GeocodeError = reason
+	})
+}
+
+func (s *BoltStore) GetTempItemGeocodeError(sessionID string) (reason string, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		reason = session.GeocodeError
+	})
+	return
+}
+
+func (s *BoltStore) SetTempItemNotes(sessionID, notes string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.ItemToAdd.Notes = notes
+	})
+}
+
+func (s *BoltStore) SetTempItemURL(sessionID, url string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.ItemToAdd.URL = url
+	})
+}
+
+func (s *BoltStore) AddTempItemImage(sessionID, imageID string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		if session.ItemToAdd.Images == nil {
+			session.ItemToAdd.Images = make(map[string]bool)
+		}
+		session.ItemToAdd.Images[imageID] = true
+	})
+}
+
+func (s *BoltStore) AddTempItemTag(sessionID, tag string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		if session.ItemToAdd.Tags == nil {
+			session.ItemToAdd.Tags = make(map[string]bool)
+		}
+		session.ItemToAdd.Tags[tag] = true
+	})
+}
+
+func (s *BoltStore) GetTempItemTags(sessionID string) (tags map[string]bool, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		tags = session.ItemToAdd.Tags
+	})
+	return
+}
+
+func (s *BoltStore) DeleteTempItemTag(sessionID, tag string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		delete(session.ItemToAdd.Tags, tag)
+	})
+}
+
+/* ########## Import ##########*/
+func (s *BoltStore) SetImportItems(sessionID string, items []constants.ItemDetails) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Import = items
+	})
+}
+
+func (s *BoltStore) GetImportItems(sessionID string) ([]constants.ItemDetails, error) {
+	var items []constants.ItemDetails
+	err := s.viewSession(sessionID, func(session *boltSession) {
+		items = session.Import
+	})
+	return items, err
+}
+
+/* ########## Items ##########*/
+func (s *BoltStore) AddItem(chatID string, itemData constants.ItemDetails) error {
+	return s.AddItems(chatID, []constants.ItemDetails{itemData})
+}
+
+func (s *BoltStore) AddItems(chatID string, items []constants.ItemDetails) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, itemData := range items {
+			if err := addBoltItem(tx, chatID, itemData); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func addBoltItem(tx *bolt.Tx, chatID string, itemData constants.ItemDetails) error {
+	data, err := json.Marshal(itemData)
+	if err != nil {
+		return err
+	}
+	items, err := subBucket(tx, bucketItems, chatID, true)
+	if err != nil {
+		return err
+	}
+	oldTags, err := boltItemTags(items, itemData.ID)
+	if err != nil {
+		return err
+	}
+	if err := items.Put([]byte(itemData.ID), data); err != nil {
+		return err
+	}
+
+	if err := adjustBoltTags(tx, chatID, tagDeltas(oldTags, itemData.Tags)); err != nil {
+		return err
+	}
+
+	itemNames, err := subBucket(tx, bucketItemNames, chatID, true)
+	if err != nil {
+		return err
+	}
+	return itemNames.Put([]byte(itemData.ID), []byte(itemData.Name))
+}
+
+/* boltItemTags reads the tags of an item in items, nil if there is no such item */
+func boltItemTags(items *bolt.Bucket, itemID string) (map[string]bool, error) {
+	data := items.Get([]byte(itemID))
+	if data == nil {
+		return nil, nil
+	}
+	var itemData constants.ItemDetails
+	if err := json.Unmarshal(data, &itemData); err != nil {
+		return nil, err
+	}
+	return itemData.Tags, nil
+}
+
+func (s *BoltStore) GetItem(chatID, itemID string) (itemData constants.ItemDetails, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		items, _ := subBucket(tx, bucketItems, chatID, false)
+		if items == nil {
+			return nil
+		}
+		data := items.Get([]byte(itemID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &itemData)
+	})
+	return
+}
+
+func (s *BoltStore) GetItems(chatID string) (map[string]constants.ItemDetails, error) {
+	items := make(map[string]constants.ItemDetails)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, _ := subBucket(tx, bucketItems, chatID, false)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var itemData constants.ItemDetails
+			if err := json.Unmarshal(v, &itemData); err != nil {
+				return err
+			}
+			items[string(k)] = itemData
+			return nil
+		})
+	})
+	return items, err
+}
+
+func (s *BoltStore) DeleteItem(chatID, itemID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		items, _ := subBucket(tx, bucketItems, chatID, false)
+		if items == nil {
+			return nil
+		}
+		oldTags, err := boltItemTags(items, itemID)
+		if err != nil {
+			return err
+		}
+		if err := items.Delete([]byte(itemID)); err != nil {
+			return err
+		}
+		if err := adjustBoltTags(tx, chatID, tagDeltas(oldTags, nil)); err != nil {
+			return err
+		}
+		itemNames, _ := subBucket(tx, bucketItemNames, chatID, false)
+		if itemNames == nil {
+			return nil
+		}
+		return itemNames.Delete([]byte(itemID))
+	})
+}
+
+/* ########## Item names ##########*/
+func (s *BoltStore) GetItemNames(chatID string) (map[string]string, error) {
+	itemNames := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, _ := subBucket(tx, bucketItemNames, chatID, false)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			itemNames[string(k)] = string(v)
+			return nil
+		})
+	})
+	return itemNames, err
+}
+
+/* ########## Tags ##########*/
+func (s *BoltStore) GetTags(chatID string) (map[string]bool, error) {
+	return s.keySet(bucketTags, chatID)
+}
+
+func (s *BoltStore) RebuildIndex(chatID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return rebuildBoltIndex(tx, chatID)
+	})
+}
+
+/* ########## Query ##########*/
+func (s *BoltStore) ResetQuery(sessionID string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Query = boltQuery{}
+	})
+}
+
+func (s *BoltStore) SetQueryItem(sessionID, itemID string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Query.Item = itemID
+	})
+}
+
+func (s *BoltStore) GetQueryItem(sessionID string) (itemID string, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		itemID = session.Query.Item
+	})
+	return
+}
+
+func (s *BoltStore) SetQueryNum(sessionID string, num int) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Query.QueryNum = num
+	})
+}
+
+func (s *BoltStore) GetQueryNum(sessionID string) (num int, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		num = session.Query.QueryNum
+	})
+	return
+}
+
+func (s *BoltStore) AddQueryTag(sessionID, tag string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		if session.Query.Tags == nil {
+			session.Query.Tags = make(map[string]bool)
+		}
+		session.Query.Tags[tag] = true
+	})
+}
+
+func (s *BoltStore) GetQueryTags(sessionID string) (tags map[string]bool, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		tags = session.Query.Tags
+	})
+	return
+}
+
+func (s *BoltStore) ExcludeQueryTag(sessionID, tag string) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		if session.Query.Excluded == nil {
+			session.Query.Excluded = make(map[string]bool)
+		}
+		session.Query.Excluded[tag] = true
+	})
+}
+
+func (s *BoltStore) GetQueryExcludedTags(sessionID string) (tags map[string]bool, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		tags = session.Query.Excluded
+	})
+	return
+}
+
+func (s *BoltStore) SetQueryMatchAll(sessionID string, matchAll bool) error {
+	return s.updateSession(sessionID, func(session *boltSession) {
+		session.Query.MatchAll = matchAll
+	})
+}
+
+func (s *BoltStore) GetQueryMatchAll(sessionID string) (matchAll bool, err error) {
+	err = s.viewSession(sessionID, func(session *boltSession) {
+		matchAll = session.Query.MatchAll
+	})
+	return
+}
+
+/* ########## Updates ##########*/
+func (s *BoltStore) MarkUpdate(updateID int, at time.Time) (first bool, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUpdates)
+		key := []byte(strconv.Itoa(updateID))
+		if b.Get(key) != nil {
+			return nil
+		}
+		first = true
+		return b.Put(key, []byte(strconv.FormatInt(at.Unix(), 10)))
+	})
+	return
+}
+
+func (s *BoltStore) UnmarkUpdate(updateID int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUpdates).Delete([]byte(strconv.Itoa(updateID)))
+	})
+}
+
+func (s *BoltStore) SweepUpdates(before time.Time) (swept int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUpdates)
+		/* Keys can't be deleted while iterating over them */
+		stale := make([][]byte, 0)
+		if err := b.ForEach(func(k, v []byte) error {
+			at, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil || at < before.Unix() {
+				stale = append(stale, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		swept = len(stale)
+		return nil
+	})
+	return
+}
+
+/* ########## Feedback ##########*/
+func (s *BoltStore) AddFeedback(feedback constants.FeedbackDetails) error {
+	data, err := json.Marshal(feedback)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		dates, err := subBucket(tx, bucketFeedback, feedback.Date, true)
+		if err != nil {
+			return err
+		}
+		seq, err := dates.NextSequence()
+		if err != nil {
+			return err
+		}
+		return dates.Put([]byte(strconv.FormatUint(seq, 10)), data)
+	})
+}
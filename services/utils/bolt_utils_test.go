@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xfated/golistbot/services/constants"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltMigrateItemIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golistbot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	/* Write a version 1 database, keyed by name */
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucket(bucketMeta)
+		meta.Put([]byte("schemaVersion"), []byte("1"))
+		items, _ := tx.CreateBucket(bucketItems)
+		chatItems, _ := items.CreateBucket([]byte("-200"))
+		data, _ := json.Marshal(constants.ItemDetails{Name: "Ramen", Address: "1 Tras St", Tags: map[string]bool{"dinner": true}})
+		chatItems.Put([]byte("Ramen"), data)
+		itemNames, _ := tx.CreateBucket(bucketItemNames)
+		chatNames, _ := itemNames.CreateBucket([]byte("-200"))
+		chatNames.Put([]byte("Ramen"), boltTrue)
+		tags, _ := tx.CreateBucket(bucketTags)
+		chatTags, _ := tags.CreateBucket([]byte("-200"))
+		chatTags.Put([]byte("dinner"), boltTrue)
+		return chatTags.Put([]byte("unused"), boltTrue)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	defer store.Close()
+
+	itemNames, err := store.GetItemNames("-200")
+	if err != nil {
+		t.Fatalf("GetItemNames: %v", err)
+	}
+	if len(itemNames) != 1 {
+		t.Fatalf("item names = %v", itemNames)
+	}
+	for itemID, name := range itemNames {
+		itemData, err := store.GetItem("-200", itemID)
+		if err != nil {
+			t.Fatalf("GetItem: %v", err)
+		}
+		if name != "Ramen" || itemData.ID != itemID || itemData.Address != "1 Tras St" {
+			t.Errorf("item %q = %+v, name %q", itemID, itemData, name)
+		}
+	}
+
+	tags, err := store.GetTags("-200")
+	if err != nil {
+		t.Fatalf("GetTags: %v", err)
+	}
+	if len(tags) != 1 || !tags["dinner"] {
+		t.Errorf("tags = %v", tags)
+	}
+}
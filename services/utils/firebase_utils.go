@@ -2,10 +2,7 @@ package utils
 
 import (
 	"context"
-	"errors"
-	"fmt"
 	"log"
-	"math/rand"
 	"os"
 	"strconv"
 	"strings"
@@ -16,17 +13,15 @@ import (
 	"github.com/xfated/golistbot/services/constants"
 
 	"google.golang.org/api/option"
-	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
-var (
-	app    *firebase.App
+/* FirebaseStore keeps the bot's data in a Firebase Realtime Database */
+type FirebaseStore struct {
 	client *db.Client
-)
+}
 
-func InitFirebase() {
+func InitFirebase() *FirebaseStore {
 	// initialize firebase app
-	var err error
 	ctx := context.Background()
 	// Initialize the app with a custom auth variable, limiting the server's access
 	ao := map[string]interface{}{"uid": "togolistbot"}
@@ -37,909 +32,712 @@ func InitFirebase() {
 	// Fetch service account
 	opt := option.WithCredentialsJSON([]byte(os.Getenv("SERVICE_ACCOUNT_JSON")))
 	// Initialize app w service account
-	app, err = firebase.NewApp(ctx, conf, opt)
+	app, err := firebase.NewApp(ctx, conf, opt)
 	if err != nil {
 		log.Println("Error initializing app:", err)
+		return &FirebaseStore{}
 	}
 
-	client, err = app.Database(ctx)
+	client, err := app.Database(ctx)
 	if err != nil {
 		log.Println("Error initializing database client:", err)
 	}
 
 	log.Println("Loaded firebase")
+	return &FirebaseStore{client: client}
+}
+
+/* path joins keys into a database path, for multi-path updates */
+func path(keys ...string) string {
+	return strings.Join(keys, "/")
 }
 
-/* ########## User State ##########*/
-func SetUserState(update *tgbotapi.Update, state constants.State) error {
+func (s *FirebaseStore) sessionRef(sessionID string) *db.Ref {
+	return s.client.NewRef("sessions").Child(sessionID)
+}
+
+/* ########## Session State ##########*/
+func (s *FirebaseStore) SetUserState(sessionID string, state constants.State) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Update(ctx, map[string]interface{}{
+	return s.sessionRef(sessionID).Update(ctx, map[string]interface{}{
 		"state": strconv.Itoa(int(state)),
-	}); err != nil {
-		log.Println("Error setting state")
-		return err
-	}
-	return nil
+	})
 }
 
-func GetUserState(update *tgbotapi.Update) (constants.State, error) {
+func (s *FirebaseStore) GetUserState(sessionID string) (constants.State, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return 0, err
-	}
-	userRef := client.NewRef("users").Child(userID)
 	var stateString string
-	if err := userRef.Child("state").Get(ctx, &stateString); err != nil {
+	if err := s.sessionRef(sessionID).Child("state").Get(ctx, &stateString); err != nil {
 		return 0, err
 	}
+	// New session
+	if stateString == "" {
+		return constants.Idle, nil
+	}
 
 	stateInt, err := strconv.Atoi(stateString)
 	if err != nil {
 		return 0, err
 	}
-	return constants.State(stateInt), err
+	return constants.State(stateInt), nil
 }
 
-/* ########## Name (Init item) ##########*/
-func InitItem(update *tgbotapi.Update) error {
+/* ########## Session activity ##########*/
+func (s *FirebaseStore) TouchSession(sessionID string, at time.Time) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	/* Set temp under userRef */
-	name, _, err := GetMessage(update)
-	if err != nil {
-		return err
-	}
-
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Set(ctx, map[string]string{
-		"name": name,
-	}); err != nil {
-		return err
-	}
-	return nil
+	return s.sessionRef(sessionID).Update(ctx, map[string]interface{}{
+		"lastActive": at.Unix(),
+	})
 }
 
-/* ########## Address ##########*/
-func SetTempItemAddress(update *tgbotapi.Update) error {
+func (s *FirebaseStore) GetSessionActivity(sessionID string) (time.Time, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
+	var lastActive int64
+	if err := s.sessionRef(sessionID).Child("lastActive").Get(ctx, &lastActive); err != nil {
+		return time.Time{}, err
 	}
-
-	/* Set temp under userRef */
-	address, _, err := GetMessage(update)
-	if err != nil {
-		return err
-	}
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Update(ctx, map[string]interface{}{
-		"address": address,
-	}); err != nil {
-		return err
+	if lastActive == 0 {
+		return time.Time{}, nil
 	}
+	return time.Unix(lastActive, 0), nil
+}
 
-	return nil
+func (s *FirebaseStore) ClearSession(sessionID string) error {
+	ctx := context.Background()
+	/* null deletes the path, a missing state reads as Idle */
+	return s.sessionRef(sessionID).Update(ctx, map[string]interface{}{
+		"state":        nil,
+		"itemToAdd":    nil,
+		"geocodeError": nil,
+		"query":        nil,
+		"import":       nil,
+		"pending":      nil,
+		"lastActive":   nil,
+	})
 }
 
-func UpdateItemAddress(update *tgbotapi.Update, itemName, address string) error {
+/* Needs ".indexOn": "lastActive" on sessions */
+func (s *FirebaseStore) StaleSessions(before time.Time) ([]string, error) {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
+	var sessions map[string]interface{}
+	if err := s.client.NewRef("sessions").OrderByChild("lastActive").StartAt(1).EndAt(before.Unix()).Get(ctx, &sessions); err != nil {
+		return nil, err
 	}
-
-	itemRef := client.NewRef("items").Child(chatID)
-	if err := itemRef.Child(itemName).Update(ctx, map[string]interface{}{
-		"address": address,
-	}); err != nil {
-		return err
+	sessionIDs := make([]string, 0, len(sessions))
+	for sessionID := range sessions {
+		sessionIDs = append(sessionIDs, sessionID)
 	}
-	return nil
+	return sessionIDs, nil
 }
 
-/* ########## Notes ##########*/
-func SetTempItemNotes(update *tgbotapi.Update) error {
+/* ########## User chats ##########*/
+func (s *FirebaseStore) AddUserChat(userID, chatID, title string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.client.NewRef("userChats").Child(userID).Update(ctx, map[string]interface{}{
+		chatID: title,
+	})
+}
 
-	/* Set temp under userRef */
-	notes, _, err := GetMessage(update)
-	if err != nil {
-		return err
+func (s *FirebaseStore) GetUserChats(userID string) (map[string]string, error) {
+	ctx := context.Background()
+	var chats map[string]string
+	if err := s.client.NewRef("userChats").Child(userID).Get(ctx, &chats); err != nil {
+		return nil, err
 	}
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Update(ctx, map[string]interface{}{
-		"notes": notes,
-	}); err != nil {
-		return err
+	if chats == nil {
+		chats = make(map[string]string)
 	}
+	return chats, nil
+}
 
-	return nil
+/* ########## Lists ##########*/
+func (s *FirebaseStore) AddList(chatID, name string) error {
+	ctx := context.Background()
+	return s.client.NewRef("lists").Child(chatID).Update(ctx, map[string]interface{}{
+		name: true,
+	})
 }
 
-func UpdateItemNotes(update *tgbotapi.Update, itemName, notes string) error {
+func (s *FirebaseStore) GetLists(chatID string) (map[string]bool, error) {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
+	var lists map[string]bool
+	if err := s.client.NewRef("lists").Child(chatID).Get(ctx, &lists); err != nil {
+		return nil, err
 	}
-
-	itemRef := client.NewRef("items").Child(chatID)
-	if err := itemRef.Child(itemName).Update(ctx, map[string]interface{}{
-		"notes": notes,
-	}); err != nil {
-		return err
+	if lists == nil {
+		lists = make(map[string]bool)
 	}
-	return nil
+	return lists, nil
 }
 
-/* ########## URL ##########*/
-func SetTempItemURL(update *tgbotapi.Update) error {
+func (s *FirebaseStore) SetActiveList(sessionID, name string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("list").Set(ctx, name)
+}
 
-	/* Set temp under userRef */
-	url, _, err := GetMessage(update)
-	if err != nil {
-		return err
-	}
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Update(ctx, map[string]interface{}{
-		"url": url,
-	}); err != nil {
-		return err
+func (s *FirebaseStore) GetActiveList(sessionID string) (string, error) {
+	ctx := context.Background()
+	var name string
+	if err := s.sessionRef(sessionID).Child("list").Get(ctx, &name); err != nil {
+		return "", err
 	}
-
-	return nil
+	return name, nil
 }
 
-func UpdateItemURL(update *tgbotapi.Update, itemName, url string) error {
+func (s *FirebaseStore) SetPendingCommand(sessionID string, command constants.PendingCommand) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("pending").Set(ctx, command)
+}
 
-	itemRef := client.NewRef("items").Child(chatID)
-	if err := itemRef.Child(itemName).Update(ctx, map[string]interface{}{
-		"url": url,
-	}); err != nil {
-		return err
+func (s *FirebaseStore) GetPendingCommand(sessionID string) (constants.PendingCommand, error) {
+	ctx := context.Background()
+	var command constants.PendingCommand
+	if err := s.sessionRef(sessionID).Child("pending").Get(ctx, &command); err != nil {
+		return constants.PendingCommand{}, err
 	}
-	return nil
+	return command, nil
 }
 
-/* ########## Images ##########*/
-func AddTempItemImage(update *tgbotapi.Update) error {
+/* ########## Targets ##########*/
+func (s *FirebaseStore) SetChatTarget(sessionID string, chatID int64) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("target").Child("chat").Set(ctx, chatID)
+}
 
-	/* Set temp under userRef */
-	imageIDs, err := GetPhotoIDs(update)
-	if err != nil {
-		return err
-	}
-	imageID := imageIDs[len(imageIDs)-1] // Take largest file size
-	if err != nil {
-		return err
-	}
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Child("images").Update(ctx, map[string]interface{}{
-		imageID: true,
-	}); err != nil {
-		return err
+func (s *FirebaseStore) GetChatTarget(sessionID string) (int64, error) {
+	ctx := context.Background()
+	var target int64
+	if err := s.sessionRef(sessionID).Child("target").Child("chat").Get(ctx, &target); err != nil {
+		return 0, err
 	}
-
-	return nil
+	return target, nil
 }
 
-func AddItemImage(update *tgbotapi.Update, itemName, imageID string) error {
+func (s *FirebaseStore) SetMessageTarget(sessionID string, messageID int) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("target").Child("message").Set(ctx, messageID)
+}
 
-	itemRef := client.NewRef("items").Child(chatID)
-	if err := itemRef.Child(itemName).Child("tags").Update(ctx, map[string]interface{}{
-		imageID: true,
-	}); err != nil {
-		return err
+func (s *FirebaseStore) GetMessageTarget(sessionID string) (int, error) {
+	ctx := context.Background()
+	var target int
+	if err := s.sessionRef(sessionID).Child("target").Child("message").Get(ctx, &target); err != nil {
+		return 0, err
 	}
-	return nil
+	return target, nil
 }
 
-func DeleteItemImage(update *tgbotapi.Update, itemName, imageID string) error {
+func (s *FirebaseStore) SetItemTarget(sessionID, itemID string) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("target").Child("item").Set(ctx, itemID)
+}
 
-	itemRef := client.NewRef("items").Child(chatID)
-	if err := itemRef.Child(itemName).Child("tags").Child(imageID).Delete(ctx); err != nil {
-		return err
+func (s *FirebaseStore) GetItemTarget(sessionID string) (string, error) {
+	ctx := context.Background()
+	var target string
+	if err := s.sessionRef(sessionID).Child("target").Child("item").Get(ctx, &target); err != nil {
+		return "", err
 	}
-	return nil
+	return target, nil
 }
 
-/* ########## Tags ##########*/
-func AddTempItemTag(update *tgbotapi.Update, tag string) error {
+func (s *FirebaseStore) SetKeyboardFilter(sessionID, filter string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("target").Child("filter").Set(ctx, filter)
+}
 
-	/* Set temp under userRef */
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Child("tags").Update(ctx, map[string]interface{}{
-		tag: true,
-	}); err != nil {
-		return err
+func (s *FirebaseStore) GetKeyboardFilter(sessionID string) (string, error) {
+	ctx := context.Background()
+	var filter string
+	if err := s.sessionRef(sessionID).Child("target").Child("filter").Get(ctx, &filter); err != nil {
+		return "", err
 	}
+	return filter, nil
+}
 
-	return nil
+func (s *FirebaseStore) SetKeyboard(sessionID string, keyboard constants.Keyboard) error {
+	ctx := context.Background()
+	return s.sessionRef(sessionID).Child("keyboard").Set(ctx, keyboard)
 }
 
-func GetTempItemTags(update *tgbotapi.Update) (map[string]bool, error) {
+func (s *FirebaseStore) GetKeyboard(sessionID string) (constants.Keyboard, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return nil, err
+	var keyboard constants.Keyboard
+	if err := s.sessionRef(sessionID).Child("keyboard").Get(ctx, &keyboard); err != nil {
+		return constants.Keyboard{}, err
 	}
+	return keyboard, nil
+}
 
-	var tagsMap map[string]bool
+/* ########## Temp item ##########*/
+func (s *FirebaseStore) SetTempItem(sessionID string, itemData constants.ItemDetails) error {
+	ctx := context.Background()
+	return s.sessionRef(sessionID).Update(ctx, map[string]interface{}{
+		"itemToAdd":    itemData,
+		"geocodeError": nil,
+	})
+}
 
-	/* Set temp under userRef */
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Child("tags").Get(ctx, &tagsMap); err != nil {
-		return nil, err
+func (s *FirebaseStore) GetTempItem(sessionID string) (constants.ItemDetails, error) {
+	ctx := context.Background()
+	var itemData constants.ItemDetails
+	if err := s.sessionRef(sessionID).Child("itemToAdd").Get(ctx, &itemData); err != nil {
+		return constants.ItemDetails{}, err
 	}
-
-	return tagsMap, nil
+	return itemData, nil
 }
 
-func DeleteTempItemTag(update *tgbotapi.Update, tag string) error {
+func (s *FirebaseStore) SetTempItemName(sessionID, name string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("itemToAdd").Update(ctx, map[string]interface{}{
+		"name": name,
+	})
+}
 
-	/* Set temp under userRef */
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Child("tags").Child(tag).Delete(ctx); err != nil {
-		return err
-	}
+func (s *FirebaseStore) SetTempItemAddress(sessionID, address string) error {
+	ctx := context.Background()
+	return s.sessionRef(sessionID).Child("itemToAdd").Update(ctx, map[string]interface{}{
+		"address": address,
+	})
+}
 
-	return nil
+func (s *FirebaseStore) SetTempItemLocation(sessionID string, location *constants.Location) error {
+	ctx := context.Background()
+	return s.sessionRef(sessionID).Child("itemToAdd").Update(ctx, map[string]interface{}{
+		"location": location,
+	})
 }
 
-func AddItemTag(update *tgbotapi.Update, itemName, tag string) error {
+func (s *FirebaseStore) SetTempItemGeocodeError(sessionID, reason string) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Update(ctx, map[string]interface{}{
+		"geocodeError": reason,
+	})
+}
 
-	itemRef := client.NewRef("items").Child(chatID)
-	if err := itemRef.Child(itemName).Child("tags").Update(ctx, map[string]interface{}{
-		tag: true,
-	}); err != nil {
-		return err
+func (s *FirebaseStore) GetTempItemGeocodeError(sessionID string) (string, error) {
+	ctx := context.Background()
+	var reason string
+	if err := s.sessionRef(sessionID).Child("geocodeError").Get(ctx, &reason); err != nil {
+		return "", err
 	}
-	return nil
+	return reason, nil
 }
 
-func DeleteItemTag(update *tgbotapi.Update, itemName, tag string) error {
+func (s *FirebaseStore) SetTempItemNotes(sessionID, notes string) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("itemToAdd").Update(ctx, map[string]interface{}{
+		"notes": notes,
+	})
+}
 
-	itemRef := client.NewRef("items").Child(chatID)
-	if err := itemRef.Child(itemName).Child("tags").Child(tag).Delete(ctx); err != nil {
-		return err
-	}
-	return nil
+func (s *FirebaseStore) SetTempItemURL(sessionID, url string) error {
+	ctx := context.Background()
+	return s.sessionRef(sessionID).Child("itemToAdd").Update(ctx, map[string]interface{}{
+		"url": url,
+	})
 }
 
-/* get list of items */
-func GetItems(update *tgbotapi.Update, filterTags map[string]bool) ([]constants.ItemDetails, error) {
+func (s *FirebaseStore) AddTempItemImage(sessionID, imageID string) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return []constants.ItemDetails{}, err
-	}
+	return s.sessionRef(sessionID).Child("itemToAdd").Child("images").Update(ctx, map[string]interface{}{
+		imageID: true,
+	})
+}
 
-	/* get items */
-	var items map[string]constants.ItemDetails
-	userRef := client.NewRef("items").Child(chatID)
-	if err := userRef.Get(ctx, &items); err != nil {
-		return []constants.ItemDetails{}, err
-	}
-	itemsList := make([]constants.ItemDetails, len(items))
-	i := 0
-	for _, itemDetails := range items {
-		itemsList[i] = itemDetails
-		i++
-	}
-
-	// To delete any tags that have not been used
-	tagsList := make([]string, len(filterTags))
-	tagUsed := make([]bool, len(filterTags))
-	i = 0
-	for tag := range filterTags {
-		tagsList[i] = tag
-		tagUsed[i] = false
-		i++
-	}
-
-	/* filter if tags are present */
-	if len(filterTags) > 0 {
-		filteredItems := make([]constants.ItemDetails, 0)
-		// For each item
-		for _, item := range items {
-			consider := false
-			// If have tags
-			if item.Tags != nil {
-				// Check if match any filter
-				for idx, tag := range tagsList {
-					/* select if any tag match */
-					if item.Tags[tag] {
-						consider = true
-						tagUsed[idx] = true
-						break
-					}
-				}
-			}
-			if consider {
-				filteredItems = append(filteredItems, item)
-			}
-		}
-		itemsList = filteredItems
-	}
+func (s *FirebaseStore) AddTempItemTag(sessionID, tag string) error {
+	ctx := context.Background()
+	return s.sessionRef(sessionID).Child("itemToAdd").Child("tags").Update(ctx, map[string]interface{}{
+		tag: true,
+	})
+}
 
-	unusedTags := make([]string, 0)
-	for idx, tag := range tagsList {
-		if !tagUsed[idx] {
-			unusedTags = append(unusedTags, tag)
-		}
-	}
-	if len(unusedTags) > 0 {
-		tagsString := strings.Join(unusedTags, ", ")
-		SendMessage(update, fmt.Sprintf("There is no item with these tags: %s.\nSo imma delete them", tagsString), false)
-		for _, tag := range unusedTags {
-			DeleteTag(update, tag)
-		}
+func (s *FirebaseStore) GetTempItemTags(sessionID string) (map[string]bool, error) {
+	ctx := context.Background()
+	var tagsMap map[string]bool
+	if err := s.sessionRef(sessionID).Child("itemToAdd").Child("tags").Get(ctx, &tagsMap); err != nil {
+		return nil, err
 	}
-
-	/* Shuffle for random */
-	rand.Shuffle(len(itemsList), func(i, j int) { itemsList[i], itemsList[j] = itemsList[j], itemsList[i] })
-
-	// DEBUG
-	// log.Printf("filterTags: %+v", filterTags)
-	// log.Printf("itemsList: %+v", itemsList)
-
-	return itemsList, nil
+	return tagsMap, nil
 }
 
-/* ########## Add Item ##########*/
-func SetChatTarget(update *tgbotapi.Update, chatID int64) error {
+func (s *FirebaseStore) DeleteTempItemTag(sessionID, tag string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
+	return s.sessionRef(sessionID).Child("itemToAdd").Child("tags").Child(tag).Delete(ctx)
+}
 
-	/* Set target */
-	chatTargetRef := client.NewRef("users").Child(userID).Child("target").Child("chat")
-	if err := chatTargetRef.Set(ctx, chatID); err != nil {
-		return err
-	}
-	return nil
+/* ########## Import ##########*/
+func (s *FirebaseStore) SetImportItems(sessionID string, items []constants.ItemDetails) error {
+	ctx := context.Background()
+	return s.sessionRef(sessionID).Child("import").Set(ctx, items)
 }
 
-func GetChatTarget(update *tgbotapi.Update) (int64, error) {
+func (s *FirebaseStore) GetImportItems(sessionID string) ([]constants.ItemDetails, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return 0, err
+	var items []constants.ItemDetails
+	if err := s.sessionRef(sessionID).Child("import").Get(ctx, &items); err != nil {
+		return nil, err
 	}
+	return items, nil
+}
 
-	/* Get target */
-	var target int64
-	chatTargetRef := client.NewRef("users").Child(userID).Child("target").Child("chat")
-	if err := chatTargetRef.Get(ctx, &target); err != nil {
-		return 0, err
-	}
-	return target, nil
+/* ########## Items ##########*/
+func (s *FirebaseStore) itemRef(chatID, itemID string) *db.Ref {
+	return s.client.NewRef("items").Child(chatID).Child(itemID)
 }
 
-func GetTempItem(update *tgbotapi.Update) (constants.ItemDetails, error) {
-	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return constants.ItemDetails{}, err
+/* increment is a server value adding delta to the number stored at a path */
+func increment(delta int) map[string]interface{} {
+	return map[string]interface{}{
+		".sv": map[string]interface{}{"increment": delta},
 	}
+}
 
-	var ItemData constants.ItemDetails
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Get(ctx, &ItemData); err != nil {
-		return constants.ItemDetails{}, err
+/* addTagDeltas adds the tag count changes to a multi-path update */
+func addTagDeltas(update map[string]interface{}, chatID string, deltas map[string]int) {
+	for tag, delta := range deltas {
+		update[path("tags", chatID, tag)] = increment(delta)
 	}
-	return ItemData, nil
 }
 
-func GetItem(update *tgbotapi.Update, name string, chatID string) (constants.ItemDetails, error) {
-	ctx := context.Background()
-
-	/* Get item */
-	var itemData constants.ItemDetails
-	chatRef := client.NewRef("items").Child(chatID)
-	if err := chatRef.Child(name).Get(ctx, &itemData); err != nil {
-		return constants.ItemDetails{}, err
+/* hasLegacyTags reports whether a tag index holds true values from before tags were counted */
+func hasLegacyTags(counts map[string]interface{}) bool {
+	for _, count := range counts {
+		if _, ok := count.(bool); ok {
+			return true
+		}
 	}
-
-	return itemData, nil
+	return false
 }
 
-func AddItem(update *tgbotapi.Update, itemData constants.ItemDetails, chatID string) error {
+/*
+addTagCounts adds the tag count changes to a multi-path update. An increment would reset a legacy true value,
+so a chat not migrated yet has its whole index counted from items, the chat's items after the update, in its place
+*/
+func (s *FirebaseStore) addTagCounts(update map[string]interface{}, chatID string, deltas map[string]int, items func() (map[string]constants.ItemDetails, error)) error {
 	ctx := context.Background()
-
-	/* Add item to item collection */
-	chatRef := client.NewRef("items").Child(chatID)
-	if err := chatRef.Child(itemData.Name).Set(ctx, itemData); err != nil {
+	var counts map[string]interface{}
+	if err := s.client.NewRef("tags").Child(chatID).Get(ctx, &counts); err != nil {
 		return err
 	}
-	chatIDInt, err := strconv.ParseInt(chatID, 10, 64)
+	if !hasLegacyTags(counts) {
+		addTagDeltas(update, chatID, deltas)
+		return nil
+	}
+	newItems, err := items()
 	if err != nil {
 		return err
 	}
+	update[path("tags", chatID)] = countTags(newItems)
+	return nil
+}
 
-	err = SendMessageTargetChat(fmt.Sprintf("%s has been added/edited", itemData.Name), chatIDInt, false)
-	if err != nil {
-		log.Printf("error SendMessageTargetChat: %+v", err)
-	}
+func (s *FirebaseStore) AddItem(chatID string, itemData constants.ItemDetails) error {
+	return s.AddItems(chatID, []constants.ItemDetails{itemData})
+}
 
-	/* Add tags to tag collection */
-	for tag := range itemData.Tags {
-		if err := updateTags(update, chatID, tag); err != nil {
+func (s *FirebaseStore) AddItems(chatID string, items []constants.ItemDetails) error {
+	ctx := context.Background()
+	/* Replaced items, to count their tags out */
+	oldItems := make(map[string]constants.ItemDetails)
+	if len(items) == 1 {
+		oldItem, err := s.GetItem(chatID, items[0].ID)
+		if err != nil {
+			return err
+		}
+		oldItems[items[0].ID] = oldItem
+	} else {
+		var err error
+		if oldItems, err = s.GetItems(chatID); err != nil {
 			return err
 		}
 	}
 
-	/* Add name to name collection */
-	nameRef := client.NewRef("itemNames").Child(chatID)
-	if err := nameRef.Update(ctx, map[string]interface{}{
-		itemData.Name: true,
-	}); err != nil {
+	/* Items, names and tag counts in a single multi-path update */
+	update := make(map[string]interface{})
+	deltas := make(map[string]int)
+	for _, itemData := range items {
+		update[path("items", chatID, itemData.ID)] = itemData
+		update[path("itemNames", chatID, itemData.ID)] = itemData.Name
+		for tag, delta := range tagDeltas(oldItems[itemData.ID].Tags, itemData.Tags) {
+			deltas[tag] += delta
+		}
+	}
+	newItems := func() (map[string]constants.ItemDetails, error) {
+		chatItems, err := s.GetItems(chatID)
+		if err != nil {
+			return nil, err
+		}
+		if chatItems == nil {
+			chatItems = make(map[string]constants.ItemDetails)
+		}
+		for _, itemData := range items {
+			chatItems[itemData.ID] = itemData
+		}
+		return chatItems, nil
+	}
+	if err := s.addTagCounts(update, chatID, deltas, newItems); err != nil {
 		return err
 	}
-	return nil
+	return s.client.NewRef("").Update(ctx, update)
 }
 
-func AddItemFromTemp(update *tgbotapi.Update, chatID string) (string, error) {
-	// get from user details
-	itemData, err := GetTempItem(update)
-	if err != nil {
-		return "", err
+func (s *FirebaseStore) GetItem(chatID, name string) (constants.ItemDetails, error) {
+	ctx := context.Background()
+	var itemData constants.ItemDetails
+	if err := s.itemRef(chatID, name).Get(ctx, &itemData); err != nil {
+		return constants.ItemDetails{}, err
 	}
-	// Add data to item
-	if err := AddItem(update, itemData, chatID); err != nil {
-		return "", err
+	return itemData, nil
+}
+
+func (s *FirebaseStore) GetItems(chatID string) (map[string]constants.ItemDetails, error) {
+	ctx := context.Background()
+	var items map[string]constants.ItemDetails
+	if err := s.client.NewRef("items").Child(chatID).Get(ctx, &items); err != nil {
+		return nil, err
 	}
-	return itemData.Name, nil
+	return items, nil
 }
 
-/* ########## Delete Item ##########*/
-func SetMessageTarget(update *tgbotapi.Update, messageID int) error {
+func (s *FirebaseStore) DeleteItem(chatID, itemID string) error {
 	ctx := context.Background()
-	chatID, userID, err := GetChatUserIDString(update)
+	oldItem, err := s.GetItem(chatID, itemID)
 	if err != nil {
 		return err
 	}
 
-	/* Set target */
-	messageTargetRef := client.NewRef("users").Child(userID).Child("target").Child("message")
-	if err := messageTargetRef.Update(ctx, map[string]interface{}{
-		chatID: messageID,
-	}); err != nil {
+	/* null deletes the path */
+	update := map[string]interface{}{
+		path("items", chatID, itemID):     nil,
+		path("itemNames", chatID, itemID): nil,
+	}
+	newItems := func() (map[string]constants.ItemDetails, error) {
+		chatItems, err := s.GetItems(chatID)
+		delete(chatItems, itemID)
+		return chatItems, err
+	}
+	if err := s.addTagCounts(update, chatID, tagDeltas(oldItem.Tags, nil), newItems); err != nil {
 		return err
 	}
-	return nil
+	return s.client.NewRef("").Update(ctx, update)
 }
 
-func GetMessageTarget(update *tgbotapi.Update) (int, error) {
+/* MigrateItemIDs re-keys items still stored under their name by a generated ID, and rebuilds the indexes. Safe to rerun */
+func (s *FirebaseStore) MigrateItemIDs() (int, error) {
 	ctx := context.Background()
-	chatID, userID, err := GetChatUserIDString(update)
-	if err != nil {
+	var chats map[string]map[string]constants.ItemDetails
+	if err := s.client.NewRef("items").Get(ctx, &chats); err != nil {
 		return 0, err
 	}
 
-	/* Get target */
-	var target int
-	messageTargetRef := client.NewRef("users").Child(userID).Child("target").Child("message")
-	if err := messageTargetRef.Child(chatID).Get(ctx, &target); err != nil {
-		return 0, err
+	migrated := 0
+	for chatID, items := range chats {
+		newItems := make(map[string]constants.ItemDetails, len(items))
+		itemNames := make(map[string]string, len(items))
+		for key, itemData := range items {
+			if itemData.ID == "" {
+				itemData.ID = NewItemID()
+				migrated++
+			} else if itemData.ID != key {
+				migrated++
+			}
+			if itemData.Name == "" {
+				itemData.Name = key
+			}
+			newItems[itemData.ID] = itemData
+			itemNames[itemData.ID] = itemData.Name
+		}
+		if err := s.client.NewRef("").Update(ctx, map[string]interface{}{
+			path("items", chatID):     newItems,
+			path("itemNames", chatID): itemNames,
+			path("tags", chatID):      countTags(newItems),
+		}); err != nil {
+			return migrated, err
+		}
 	}
-	return target, nil
+	return migrated, nil
 }
 
-func GetItemNames(update *tgbotapi.Update, chatID string) (map[string]bool, error) {
+/* ########## Item names ##########*/
+func (s *FirebaseStore) GetItemNames(chatID string) (map[string]string, error) {
 	ctx := context.Background()
-
-	var itemNames map[string]bool
-	nameRef := client.NewRef("itemNames").Child(chatID)
-	if err := nameRef.Get(ctx, &itemNames); err != nil {
-		return map[string]bool{}, err
+	var itemNames map[string]string
+	if err := s.client.NewRef("itemNames").Child(chatID).Get(ctx, &itemNames); err != nil {
+		return map[string]string{}, err
 	}
-
 	return itemNames, nil
 }
 
-/* Read / Delete / Update tags */
-func GetTags(update *tgbotapi.Update, chatID string) (map[string]bool, error) {
+/* ########## Tags ##########*/
+func (s *FirebaseStore) GetTags(chatID string) (map[string]bool, error) {
 	ctx := context.Background()
-	chatRef := client.NewRef("tags").Child(chatID)
-
-	/* Retrieve tags */
-	var tags map[string]bool
-	if err := chatRef.Get(ctx, &tags); err != nil {
+	var counts map[string]interface{}
+	if err := s.client.NewRef("tags").Child(chatID).Get(ctx, &counts); err != nil {
 		return map[string]bool{}, err
 	}
-
-	// /* get slice of tags */
-	// tagSlice := make([]string, len(tags))
-	// i := 0
-	// for tag := range tags {
-	// 	tagSlice[i] = tag
-	// 	i++
-	// }
+	/* Counts can't be removed in the update that brings them to 0. Tags from before counting hold true until the next write */
+	tags := make(map[string]bool, len(counts))
+	for tag, count := range counts {
+		switch count := count.(type) {
+		case float64:
+			tags[tag] = count > 0
+		case bool:
+			tags[tag] = count
+		}
+		if !tags[tag] {
+			delete(tags, tag)
+		}
+	}
 	return tags, nil
 }
 
-func DeleteTag(update *tgbotapi.Update, tag string) error {
-	/* Only can delete from within chat */
+func (s *FirebaseStore) RebuildIndex(chatID string) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
+	items, err := s.GetItems(chatID)
 	if err != nil {
 		return err
 	}
-
-	/* Delete tag record */
-	chatRef := client.NewRef("tags").Child(chatID)
-	if err := chatRef.Child(tag).Delete(ctx); err != nil {
-		return err
-	}
-	return nil
-}
-
-func updateTags(update *tgbotapi.Update, chatID string, tag string) error {
-	/* Can update when adding item from bot privat chat */
-	/* If same tag won't update. Implicitly prevent double records */
-	ctx := context.Background()
-
-	chatRef := client.NewRef("tags").Child(chatID)
-	if err := chatRef.Update(ctx, map[string]interface{}{
-		tag: true,
-	}); err != nil {
-		return err
+	itemNames := make(map[string]string, len(items))
+	for itemID, itemData := range items {
+		itemNames[itemID] = itemData.Name
 	}
-
-	return nil
+	return s.client.NewRef("").Update(ctx, map[string]interface{}{
+		path("tags", chatID):      countTags(items),
+		path("itemNames", chatID): itemNames,
+	})
 }
 
 /* ########## Query ##########*/
-func ResetQuery(update *tgbotapi.Update) error {
+func (s *FirebaseStore) ResetQuery(sessionID string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	/* Delete query */
-	queryRef := client.NewRef("users").Child(userID).Child("query")
-	if err := queryRef.Delete(ctx); err != nil {
-		return err
-	}
-	return nil
+	return s.sessionRef(sessionID).Child("query").Delete(ctx)
 }
 
-// message should contain name
-func SetQueryName(update *tgbotapi.Update, name string) error {
+func (s *FirebaseStore) SetQueryItem(sessionID, itemID string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	queryRef := client.NewRef("users").Child(userID).Child("query")
-	if err := queryRef.Update(ctx, map[string]interface{}{
-		"name": name,
-	}); err != nil {
-		return err
-	}
-	return nil
+	return s.sessionRef(sessionID).Child("query").Update(ctx, map[string]interface{}{
+		"item": itemID,
+	})
 }
 
-func GetQueryName(update *tgbotapi.Update) (string, error) {
+func (s *FirebaseStore) GetQueryItem(sessionID string) (string, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
+	var itemID string
+	if err := s.sessionRef(sessionID).Child("query").Child("item").Get(ctx, &itemID); err != nil {
 		return "", err
 	}
-
-	queryRef := client.NewRef("users").Child(userID).Child("query").Child("name")
-	var name string
-	if err := queryRef.Get(ctx, &name); err != nil {
-		return "", err
-	}
-	return name, err
+	return itemID, nil
 }
 
-func SetQueryNum(update *tgbotapi.Update, num int) error {
+func (s *FirebaseStore) SetQueryNum(sessionID string, num int) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	/* Set number of queries*/
-	queryRef := client.NewRef("users").Child(userID).Child("query")
-	if err := queryRef.Update(ctx, map[string]interface{}{
+	return s.sessionRef(sessionID).Child("query").Update(ctx, map[string]interface{}{
 		"queryNum": num,
-	}); err != nil {
-		return err
-	}
-	return nil
+	})
 }
 
-func GetQueryNum(update *tgbotapi.Update) (int, error) {
+func (s *FirebaseStore) GetQueryNum(sessionID string) (int, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return 0, err
-	}
-
-	queryRef := client.NewRef("users").Child(userID).Child("query")
 	var queryNum int
-	if err := queryRef.Child("queryNum").Get(ctx, &queryNum); err != nil {
+	if err := s.sessionRef(sessionID).Child("query").Child("queryNum").Get(ctx, &queryNum); err != nil {
 		return 0, err
 	}
-	return queryNum, err
+	return queryNum, nil
 }
 
-// message should contain tag
-func AddQueryTag(update *tgbotapi.Update, tag string) error {
+func (s *FirebaseStore) AddQueryTag(sessionID, tag string) error {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	/* Add tag */
-	queryRef := client.NewRef("users").Child(userID).Child("query")
-	if err := queryRef.Child("tags").Update(ctx, map[string]interface{}{
+	return s.sessionRef(sessionID).Child("query").Child("tags").Update(ctx, map[string]interface{}{
 		tag: true,
-	}); err != nil {
-		return err
-	}
-	return nil
+	})
 }
 
-func GetQueryTags(update *tgbotapi.Update) (map[string]bool, error) {
+func (s *FirebaseStore) GetQueryTags(sessionID string) (map[string]bool, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return map[string]bool{}, err
-	}
-
 	var tagsMap map[string]bool
-	queryRef := client.NewRef("users").Child(userID).Child("query")
-	if err := queryRef.Child("tags").Get(ctx, &tagsMap); err != nil {
+	if err := s.sessionRef(sessionID).Child("query").Child("tags").Get(ctx, &tagsMap); err != nil {
 		return map[string]bool{}, err
 	}
-
-	// var tags = make([]string, len(tagsMap))
-	// i := 0
-	// for tag := range tagsMap {
-	// 	tags[i] = tag
-	// 	i++
-	// }
 	return tagsMap, nil
 }
 
-func AddMessageToDelete(update *tgbotapi.Update, message *tgbotapi.Message) error {
+func (s *FirebaseStore) ExcludeQueryTag(sessionID, tag string) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	if message == nil {
-		return errors.New("nil message")
-	}
-	messageID := strconv.Itoa(message.MessageID)
-
-	/* Add recent message data */
-	recentDeleteRef := client.NewRef("deleteRecord").Child(chatID)
-	if err := recentDeleteRef.Child("messages").Update(ctx, map[string]interface{}{
-		messageID: true,
-	}); err != nil {
-		return err
-	}
-	return nil
+	return s.sessionRef(sessionID).Child("query").Child("excluded").Update(ctx, map[string]interface{}{
+		tag: true,
+	})
 }
 
-func ResetMessagesToDelete(update *tgbotapi.Update) error {
+func (s *FirebaseStore) GetQueryExcludedTags(sessionID string) (map[string]bool, error) {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	/* Delete recent message data */
-	recentDeleteRef := client.NewRef("deleteRecord").Child(chatID)
-	if err := recentDeleteRef.Child("messages").Delete(ctx); err != nil {
-		return err
+	var tagsMap map[string]bool
+	if err := s.sessionRef(sessionID).Child("query").Child("excluded").Get(ctx, &tagsMap); err != nil {
+		return map[string]bool{}, err
 	}
-	return nil
+	return tagsMap, nil
 }
 
-func DeleteRecentMessages(update *tgbotapi.Update) error {
+func (s *FirebaseStore) SetQueryMatchAll(sessionID string, matchAll bool) error {
 	ctx := context.Background()
-	chatIDString, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-	chatID, _, err := GetChatUserID(update)
-	if err != nil {
-		return err
-	}
-
-	/* Get recent message data */
-	recentDeleteRef := client.NewRef("deleteRecord").Child(chatIDString)
-	var messageIDs map[string]bool
-	if err := recentDeleteRef.Child("messages").Get(ctx, &messageIDs); err != nil {
-		return err
-	}
-	// Delete one by one
-	for messageIDString := range messageIDs {
-		messageID, err := strconv.Atoi(messageIDString)
-		if err != nil {
-			return err
-		}
-
-		if err := DeleteMessage(chatID, messageID); err != nil {
-			log.Printf("Error DeleteMessage: %+v", err)
-			// return err
-		}
-	}
-	if err := ResetMessagesToDelete(update); err != nil {
-		return err
-	}
-	return nil
+	return s.sessionRef(sessionID).Child("query").Update(ctx, map[string]interface{}{
+		"matchAll": matchAll,
+	})
 }
 
-/* ########## Delete Item ##########*/
-func SetItemTarget(update *tgbotapi.Update, name string) error {
+func (s *FirebaseStore) GetQueryMatchAll(sessionID string) (bool, error) {
 	ctx := context.Background()
-	chatID, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	/* Set target */
-	itemTargetRef := client.NewRef("users").Child(userID).Child("target").Child("item")
-	if err := itemTargetRef.Update(ctx, map[string]interface{}{
-		chatID: name,
-	}); err != nil {
-		return err
+	var matchAll bool
+	if err := s.sessionRef(sessionID).Child("query").Child("matchAll").Get(ctx, &matchAll); err != nil {
+		return false, err
 	}
-	return nil
+	return matchAll, nil
 }
 
-func GetItemTarget(update *tgbotapi.Update) (string, error) {
+/* ########## Updates ##########*/
+func (s *FirebaseStore) MarkUpdate(updateID int, at time.Time) (bool, error) {
 	ctx := context.Background()
-	chatID, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return "", err
-	}
-
-	/* Get target */
-	var target string
-	itemTargetRef := client.NewRef("users").Child(userID).Child("target").Child("item")
-	if err := itemTargetRef.Child(chatID).Get(ctx, &target); err != nil {
-		return "", err
-	}
-	return target, nil
+	first := false
+	err := s.client.NewRef("updates").Child(strconv.Itoa(updateID)).Transaction(ctx, func(node db.TransactionNode) (interface{}, error) {
+		var processed int64
+		if err := node.Unmarshal(&processed); err != nil {
+			return nil, err
+		}
+		// Runs again if the node changed meanwhile, so first is set on every run
+		if processed != 0 {
+			first = false
+			return processed, nil
+		}
+		first = true
+		return at.Unix(), nil
+	})
+	return first, err
 }
 
-func DeleteItem(update *tgbotapi.Update, itemName string) error {
+func (s *FirebaseStore) UnmarkUpdate(updateID int) error {
 	ctx := context.Background()
-	chatID, _, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-	chatRef := client.NewRef("items").Child(chatID)
-	if err := chatRef.Child(itemName).Delete(ctx); err != nil {
-		return err
-	}
-	nameRef := client.NewRef("itemNames").Child(chatID)
-	if err := nameRef.Child(itemName).Delete(ctx); err != nil {
-		return err
-	}
-	return nil
+	return s.client.NewRef("updates").Child(strconv.Itoa(updateID)).Delete(ctx)
 }
 
-/* ########## Edit Item ##########*/
-func AddItemToTemp(update *tgbotapi.Update, itemData constants.ItemDetails) error {
+func (s *FirebaseStore) SweepUpdates(before time.Time) (int, error) {
 	ctx := context.Background()
-	_, userID, err := GetChatUserIDString(update)
-	if err != nil {
-		return err
-	}
-
-	userRef := client.NewRef("users").Child(userID)
-	if err := userRef.Child("itemToAdd").Set(ctx, itemData); err != nil {
-		return err
+	var updates map[string]int64
+	if err := s.client.NewRef("updates").OrderByValue().EndAt(before.Unix()).Get(ctx, &updates); err != nil {
+		return 0, err
 	}
-	return nil
-}
-
-func CopyItemToTempItem(update *tgbotapi.Update, itemName string, chatID string) error {
-	itemData, err := GetItem(update, itemName, chatID)
-	if err != nil {
-		return err
+	if len(updates) == 0 {
+		return 0, nil
 	}
-	if err := AddItemToTemp(update, itemData); err != nil {
-		return err
+	stale := make(map[string]interface{}, len(updates))
+	for updateID := range updates {
+		stale[updateID] = nil
 	}
-	return nil
+	return len(stale), s.client.NewRef("updates").Update(ctx, stale)
 }
 
 /* ########## Feedback ##########*/
-func AddFeedback(update *tgbotapi.Update) {
-	ctx := context.Background()
-
-	currentTime := time.Now()
-	date := currentTime.Format("01-02-2006")
-	feedback := update.Message.Text
-	user := update.Message.From
-	username := user.UserName
-	userid := user.ID
-	chatid := update.Message.Chat.ID
-
-	feedbackRef := client.NewRef("feedback").Child(date)
-	if _, err := feedbackRef.Push(ctx, map[string]interface{}{
-		"username": username,
-		"userid":   userid,
-		"chatid":   chatid,
-		"feedback": feedback,
-	}); err != nil {
-		log.Printf("error push feedback: %+v", err)
-	}
+func (s *FirebaseStore) AddFeedback(feedback constants.FeedbackDetails) error {
+	ctx := context.Background()
+	_, err := s.client.NewRef("feedback").Child(feedback.Date).Push(ctx, feedback)
+	return err
 }
@@ -0,0 +1,286 @@
+package utils
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+/* Geocoder turns an address into coordinates */
+type Geocoder interface {
+	Geocode(address string) (constants.Location, error)
+}
+
+/* ErrAddressNotFound is returned by a Geocoder that doesn't know the address */
+var ErrAddressNotFound = errors.New("address not found")
+
+/* geocoder places addresses set on items. Nil leaves them without a location */
+var geocoder Geocoder
+
+/* SetGeocoder replaces the geocoder, e.g. with a gazetteer in tests. Nil turns geocoding off */
+func SetGeocoder(g Geocoder) {
+	geocoder = g
+}
+
+/*
+InitGeocoder returns the geocoder chosen by GEOCODER: "http" for a Nominatim compatible service at GEOCODER_URL,
+"gazetteer" for the places listed in GAZETTEER_FILE, or nil to leave addresses without a location
+*/
+func InitGeocoder() Geocoder {
+	switch os.Getenv("GEOCODER") {
+	case "http":
+		endpoint := os.Getenv("GEOCODER_URL")
+		if endpoint == "" {
+			endpoint = defaultGeocoderURL
+		}
+		return NewCachingGeocoder(NewHTTPGeocoder(endpoint))
+	case "gazetteer":
+		gazetteer, err := LoadGazetteer(os.Getenv("GAZETTEER_FILE"))
+		if err != nil {
+			log.Printf("Error loading gazetteer, addresses won't be geocoded: %+v", err)
+			return nil
+		}
+		return NewCachingGeocoder(gazetteer)
+	}
+	return nil
+}
+
+/* ########## HTTP ##########*/
+const defaultGeocoderURL = "https://nominatim.openstreetmap.org/search"
+
+/* HTTPGeocoder asks a search endpoint answering like Nominatim's, with a list of places having "lat" and "lon" */
+type HTTPGeocoder struct {
+	URL    string
+	Client *http.Client
+	// Nominatim's usage policy asks for one naming the application
+	UserAgent string
+}
+
+func NewHTTPGeocoder(endpoint string) *HTTPGeocoder {
+	return &HTTPGeocoder{
+		URL:       endpoint,
+		Client:    &http.Client{Timeout: 5 * time.Second},
+		UserAgent: "golistbot",
+	}
+}
+
+func (g *HTTPGeocoder) Geocode(address string) (constants.Location, error) {
+	endpoint, err := url.Parse(g.URL)
+	if err != nil {
+		return constants.Location{}, err
+	}
+	query := endpoint.Query()
+	query.Set("q", address)
+	query.Set("format", "json")
+	query.Set("limit", "1")
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return constants.Location{}, err
+	}
+	req.Header.Set("User-Agent", g.UserAgent)
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return constants.Location{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return constants.Location{}, fmt.Errorf("geocoder answered %s", resp.Status)
+	}
+
+	var places []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return constants.Location{}, fmt.Errorf("geocoder answer not understood: %v", err)
+	}
+	if len(places) == 0 {
+		return constants.Location{}, ErrAddressNotFound
+	}
+	latitude, err := strconv.ParseFloat(places[0].Lat, 64)
+	if err != nil {
+		return constants.Location{}, fmt.Errorf("geocoder answer not understood: %v", err)
+	}
+	longitude, err := strconv.ParseFloat(places[0].Lon, 64)
+	if err != nil {
+		return constants.Location{}, fmt.Errorf("geocoder answer not understood: %v", err)
+	}
+	return constants.Location{Latitude: latitude, Longitude: longitude}, nil
+}
+
+/* ########## Gazetteer ##########*/
+/* Gazetteer places addresses naming one of its places, like streets or postal codes, without network */
+type Gazetteer struct {
+	places map[string]constants.Location
+}
+
+/*
+LoadGazetteer reads a CSV file of places, one "name,latitude,longitude" a line.
+Lines starting with # are comments
+*/
+func LoadGazetteer(path string) (*Gazetteer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	gazetteer := &Gazetteer{places: make(map[string]constants.Location, len(records))}
+	for i, record := range records {
+		latitude, errLat := strconv.ParseFloat(record[1], 64)
+		longitude, errLng := strconv.ParseFloat(record[2], 64)
+		if errLat != nil || errLng != nil {
+			return nil, fmt.Errorf("%s line %d: invalid coordinates %q, %q", path, i+1, record[1], record[2])
+		}
+		gazetteer.places[normalizeAddress(record[0])] = constants.Location{Latitude: latitude, Longitude: longitude}
+	}
+	return gazetteer, nil
+}
+
+/* Geocode finds the place named by the whole address, or else the longest place named in it */
+func (g *Gazetteer) Geocode(address string) (constants.Location, error) {
+	address = normalizeAddress(address)
+	if location, ok := g.places[address]; ok {
+		return location, nil
+	}
+	best := ""
+	for name := range g.places {
+		if len(name) > len(best) && strings.Contains(" "+address+" ", " "+name+" ") {
+			best = name
+		}
+	}
+	if best == "" {
+		return constants.Location{}, ErrAddressNotFound
+	}
+	return g.places[best], nil
+}
+
+/* normalizeAddress lower cases the words of an address, separated by single spaces */
+func normalizeAddress(address string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(address), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+/* ########## Cache ##########*/
+/* Addresses a CachingGeocoder remembers, before starting over */
+const maxCachedAddresses = 10000
+
+type cachedGeocode struct {
+	location constants.Location
+	err      error
+}
+
+/* CachingGeocoder remembers the location of every address, and the addresses not found. Other errors are retried */
+type CachingGeocoder struct {
+	geocoder Geocoder
+	mu       sync.Mutex
+	results  map[string]cachedGeocode
+}
+
+func NewCachingGeocoder(g Geocoder) *CachingGeocoder {
+	return &CachingGeocoder{geocoder: g, results: make(map[string]cachedGeocode)}
+}
+
+func (g *CachingGeocoder) Geocode(address string) (constants.Location, error) {
+	key := normalizeAddress(address)
+	g.mu.Lock()
+	result, ok := g.results[key]
+	g.mu.Unlock()
+	if ok {
+		return result.location, result.err
+	}
+
+	location, err := g.geocoder.Geocode(address)
+	if err == nil || err == ErrAddressNotFound {
+		g.mu.Lock()
+		if len(g.results) >= maxCachedAddresses {
+			g.results = make(map[string]cachedGeocode)
+		}
+		g.results[key] = cachedGeocode{location, err}
+		g.mu.Unlock()
+	}
+	return location, err
+}
+
+/* ########## Items ##########*/
+/*
+geocodeTempItem places the item being added at its new address, unless it has a location sent by the user.
+Failures only leave it without a location, with the reason kept for /preview
+*/
+func geocodeTempItem(store Store, sessionID, address string) {
+	if geocoder == nil {
+		return
+	}
+	itemData, err := store.GetTempItem(sessionID)
+	if err != nil {
+		log.Printf("Error GetTempItem: %+v", err)
+		return
+	}
+	if itemData.Location != nil && !itemData.Location.Geocoded {
+		return
+	}
+
+	var location *constants.Location
+	reason := ""
+	if found, err := geocoder.Geocode(address); err != nil {
+		log.Printf("Error geocoding %q: %+v", address, err)
+		reason = geocodeFailure(err)
+	} else {
+		found.Geocoded = true
+		location = &found
+	}
+	// Without one found, the location of the previous address is removed
+	if location != nil || itemData.Location != nil {
+		if err := store.SetTempItemLocation(sessionID, location); err != nil {
+			log.Printf("Error SetTempItemLocation: %+v", err)
+		}
+	}
+	if err := store.SetTempItemGeocodeError(sessionID, reason); err != nil {
+		log.Printf("Error SetTempItemGeocodeError: %+v", err)
+	}
+}
+
+/* geocodeItem places the item about to be stored at its address, if it has none placed yet. Failures only leave it without a location */
+func geocodeItem(itemData *constants.ItemDetails) {
+	if geocoder == nil || itemData.Address == "" || itemData.Location != nil {
+		return
+	}
+	location, err := geocoder.Geocode(itemData.Address)
+	if err != nil {
+		log.Printf("Error geocoding %q: %+v", itemData.Address, err)
+		return
+	}
+	location.Geocoded = true
+	itemData.Location = &location
+}
+
+/* geocodeFailure explains to users why an address wasn't placed */
+func geocodeFailure(err error) string {
+	if err == ErrAddressNotFound {
+		return "the address wasn't found"
+	}
+	return "the map service couldn't be reached"
+}
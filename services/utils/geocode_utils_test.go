@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+func writeGazetteer(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "golistbot")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	path := filepath.Join(dir, "places.csv")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func TestGazetteer(t *testing.T) {
+	path := writeGazetteer(t, "# name, latitude, longitude\n"+
+		"Tras Street, 1.2770, 103.8460\n"+
+		"Tanjong Pagar, 1.2765, 103.8456\n"+
+		"Tanjong Pagar Road, 1.2790, 103.8430\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	gazetteer, err := LoadGazetteer(path)
+	if err != nil {
+		t.Fatalf("LoadGazetteer: %v", err)
+	}
+
+	tests := map[string]constants.Location{
+		"tras street":                {Latitude: 1.2770, Longitude: 103.8460},
+		"12 Tras Street, #01-02":     {Latitude: 1.2770, Longitude: 103.8460},
+		"Tanjong Pagar":              {Latitude: 1.2765, Longitude: 103.8456},
+		"100 Tanjong Pagar Road":     {Latitude: 1.2790, Longitude: 103.8430},
+		"near tanjong pagar station": {Latitude: 1.2765, Longitude: 103.8456},
+	}
+	for address, want := range tests {
+		if got, err := gazetteer.Geocode(address); err != nil || got != want {
+			t.Errorf("Geocode(%q) = %v, %v, want %v", address, got, err, want)
+		}
+	}
+	for _, address := range []string{"Orchard Road", "Trass Street", ""} {
+		if _, err := gazetteer.Geocode(address); err != ErrAddressNotFound {
+			t.Errorf("Geocode(%q) error = %v, want ErrAddressNotFound", address, err)
+		}
+	}
+}
+
+func TestLoadGazetteerInvalid(t *testing.T) {
+	for _, contents := range []string{"Tras Street, north, 103.8460\n", "Tras Street, 1.2770\n"} {
+		path := writeGazetteer(t, contents)
+		if _, err := LoadGazetteer(path); err == nil {
+			t.Errorf("LoadGazetteer(%q) succeeded", contents)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestHTTPGeocoder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("q") {
+		case "1 Tras St":
+			fmt.Fprint(w, `[{"lat": "1.2770", "lon": "103.8460", "display_name": "1, Tras Street"}]`)
+		case "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, `[]`)
+		}
+	}))
+	defer server.Close()
+	geocoder := NewHTTPGeocoder(server.URL)
+
+	if got, err := geocoder.Geocode("1 Tras St"); err != nil || got != (constants.Location{Latitude: 1.277, Longitude: 103.846}) {
+		t.Errorf("Geocode = %v, %v", got, err)
+	}
+	if _, err := geocoder.Geocode("nowhere"); err != ErrAddressNotFound {
+		t.Errorf("Geocode(nowhere) error = %v, want ErrAddressNotFound", err)
+	}
+	if _, err := geocoder.Geocode("down"); err == nil || err == ErrAddressNotFound {
+		t.Errorf("Geocode(down) error = %v, want a service error", err)
+	}
+}
+
+/* countingGeocoder answers from places, failing for "down", and counts the lookups */
+type countingGeocoder struct {
+	places  map[string]constants.Location
+	lookups int
+}
+
+func (g *countingGeocoder) Geocode(address string) (constants.Location, error) {
+	g.lookups++
+	if address == "down" {
+		return constants.Location{}, errors.New("unreachable")
+	}
+	location, ok := g.places[address]
+	if !ok {
+		return constants.Location{}, ErrAddressNotFound
+	}
+	return location, nil
+}
+
+func TestCachingGeocoder(t *testing.T) {
+	counting := &countingGeocoder{places: map[string]constants.Location{"1 Tras St": {Latitude: 1.277, Longitude: 103.846}}}
+	geocoder := NewCachingGeocoder(counting)
+
+	for _, address := range []string{"1 Tras St", "1 tras st.", "nowhere", "Nowhere"} {
+		geocoder.Geocode(address)
+	}
+	if counting.lookups != 2 {
+		t.Errorf("%d lookups for 2 addresses", counting.lookups)
+	}
+	if got, err := geocoder.Geocode("1  TRAS ST"); err != nil || got.Latitude != 1.277 {
+		t.Errorf("cached Geocode = %v, %v", got, err)
+	}
+	if _, err := geocoder.Geocode("nowhere"); err != ErrAddressNotFound {
+		t.Errorf("cached Geocode(nowhere) error = %v, want ErrAddressNotFound", err)
+	}
+
+	// Unreachable services are asked again
+	geocoder.Geocode("down")
+	geocoder.Geocode("down")
+	if counting.lookups != 4 {
+		t.Errorf("%d lookups after 2 failures, want 4", counting.lookups)
+	}
+}
+
+func TestAddItemGeocodes(t *testing.T) {
+	SetMessenger(NewRecordingMessenger())
+	counting := &countingGeocoder{places: map[string]constants.Location{"1 Tras St": {Latitude: 1.277, Longitude: 103.846}}}
+	SetGeocoder(counting)
+	defer SetGeocoder(nil)
+	store := NewMemoryStore()
+	list := ItemList{ChatID: -200}
+
+	sent := &constants.Location{Latitude: 1.3, Longitude: 103.85}
+	tests := []struct {
+		itemData constants.ItemDetails
+		want     *constants.Location
+	}{
+		{constants.ItemDetails{ID: "ramen1", Name: "Ramen", Address: "1 Tras St"}, &constants.Location{Latitude: 1.277, Longitude: 103.846, Geocoded: true}},
+		{constants.ItemDetails{ID: "udon1", Name: "Udon", Address: "nowhere"}, nil},
+		{constants.ItemDetails{ID: "soba1", Name: "Soba"}, nil},
+		// A sent location stays
+		{constants.ItemDetails{ID: "curry1", Name: "Curry", Address: "1 Tras St", Location: sent}, sent},
+	}
+	for _, test := range tests {
+		if err := AddItem(store, test.itemData, list); err != nil {
+			t.Fatalf("AddItem: %v", err)
+		}
+		itemData, err := store.GetItem(list.ID(), test.itemData.ID)
+		if err != nil {
+			t.Fatalf("GetItem: %v", err)
+		}
+		if !reflect.DeepEqual(itemData.Location, test.want) {
+			t.Errorf("%s at %q: location = %+v, want %+v", test.itemData.ID, test.itemData.Address, itemData.Location, test.want)
+		}
+	}
+	if counting.lookups != 2 {
+		t.Errorf("%d lookups, want 2", counting.lookups)
+	}
+
+	// Imports aren't looked up, so hundreds of rows don't hold up the chat or flood the service
+	counting.lookups = 0
+	items := []constants.ItemDetails{
+		{ID: "pho1", Name: "Pho", Address: "1 Tras St"},
+		{ID: "curry2", Name: "Curry", Address: "1 Tras St", Location: sent},
+	}
+	if err := AddItems(store, items, list); err != nil {
+		t.Fatalf("AddItems: %v", err)
+	}
+	stored, err := store.GetItems(list.ID())
+	if err != nil {
+		t.Fatalf("GetItems: %v", err)
+	}
+	if stored["pho1"].Location != nil || !reflect.DeepEqual(stored["curry2"].Location, sent) {
+		t.Errorf("imported locations = %+v, %+v", stored["pho1"].Location, stored["curry2"].Location)
+	}
+	if counting.lookups != 0 {
+		t.Errorf("%d lookups for the import, want 0", counting.lookups)
+	}
+}
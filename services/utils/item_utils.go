@@ -0,0 +1,464 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+/* ItemSyntax is the syntax of ParseItem, for replies to users */
+const ItemSyntax = "name | address | #tag #tag | URL | notes"
+
+/*
+ParseItem parses an item written on one line, as in ItemSyntax.
+The name comes first. The other fields may be left out or come in any order:
+a field of only #tags holds tags (so an address like "#01-23 Tras St" stays one), one starting with http:// or https:// is the URL,
+and the first and second other fields are the address and notes
+*/
+func ParseItem(text string) (constants.ItemDetails, error) {
+	fields := strings.Split(text, "|")
+	itemData := constants.ItemDetails{
+		Name: strings.TrimSpace(fields[0]),
+	}
+	if itemData.Name == "" {
+		return itemData, errors.New("the name is missing. It goes before the first |")
+	}
+
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		switch {
+		case field == "":
+			continue
+		case isTagsField(field):
+			tags, err := parseTags(field)
+			if err != nil {
+				return itemData, err
+			}
+			if itemData.Tags == nil {
+				itemData.Tags = make(map[string]bool)
+			}
+			for _, tag := range tags {
+				itemData.Tags[tag] = true
+			}
+		case strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://"):
+			if itemData.URL != "" {
+				return itemData, fmt.Errorf("there are two URLs: %s and %s", itemData.URL, field)
+			}
+			itemData.URL = field
+		case itemData.Address == "":
+			itemData.Address = field
+		case itemData.Notes == "":
+			itemData.Notes = field
+		default:
+			return itemData, fmt.Errorf("%q is one field too many. After the name there can only be an address, notes, #tags and a URL", field)
+		}
+	}
+	return itemData, nil
+}
+
+/* isTagsField reports whether every word of the field starts with # */
+func isTagsField(field string) bool {
+	for _, word := range strings.Fields(field) {
+		if !strings.HasPrefix(word, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+/* parseTags parses a field like "#ramen #dinner" */
+func parseTags(field string) ([]string, error) {
+	words := strings.Fields(field)
+	tags := make([]string, 0, len(words))
+	for _, word := range words {
+		tag := strings.TrimPrefix(word, "#")
+		if tag == "" {
+			return nil, fmt.Errorf("there is an empty tag in %q", field)
+		}
+		if err := CheckTag(tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+/* ########## Tag Filter ##########*/
+/* MatchTags reports whether an item with the tags passes the filter */
+func MatchTags(filter constants.TagFilter, tags map[string]bool) bool {
+	for tag := range filter.Excluded {
+		if tags[tag] {
+			return false
+		}
+	}
+	if len(filter.Tags) == 0 {
+		return true
+	}
+	for tag := range filter.Tags {
+		if tags[tag] && !filter.MatchAll {
+			return true
+		}
+		if !tags[tag] && filter.MatchAll {
+			return false
+		}
+	}
+	return filter.MatchAll
+}
+
+/* FormatTagFilter writes the filter as an expression, like "(dinner OR cheap) AND NOT spicy". Empty for no filter */
+func FormatTagFilter(filter constants.TagFilter) string {
+	terms := make([]string, 0, len(filter.Excluded)+1)
+	tags := sortedKeys(filter.Tags)
+	switch {
+	case len(tags) == 1 || len(tags) > 1 && filter.MatchAll:
+		terms = append(terms, tags...)
+	case len(tags) > 1 && len(filter.Excluded) > 0:
+		terms = append(terms, "("+strings.Join(tags, " OR ")+")")
+	case len(tags) > 1:
+		terms = append(terms, strings.Join(tags, " OR "))
+	}
+	for _, tag := range sortedKeys(filter.Excluded) {
+		terms = append(terms, "NOT "+tag)
+	}
+	return strings.Join(terms, " AND ")
+}
+
+/* ########## Import ##########*/
+/* ImportRow is an item read by the Parse functions below, with the line or record number it came from */
+type ImportRow struct {
+	Line     int
+	ItemData constants.ItemDetails
+	// Why the row can't be imported, if it can't
+	Err error
+}
+
+/* ParseImportText reads one item per line, in the syntax of ParseItem. Empty lines are skipped */
+func ParseImportText(text string) []ImportRow {
+	rows := make([]ImportRow, 0)
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		itemData, err := ParseItem(line)
+		rows = append(rows, ImportRow{Line: i + 1, ItemData: itemData, Err: err})
+	}
+	return rows
+}
+
+/*
+ParseImportCSV reads items from CSV with a header row.
+Columns are matched by name, ignoring case: name (required), address, notes, url, tags, images
+(telegram file IDs, as exported), latitude and longitude. Other columns are ignored
+*/
+func ParseImportCSV(content []byte) ([]ImportRow, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("the file is empty")
+	}
+
+	columns := make(map[string]int)
+	for i, header := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(header))] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("there is no name column. The first row should name the columns: name, address, notes, url, tags")
+	}
+	cell := func(record []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	rows := make([]ImportRow, 0, len(records)-1)
+	for i, record := range records[1:] {
+		itemData := constants.ItemDetails{
+			Name:    cell(record, "name"),
+			Address: cell(record, "address"),
+			Notes:   cell(record, "notes"),
+			URL:     cell(record, "url"),
+			Tags:    tagSet(splitTags(cell(record, "tags"))),
+			Images:  tagSet(strings.Fields(cell(record, "images"))),
+		}
+		// Line 1 is the header
+		row := ImportRow{Line: i + 2}
+		itemData.Location, row.Err = parseLocation(cell(record, "latitude"), cell(record, "longitude"))
+		row.ItemData = itemData
+		if row.Err == nil {
+			row.Err = checkItem(itemData)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+/* importJSONItem is an item in a JSON import. Tags are a list, or a string like those of CSV */
+type importJSONItem struct {
+	Name    string          `json:"name"`
+	Address string          `json:"address"`
+	Notes   string          `json:"notes"`
+	URL     string          `json:"url"`
+	Tags    json.RawMessage `json:"tags"`
+	Images  []string        `json:"images"`
+	// Pointers, as 0 is a valid coordinate
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+/* ParseImportJSON reads items from a JSON list of objects with the fields of ParseImportCSV */
+func ParseImportJSON(content []byte) ([]ImportRow, error) {
+	var records []importJSONItem
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, fmt.Errorf("not a JSON list of items: %v", err)
+	}
+
+	rows := make([]ImportRow, 0, len(records))
+	for i, record := range records {
+		itemData := constants.ItemDetails{
+			Name:    strings.TrimSpace(record.Name),
+			Address: strings.TrimSpace(record.Address),
+			Notes:   strings.TrimSpace(record.Notes),
+			URL:     strings.TrimSpace(record.URL),
+			Images:  tagSet(record.Images),
+		}
+		row := ImportRow{Line: i + 1}
+		var tagList []string
+		var tagString string
+		switch {
+		case len(record.Tags) == 0 || string(record.Tags) == "null":
+		case json.Unmarshal(record.Tags, &tagList) == nil:
+			for i := range tagList {
+				tagList[i] = strings.TrimPrefix(strings.TrimSpace(tagList[i]), "#")
+			}
+			itemData.Tags = tagSet(tagList)
+		case json.Unmarshal(record.Tags, &tagString) == nil:
+			itemData.Tags = tagSet(splitTags(tagString))
+		default:
+			row.Err = errors.New("tags should be a list or a string")
+		}
+		switch {
+		case row.Err != nil, record.Latitude == nil && record.Longitude == nil:
+		case record.Latitude == nil || record.Longitude == nil:
+			row.Err = errors.New("latitude and longitude should both be given")
+		default:
+			itemData.Location, row.Err = newLocation(*record.Latitude, *record.Longitude)
+		}
+		row.ItemData = itemData
+		if row.Err == nil {
+			row.Err = checkItem(itemData)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+/* parseLocation reads the latitude and longitude of a CSV row. Neither given is no location */
+func parseLocation(latitude, longitude string) (*constants.Location, error) {
+	if latitude == "" && longitude == "" {
+		return nil, nil
+	}
+	lat, latErr := strconv.ParseFloat(latitude, 64)
+	lng, lngErr := strconv.ParseFloat(longitude, 64)
+	if latErr != nil || lngErr != nil {
+		return nil, errors.New("latitude and longitude should both be numbers")
+	}
+	return newLocation(lat, lng)
+}
+
+/* newLocation checks the coordinates are on the map. Imported locations are kept like sent ones */
+func newLocation(latitude, longitude float64) (*constants.Location, error) {
+	if latitude < -90 || latitude > 90 || longitude < -180 || longitude > 180 {
+		return nil, fmt.Errorf("%v, %v is not a latitude and longitude on the map", latitude, longitude)
+	}
+	return &constants.Location{Latitude: latitude, Longitude: longitude}, nil
+}
+
+/* splitTags splits tags separated by commas or spaces, with or without # */
+func splitTags(tags string) []string {
+	words := strings.FieldsFunc(tags, func(r rune) bool {
+		return r == ',' || r == ';' || unicode.IsSpace(r)
+	})
+	for i, word := range words {
+		words[i] = strings.TrimPrefix(word, "#")
+	}
+	return words
+}
+
+/* tagSet makes a set of the non empty strings, like tags or image IDs */
+func tagSet(tags []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, tag := range tags {
+		if tag != "" {
+			set[tag] = true
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return set
+}
+
+/* checkItem reports why an imported item can't be stored */
+func checkItem(itemData constants.ItemDetails) error {
+	if itemData.Name == "" {
+		return errors.New("the name is missing")
+	}
+	for tag := range itemData.Tags {
+		if err := CheckTag(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Characters tags can't have, as they key the tag index and Firebase keys can't have them */
+const invalidTagChars = "/.#$[]"
+
+/* CheckTag reports why a tag can't be stored, the same for every way of adding one */
+func CheckTag(tag string) error {
+	if tag == "" {
+		return errors.New("a tag can't be empty")
+	}
+	if i := strings.IndexAny(tag, invalidTagChars); i >= 0 {
+		return fmt.Errorf("tag %q has a %c, which tags can't have (nor any of %s)", tag, tag[i], invalidTagChars)
+	}
+	if strings.IndexFunc(tag, unicode.IsControl) >= 0 {
+		return fmt.Errorf("tag %q has a control character, which tags can't have", tag)
+	}
+	return nil
+}
+
+/* ########## Export ##########*/
+/* Export formats, by file extension */
+const (
+	ExportCSV      = "csv"
+	ExportJSON     = "json"
+	ExportMarkdown = "md"
+)
+
+var ExportFormats = []string{ExportCSV, ExportJSON, ExportMarkdown}
+
+/* exportJSONItem is an item in a JSON export, which ParseImportJSON reads back */
+type exportJSONItem struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Address string   `json:"address,omitempty"`
+	Notes   string   `json:"notes,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	Tags    []string `json:"tags"`
+	Images  []string `json:"images"`
+	// Pointers, as 0 is a valid coordinate
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+/* ExportItems writes the items in the format, sorted by name. CSV and JSON exports can be imported again */
+func ExportItems(format, title string, items []constants.ItemDetails) ([]byte, error) {
+	sorted := make([]constants.ItemDetails, len(items))
+	copy(sorted, items)
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.ToLower(sorted[i].Name) < strings.ToLower(sorted[j].Name)
+	})
+
+	switch format {
+	case ExportCSV:
+		return exportCSV(sorted)
+	case ExportJSON:
+		records := make([]exportJSONItem, len(sorted))
+		for i, itemData := range sorted {
+			records[i] = exportJSONItem{
+				ID:      itemData.ID,
+				Name:    itemData.Name,
+				Address: itemData.Address,
+				Notes:   itemData.Notes,
+				URL:     itemData.URL,
+				Tags:    sortedKeys(itemData.Tags),
+				Images:  sortedKeys(itemData.Images),
+			}
+			if itemData.Location != nil {
+				records[i].Latitude = &itemData.Location.Latitude
+				records[i].Longitude = &itemData.Location.Longitude
+			}
+		}
+		return json.MarshalIndent(records, "", "  ")
+	case ExportMarkdown:
+		return exportMarkdown(title, sorted), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+func exportCSV(items []constants.ItemDetails) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"name", "address", "notes", "url", "tags", "images", "latitude", "longitude"})
+	for _, itemData := range items {
+		latitude, longitude := "", ""
+		if itemData.Location != nil {
+			latitude = strconv.FormatFloat(itemData.Location.Latitude, 'f', -1, 64)
+			longitude = strconv.FormatFloat(itemData.Location.Longitude, 'f', -1, 64)
+		}
+		writer.Write([]string{
+			itemData.Name,
+			itemData.Address,
+			itemData.Notes,
+			itemData.URL,
+			strings.Join(sortedKeys(itemData.Tags), " "),
+			strings.Join(sortedKeys(itemData.Images), " "),
+			latitude,
+			longitude,
+		})
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
+
+func exportMarkdown(title string, items []constants.ItemDetails) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n", title)
+	for _, itemData := range items {
+		fmt.Fprintf(&buf, "\n## %s\n", itemData.Name)
+		if itemData.Address != "" {
+			fmt.Fprintf(&buf, "- Address: %s\n", itemData.Address)
+		}
+		if itemData.Notes != "" {
+			fmt.Fprintf(&buf, "- Notes: %s\n", itemData.Notes)
+		}
+		if itemData.URL != "" {
+			fmt.Fprintf(&buf, "- URL: <%s>\n", itemData.URL)
+		}
+		if len(itemData.Tags) > 0 {
+			fmt.Fprintf(&buf, "- Tags: #%s\n", strings.Join(sortedKeys(itemData.Tags), " #"))
+		}
+		if len(itemData.Images) > 0 {
+			fmt.Fprintf(&buf, "- Images: %s\n", strings.Join(sortedKeys(itemData.Images), ", "))
+		}
+		if itemData.Location != nil {
+			fmt.Fprintf(&buf, "- Location: %s\n", FormatLocation(*itemData.Location))
+		}
+	}
+	return buf.Bytes()
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+func TestParseItem(t *testing.T) {
+	tests := []struct {
+		text     string
+		itemData constants.ItemDetails
+		err      string
+	}{
+		{
+			text:     "Ramen Keisuke",
+			itemData: constants.ItemDetails{Name: "Ramen Keisuke"},
+		},
+		{
+			text: " Ramen Keisuke | 1 Tras St | #ramen #dinner | https://ramen.example | Go early ",
+			itemData: constants.ItemDetails{
+				Name:    "Ramen Keisuke",
+				Address: "1 Tras St",
+				Notes:   "Go early",
+				URL:     "https://ramen.example",
+				Tags:    map[string]bool{"ramen": true, "dinner": true},
+			},
+		},
+		{
+			text:     "Ramen | https://ramen.example | | #ramen",
+			itemData: constants.ItemDetails{Name: "Ramen", URL: "https://ramen.example", Tags: map[string]bool{"ramen": true}},
+		},
+		// Not every word is a tag, so it is the address
+		{
+			text:     "Ramen | #01-23 Tras St | #ramen",
+			itemData: constants.ItemDetails{Name: "Ramen", Address: "#01-23 Tras St", Tags: map[string]bool{"ramen": true}},
+		},
+		{text: " | 1 Tras St", err: "name is missing"},
+		{text: "Ramen | # #ramen", err: "empty tag"},
+		{text: "Ramen | #a/b", err: "has a /"},
+		{text: "Ramen | #ramen.spot", err: "has a ."},
+		{text: "Ramen | ##ramen", err: "has a #"},
+		{text: "Ramen | http://a | https://b", err: "two URLs"},
+		{text: "Ramen | 1 Tras St | Go early | Cash only", err: `"Cash only" is one field too many`},
+	}
+	for _, test := range tests {
+		itemData, err := ParseItem(test.text)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("ParseItem(%q) error = %v, want %q", test.text, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(itemData, test.itemData) {
+			t.Errorf("ParseItem(%q) = %+v, %v, want %+v", test.text, itemData, err, test.itemData)
+		}
+	}
+}
+
+func TestCheckTag(t *testing.T) {
+	for _, tag := range []string{"ramen", "late-night", "chef's_pick", "拉面"} {
+		if err := CheckTag(tag); err != nil {
+			t.Errorf("CheckTag(%q) = %v", tag, err)
+		}
+	}
+	for _, tag := range []string{"", "a/b", "v1.2", "#1", "$5", "[a]", "tab\tbed"} {
+		if err := CheckTag(tag); err == nil {
+			t.Errorf("CheckTag(%q) succeeded", tag)
+		}
+	}
+	// Imported rows are held to the same rule
+	rows := ParseImportText("Ramen | #dinner\nUdon\nPho | #$5")
+	if len(rows) != 3 || rows[0].Err != nil || rows[2].Err == nil || !strings.Contains(rows[2].Err.Error(), "has a $") {
+		t.Errorf("rows = %+v", rows)
+	}
+	rows, err := ParseImportCSV([]byte("name,tags\nRamen,dinner\nUdon,lunch;v1.2\n"))
+	if err != nil || len(rows) != 2 || rows[0].Err != nil || rows[1].Err == nil {
+		t.Errorf("CSV rows = %+v, %v", rows, err)
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	set := func(tags ...string) map[string]bool { return tagSet(tags) }
+	tests := []struct {
+		filter     constants.TagFilter
+		expression string
+		// Tags of items the filter matches, and doesn't
+		match, skip []map[string]bool
+	}{
+		{
+			filter: constants.TagFilter{},
+			match:  []map[string]bool{nil, set("dinner")},
+		},
+		{
+			filter:     constants.TagFilter{Tags: set("dinner", "cheap")},
+			expression: "cheap OR dinner",
+			match:      []map[string]bool{set("dinner"), set("cheap", "lunch")},
+			skip:       []map[string]bool{nil, set("lunch")},
+		},
+		{
+			filter:     constants.TagFilter{MatchAll: true, Tags: set("dinner", "cheap")},
+			expression: "cheap AND dinner",
+			match:      []map[string]bool{set("dinner", "cheap"), set("dinner", "cheap", "spicy")},
+			skip:       []map[string]bool{nil, set("dinner")},
+		},
+		{
+			filter:     constants.TagFilter{MatchAll: true, Tags: set("dinner", "cheap"), Excluded: set("spicy")},
+			expression: "cheap AND dinner AND NOT spicy",
+			match:      []map[string]bool{set("dinner", "cheap")},
+			skip:       []map[string]bool{set("dinner", "cheap", "spicy")},
+		},
+		{
+			filter:     constants.TagFilter{Tags: set("dinner", "cheap"), Excluded: set("spicy", "far")},
+			expression: "(cheap OR dinner) AND NOT far AND NOT spicy",
+			match:      []map[string]bool{set("cheap")},
+			skip:       []map[string]bool{set("dinner", "far"), set("spicy")},
+		},
+		{
+			filter:     constants.TagFilter{Excluded: set("spicy")},
+			expression: "NOT spicy",
+			match:      []map[string]bool{nil, set("dinner")},
+			skip:       []map[string]bool{set("spicy")},
+		},
+	}
+	for _, test := range tests {
+		if expression := FormatTagFilter(test.filter); expression != test.expression {
+			t.Errorf("FormatTagFilter(%+v) = %q, want %q", test.filter, expression, test.expression)
+		}
+		for _, tags := range test.match {
+			if !MatchTags(test.filter, tags) {
+				t.Errorf("%q doesn't match %v", test.expression, tags)
+			}
+		}
+		for _, tags := range test.skip {
+			if MatchTags(test.filter, tags) {
+				t.Errorf("%q matches %v", test.expression, tags)
+			}
+		}
+	}
+}
+
+/* Exports in CSV and JSON are read back by the import as the same items */
+func TestImportLocation(t *testing.T) {
+	csvRows, err := ParseImportCSV([]byte("name,latitude,longitude\n" +
+		"Ramen,1.277,103.846\n" +
+		"Udon,,\n" +
+		"Soba,north,103.846\n" +
+		"Pho,1.277,\n" +
+		"Laksa,91,103.846\n"))
+	if err != nil {
+		t.Fatalf("ParseImportCSV: %v", err)
+	}
+	jsonRows, err := ParseImportJSON([]byte(`[
+		{"name": "Ramen", "latitude": 1.277, "longitude": 103.846},
+		{"name": "Udon"},
+		{"name": "Pho", "latitude": 1.277},
+		{"name": "Laksa", "latitude": 91, "longitude": 103.846}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseImportJSON: %v", err)
+	}
+
+	ramen := &constants.Location{Latitude: 1.277, Longitude: 103.846}
+	for format, rows := range map[string][]ImportRow{"csv": csvRows, "json": jsonRows} {
+		if rows[0].Err != nil || !reflect.DeepEqual(rows[0].ItemData.Location, ramen) {
+			t.Errorf("%s: Ramen = %+v, want at %+v", format, rows[0], ramen)
+		}
+		if rows[1].Err != nil || rows[1].ItemData.Location != nil {
+			t.Errorf("%s: Udon = %+v, want no location", format, rows[1])
+		}
+		// The rows after are invalid
+		for _, row := range rows[2:] {
+			if row.Err == nil {
+				t.Errorf("%s: %s at %+v, want an error", format, row.ItemData.Name, row.ItemData.Location)
+			}
+		}
+	}
+}
+
+func TestExportItems(t *testing.T) {
+	items := []constants.ItemDetails{
+		{ID: "udon1", Name: "Udon", Notes: "Cash only, \"no\" cards", Tags: map[string]bool{"noodles": true, "lunch": true}},
+		{ID: "ramen1", Name: "Ramen", Address: "1 Tras St", URL: "https://ramen.example", Images: map[string]bool{"photo1": true},
+			Location: &constants.Location{Latitude: 1.277, Longitude: 103.846}},
+		// A valid coordinate, not a missing one
+		{ID: "null1", Name: "Null Island", Location: &constants.Location{}},
+	}
+	parsers := map[string]func([]byte) ([]ImportRow, error){
+		ExportCSV:  ParseImportCSV,
+		ExportJSON: ParseImportJSON,
+	}
+	for format, parse := range parsers {
+		content, err := ExportItems(format, "Food", items)
+		if err != nil {
+			t.Fatalf("%s: ExportItems: %v", format, err)
+		}
+		rows, err := parse(content)
+		if err != nil {
+			t.Fatalf("%s: parse %s: %v", format, content, err)
+		}
+		if len(rows) != 3 {
+			t.Fatalf("%s: %d rows", format, len(rows))
+		}
+		// Sorted by name, without IDs
+		for i, want := range []constants.ItemDetails{items[2], items[1], items[0]} {
+			want.ID = ""
+			if rows[i].Err != nil || !reflect.DeepEqual(rows[i].ItemData, want) {
+				t.Errorf("%s: row %d = %+v, want %+v", format, i, rows[i], want)
+			}
+		}
+	}
+
+	content, err := ExportItems(ExportMarkdown, "Food", items)
+	if err != nil {
+		t.Fatalf("md: ExportItems: %v", err)
+	}
+	for _, text := range []string{"# Food\n", "## Ramen\n- Address: 1 Tras St\n", "- Tags: #lunch #noodles\n", "- Location: 1.27700, 103.84600\n"} {
+		if !strings.Contains(string(content), text) {
+			t.Errorf("md: no %q in %s", text, content)
+		}
+	}
+}
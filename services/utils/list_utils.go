@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/xfated/golistbot/services/constants"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* MainList names the list every chat has, holding the items added before it had named lists */
+const MainList = "main"
+
+/* Longest name of a list, in characters */
+const MaxListName = 32
+
+var (
+	ErrInvalidListName = errors.New("invalid list name")
+	ErrListExists      = errors.New("list already exists")
+	ErrListNotFound    = errors.New("list not found")
+)
+
+/*
+ItemList is one of the lists of a chat. Item commands work on the list the user picked in the chat,
+and flows redirected to the bot's chat on the one picked in the chat they were started in
+*/
+type ItemList struct {
+	ChatID int64
+	Name   string
+}
+
+/* ID keys the items, item names and tags of the list. The main list keeps the chat ID, as before lists */
+func (l ItemList) ID() string {
+	chatID := strconv.FormatInt(l.ChatID, 10)
+	if l.Name == MainList || l.Name == "" {
+		return chatID
+	}
+	return chatID + "_" + l.Name
+}
+
+/* inList names a named list for messages about its items, as " in <name>". Empty for the main list */
+func inList(list ItemList) string {
+	if list.Name == MainList || list.Name == "" {
+		return ""
+	}
+	return " in " + list.Name
+}
+
+/* ListName normalizes a name for a list: lower case letters, digits, - and _ */
+func ListName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || len([]rune(name)) > MaxListName {
+		return "", ErrInvalidListName
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return "", ErrInvalidListName
+		}
+	}
+	return name, nil
+}
+
+/* ListNames returns the names of the chat's lists, the main list first */
+func ListNames(store Store, chatID int64) ([]string, error) {
+	lists, err := store.GetLists(strconv.FormatInt(chatID, 10))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(lists)+1)
+	for name := range lists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{MainList}, names...), nil
+}
+
+/* ListChoices are the lists of the chat, the main list first */
+func ListChoices(store Store, chatID int64) ([]Choice, error) {
+	names, err := ListNames(store, chatID)
+	if err != nil {
+		return nil, err
+	}
+	choices := make([]Choice, len(names))
+	for i, name := range names {
+		choices[i] = Choice{Label: name, Data: name}
+	}
+	return choices, nil
+}
+
+/*
+activeList returns the list the user picked in the chat, or the main list if there is none to pick.
+ambiguous is true when the chat has named lists and the user hasn't picked one
+*/
+func activeList(store Store, chatID int64, userID int) (list ItemList, ambiguous bool, err error) {
+	list = ItemList{ChatID: chatID, Name: MainList}
+	name, err := store.GetActiveList(SessionID(userID, chatID))
+	if err != nil {
+		return list, false, err
+	}
+	if name == MainList {
+		return list, false, nil
+	}
+	lists, err := store.GetLists(strconv.FormatInt(chatID, 10))
+	if err != nil {
+		return list, false, err
+	}
+	if lists[name] {
+		list.Name = name
+		return list, false, nil
+	}
+	return list, len(lists) > 0, nil
+}
+
+/* GetList returns the list the user works on in the chat of the update */
+func GetList(store Store, update *tgbotapi.Update) (ItemList, error) {
+	chatID, userID, err := GetChatUserID(update)
+	if err != nil {
+		return ItemList{}, err
+	}
+	list, _, err := activeList(store, chatID, userID)
+	return list, err
+}
+
+/* GetTargetList returns the list the user works on in the chat the flow was started in */
+func GetTargetList(store Store, update *tgbotapi.Update) (ItemList, error) {
+	_, userID, err := GetChatUserID(update)
+	if err != nil {
+		return ItemList{}, err
+	}
+	chatID, err := GetChatTarget(store, update)
+	if err != nil {
+		return ItemList{}, err
+	}
+	list, _, err := activeList(store, chatID, userID)
+	return list, err
+}
+
+/* ListAmbiguous reports whether the user has to pick one of the chat's lists for item commands */
+func ListAmbiguous(store Store, update *tgbotapi.Update) (bool, error) {
+	chatID, userID, err := GetChatUserID(update)
+	if err != nil {
+		return false, err
+	}
+	_, ambiguous, err := activeList(store, chatID, userID)
+	return ambiguous, err
+}
+
+/* NewList creates a named list in the chat of the update, and has the user use it */
+func NewList(store Store, update *tgbotapi.Update, name string) (ItemList, error) {
+	chatID, _, err := GetChatUserID(update)
+	if err != nil {
+		return ItemList{}, err
+	}
+	name, err = ListName(name)
+	if err != nil {
+		return ItemList{}, err
+	}
+	lists, err := store.GetLists(strconv.FormatInt(chatID, 10))
+	if err != nil {
+		return ItemList{}, err
+	}
+	if name == MainList || lists[name] {
+		return ItemList{ChatID: chatID, Name: name}, ErrListExists
+	}
+	if err := store.AddList(strconv.FormatInt(chatID, 10), name); err != nil {
+		return ItemList{}, err
+	}
+	return UseList(store, update, name)
+}
+
+/* UseList has the user use one of the lists of the chat of the update */
+func UseList(store Store, update *tgbotapi.Update, name string) (ItemList, error) {
+	chatID, _, err := GetChatUserID(update)
+	if err != nil {
+		return ItemList{}, err
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name != MainList {
+		lists, err := store.GetLists(strconv.FormatInt(chatID, 10))
+		if err != nil {
+			return ItemList{}, err
+		}
+		if !lists[name] {
+			return ItemList{}, ErrListNotFound
+		}
+	}
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return ItemList{}, err
+	}
+	if err := store.SetActiveList(sessionID, name); err != nil {
+		return ItemList{}, err
+	}
+	return ItemList{ChatID: chatID, Name: name}, nil
+}
+
+func SetPendingCommand(store Store, update *tgbotapi.Update, command constants.PendingCommand) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetPendingCommand(sessionID, command)
+}
+
+func GetPendingCommand(store Store, update *tgbotapi.Update) (constants.PendingCommand, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return constants.PendingCommand{}, err
+	}
+	return store.GetPendingCommand(sessionID)
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestListName(t *testing.T) {
+	valid := map[string]string{
+		"movies":         "movies",
+		" Weekend-Hikes": "weekend-hikes",
+		"food_2":         "food_2",
+		"café":           "café",
+	}
+	for name, want := range valid {
+		if got, err := ListName(name); err != nil || got != want {
+			t.Errorf("ListName(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"", "weekend hikes", "a/b", "food.old", "abcdefghijklmnopqrstuvwxyz1234567"} {
+		if _, err := ListName(name); err != ErrInvalidListName {
+			t.Errorf("ListName(%q) error = %v, want ErrInvalidListName", name, err)
+		}
+	}
+}
+
+func TestItemListID(t *testing.T) {
+	tests := map[ItemList]string{
+		{ChatID: -200, Name: MainList}: "-200",
+		{ChatID: -200}:                 "-200",
+		{ChatID: -200, Name: "movies"}: "-200_movies",
+		{ChatID: 100, Name: "movies"}:  "100_movies",
+	}
+	for list, want := range tests {
+		if got := list.ID(); got != want {
+			t.Errorf("%+v.ID() = %q, want %q", list, got, want)
+		}
+	}
+}
+
+func TestActiveList(t *testing.T) {
+	store := NewMemoryStore()
+	update := testUpdate()
+	check := func(name string, ambiguous bool) {
+		t.Helper()
+		list, err := GetList(store, update)
+		if err != nil || list.Name != name {
+			t.Errorf("GetList = %+v, %v, want %s", list, err, name)
+		}
+		if got, err := ListAmbiguous(store, update); err != nil || got != ambiguous {
+			t.Errorf("ListAmbiguous = %v, %v, want %v", got, err, ambiguous)
+		}
+	}
+
+	// Only the main list
+	check(MainList, false)
+
+	// Another user's new list leaves the choice open
+	store.AddList("-200", "movies")
+	check(MainList, true)
+
+	if _, err := UseList(store, update, "Movies"); err != nil {
+		t.Fatalf("UseList: %v", err)
+	}
+	check("movies", false)
+	if _, err := UseList(store, update, "films"); err != ErrListNotFound {
+		t.Errorf("UseList(films) error = %v, want ErrListNotFound", err)
+	}
+	check("movies", false)
+
+	if _, err := NewList(store, update, "movies"); err != ErrListExists {
+		t.Errorf("NewList(movies) error = %v, want ErrListExists", err)
+	}
+	if list, err := NewList(store, update, "Food"); err != nil || list.ID() != "-200_food" {
+		t.Errorf("NewList(Food) = %+v, %v", list, err)
+	}
+	check("food", false)
+	if _, err := UseList(store, update, MainList); err != nil {
+		t.Fatalf("UseList(main): %v", err)
+	}
+	check(MainList, false)
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/xfated/golistbot/services/constants"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* NearbyLimit is how many of the closest items a near me query sends */
+const NearbyLimit = 5
+
+/* Mean radius of the earth, in meters */
+const earthRadius = 6371000
+
+/*
+GetLocation returns the location or venue sent in the update, with the venue's address.
+The address is empty for a location, live or not
+*/
+func GetLocation(update *tgbotapi.Update) (constants.Location, string, error) {
+	switch {
+	case update.Message == nil:
+	case update.Message.Venue != nil:
+		venue := update.Message.Venue
+		return constants.Location{Latitude: venue.Location.Latitude, Longitude: venue.Location.Longitude}, venue.Address, nil
+	case update.Message.Location != nil:
+		location := update.Message.Location
+		return constants.Location{Latitude: location.Latitude, Longitude: location.Longitude}, "", nil
+	}
+	return constants.Location{}, "", errors.New("no location in message")
+}
+
+/* Distance is the great circle distance between two locations, in meters */
+func Distance(from, to constants.Location) float64 {
+	lat1, lat2 := from.Latitude*math.Pi/180, to.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (to.Longitude - from.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+/* FormatDistance writes meters as e.g. "350 m", "1.2 km" or "15 km" */
+func FormatDistance(meters float64) string {
+	switch {
+	case meters < 1000:
+		return fmt.Sprintf("%.0f m", meters)
+	case meters < 10000:
+		return fmt.Sprintf("%.1f km", meters/1000)
+	}
+	return fmt.Sprintf("%.0f km", meters/1000)
+}
+
+/* NearbyItem is an item with its distance from a location */
+type NearbyItem struct {
+	ItemData constants.ItemDetails
+	Distance float64
+}
+
+/* NearestItems returns the limit items closest to the location, nearest first. Items without a location are left out */
+func NearestItems(items []constants.ItemDetails, from constants.Location, limit int) []NearbyItem {
+	nearby := make([]NearbyItem, 0, len(items))
+	for _, itemData := range items {
+		if itemData.Location != nil {
+			nearby = append(nearby, NearbyItem{itemData, Distance(from, *itemData.Location)})
+		}
+	}
+	sort.Slice(nearby, func(i, j int) bool {
+		return nearby[i].Distance < nearby[j].Distance
+	})
+	if len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+	return nearby
+}
+
+/* SendItemVenue sends the item as a venue, a pin on a map with its name and address */
+func SendItemVenue(update *tgbotapi.Update, itemData constants.ItemDetails) error {
+	if itemData.Location == nil {
+		return errors.New("item has no location")
+	}
+	chatID, _, err := GetChatUserID(update)
+	if err != nil {
+		return err
+	}
+	// Telegram requires an address
+	address := itemData.Address
+	if address == "" {
+		address = FormatLocation(*itemData.Location)
+	}
+	venue := tgbotapi.NewVenue(chatID, itemData.Name, address, itemData.Location.Latitude, itemData.Location.Longitude)
+	_, err = messenger.Send(venue)
+	return err
+}
+
+/* FormatLocation writes the coordinates of a location */
+func FormatLocation(location constants.Location) string {
+	return fmt.Sprintf("%.5f, %.5f", location.Latitude, location.Longitude)
+}
+
+/* SendLocationRequest asks for the user's location, with a button sharing it in private chats, where telegram allows one */
+func SendLocationRequest(store Store, update *tgbotapi.Update, text string) {
+	chatID, userID, err := GetChatUserID(update)
+	if err != nil {
+		log.Printf("Error GetChatUserID: %+v", err)
+		return
+	}
+	if chatID != int64(userID) {
+		messageTarget, err := GetMessageTarget(store, update)
+		if err != nil {
+			log.Printf("Error GetMessageTarget: %+v", err)
+		}
+		SendMessageForceReply(update, text+"\n\n(Attach it with 📎 → Location)", messageTarget, false)
+		return
+	}
+	keyboard := tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButtonLocation("Send my location")))
+	keyboard.ResizeKeyboard = true
+	keyboard.OneTimeKeyboard = true
+	SetReplyMarkupKeyboard(store, update, text, keyboard, false)
+}
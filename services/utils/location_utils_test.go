@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"math"
+	"testing"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		from, to constants.Location
+		// Meters, to within 0.5%
+		distance float64
+	}{
+		{constants.Location{Latitude: 1.2765, Longitude: 103.8456}, constants.Location{Latitude: 1.2765, Longitude: 103.8456}, 0},
+		// Tanjong Pagar to Changi Airport
+		{constants.Location{Latitude: 1.2765, Longitude: 103.8456}, constants.Location{Latitude: 1.3644, Longitude: 103.9915}, 18930},
+		// London to Paris
+		{constants.Location{Latitude: 51.5074, Longitude: -0.1278}, constants.Location{Latitude: 48.8566, Longitude: 2.3522}, 343500},
+	}
+	for _, test := range tests {
+		distance := Distance(test.from, test.to)
+		if math.Abs(distance-test.distance) > test.distance*0.005+1 {
+			t.Errorf("Distance(%v, %v) = %.0f, want %.0f", test.from, test.to, distance, test.distance)
+		}
+	}
+}
+
+func TestFormatDistance(t *testing.T) {
+	tests := map[float64]string{
+		12.4:   "12 m",
+		999:    "999 m",
+		1234:   "1.2 km",
+		15600:  "16 km",
+		343500: "344 km",
+	}
+	for meters, want := range tests {
+		if got := FormatDistance(meters); got != want {
+			t.Errorf("FormatDistance(%v) = %q, want %q", meters, got, want)
+		}
+	}
+}
+
+func TestNearestItems(t *testing.T) {
+	here := constants.Location{Latitude: 1.2765, Longitude: 103.8456}
+	items := []constants.ItemDetails{
+		{Name: "Far", Location: &constants.Location{Latitude: 1.3644, Longitude: 103.9915}},
+		{Name: "Nowhere"},
+		{Name: "Near", Location: &constants.Location{Latitude: 1.2770, Longitude: 103.8460}},
+		{Name: "Middle", Location: &constants.Location{Latitude: 1.3000, Longitude: 103.8500}},
+	}
+	nearby := NearestItems(items, here, 2)
+	if len(nearby) != 2 || nearby[0].ItemData.Name != "Near" || nearby[1].ItemData.Name != "Middle" {
+		t.Fatalf("NearestItems = %+v, want Near then Middle", nearby)
+	}
+	if nearby[0].Distance > nearby[1].Distance {
+		t.Errorf("distances %v and %v not in order", nearby[0].Distance, nearby[1].Distance)
+	}
+	if nearby := NearestItems(items, here, 10); len(nearby) != 3 {
+		t.Errorf("NearestItems kept %d items, want the 3 with a location", len(nearby))
+	}
+}
@@ -0,0 +1,637 @@
+package utils
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+/* MemoryStore keeps the bot's data in memory. Used for tests and local runs */
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*memorySession
+	items     map[string]map[string]constants.ItemDetails
+	itemNames map[string]map[string]string
+	tags      map[string]map[string]int
+	feedback  []constants.FeedbackDetails
+	userChats map[string]map[string]string
+	lists     map[string]map[string]bool
+	updates   map[int]time.Time
+}
+
+type memorySession struct {
+	state         constants.State
+	itemToAdd     constants.ItemDetails
+	geocodeError  string
+	chatTarget    int64
+	messageTarget int
+	itemTarget    string
+	filter        string
+	keyboard      constants.Keyboard
+	query         memoryQuery
+	importItems   []constants.ItemDetails
+	list          string
+	pending       constants.PendingCommand
+	lastActive    time.Time
+}
+
+type memoryQuery struct {
+	item     string
+	queryNum int
+	tags     map[string]bool
+	excluded map[string]bool
+	matchAll bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions:  make(map[string]*memorySession),
+		items:     make(map[string]map[string]constants.ItemDetails),
+		itemNames: make(map[string]map[string]string),
+		tags:      make(map[string]map[string]int),
+		userChats: make(map[string]map[string]string),
+		lists:     make(map[string]map[string]bool),
+		updates:   make(map[int]time.Time),
+	}
+}
+
+/* session returns the record of a session, creating it if needed. Caller holds mu */
+func (s *MemoryStore) session(sessionID string) *memorySession {
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		session = &memorySession{}
+		s.sessions[sessionID] = session
+	}
+	return session
+}
+
+func copyBoolMap(m map[string]bool) map[string]bool {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]bool, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyItem(itemData constants.ItemDetails) constants.ItemDetails {
+	itemData.Images = copyBoolMap(itemData.Images)
+	itemData.Tags = copyBoolMap(itemData.Tags)
+	itemData.Location = copyLocation(itemData.Location)
+	return itemData
+}
+
+func copyLocation(location *constants.Location) *constants.Location {
+	if location == nil {
+		return nil
+	}
+	copied := *location
+	return &copied
+}
+
+/* ########## Session State ##########*/
+func (s *MemoryStore) SetUserState(sessionID string, state constants.State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).state = state
+	return nil
+}
+
+func (s *MemoryStore) GetUserState(sessionID string) (constants.State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).state, nil
+}
+
+/* ########## Session activity ##########*/
+func (s *MemoryStore) TouchSession(sessionID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).lastActive = at
+	return nil
+}
+
+func (s *MemoryStore) GetSessionActivity(sessionID string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).lastActive, nil
+}
+
+func (s *MemoryStore) ClearSession(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.session(sessionID)
+	session.state = constants.Idle
+	session.itemToAdd = constants.ItemDetails{}
+	session.geocodeError = ""
+	session.query = memoryQuery{}
+	session.importItems = nil
+	session.pending = constants.PendingCommand{}
+	session.lastActive = time.Time{}
+	return nil
+}
+
+func (s *MemoryStore) StaleSessions(before time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessionIDs := make([]string, 0)
+	for sessionID, session := range s.sessions {
+		if !session.lastActive.IsZero() && session.lastActive.Before(before) {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	sort.Strings(sessionIDs)
+	return sessionIDs, nil
+}
+
+/* ########## User chats ##########*/
+func (s *MemoryStore) AddUserChat(userID, chatID, title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.userChats[userID] == nil {
+		s.userChats[userID] = make(map[string]string)
+	}
+	s.userChats[userID][chatID] = title
+	return nil
+}
+
+func (s *MemoryStore) GetUserChats(userID string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chats := make(map[string]string, len(s.userChats[userID]))
+	for chatID, title := range s.userChats[userID] {
+		chats[chatID] = title
+	}
+	return chats, nil
+}
+
+/* ########## Lists ##########*/
+func (s *MemoryStore) AddList(chatID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lists[chatID] == nil {
+		s.lists[chatID] = make(map[string]bool)
+	}
+	s.lists[chatID][name] = true
+	return nil
+}
+
+func (s *MemoryStore) GetLists(chatID string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lists := copyBoolMap(s.lists[chatID])
+	if lists == nil {
+		lists = make(map[string]bool)
+	}
+	return lists, nil
+}
+
+func (s *MemoryStore) SetActiveList(sessionID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).list = name
+	return nil
+}
+
+func (s *MemoryStore) GetActiveList(sessionID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).list, nil
+}
+
+func (s *MemoryStore) SetPendingCommand(sessionID string, command constants.PendingCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).pending = command
+	return nil
+}
+
+func (s *MemoryStore) GetPendingCommand(sessionID string) (constants.PendingCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).pending, nil
+}
+
+/* ########## Targets ##########*/
+func (s *MemoryStore) SetChatTarget(sessionID string, chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).chatTarget = chatID
+	return nil
+}
+
+func (s *MemoryStore) GetChatTarget(sessionID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).chatTarget, nil
+}
+
+func (s *MemoryStore) SetMessageTarget(sessionID string, messageID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).messageTarget = messageID
+	return nil
+}
+
+func (s *MemoryStore) GetMessageTarget(sessionID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).messageTarget, nil
+}
+
+func (s *MemoryStore) SetItemTarget(sessionID, itemID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).itemTarget = itemID
+	return nil
+}
+
+func (s *MemoryStore) GetItemTarget(sessionID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).itemTarget, nil
+}
+
+func (s *MemoryStore) SetKeyboardFilter(sessionID, filter string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).filter = filter
+	return nil
+}
+
+func (s *MemoryStore) GetKeyboardFilter(sessionID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).filter, nil
+}
+
+func (s *MemoryStore) SetKeyboard(sessionID string, keyboard constants.Keyboard) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keyboard.Values = append([]string(nil), keyboard.Values...)
+	s.session(sessionID).keyboard = keyboard
+	return nil
+}
+
+func (s *MemoryStore) GetKeyboard(sessionID string) (constants.Keyboard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).keyboard, nil
+}
+
+/* ########## Temp item ##########*/
+func (s *MemoryStore) SetTempItem(sessionID string, itemData constants.ItemDetails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.session(sessionID)
+	session.itemToAdd = copyItem(itemData)
+	session.geocodeError = ""
+	return nil
+}
+
+func (s *MemoryStore) GetTempItem(sessionID string) (constants.ItemDetails, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyItem(s.session(sessionID).itemToAdd), nil
+}
+
+func (s *MemoryStore) SetTempItemName(sessionID, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).itemToAdd.Name = name
+	return nil
+}
+
+func (s *MemoryStore) SetTempItemAddress(sessionID, address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).itemToAdd.Address = address
+	return nil
+}
+
+func (s *MemoryStore) SetTempItemLocation(sessionID string, location *constants.Location) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).itemToAdd.Location = copyLocation(location)
+	return nil
+}
+
+func (s *MemoryStore) SetTempItemGeocodeError(sessionID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).geocodeError = reason
+	return nil
+}
+
+func (s *MemoryStore) GetTempItemGeocodeError(sessionID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).geocodeError, nil
+}
+
+func (s *MemoryStore) SetTempItemNotes(sessionID, notes string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).itemToAdd.Notes = notes
+	return nil
+}
+
+func (s *MemoryStore) SetTempItemURL(sessionID, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).itemToAdd.URL = url
+	return nil
+}
+
+func (s *MemoryStore) AddTempItemImage(sessionID, imageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	itemToAdd := &s.session(sessionID).itemToAdd
+	if itemToAdd.Images == nil {
+		itemToAdd.Images = make(map[string]bool)
+	}
+	itemToAdd.Images[imageID] = true
+	return nil
+}
+
+func (s *MemoryStore) AddTempItemTag(sessionID, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	itemToAdd := &s.session(sessionID).itemToAdd
+	if itemToAdd.Tags == nil {
+		itemToAdd.Tags = make(map[string]bool)
+	}
+	itemToAdd.Tags[tag] = true
+	return nil
+}
+
+func (s *MemoryStore) GetTempItemTags(sessionID string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyBoolMap(s.session(sessionID).itemToAdd.Tags), nil
+}
+
+func (s *MemoryStore) DeleteTempItemTag(sessionID, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.session(sessionID).itemToAdd.Tags, tag)
+	return nil
+}
+
+/* ########## Import ##########*/
+func (s *MemoryStore) SetImportItems(sessionID string, items []constants.ItemDetails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	importItems := make([]constants.ItemDetails, len(items))
+	for i, itemData := range items {
+		importItems[i] = copyItem(itemData)
+	}
+	s.session(sessionID).importItems = importItems
+	return nil
+}
+
+func (s *MemoryStore) GetImportItems(sessionID string) ([]constants.ItemDetails, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	importItems := s.session(sessionID).importItems
+	items := make([]constants.ItemDetails, len(importItems))
+	for i, itemData := range importItems {
+		items[i] = copyItem(itemData)
+	}
+	return items, nil
+}
+
+/* ########## Items ##########*/
+/* adjustTags applies tag count changes, dropping tags no longer used. Caller holds mu */
+func (s *MemoryStore) adjustTags(chatID string, deltas map[string]int) {
+	if s.tags[chatID] == nil {
+		s.tags[chatID] = make(map[string]int)
+	}
+	for tag, delta := range deltas {
+		s.tags[chatID][tag] += delta
+		if s.tags[chatID][tag] <= 0 {
+			delete(s.tags[chatID], tag)
+		}
+	}
+}
+
+func (s *MemoryStore) AddItem(chatID string, itemData constants.ItemDetails) error {
+	return s.AddItems(chatID, []constants.ItemDetails{itemData})
+}
+
+func (s *MemoryStore) AddItems(chatID string, items []constants.ItemDetails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, itemData := range items {
+		s.addItem(chatID, itemData)
+	}
+	return nil
+}
+
+/* addItem adds or replaces an item, caller holds mu */
+func (s *MemoryStore) addItem(chatID string, itemData constants.ItemDetails) {
+	if s.items[chatID] == nil {
+		s.items[chatID] = make(map[string]constants.ItemDetails)
+	}
+	oldTags := s.items[chatID][itemData.ID].Tags
+	s.items[chatID][itemData.ID] = copyItem(itemData)
+	s.adjustTags(chatID, tagDeltas(oldTags, itemData.Tags))
+
+	if s.itemNames[chatID] == nil {
+		s.itemNames[chatID] = make(map[string]string)
+	}
+	s.itemNames[chatID][itemData.ID] = itemData.Name
+}
+
+func (s *MemoryStore) GetItem(chatID, itemID string) (constants.ItemDetails, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyItem(s.items[chatID][itemID]), nil
+}
+
+func (s *MemoryStore) GetItems(chatID string) (map[string]constants.ItemDetails, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.items[chatID] == nil {
+		return nil, nil
+	}
+	items := make(map[string]constants.ItemDetails, len(s.items[chatID]))
+	for itemID, itemData := range s.items[chatID] {
+		items[itemID] = copyItem(itemData)
+	}
+	return items, nil
+}
+
+func (s *MemoryStore) DeleteItem(chatID, itemID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adjustTags(chatID, tagDeltas(s.items[chatID][itemID].Tags, nil))
+	delete(s.items[chatID], itemID)
+	delete(s.itemNames[chatID], itemID)
+	return nil
+}
+
+/* ########## Item names ##########*/
+func (s *MemoryStore) GetItemNames(chatID string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	itemNames := make(map[string]string, len(s.itemNames[chatID]))
+	for itemID, name := range s.itemNames[chatID] {
+		itemNames[itemID] = name
+	}
+	return itemNames, nil
+}
+
+/* ########## Tags ##########*/
+func (s *MemoryStore) GetTags(chatID string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tags := make(map[string]bool, len(s.tags[chatID]))
+	for tag := range s.tags[chatID] {
+		tags[tag] = true
+	}
+	return tags, nil
+}
+
+func (s *MemoryStore) RebuildIndex(chatID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[chatID] = countTags(s.items[chatID])
+	s.itemNames[chatID] = make(map[string]string, len(s.items[chatID]))
+	for itemID, itemData := range s.items[chatID] {
+		s.itemNames[chatID][itemID] = itemData.Name
+	}
+	return nil
+}
+
+/* ########## Query ##########*/
+func (s *MemoryStore) ResetQuery(sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).query = memoryQuery{}
+	return nil
+}
+
+func (s *MemoryStore) SetQueryItem(sessionID, itemID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).query.item = itemID
+	return nil
+}
+
+func (s *MemoryStore) GetQueryItem(sessionID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).query.item, nil
+}
+
+func (s *MemoryStore) SetQueryNum(sessionID string, num int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).query.queryNum = num
+	return nil
+}
+
+func (s *MemoryStore) GetQueryNum(sessionID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).query.queryNum, nil
+}
+
+func (s *MemoryStore) AddQueryTag(sessionID, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := &s.session(sessionID).query
+	if query.tags == nil {
+		query.tags = make(map[string]bool)
+	}
+	query.tags[tag] = true
+	return nil
+}
+
+func (s *MemoryStore) GetQueryTags(sessionID string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyBoolMap(s.session(sessionID).query.tags), nil
+}
+
+func (s *MemoryStore) ExcludeQueryTag(sessionID, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query := &s.session(sessionID).query
+	if query.excluded == nil {
+		query.excluded = make(map[string]bool)
+	}
+	query.excluded[tag] = true
+	return nil
+}
+
+func (s *MemoryStore) GetQueryExcludedTags(sessionID string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyBoolMap(s.session(sessionID).query.excluded), nil
+}
+
+func (s *MemoryStore) SetQueryMatchAll(sessionID string, matchAll bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session(sessionID).query.matchAll = matchAll
+	return nil
+}
+
+func (s *MemoryStore) GetQueryMatchAll(sessionID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.session(sessionID).query.matchAll, nil
+}
+
+/* ########## Updates ##########*/
+func (s *MemoryStore) MarkUpdate(updateID int, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.updates[updateID]; ok {
+		return false, nil
+	}
+	s.updates[updateID] = at
+	return true, nil
+}
+
+func (s *MemoryStore) UnmarkUpdate(updateID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.updates, updateID)
+	return nil
+}
+
+func (s *MemoryStore) SweepUpdates(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	swept := 0
+	for updateID, at := range s.updates {
+		if at.Before(before) {
+			delete(s.updates, updateID)
+			swept++
+		}
+	}
+	return swept, nil
+}
+
+/* ########## Feedback ##########*/
+func (s *MemoryStore) AddFeedback(feedback constants.FeedbackDetails) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.feedback = append(s.feedback, feedback)
+	return nil
+}
+
+func (s *MemoryStore) GetFeedback() []constants.FeedbackDetails {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	feedback := make([]constants.FeedbackDetails, len(s.feedback))
+	copy(feedback, s.feedback)
+	return feedback
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// Messenger delivers the bot's messages to a chat front end.
+// Every Send helper in this package goes through the active Messenger.
+type Messenger interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	AnswerInlineQuery(config tgbotapi.InlineConfig) error
+	AnswerCallbackQuery(config tgbotapi.CallbackConfig) error
+	// DownloadFile returns the content of a file sent to the bot, e.g. a document
+	DownloadFile(fileID string) ([]byte, error)
+}
+
+/* MaxDownloadSize is the largest file DownloadFile reads */
+const MaxDownloadSize = 1 << 20
+
+var messenger Messenger
+
+/* SetMessenger replaces the active messenger, e.g. with a RecordingMessenger in tests */
+func SetMessenger(m Messenger) {
+	messenger = m
+}
+
+/* ########## Telegram ##########*/
+/* TelegramMessenger talks to the telegram bot API */
+type TelegramMessenger struct {
+	bot *tgbotapi.BotAPI
+}
+
+func NewTelegramMessenger(token string) (*TelegramMessenger, error) {
+	bot, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return nil, err
+	}
+	return &TelegramMessenger{bot: bot}, nil
+}
+
+/* Username of the bot, as returned by getMe */
+func (m *TelegramMessenger) Username() string {
+	return m.bot.Self.UserName
+}
+
+func (m *TelegramMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return m.bot.Send(c)
+}
+
+func (m *TelegramMessenger) AnswerInlineQuery(config tgbotapi.InlineConfig) error {
+	_, err := m.bot.AnswerInlineQuery(config)
+	return err
+}
+
+func (m *TelegramMessenger) AnswerCallbackQuery(config tgbotapi.CallbackConfig) error {
+	_, err := m.bot.AnswerCallbackQuery(config)
+	return err
+}
+
+func (m *TelegramMessenger) DownloadFile(fileID string) ([]byte, error) {
+	url, err := m.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading file: %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, MaxDownloadSize))
+}
+
+/* ########## Recording ##########*/
+/* RecordedMessage is a message captured by RecordingMessenger */
+type RecordedMessage struct {
+	MessageID int
+	ChatID    int64
+	Text      string
+	ParseMode string
+	ReplyTo   int
+	// Button labels, row by row, of an inline or reply keyboard
+	Keyboard [][]string
+	// Callback data of inline keyboard buttons, laid out like Keyboard
+	CallbackData [][]string
+	// Set when the keyboard was removed
+	RemoveKeyboard bool
+	PhotoID        string
+	// Set when the message is a venue, whose title and address are in Text
+	Venue bool
+	// ID of the message whose text or keyboard this message replaced, if it was an edit
+	EditedID int
+	// Name and content of an uploaded document
+	DocumentName string
+	Document     []byte
+}
+
+/* Buttons returns the labels of all buttons in the message's keyboard */
+func (m RecordedMessage) Buttons() []string {
+	buttons := make([]string, 0)
+	for _, row := range m.Keyboard {
+		buttons = append(buttons, row...)
+	}
+	return buttons
+}
+
+/* RecordingMessenger keeps every message sent instead of delivering it */
+type RecordingMessenger struct {
+	mu      sync.Mutex
+	nextID  int
+	sent    []RecordedMessage
+	files   map[string][]byte
+	answers []tgbotapi.InlineConfig
+	toasts  []string
+}
+
+func NewRecordingMessenger() *RecordingMessenger {
+	return &RecordingMessenger{files: make(map[string][]byte)}
+}
+
+/* AddFile makes content downloadable as fileID */
+func (m *RecordingMessenger) AddFile(fileID string, content []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[fileID] = content
+}
+
+func (m *RecordingMessenger) DownloadFile(fileID string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, ok := m.files[fileID]
+	if !ok {
+		return nil, errors.New("no such file")
+	}
+	return content, nil
+}
+
+func (m *RecordingMessenger) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	recorded := RecordedMessage{MessageID: m.nextID}
+	switch config := c.(type) {
+	case tgbotapi.EditMessageTextConfig:
+		recorded.MessageID = config.MessageID
+		recorded.EditedID = config.MessageID
+		recorded.ChatID = config.ChatID
+		recorded.Text = config.Text
+		if config.ReplyMarkup != nil {
+			recordReplyMarkup(&recorded, *config.ReplyMarkup)
+		}
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		recorded.MessageID = config.MessageID
+		recorded.EditedID = config.MessageID
+		recorded.ChatID = config.ChatID
+		if config.ReplyMarkup != nil {
+			recordReplyMarkup(&recorded, *config.ReplyMarkup)
+		}
+	case tgbotapi.MessageConfig:
+		recorded.ChatID = config.ChatID
+		recorded.Text = config.Text
+		recorded.ParseMode = config.ParseMode
+		recorded.ReplyTo = config.ReplyToMessageID
+		recordReplyMarkup(&recorded, config.ReplyMarkup)
+	case tgbotapi.PhotoConfig:
+		recorded.ChatID = config.ChatID
+		recorded.PhotoID = config.FileID
+		recorded.Text = config.Caption
+	case tgbotapi.VenueConfig:
+		recorded.ChatID = config.ChatID
+		recorded.Text = config.Title + "\n" + config.Address
+		recorded.Venue = true
+	case tgbotapi.DocumentConfig:
+		recorded.ChatID = config.ChatID
+		recorded.Text = config.Caption
+		if file, ok := config.File.(tgbotapi.FileBytes); ok {
+			recorded.DocumentName = file.Name
+			recorded.Document = file.Bytes
+		}
+	}
+	m.sent = append(m.sent, recorded)
+	return tgbotapi.Message{
+		MessageID: recorded.MessageID,
+		Chat:      &tgbotapi.Chat{ID: recorded.ChatID},
+		Text:      recorded.Text,
+	}, nil
+}
+
+func recordReplyMarkup(recorded *RecordedMessage, markup interface{}) {
+	switch keyboard := markup.(type) {
+	case tgbotapi.InlineKeyboardMarkup:
+		for _, row := range keyboard.InlineKeyboard {
+			labels := make([]string, len(row))
+			data := make([]string, len(row))
+			for i, button := range row {
+				labels[i] = button.Text
+				if button.CallbackData != nil {
+					data[i] = *button.CallbackData
+				}
+			}
+			recorded.Keyboard = append(recorded.Keyboard, labels)
+			recorded.CallbackData = append(recorded.CallbackData, data)
+		}
+	case tgbotapi.ReplyKeyboardMarkup:
+		for _, row := range keyboard.Keyboard {
+			labels := make([]string, len(row))
+			for i, button := range row {
+				labels[i] = button.Text
+			}
+			recorded.Keyboard = append(recorded.Keyboard, labels)
+		}
+	case tgbotapi.ReplyKeyboardRemove:
+		recorded.RemoveKeyboard = true
+	}
+}
+
+func (m *RecordingMessenger) AnswerInlineQuery(config tgbotapi.InlineConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.answers = append(m.answers, config)
+	return nil
+}
+
+func (m *RecordingMessenger) AnswerCallbackQuery(config tgbotapi.CallbackConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.toasts = append(m.toasts, config.Text)
+	return nil
+}
+
+/* TakeToasts returns the texts of the callback query answers sent since the last call, empty for answers without one */
+func (m *RecordingMessenger) TakeToasts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	toasts := m.toasts
+	m.toasts = nil
+	return toasts
+}
+
+/* TakeInlineAnswers returns the inline query answers sent since the last call */
+func (m *RecordingMessenger) TakeInlineAnswers() []tgbotapi.InlineConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	answers := m.answers
+	m.answers = nil
+	return answers
+}
+
+/* Take returns the messages sent since the last call */
+func (m *RecordingMessenger) Take() []RecordedMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := m.sent
+	m.sent = nil
+	return sent
+}
@@ -0,0 +1,412 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+/* SearchLimit is how many items a search sends */
+const SearchLimit = 5
+
+/* Weights of the fields an item's terms come from. A match in the name counts most */
+const (
+	nameWeight = 3
+	tagWeight  = 2
+	textWeight = 1
+)
+
+/* SearchHit is an item found by SearchItems, with how well it matched the search */
+type SearchHit struct {
+	ItemData constants.ItemDetails
+	Score    float64
+}
+
+/*
+searchIndex maps the terms of a list's items to the items having them, with the weight of the best field having the term,
+and the bigrams of the terms to the terms, to find the ones similar to a word without going through all of them
+*/
+type searchIndex struct {
+	mu sync.Mutex
+	// The store the items were read from
+	store    Store
+	items    map[string]constants.ItemDetails
+	postings map[string]map[string]float64
+	grams    map[string]map[string]bool
+	built    time.Time
+	used     time.Time
+}
+
+/* Longest an index is used before it is read again from the store, to pick up items written by other instances */
+const searchIndexTTL = 10 * time.Minute
+
+/* Most lists with an index kept in memory. The least recently searched is dropped for another */
+const maxSearchIndexes = 100
+
+/*
+searchIndexes are kept by list ID, and updated by the item writes of this process.
+A list being read for an index is in loading, set once an item of it is written meanwhile, as the index could miss it
+*/
+var searchIndexes = struct {
+	sync.Mutex
+	lists   map[string]*searchIndex
+	loading map[string]bool
+}{lists: make(map[string]*searchIndex), loading: make(map[string]bool)}
+
+/*
+SearchItems ranks the list's items by how well their name, address, notes and tags match the text, returning the best limit.
+Words of the text match terms starting with them, and terms a typo or two away. Items matching more words rank higher
+*/
+func SearchItems(store Store, listID, text string, limit int) ([]SearchHit, error) {
+	words := searchTerms(text)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	index, err := loadSearchIndex(store, listID)
+	if err != nil {
+		return nil, err
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	scores := make(map[string]float64)
+	for _, word := range words {
+		for itemID, score := range index.match(word) {
+			scores[itemID] += score
+		}
+	}
+	hits := make([]SearchHit, 0, len(scores))
+	for itemID, score := range scores {
+		hits = append(hits, SearchHit{ItemData: index.items[itemID], Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return strings.ToLower(hits[i].ItemData.Name) < strings.ToLower(hits[j].ItemData.Name)
+	})
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+/* cachedSearchIndex returns the list's index if it is kept for the store and fresh, marking it used */
+func cachedSearchIndex(store Store, listID string) *searchIndex {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	index := searchIndexes.lists[listID]
+	if index == nil || index.store != store {
+		return nil
+	}
+	now := time.Now()
+	if now.Sub(index.built) > searchIndexTTL {
+		delete(searchIndexes.lists, listID)
+		return nil
+	}
+	index.used = now
+	return index
+}
+
+/*
+loadSearchIndex returns the list's index, reading its items from the store if it isn't kept.
+An index read while an item of the list was written isn't kept, and one read alongside another load isn't either
+*/
+func loadSearchIndex(store Store, listID string) (*searchIndex, error) {
+	if index := cachedSearchIndex(store, listID); index != nil {
+		return index, nil
+	}
+	searchIndexes.Lock()
+	_, concurrent := searchIndexes.loading[listID]
+	if !concurrent {
+		searchIndexes.loading[listID] = false
+	}
+	searchIndexes.Unlock()
+
+	items, err := store.GetItems(listID)
+	if err != nil {
+		if !concurrent {
+			searchIndexes.Lock()
+			delete(searchIndexes.loading, listID)
+			searchIndexes.Unlock()
+		}
+		return nil, err
+	}
+	index := &searchIndex{
+		store:    store,
+		items:    make(map[string]constants.ItemDetails),
+		postings: make(map[string]map[string]float64),
+		grams:    make(map[string]map[string]bool),
+	}
+	for _, itemData := range items {
+		index.put(itemData)
+	}
+	index.built = time.Now()
+	index.used = index.built
+
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	written := searchIndexes.loading[listID]
+	if !concurrent {
+		delete(searchIndexes.loading, listID)
+	}
+	// Kept up to date by the writes, unlike this one
+	if kept := searchIndexes.lists[listID]; kept != nil && kept.store == store {
+		kept.used = index.used
+		return kept, nil
+	}
+	if concurrent || written {
+		return index, nil
+	}
+	if _, ok := searchIndexes.lists[listID]; !ok && len(searchIndexes.lists) >= maxSearchIndexes {
+		var oldest string
+		for id, kept := range searchIndexes.lists {
+			if oldest == "" || kept.used.Before(searchIndexes.lists[oldest].used) {
+				oldest = id
+			}
+		}
+		delete(searchIndexes.lists, oldest)
+	}
+	searchIndexes.lists[listID] = index
+	return index, nil
+}
+
+/* writtenSearchIndex returns the list's index if it is kept, after marking a load of the list as missing a write */
+func writtenSearchIndex(store Store, listID string) *searchIndex {
+	searchIndexes.Lock()
+	if _, ok := searchIndexes.loading[listID]; ok {
+		searchIndexes.loading[listID] = true
+	}
+	searchIndexes.Unlock()
+	return cachedSearchIndex(store, listID)
+}
+
+/* indexItems updates the list's index, if kept, with items just stored */
+func indexItems(store Store, listID string, items ...constants.ItemDetails) {
+	if index := writtenSearchIndex(store, listID); index != nil {
+		index.mu.Lock()
+		defer index.mu.Unlock()
+		for _, itemData := range items {
+			index.put(itemData)
+		}
+	}
+}
+
+/* unindexItem drops an item just deleted from the list's index, if kept */
+func unindexItem(store Store, listID, itemID string) {
+	if index := writtenSearchIndex(store, listID); index != nil {
+		index.mu.Lock()
+		defer index.mu.Unlock()
+		index.remove(itemID)
+	}
+}
+
+/* forgetSearchIndex drops the list's index, to be read again from the store by the next search */
+func forgetSearchIndex(listID string) {
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	if _, ok := searchIndexes.loading[listID]; ok {
+		searchIndexes.loading[listID] = true
+	}
+	delete(searchIndexes.lists, listID)
+}
+
+/* put indexes the item, in place of the item with its ID */
+func (index *searchIndex) put(itemData constants.ItemDetails) {
+	index.remove(itemData.ID)
+	for term, weight := range itemTerms(itemData) {
+		if index.postings[term] == nil {
+			index.postings[term] = make(map[string]float64)
+			for _, gram := range termGrams(term) {
+				if index.grams[gram] == nil {
+					index.grams[gram] = make(map[string]bool)
+				}
+				index.grams[gram][term] = true
+			}
+		}
+		index.postings[term][itemData.ID] = weight
+	}
+	index.items[itemData.ID] = itemData
+}
+
+/* remove forgets the item, and the terms no other item has */
+func (index *searchIndex) remove(itemID string) {
+	indexed, ok := index.items[itemID]
+	if !ok {
+		return
+	}
+	for term := range itemTerms(indexed) {
+		delete(index.postings[term], itemID)
+		if len(index.postings[term]) > 0 {
+			continue
+		}
+		delete(index.postings, term)
+		for _, gram := range termGrams(term) {
+			delete(index.grams[gram], term)
+			if len(index.grams[gram]) == 0 {
+				delete(index.grams, gram)
+			}
+		}
+	}
+	delete(index.items, itemID)
+}
+
+/*
+candidates are the terms that can be similar to the word. Each typo changes at most 3 of the word's bigrams,
+so a term it can match shares all but 3 per typo allowed, and at least one as typos are under a quarter of the word
+*/
+func (index *searchIndex) candidates(word string) []string {
+	grams := termGrams(word)
+	if len(grams) < 2 {
+		// A single letter only matches itself
+		if _, ok := index.postings[word]; ok {
+			return []string{word}
+		}
+		return nil
+	}
+	shared := make(map[string]int)
+	for _, gram := range grams {
+		for term := range index.grams[gram] {
+			shared[term]++
+		}
+	}
+	least := len(grams) - 3*maxTypos([]rune(word))
+	terms := make([]string, 0)
+	for term, count := range shared {
+		if count >= least {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+/* match scores the items having terms similar to the word, by their best term */
+func (index *searchIndex) match(word string) map[string]float64 {
+	scores := make(map[string]float64)
+	for _, term := range index.candidates(word) {
+		similarity := termSimilarity(word, term)
+		if similarity == 0 {
+			continue
+		}
+		for itemID, weight := range index.postings[term] {
+			if score := similarity * weight; score > scores[itemID] {
+				scores[itemID] = score
+			}
+		}
+	}
+	return scores
+}
+
+/* termGrams are the distinct pairs of neighbouring letters of the term, with the first marked as such */
+func termGrams(term string) []string {
+	runes := append([]rune{'^'}, []rune(term)...)
+	seen := make(map[string]bool)
+	grams := make([]string, 0, len(runes)-1)
+	for i := 1; i < len(runes); i++ {
+		gram := string(runes[i-1 : i+1])
+		if !seen[gram] {
+			seen[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+/* itemTerms are the terms of the item's fields, with the weight of the best field having each */
+func itemTerms(itemData constants.ItemDetails) map[string]float64 {
+	terms := make(map[string]float64)
+	add := func(text string, weight float64) {
+		for _, term := range searchTerms(text) {
+			if weight > terms[term] {
+				terms[term] = weight
+			}
+		}
+	}
+	add(itemData.Name, nameWeight)
+	for tag := range itemData.Tags {
+		add(tag, tagWeight)
+	}
+	add(itemData.Address, textWeight)
+	add(itemData.Notes, textWeight)
+	return terms
+}
+
+/* searchTerms splits text into lower case words of letters and digits */
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+/*
+termSimilarity is 1 for the same term, less for a term starting with the word or a typo away, and 0 for others.
+Short words must match exactly, or start the term
+*/
+func termSimilarity(word, term string) float64 {
+	if word == term {
+		return 1
+	}
+	w, t := []rune(word), []rune(term)
+	typos := maxTypos(w)
+
+	similarity := 0.0
+	if diff := len(t) - len(w); diff <= typos && -diff <= typos {
+		if d := editDistance(w, t); d <= typos {
+			similarity = 1 - 0.25*float64(d)
+		}
+	}
+	if len(w) >= 2 && len(t) > len(w) {
+		if d := editDistance(w, t[:len(w)]); d <= typos && 0.8-0.25*float64(d) > similarity {
+			similarity = 0.8 - 0.25*float64(d)
+		}
+	}
+	return similarity
+}
+
+/* maxTypos is how many typos a word may have: one per 4 letters, up to 2 */
+func maxTypos(word []rune) int {
+	typos := len(word) / 4
+	if typos > 2 {
+		typos = 2
+	}
+	return typos
+}
+
+/* editDistance counts the insertions, deletions, substitutions and swaps of neighbours turning a into b */
+func editDistance(a, b []rune) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = minInt(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				rows[i][j] = minInt(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(a)][len(b)]
+}
+
+func minInt(values ...int) int {
+	least := values[0]
+	for _, value := range values[1:] {
+		if value < least {
+			least = value
+		}
+	}
+	return least
+}
@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+func TestSearchItems(t *testing.T) {
+	SetMessenger(NewRecordingMessenger())
+	store := NewMemoryStore()
+	update := testUpdate()
+	list, _ := GetList(store, update)
+	chatID := list.ID()
+	for _, itemData := range []constants.ItemDetails{
+		{ID: "ramen1", Name: "Ramen Keisuke", Address: "1 Tras St", Tags: map[string]bool{"dinner": true}},
+		{ID: "udon1", Name: "Udon Shop", Notes: "Better than the ramen nearby", Tags: map[string]bool{"lunch": true}},
+		{ID: "cafe1", Name: "Tras Cafe", Address: "9 Tras St", Tags: map[string]bool{"coffee": true}},
+	} {
+		store.AddItem(chatID, itemData)
+	}
+
+	search := func(text string) []string {
+		t.Helper()
+		hits, err := SearchItems(store, chatID, text, SearchLimit)
+		if err != nil {
+			t.Fatalf("SearchItems(%q): %v", text, err)
+		}
+		names := make([]string, len(hits))
+		for i, hit := range hits {
+			names[i] = hit.ItemData.Name
+		}
+		return names
+	}
+	tests := []struct {
+		text string
+		// Names of the hits, best first
+		names []string
+	}{
+		// A match in the name ranks above one in the notes
+		{text: "ramen", names: []string{"Ramen Keisuke", "Udon Shop"}},
+		{text: "RAMNE", names: []string{"Ramen Keisuke", "Udon Shop"}},
+		{text: "keisk", names: []string{"Ramen Keisuke"}},
+		{text: "cofee", names: []string{"Tras Cafe"}},
+		// Matching more words ranks higher
+		{text: "tras ramen", names: []string{"Ramen Keisuke", "Tras Cafe", "Udon Shop"}},
+		// Short words aren't taken as typos
+		{text: "dun"},
+		{text: "sushi"},
+		{text: " ? "},
+	}
+	for _, test := range tests {
+		names := search(test.text)
+		if len(names) != len(test.names) {
+			t.Errorf("search %q = %v, want %v", test.text, names, test.names)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.names[i] {
+				t.Errorf("search %q = %v, want %v", test.text, names, test.names)
+				break
+			}
+		}
+	}
+
+	// The index follows the items written through the bot, without reading them again
+	index := cachedSearchIndex(store, chatID)
+	if err := DeleteItem(store, update, "ramen1"); err != nil {
+		t.Fatalf("DeleteItem: %v", err)
+	}
+	if err := AddItem(store, constants.ItemDetails{ID: "udon1", Name: "Udon Shop", Tags: map[string]bool{"lunch": true}}, list); err != nil {
+		t.Fatalf("AddItem: %v", err)
+	}
+	if err := AddItems(store, []constants.ItemDetails{{ID: "soba1", Name: "Soba House"}}, list); err != nil {
+		t.Fatalf("AddItems: %v", err)
+	}
+	if cachedSearchIndex(store, chatID) != index {
+		t.Fatalf("index read again after writes")
+	}
+	if names := search("ramen"); len(names) != 0 {
+		t.Errorf("search ramen after changes = %v, want none", names)
+	}
+	if names := search("lnch"); len(names) != 1 || names[0] != "Udon Shop" {
+		t.Errorf("search lnch after changes = %v, want [Udon Shop]", names)
+	}
+	if names := search("sobah"); len(names) != 1 || names[0] != "Soba House" {
+		t.Errorf("search sobah after changes = %v, want [Soba House]", names)
+	}
+	// Terms of deleted items go with them
+	if _, ok := index.postings["keisuke"]; ok {
+		t.Errorf("term of deleted item kept")
+	}
+	if _, ok := index.grams["^k"]; ok {
+		t.Errorf("bigram of deleted item kept")
+	}
+
+	// Items written by other instances are read once the index is old
+	store.AddItem(chatID, constants.ItemDetails{ID: "pho1", Name: "Pho Stall"})
+	if names := search("pho"); len(names) != 0 {
+		t.Errorf("search pho before the index is old = %v", names)
+	}
+	index.built = time.Now().Add(-searchIndexTTL - time.Minute)
+	if names := search("pho"); len(names) != 1 {
+		t.Errorf("search pho once the index is old = %v", names)
+	}
+}
+
+func TestSearchCandidates(t *testing.T) {
+	index := &searchIndex{
+		items:    make(map[string]constants.ItemDetails),
+		postings: make(map[string]map[string]float64),
+		grams:    make(map[string]map[string]bool),
+	}
+	index.put(constants.ItemDetails{ID: "1", Name: "Ramen Restaurant", Notes: "noodle soup near the river, a rare treat"})
+	index.put(constants.ItemDetails{ID: "2", Name: "R", Tags: map[string]bool{"mexican": true}})
+
+	tests := []struct {
+		word string
+		// Terms similar to the word, which must be among the candidates
+		similar []string
+		// Candidates at most, of the 12 terms
+		most int
+	}{
+		{word: "ramen", similar: []string{"ramen"}, most: 3},
+		{word: "rmaen", similar: []string{"ramen"}, most: 3},
+		{word: "restuarant", similar: []string{"restaurant"}, most: 2},
+		{word: "ra", similar: []string{"ramen", "rare"}, most: 3},
+		{word: "r", similar: []string{"r"}, most: 1},
+		{word: "xyz", most: 0},
+	}
+	for _, test := range tests {
+		candidates := index.candidates(test.word)
+		if len(candidates) > test.most {
+			t.Errorf("candidates(%q) = %v, want at most %d", test.word, candidates, test.most)
+		}
+		sort.Strings(candidates)
+		for _, term := range test.similar {
+			if i := sort.SearchStrings(candidates, term); i == len(candidates) || candidates[i] != term {
+				t.Errorf("candidates(%q) = %v, missing %q", test.word, candidates, term)
+			}
+		}
+	}
+	// No term a word is similar to is left out
+	for term := range index.postings {
+		for _, word := range []string{"ramen", "rmaen", "ramn", "restrant", "noodel", "soupp", "rivr", "mexcian", "ra", "r"} {
+			if termSimilarity(word, term) == 0 {
+				continue
+			}
+			found := false
+			for _, candidate := range index.candidates(word) {
+				found = found || candidate == term
+			}
+			if !found {
+				t.Errorf("candidates(%q) miss similar term %q", word, term)
+			}
+		}
+	}
+}
+
+/* racingStore stores an item of the list right after a read of its items, as another update could */
+type racingStore struct {
+	Store
+	list  ItemList
+	write *constants.ItemDetails
+}
+
+func (s *racingStore) GetItems(chatID string) (map[string]constants.ItemDetails, error) {
+	items, err := s.Store.GetItems(chatID)
+	if s.write != nil {
+		itemData := *s.write
+		s.write = nil
+		AddItem(s, itemData, s.list)
+	}
+	return items, err
+}
+
+func TestSearchIndexWrittenWhileRead(t *testing.T) {
+	SetMessenger(NewRecordingMessenger())
+	list := ItemList{ChatID: -700}
+	store := &racingStore{Store: NewMemoryStore(), list: list, write: &constants.ItemDetails{ID: "ramen1", Name: "Ramen"}}
+
+	// Read before the item was stored, so it isn't found
+	if hits, err := SearchItems(store, list.ID(), "ramen", SearchLimit); err != nil || len(hits) != 0 {
+		t.Fatalf("first search = %v, %v", hits, err)
+	}
+	// The index missing it wasn't kept
+	hits, err := SearchItems(store, list.ID(), "ramen", SearchLimit)
+	if err != nil || len(hits) != 1 || hits[0].ItemData.Name != "Ramen" {
+		t.Errorf("search after the write = %v, %v, want Ramen", hits, err)
+	}
+}
+
+func TestSearchIndexesBounded(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 0; i < maxSearchIndexes+10; i++ {
+		if _, err := SearchItems(store, fmt.Sprintf("bounded%d", i), "ramen", SearchLimit); err != nil {
+			t.Fatalf("SearchItems: %v", err)
+		}
+	}
+	searchIndexes.Lock()
+	kept := len(searchIndexes.lists)
+	_, newest := searchIndexes.lists[fmt.Sprintf("bounded%d", maxSearchIndexes+9)]
+	searchIndexes.Unlock()
+	if kept > maxSearchIndexes || !newest {
+		t.Errorf("%d indexes kept, newest kept %v", kept, newest)
+	}
+}
+
+func TestTermSimilarity(t *testing.T) {
+	tests := []struct {
+		word, term string
+		similar    bool
+	}{
+		{"ramen", "ramen", true},
+		{"ram", "ramen", true},
+		{"ramn", "ramen", true},
+		{"rmaen", "ramen", true},
+		{"restuarant", "restaurant", true},
+		{"restrant", "restaurant", true},
+		{"r", "ramen", false},
+		{"rem", "ramen", false},
+		{"ramen", "ram", false},
+		{"noodle", "ramen", false},
+	}
+	for _, test := range tests {
+		if similar := termSimilarity(test.word, test.term) > 0; similar != test.similar {
+			t.Errorf("termSimilarity(%q, %q) > 0 = %v, want %v", test.word, test.term, similar, test.similar)
+		}
+	}
+}
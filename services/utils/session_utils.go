@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const defaultSessionTimeout = 30 * time.Minute
+
+/* SESSION_TIMEOUT is how long a session can be inactive before it is reset to Idle, e.g. "30m". 0 disables */
+var SESSION_TIMEOUT = parseSessionTimeout(os.Getenv("SESSION_TIMEOUT"))
+
+func parseSessionTimeout(value string) time.Duration {
+	if value == "" {
+		return defaultSessionTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		log.Printf("Invalid SESSION_TIMEOUT %q, using %v", value, defaultSessionTimeout)
+		return defaultSessionTimeout
+	}
+	return timeout
+}
+
+/* ########## Activity ##########*/
+func TouchSession(store Store, update *tgbotapi.Update) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.TouchSession(sessionID, time.Now())
+}
+
+/*
+ExpireSession clears the session of the update if it has been inactive for longer than timeout.
+Returns the state the session was in when it expired, or Idle if it didn't.
+*/
+func ExpireSession(store Store, update *tgbotapi.Update, timeout time.Duration) (constants.State, error) {
+	if timeout <= 0 {
+		return constants.Idle, nil
+	}
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return constants.Idle, err
+	}
+	lastActive, err := store.GetSessionActivity(sessionID)
+	if err != nil || lastActive.IsZero() || time.Since(lastActive) <= timeout {
+		return constants.Idle, err
+	}
+
+	state, err := store.GetUserState(sessionID)
+	if err != nil {
+		return constants.Idle, err
+	}
+	return state, store.ClearSession(sessionID)
+}
+
+/* ########## Sweeper ##########*/
+/* ExpiredNotifier tells the user of a session that the flow it was in, state, was cancelled */
+type ExpiredNotifier func(sessionID string, state constants.State)
+
+/*
+SweepSessions clears sessions inactive since before, telling users of those in a flow that it was cancelled.
+Their next message then finds a cleared session, so this is the only notice they get
+*/
+func SweepSessions(store Store, before time.Time, notify ExpiredNotifier) (int, error) {
+	sessionIDs, err := store.StaleSessions(before)
+	if err != nil {
+		return 0, err
+	}
+	for i, sessionID := range sessionIDs {
+		state, err := store.GetUserState(sessionID)
+		if err != nil {
+			return i, err
+		}
+		if err := store.ClearSession(sessionID); err != nil {
+			return i, err
+		}
+		if state != constants.Idle && notify != nil {
+			notify(sessionID, state)
+		}
+	}
+	return len(sessionIDs), nil
+}
+
+/* RunSessionSweeper sweeps sessions inactive for longer than timeout, every interval. Blocks until stop is closed (never if nil) */
+func RunSessionSweeper(store Store, timeout, interval time.Duration, notify ExpiredNotifier, stop <-chan struct{}) {
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sessions, err := SweepSessions(store, time.Now().Add(-timeout), notify)
+			if err != nil {
+				log.Printf("error SweepSessions: %+v", err)
+				continue
+			}
+			if sessions > 0 {
+				log.Printf("Swept %d session(s)", sessions)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
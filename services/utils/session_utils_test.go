@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+)
+
+func TestSweepSessions(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.SetUserState("stale", constants.AddNewSetAddress)
+	store.SetTempItem("stale", constants.ItemDetails{Name: "Ramen"})
+	store.TouchSession("stale", now.Add(-time.Hour))
+	store.TouchSession("idle", now.Add(-time.Hour))
+	store.SetUserState("active", constants.QuerySelectType)
+	store.TouchSession("active", now)
+
+	// Only sessions in a flow are told it was cancelled
+	notified := make(map[string]constants.State)
+	notify := func(sessionID string, state constants.State) {
+		if state, _ := store.GetUserState(sessionID); state != constants.Idle {
+			t.Errorf("%s notified before it was cleared", sessionID)
+		}
+		notified[sessionID] = state
+	}
+	sessions, err := SweepSessions(store, now.Add(-time.Minute), notify)
+	if err != nil {
+		t.Fatalf("SweepSessions: %v", err)
+	}
+	if sessions != 2 {
+		t.Errorf("swept %d session(s), want 2", sessions)
+	}
+	if want := map[string]constants.State{"stale": constants.AddNewSetAddress}; !reflect.DeepEqual(notified, want) {
+		t.Errorf("notified %v, want %v", notified, want)
+	}
+	if state, _ := store.GetUserState("stale"); state != constants.Idle {
+		t.Errorf("stale state = %d", state)
+	}
+	if itemData, _ := store.GetTempItem("stale"); itemData.Name != "" {
+		t.Errorf("stale temp item = %+v", itemData)
+	}
+	if state, _ := store.GetUserState("active"); state != constants.QuerySelectType {
+		t.Errorf("active state = %d", state)
+	}
+}
+
+func TestParseSessionID(t *testing.T) {
+	for _, test := range []struct {
+		userID int
+		chatID int64
+	}{{100, 100}, {100, -200}, {7, -1001234567890}} {
+		userID, chatID, err := ParseSessionID(SessionID(test.userID, test.chatID))
+		if err != nil || userID != test.userID || chatID != test.chatID {
+			t.Errorf("ParseSessionID(SessionID(%d, %d)) = %d, %d, %v", test.userID, test.chatID, userID, chatID, err)
+		}
+	}
+	for _, sessionID := range []string{"", "100", "a_-200", "100_b"} {
+		if _, _, err := ParseSessionID(sessionID); err == nil {
+			t.Errorf("ParseSessionID(%q) succeeded", sessionID)
+		}
+	}
+}
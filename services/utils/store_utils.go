@@ -0,0 +1,717 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// Store is the storage backend of the bot.
+// Chats are keyed by their telegram IDs (as strings), items by their generated ID.
+// Items, item names and tags are kept per list, keyed by ItemList.ID: the chat ID for a chat's main list.
+// Conversation data (state, targets, temp item, query) is kept per session: one user in one chat,
+// keyed by SessionID. A user can run separate flows in each of their chats.
+// Reading a value that was never set returns its zero value instead of an error.
+type Store interface {
+	/* Session state */
+	SetUserState(sessionID string, state constants.State) error
+	GetUserState(sessionID string) (constants.State, error)
+
+	/* Session activity */
+	TouchSession(sessionID string, at time.Time) error
+	// GetSessionActivity returns the zero time for sessions without recorded activity
+	GetSessionActivity(sessionID string) (time.Time, error)
+	// ClearSession resets a session to Idle, dropping its temp item, query, import, pending command and activity. Targets are kept
+	ClearSession(sessionID string) error
+	// StaleSessions lists the sessions last active before the given time
+	StaleSessions(before time.Time) ([]string, error)
+
+	/* User chats (the chats each user has used the bot in, for inline queries) */
+	// AddUserChat records the chat of a user with its title, which is empty for private chats
+	AddUserChat(userID, chatID, title string) error
+	// GetUserChats returns the titles of the user's chats by chat ID
+	GetUserChats(userID string) (map[string]string, error)
+
+	/* Lists (named lists of a chat, besides its main list) */
+	AddList(chatID, name string) error
+	// GetLists returns the names of the chat's named lists
+	GetLists(chatID string) (map[string]bool, error)
+	// The list the session's item commands use, empty if none was picked. Kept by ClearSession
+	SetActiveList(sessionID, name string) error
+	GetActiveList(sessionID string) (string, error)
+	// A command waiting for a list to be picked, as it was sent
+	SetPendingCommand(sessionID string, command constants.PendingCommand) error
+	GetPendingCommand(sessionID string) (constants.PendingCommand, error)
+
+	/* Targets */
+	SetChatTarget(sessionID string, chatID int64) error
+	GetChatTarget(sessionID string) (int64, error)
+	SetMessageTarget(sessionID string, messageID int) error
+	GetMessageTarget(sessionID string) (int, error)
+	SetItemTarget(sessionID, itemID string) error
+	GetItemTarget(sessionID string) (string, error)
+	// Typed filter of the paged keyboard shown in the session
+	SetKeyboardFilter(sessionID, filter string) error
+	GetKeyboardFilter(sessionID string) (string, error)
+	// Buttons of the last inline keyboard sent in the session
+	SetKeyboard(sessionID string, keyboard constants.Keyboard) error
+	GetKeyboard(sessionID string) (constants.Keyboard, error)
+
+	/* Temp item (item being added or edited) */
+	SetTempItem(sessionID string, itemData constants.ItemDetails) error
+	GetTempItem(sessionID string) (constants.ItemDetails, error)
+	SetTempItemName(sessionID, name string) error
+	SetTempItemAddress(sessionID, address string) error
+	// Nil removes the location
+	SetTempItemLocation(sessionID string, location *constants.Location) error
+	// Why the address of the temp item wasn't placed on a map, empty if it was. Cleared by SetTempItem
+	SetTempItemGeocodeError(sessionID, reason string) error
+	GetTempItemGeocodeError(sessionID string) (string, error)
+	SetTempItemNotes(sessionID, notes string) error
+	SetTempItemURL(sessionID, url string) error
+	AddTempItemImage(sessionID, imageID string) error
+	AddTempItemTag(sessionID, tag string) error
+	GetTempItemTags(sessionID string) (map[string]bool, error)
+	DeleteTempItemTag(sessionID, tag string) error
+
+	/* Import (items parsed for /import, waiting for confirmation) */
+	SetImportItems(sessionID string, items []constants.ItemDetails) error
+	GetImportItems(sessionID string) ([]constants.ItemDetails, error)
+
+	/* Items */
+	// AddItem and DeleteItem write the item together with its tags and itemNames
+	// entries in one atomic update: either every path changes or none do.
+	// AddItems writes all of its items in a single such update.
+	AddItem(chatID string, itemData constants.ItemDetails) error
+	AddItems(chatID string, items []constants.ItemDetails) error
+	GetItem(chatID, itemID string) (constants.ItemDetails, error)
+	GetItems(chatID string) (map[string]constants.ItemDetails, error)
+	DeleteItem(chatID, itemID string) error
+
+	/* Item names (item ID -> name) */
+	GetItemNames(chatID string) (map[string]string, error)
+
+	/* Tags */
+	// Every tag counts the items using it, kept in step by the item writes above.
+	// GetTags only returns tags used by at least one item.
+	GetTags(chatID string) (map[string]bool, error)
+	// RebuildIndex recomputes the tags and itemNames of a chat from its items
+	RebuildIndex(chatID string) error
+
+	/* Query */
+	ResetQuery(sessionID string) error
+	SetQueryItem(sessionID, itemID string) error
+	GetQueryItem(sessionID string) (string, error)
+	SetQueryNum(sessionID string, num int) error
+	GetQueryNum(sessionID string) (int, error)
+	AddQueryTag(sessionID, tag string) error
+	GetQueryTags(sessionID string) (map[string]bool, error)
+	ExcludeQueryTag(sessionID, tag string) error
+	GetQueryExcludedTags(sessionID string) (map[string]bool, error)
+	SetQueryMatchAll(sessionID string, matchAll bool) error
+	GetQueryMatchAll(sessionID string) (bool, error)
+
+	/* Updates delivered by the webhook, so redeliveries are skipped */
+	// Records the update as processed at the time, reporting false if it already was
+	MarkUpdate(updateID int, at time.Time) (bool, error)
+	// Forgets the update, so its redelivery is processed
+	UnmarkUpdate(updateID int) error
+	// Forgets updates processed before, returning how many
+	SweepUpdates(before time.Time) (int, error)
+
+	/* Feedback */
+	AddFeedback(feedback constants.FeedbackDetails) error
+}
+
+/* InitStore opens the storage backend selected by the STORE environment variable */
+func InitStore() Store {
+	switch os.Getenv("STORE") {
+	case "bolt":
+		return InitBolt()
+	case "memory":
+		log.Println("Using in-memory store. Data is lost on restart")
+		return NewMemoryStore()
+	default:
+		return InitFirebase()
+	}
+}
+
+/* ########## User State ##########*/
+func SetUserState(store Store, update *tgbotapi.Update, state constants.State) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	if err := store.SetUserState(sessionID, state); err != nil {
+		log.Println("Error setting state")
+		return err
+	}
+	return nil
+}
+
+func GetUserState(store Store, update *tgbotapi.Update) (constants.State, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return 0, err
+	}
+	return store.GetUserState(sessionID)
+}
+
+/* NewItemID generates a unique, time ordered ID for a new item */
+func NewItemID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(rand.Int63n(36*36*36*36), 36)
+}
+
+/* ########## User chats ##########*/
+/* RecordUserChat remembers the chat of a message for its sender's inline queries */
+func RecordUserChat(store Store, update *tgbotapi.Update) error {
+	if update.Message == nil || update.Message.Chat == nil {
+		return nil
+	}
+	chatID, userID, err := GetChatUserIDString(update)
+	if err != nil {
+		return err
+	}
+	return store.AddUserChat(userID, chatID, update.Message.Chat.Title)
+}
+
+/* ########## Name (Init item) ##########*/
+func InitItem(store Store, update *tgbotapi.Update, name string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+
+	/* Set temp under user */
+	return store.SetTempItem(sessionID, constants.ItemDetails{
+		Name: name,
+	})
+}
+
+/* Start an item in the user's private chat session, for flows redirected from a group */
+func InitPrivateItem(store Store, update *tgbotapi.Update, name string) error {
+	_, userID, err := GetChatUserID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetTempItem(SessionID(userID, int64(userID)), constants.ItemDetails{
+		Name: name,
+	})
+}
+
+func SetTempItemName(store Store, update *tgbotapi.Update) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+
+	name, _, err := GetMessage(update)
+	if err != nil {
+		return err
+	}
+	return store.SetTempItemName(sessionID, name)
+}
+
+/* ########## Address ##########*/
+func SetTempItemAddress(store Store, update *tgbotapi.Update) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+
+	address, _, err := GetMessage(update)
+	if err != nil {
+		return err
+	}
+	if err := store.SetTempItemAddress(sessionID, address); err != nil {
+		return err
+	}
+	geocodeTempItem(store, sessionID, address)
+	return nil
+}
+
+/* SetTempItemAddressTo stores an address not taken from the message, like a venue's */
+func SetTempItemAddressTo(store Store, update *tgbotapi.Update, address string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetTempItemAddress(sessionID, address)
+}
+
+/* ########## Location ##########*/
+/* SetTempItemLocation stores the location or venue sent, returning it with the venue's address (empty for a location) */
+func SetTempItemLocation(store Store, update *tgbotapi.Update) (constants.Location, string, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return constants.Location{}, "", err
+	}
+	location, address, err := GetLocation(update)
+	if err != nil {
+		return location, address, err
+	}
+	if err := store.SetTempItemLocation(sessionID, &location); err != nil {
+		return location, address, err
+	}
+	// A sent location stands in for the one the address failed to give
+	return location, address, store.SetTempItemGeocodeError(sessionID, "")
+}
+
+/* GetTempItemGeocodeError returns why the item's address wasn't placed on a map, or "" */
+func GetTempItemGeocodeError(store Store, update *tgbotapi.Update) (string, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return "", err
+	}
+	return store.GetTempItemGeocodeError(sessionID)
+}
+
+/* ########## Notes ##########*/
+func SetTempItemNotes(store Store, update *tgbotapi.Update) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+
+	notes, _, err := GetMessage(update)
+	if err != nil {
+		return err
+	}
+	return store.SetTempItemNotes(sessionID, notes)
+}
+
+/* ########## URL ##########*/
+func SetTempItemURL(store Store, update *tgbotapi.Update) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+
+	url, _, err := GetMessage(update)
+	if err != nil {
+		return err
+	}
+	return store.SetTempItemURL(sessionID, url)
+}
+
+/* ########## Images ##########*/
+func AddTempItemImage(store Store, update *tgbotapi.Update) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+
+	imageIDs, err := GetPhotoIDs(update)
+	if err != nil {
+		return err
+	}
+	imageID := imageIDs[len(imageIDs)-1] // Take largest file size
+	return store.AddTempItemImage(sessionID, imageID)
+}
+
+/* ########## Tags ##########*/
+func AddTempItemTag(store Store, update *tgbotapi.Update, tag string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.AddTempItemTag(sessionID, tag)
+}
+
+func GetTempItemTags(store Store, update *tgbotapi.Update) (map[string]bool, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetTempItemTags(sessionID)
+}
+
+func DeleteTempItemTag(store Store, update *tgbotapi.Update, tag string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.DeleteTempItemTag(sessionID, tag)
+}
+
+/* get list of items matching the filter */
+func GetItems(store Store, update *tgbotapi.Update, filter constants.TagFilter) ([]constants.ItemDetails, error) {
+	list, err := GetList(store, update)
+	if err != nil {
+		return []constants.ItemDetails{}, err
+	}
+
+	/* get items */
+	items, err := store.GetItems(list.ID())
+	if err != nil {
+		return []constants.ItemDetails{}, err
+	}
+	itemsList := make([]constants.ItemDetails, 0, len(items))
+	for _, itemDetails := range items {
+		if MatchTags(filter, itemDetails.Tags) {
+			itemsList = append(itemsList, itemDetails)
+		}
+	}
+
+	/* Shuffle for random */
+	rand.Shuffle(len(itemsList), func(i, j int) { itemsList[i], itemsList[j] = itemsList[j], itemsList[i] })
+
+	return itemsList, nil
+}
+
+/* ########## Add Item ##########*/
+func SetChatTarget(store Store, update *tgbotapi.Update, chatID int64) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetChatTarget(sessionID, chatID)
+}
+
+/* Set the chat target of the user's private chat session, for flows redirected from a group */
+func SetPrivateChatTarget(store Store, update *tgbotapi.Update, chatID int64) error {
+	_, userID, err := GetChatUserID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetChatTarget(SessionID(userID, int64(userID)), chatID)
+}
+
+func GetChatTarget(store Store, update *tgbotapi.Update) (int64, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return 0, err
+	}
+	return store.GetChatTarget(sessionID)
+}
+
+func GetTempItem(store Store, update *tgbotapi.Update) (constants.ItemDetails, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return constants.ItemDetails{}, err
+	}
+	return store.GetTempItem(sessionID)
+}
+
+func GetItem(store Store, itemID string, chatID string) (constants.ItemDetails, error) {
+	return store.GetItem(chatID, itemID)
+}
+
+/*
+AddItem adds a new item to the list, or replaces the item with the same ID, placing it at its address if it has no location.
+The chat is only notified once stored
+*/
+func AddItem(store Store, itemData constants.ItemDetails, list ItemList) error {
+	if itemData.ID == "" {
+		itemData.ID = NewItemID()
+	}
+	geocodeItem(&itemData)
+	if err := store.AddItem(list.ID(), itemData); err != nil {
+		return err
+	}
+	indexItems(store, list.ID(), itemData)
+
+	err := SendMessageTargetChat(fmt.Sprintf("%s has been added/edited%s", itemData.Name, inList(list)), list.ChatID, false)
+	if err != nil {
+		log.Printf("error SendMessageTargetChat: %+v", err)
+	}
+	return nil
+}
+
+/*
+AddItems adds new items to the list in one batch, announcing them to the chat once stored.
+They aren't placed at their addresses, as looking up hundreds would hold up the chat and exceed the service's rate
+*/
+func AddItems(store Store, items []constants.ItemDetails, list ItemList) error {
+	for i := range items {
+		if items[i].ID == "" {
+			items[i].ID = NewItemID()
+		}
+	}
+	if err := store.AddItems(list.ID(), items); err != nil {
+		return err
+	}
+	indexItems(store, list.ID(), items...)
+
+	err := SendMessageTargetChat(fmt.Sprintf("%d item(s) have been imported%s", len(items), inList(list)), list.ChatID, false)
+	if err != nil {
+		log.Printf("error SendMessageTargetChat: %+v", err)
+	}
+	return nil
+}
+
+func AddItemFromTemp(store Store, update *tgbotapi.Update, list ItemList) (string, error) {
+	// get from user details
+	itemData, err := GetTempItem(store, update)
+	if err != nil {
+		return "", err
+	}
+	// Add data to item
+	if err := AddItem(store, itemData, list); err != nil {
+		return "", err
+	}
+	return itemData.Name, nil
+}
+
+/* ########## Import ##########*/
+func SetImportItems(store Store, update *tgbotapi.Update, items []constants.ItemDetails) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetImportItems(sessionID, items)
+}
+
+func GetImportItems(store Store, update *tgbotapi.Update) ([]constants.ItemDetails, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetImportItems(sessionID)
+}
+
+/* ########## Delete Item ##########*/
+func SetMessageTarget(store Store, update *tgbotapi.Update, messageID int) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetMessageTarget(sessionID, messageID)
+}
+
+func GetMessageTarget(store Store, update *tgbotapi.Update) (int, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return 0, err
+	}
+	return store.GetMessageTarget(sessionID)
+}
+
+func GetItemNames(store Store, chatID string) (map[string]string, error) {
+	return store.GetItemNames(chatID)
+}
+
+/* Read tags */
+func GetTags(store Store, chatID string) (map[string]bool, error) {
+	return store.GetTags(chatID)
+}
+
+/* Rebuild tags and item names of the chat from its items */
+func RebuildIndex(store Store, update *tgbotapi.Update) error {
+	list, err := GetList(store, update)
+	if err != nil {
+		return err
+	}
+	// Searches read the items again too
+	forgetSearchIndex(list.ID())
+	return store.RebuildIndex(list.ID())
+}
+
+/* tagDeltas returns how the count of each tag changes when an item's tags go from oldTags to newTags */
+func tagDeltas(oldTags, newTags map[string]bool) map[string]int {
+	deltas := make(map[string]int)
+	for tag := range oldTags {
+		if !newTags[tag] {
+			deltas[tag]--
+		}
+	}
+	for tag := range newTags {
+		if !oldTags[tag] {
+			deltas[tag]++
+		}
+	}
+	return deltas
+}
+
+/* countTags counts the items using each tag */
+func countTags(items map[string]constants.ItemDetails) map[string]int {
+	counts := make(map[string]int)
+	for _, itemData := range items {
+		for tag := range itemData.Tags {
+			counts[tag]++
+		}
+	}
+	return counts
+}
+
+/* ########## Query ##########*/
+func ResetQuery(store Store, update *tgbotapi.Update) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.ResetQuery(sessionID)
+}
+
+func SetQueryItem(store Store, update *tgbotapi.Update, itemID string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetQueryItem(sessionID, itemID)
+}
+
+func GetQueryItem(store Store, update *tgbotapi.Update) (string, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return "", err
+	}
+	return store.GetQueryItem(sessionID)
+}
+
+func SetQueryNum(store Store, update *tgbotapi.Update, num int) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetQueryNum(sessionID, num)
+}
+
+func GetQueryNum(store Store, update *tgbotapi.Update) (int, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return 0, err
+	}
+	return store.GetQueryNum(sessionID)
+}
+
+// message should contain tag
+func AddQueryTag(store Store, update *tgbotapi.Update, tag string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.AddQueryTag(sessionID, tag)
+}
+
+func GetQueryTags(store Store, update *tgbotapi.Update) (map[string]bool, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return map[string]bool{}, err
+	}
+	return store.GetQueryTags(sessionID)
+}
+
+func ExcludeQueryTag(store Store, update *tgbotapi.Update, tag string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.ExcludeQueryTag(sessionID, tag)
+}
+
+func SetQueryMatchAll(store Store, update *tgbotapi.Update, matchAll bool) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetQueryMatchAll(sessionID, matchAll)
+}
+
+/* GetQueryFilter returns the tags selected and excluded for the query, and whether to match all of the selected */
+func GetQueryFilter(store Store, update *tgbotapi.Update) (constants.TagFilter, error) {
+	var filter constants.TagFilter
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return filter, err
+	}
+	if filter.Tags, err = store.GetQueryTags(sessionID); err != nil {
+		return filter, err
+	}
+	if filter.Excluded, err = store.GetQueryExcludedTags(sessionID); err != nil {
+		return filter, err
+	}
+	filter.MatchAll, err = store.GetQueryMatchAll(sessionID)
+	return filter, err
+}
+
+/* ########## Delete Item ##########*/
+func SetItemTarget(store Store, update *tgbotapi.Update, itemID string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetItemTarget(sessionID, itemID)
+}
+
+func GetItemTarget(store Store, update *tgbotapi.Update) (string, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return "", err
+	}
+	return store.GetItemTarget(sessionID)
+}
+
+func SetKeyboardFilter(store Store, update *tgbotapi.Update, filter string) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetKeyboardFilter(sessionID, filter)
+}
+
+func GetKeyboardFilter(store Store, update *tgbotapi.Update) (string, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return "", err
+	}
+	return store.GetKeyboardFilter(sessionID)
+}
+
+func DeleteItem(store Store, update *tgbotapi.Update, itemID string) error {
+	list, err := GetList(store, update)
+	if err != nil {
+		return err
+	}
+	if err := store.DeleteItem(list.ID(), itemID); err != nil {
+		return err
+	}
+	unindexItem(store, list.ID(), itemID)
+	return nil
+}
+
+/* ########## Edit Item ##########*/
+func AddItemToTemp(store Store, update *tgbotapi.Update, itemData constants.ItemDetails) error {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return err
+	}
+	return store.SetTempItem(sessionID, itemData)
+}
+
+func CopyItemToTempItem(store Store, update *tgbotapi.Update, itemID string, chatID string) error {
+	itemData, err := GetItem(store, itemID, chatID)
+	if err != nil {
+		return err
+	}
+	if err := AddItemToTemp(store, update, itemData); err != nil {
+		return err
+	}
+	return nil
+}
+
+/* ########## Feedback ##########*/
+func AddFeedback(store Store, update *tgbotapi.Update) {
+	if update.Message == nil {
+		log.Printf("Message nil")
+		return
+	}
+
+	user := update.Message.From
+	feedback := constants.FeedbackDetails{
+		Date:     time.Now().Format("01-02-2006"),
+		Username: user.UserName,
+		UserID:   user.ID,
+		ChatID:   update.Message.Chat.ID,
+		Feedback: update.Message.Text,
+	}
+	if err := store.AddFeedback(feedback); err != nil {
+		log.Printf("error push feedback: %+v", err)
+	}
+}
@@ -1,10 +1,14 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,18 +21,21 @@ var (
 	TELEGRAM_BOT_TOKEN = os.Getenv("TELEGRAM_BOT_TOKEN")
 	FEEDBACK_CHATID    = os.Getenv("FEEDBACK_CHAT")
 	baseURL            = "https://togolist-bot.herokuapp.com/"
-	bot                *tgbotapi.BotAPI
+
+	// Resolved from getMe by InitTelegram
+	BOT_USERNAME = "toGoListBot"
 )
 
 /* Init */
 func InitTelegram() {
-	var err error
-
 	// Init bot
-	bot, err = tgbotapi.NewBotAPI(TELEGRAM_BOT_TOKEN)
+	telegram, err := NewTelegramMessenger(TELEGRAM_BOT_TOKEN)
 	if err != nil {
 		log.Println(err)
+		return
 	}
+	SetMessenger(telegram)
+	BOT_USERNAME = telegram.Username()
 
 	// Set webhook
 	// _, err = bot.SetWebhook(tgbotapi.NewWebhook(baseURL + bot.Token))
@@ -40,12 +47,17 @@ func InitTelegram() {
 }
 
 /* Redirect */
-func RedirectToBotChat(update *tgbotapi.Update, text, urltext, url string) {
+/* BotLink links to the bot's chat, sending "/start <start>" when opened */
+func BotLink(start string) string {
+	return "https://t.me/" + BOT_USERNAME + "?start=" + start
+}
+
+func RedirectToBotChat(update *tgbotapi.Update, text, urltext, url string) *tgbotapi.Message {
 	redirectButton := tgbotapi.NewInlineKeyboardButtonURL(urltext, url)
 	row := tgbotapi.NewInlineKeyboardRow(redirectButton)
 
 	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(row)
-	SendInlineKeyboard(update, text, inlineKeyboard, false)
+	return SendInlineKeyboard(update, text, inlineKeyboard, false)
 }
 
 // func RedirectToChat(update *tgbotapi.Update, text string) {
@@ -74,15 +86,6 @@ func LogCallbackQuery(update *tgbotapi.Update) {
 	}
 }
 
-/* Deleting */
-func DeleteMessage(chatID int64, messageID int) error {
-	deleteConfig := tgbotapi.NewDeleteMessage(chatID, messageID)
-	if _, err := bot.DeleteMessage(deleteConfig); err != nil {
-		return err
-	}
-	return nil
-}
-
 /* Sending */
 func SendMessage(update *tgbotapi.Update, text string, markdown bool) *tgbotapi.Message {
 	chatID, _, err := GetChatUserID(update)
@@ -95,9 +98,10 @@ func SendMessage(update *tgbotapi.Update, text string, markdown bool) *tgbotapi.
 	if markdown {
 		msg.ParseMode = "MarkdownV2"
 	}
-	message, err := bot.Send(msg)
+	message, err := messenger.Send(msg)
 	if err != nil {
-		log.Printf("Error bot.Send: %+v", err)
+		log.Printf("Error messenger.Send: %+v", err)
+		return nil
 	}
 
 	// Debug
@@ -108,6 +112,7 @@ func SendMessage(update *tgbotapi.Update, text string, markdown bool) *tgbotapi.
 func SendMessageForceReply(update *tgbotapi.Update, text string, messageID int, markdown bool) *tgbotapi.Message {
 	chatID, _, err := GetChatUserID(update)
 	if err != nil {
+		log.Printf("Error GetChatUserID: %+v", err)
 		return nil
 	}
 
@@ -120,7 +125,11 @@ func SendMessageForceReply(update *tgbotapi.Update, text string, messageID int,
 	if markdown {
 		msg.ParseMode = "MarkdownV2"
 	}
-	message, _ := bot.Send(msg)
+	message, err := messenger.Send(msg)
+	if err != nil {
+		log.Printf("Error sending force reply: %+v", err)
+		return nil
+	}
 	return &message
 }
 
@@ -129,13 +138,18 @@ func SendMessageTargetChat(text string, chatID int64, markdown bool) error {
 	if markdown {
 		msg.ParseMode = "MarkdownV2"
 	}
-	_, err := bot.Send(msg)
+	_, err := messenger.Send(msg)
 	return err
 }
 
-func SendUnknownCommand(update *tgbotapi.Update) {
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Unknown command, please use /start for commands")
-	bot.Send(msg)
+/* RemoveMarkupKeyboardTargetChat sends text to the chat, removing the reply keyboard of a flow */
+func RemoveMarkupKeyboardTargetChat(text string, chatID int64) error {
+	msg := tgbotapi.NewMessage(chatID, text)
+	removeKeyboard := tgbotapi.NewRemoveKeyboard(true)
+	removeKeyboard.Selective = true
+	msg.ReplyMarkup = removeKeyboard
+	_, err := messenger.Send(msg)
+	return err
 }
 
 func SendPhoto(update *tgbotapi.Update, photoID string) error {
@@ -144,11 +158,24 @@ func SendPhoto(update *tgbotapi.Update, photoID string) error {
 		return err
 	}
 	photoConfig := tgbotapi.NewPhotoShare(chatID, photoID)
-	bot.Send(photoConfig)
-	return nil
+	_, err = messenger.Send(photoConfig)
+	return err
+}
+
+/* SendDocument uploads content as a file named fileName */
+func SendDocument(update *tgbotapi.Update, fileName string, content []byte, caption string) error {
+	chatID, _, err := GetChatUserID(update)
+	if err != nil {
+		return err
+	}
+	document := tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{Name: fileName, Bytes: content})
+	document.Caption = caption
+	_, err = messenger.Send(document)
+	return err
 }
 
-func SendItemDetails(update *tgbotapi.Update, itemData constants.ItemDetails, sendImage bool) {
+/* ItemText describes an item as sent by SendItemDetails, without its URL */
+func ItemText(itemData constants.ItemDetails) string {
 	itemText := ""
 
 	if itemData.Name != "" {
@@ -173,28 +200,120 @@ func SendItemDetails(update *tgbotapi.Update, itemData constants.ItemDetails, se
 	if itemData.Notes != "" {
 		itemText = itemText + fmt.Sprintf("Notes: %s", itemData.Notes)
 	}
+	return itemText
+}
+
+/* itemURLKeyboard is a button opening the item's URL */
+func itemURLKeyboard(itemData constants.ItemDetails) tgbotapi.InlineKeyboardMarkup {
+	redirectButton := tgbotapi.NewInlineKeyboardButtonURL(itemData.URL, itemData.URL)
+	row := tgbotapi.NewInlineKeyboardRow(redirectButton)
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+func SendItemDetails(update *tgbotapi.Update, itemData constants.ItemDetails, sendImage bool) error {
+	itemText := ItemText(itemData)
 	if itemData.URL != "" {
 		// itemText = itemText + fmt.Sprintf("URL: %s\n", itemData.URL)
 
 		/* To send as inline keyboard */
-		redirectButton := tgbotapi.NewInlineKeyboardButtonURL(itemData.URL, itemData.URL)
-		row := tgbotapi.NewInlineKeyboardRow(redirectButton)
-		inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(row)
-		SendInlineKeyboard(update, itemText, inlineKeyboard, false)
+		if msg := SendInlineKeyboard(update, itemText, itemURLKeyboard(itemData), false); msg == nil {
+			return errors.New("item details not sent")
+		}
 	} else {
-		SendMessage(update, itemText, false)
+		if msg := SendMessage(update, itemText, false); msg == nil {
+			return errors.New("item details not sent")
+		}
+	}
+	if itemData.Location != nil {
+		if err := SendItemVenue(update, itemData); err != nil {
+			return err
+		}
 	}
 	if sendImage && itemData.Images != nil {
 		for imageID := range itemData.Images {
-			SendPhoto(update, imageID)
+			if err := SendPhoto(update, imageID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* ########## Inline mode ##########*/
+/* InlineQueryResultCachedPhoto is a photo already on telegram's servers, which tgbotapi v4 has no type for */
+type InlineQueryResultCachedPhoto struct {
+	Type        string                         `json:"type"`
+	ID          string                         `json:"id"`
+	PhotoFileID string                         `json:"photo_file_id"`
+	Title       string                         `json:"title,omitempty"`
+	Description string                         `json:"description,omitempty"`
+	Caption     string                         `json:"caption,omitempty"`
+	ReplyMarkup *tgbotapi.InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+/* Telegram's limit on the caption of a photo */
+const maxCaptionLength = 1024
+
+/*
+InlineResultID is a result ID for an item of a list, unique across the lists and within Telegram's 64 bytes
+however long the list's name is
+*/
+func InlineResultID(listID, itemID string) string {
+	sum := sha256.Sum256([]byte(listID + "\x00" + itemID))
+	return base64.RawURLEncoding.EncodeToString(sum[:18])
+}
+
+/*
+ItemInlineResult shares an item like SendItemDetails does: as one of its images with the details as caption,
+or as text if it has none. description is shown under the name in the list of results
+*/
+func ItemInlineResult(resultID string, itemData constants.ItemDetails, description string) interface{} {
+	var keyboard *tgbotapi.InlineKeyboardMarkup
+	if itemData.URL != "" {
+		urlKeyboard := itemURLKeyboard(itemData)
+		keyboard = &urlKeyboard
+	}
+	itemText := ItemText(itemData)
+
+	if imageIDs := itemData.GetImageIDs(); len(imageIDs) > 0 {
+		sort.Strings(imageIDs)
+		if caption := []rune(itemText); len(caption) > maxCaptionLength {
+			itemText = string(caption[:maxCaptionLength])
+		}
+		return InlineQueryResultCachedPhoto{
+			Type:        "photo",
+			ID:          resultID,
+			PhotoFileID: imageIDs[0],
+			Title:       itemData.Name,
+			Description: description,
+			Caption:     itemText,
+			ReplyMarkup: keyboard,
 		}
 	}
+	article := tgbotapi.NewInlineQueryResultArticle(resultID, itemData.Name, itemText)
+	article.Description = description
+	article.ReplyMarkup = keyboard
+	return article
+}
+
+/* AnswerInlineQuery sends the results of the update's inline query. They are only cached for the user who asked */
+func AnswerInlineQuery(update *tgbotapi.Update, results []interface{}) error {
+	if update.InlineQuery == nil {
+		return errors.New("no inline query")
+	}
+	return messenger.AnswerInlineQuery(tgbotapi.InlineConfig{
+		InlineQueryID: update.InlineQuery.ID,
+		Results:       results,
+		CacheTime:     10,
+		IsPersonal:    true,
+	})
 }
 
-func SetReplyMarkupKeyboard(update *tgbotapi.Update, text string, keyboard tgbotapi.ReplyKeyboardMarkup, markdown bool) {
+func SetReplyMarkupKeyboard(store Store, update *tgbotapi.Update, text string, keyboard tgbotapi.ReplyKeyboardMarkup, markdown bool) {
 	chatID, _, err := GetChatUserID(update)
 	if err != nil {
 		log.Printf("Error GetChatUserID: %+v", err)
+		return
 	}
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.BaseChat.ReplyMarkup = keyboard
@@ -205,7 +324,7 @@ func SetReplyMarkupKeyboard(update *tgbotapi.Update, text string, keyboard tgbot
 		if update.Message != nil {
 			messageTarget = update.Message.MessageID
 		} else {
-			messageTarget, err = GetMessageTarget(update)
+			messageTarget, err = GetMessageTarget(store, update)
 			if err != nil {
 				log.Printf("Error GetMessageTarget: %+v", err)
 			}
@@ -215,13 +334,14 @@ func SetReplyMarkupKeyboard(update *tgbotapi.Update, text string, keyboard tgbot
 	if markdown {
 		msg.ParseMode = "MarkdownV2"
 	}
-	_, err = bot.Send(msg)
+	_, err = messenger.Send(msg)
 	if err != nil {
 		log.Printf("Error setting markup keyboard: %+v", err)
 	}
 }
 
-func CreateAndSendInlineKeyboard(update *tgbotapi.Update, text string, col int, buttons ...string) *tgbotapi.Message {
+/* NewInlineKeyboard lays out buttons col to a row, each with its label as callback data */
+func NewInlineKeyboard(col int, buttons ...string) tgbotapi.InlineKeyboardMarkup {
 	var buttonList []tgbotapi.InlineKeyboardButton
 
 	for _, button := range buttons {
@@ -238,10 +358,20 @@ func CreateAndSendInlineKeyboard(update *tgbotapi.Update, text string, col int,
 		rows = append(rows, buttonList[i:end])
 	}
 
-	inlineKeyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
-	return SendInlineKeyboard(update, text, inlineKeyboard, false)
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
 }
 
+/* CreateAndSendInlineKeyboard sends buttons laid out by NewInlineKeyboard, with tokens of the session as callback data */
+func CreateAndSendInlineKeyboard(store Store, update *tgbotapi.Update, text string, col int, buttons ...string) *tgbotapi.Message {
+	keyboard, err := tokenizeKeyboard(store, update, NewInlineKeyboard(col, buttons...))
+	if err != nil {
+		log.Printf("Error tokenizing keyboard: %+v", err)
+		return nil
+	}
+	return SendInlineKeyboard(update, text, keyboard, false)
+}
+
+/* SendInlineKeyboard sends the keyboard as is. Callback buttons go through the functions taking a store instead */
 func SendInlineKeyboard(update *tgbotapi.Update, text string, keyboard tgbotapi.InlineKeyboardMarkup, markdown bool) *tgbotapi.Message {
 	chatID, _, err := GetChatUserID(update)
 	if err != nil {
@@ -253,7 +383,7 @@ func SendInlineKeyboard(update *tgbotapi.Update, text string, keyboard tgbotapi.
 	if markdown {
 		msg.ParseMode = "MarkdownV2"
 	}
-	message, err := bot.Send(msg)
+	message, err := messenger.Send(msg)
 	if err != nil {
 		log.Printf("Error setting markup keyboard: %+v", err)
 		return nil
@@ -262,10 +392,297 @@ func SendInlineKeyboard(update *tgbotapi.Update, text string, keyboard tgbotapi.
 
 }
 
-func RemoveMarkupKeyboard(update *tgbotapi.Update, text string, markdown bool) *tgbotapi.Message {
+/* ########## Pages ##########*/
+/* Choice is a button of a paged keyboard */
+type Choice struct {
+	Label string
+	Data  string
+}
+
+const (
+	// Choices on a page of a paged keyboard
+	PageSize = 8
+	// Callback data of the buttons turning to a page, followed by the page number
+	PageData = "/page "
+	// Callback data of the button clearing the typed filter
+	ClearFilterData = "/clearfilter"
+)
+
+/* ItemChoices has a choice per item, labelled with the item name and the item ID as data, sorted by name */
+func ItemChoices(itemNames map[string]string) []Choice {
+	choices := make([]Choice, 0, len(itemNames))
+	for itemID, name := range itemNames {
+		choices = append(choices, Choice{Label: name, Data: itemID})
+	}
+	sort.Slice(choices, func(i, j int) bool {
+		if choices[i].Label == choices[j].Label {
+			return choices[i].Data < choices[j].Data
+		}
+		return choices[i].Label < choices[j].Label
+	})
+	return choices
+}
+
+/* TagChoices has a choice per tag, with the tag as label and data, sorted */
+func TagChoices(tags map[string]bool) []Choice {
+	choices := make([]Choice, 0, len(tags))
+	for _, tag := range sortedKeys(tags) {
+		choices = append(choices, Choice{Label: tag, Data: tag})
+	}
+	return choices
+}
+
+/* FilterChoices keeps the choices whose label contains filter, ignoring case */
+func FilterChoices(choices []Choice, filter string) []Choice {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	if filter == "" {
+		return choices
+	}
+	filtered := make([]Choice, 0)
+	for _, choice := range choices {
+		if strings.Contains(strings.ToLower(choice.Label), filter) {
+			filtered = append(filtered, choice)
+		}
+	}
+	return filtered
+}
+
+/* PageCount is the number of pages the choices take, at least one */
+func PageCount(choices int) int {
+	if choices <= PageSize {
+		return 1
+	}
+	return (choices + PageSize - 1) / PageSize
+}
+
+/*
+NewPagedKeyboard lays out a page of choices, one to a row, the first page being 0.
+More than a page of choices gets a row of previous, "page/pages" and next buttons.
+Extra buttons like /done come last on every page, after a button to clear the filter if filtered
+*/
+func NewPagedKeyboard(choices []Choice, page int, filtered bool, extra ...string) tgbotapi.InlineKeyboardMarkup {
+	pages := PageCount(len(choices))
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, PageSize+3)
+	start := page * PageSize
+	end := start + PageSize
+	if end > len(choices) {
+		end = len(choices)
+	}
+	for _, choice := range choices[start:end] {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(choice.Label, choice.Data)))
+	}
+
+	if pages > 1 {
+		var nav []tgbotapi.InlineKeyboardButton
+		if page > 0 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("« prev", PageData+strconv.Itoa(page-1)))
+		}
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%d/%d", page+1, pages), PageData+strconv.Itoa(page)))
+		if page < pages-1 {
+			nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("next »", PageData+strconv.Itoa(page+1)))
+		}
+		rows = append(rows, nav)
+	}
+	if filtered {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Show all", ClearFilterData)))
+	}
+	if len(extra) > 0 {
+		rows = append(rows, NewInlineKeyboard(len(extra), extra...).InlineKeyboard...)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+/* ParsePageData returns the page a navigation button of NewPagedKeyboard turns to */
+func ParsePageData(data string) (int, bool) {
+	if !strings.HasPrefix(data, PageData) {
+		return 0, false
+	}
+	page, err := strconv.Atoi(strings.TrimPrefix(data, PageData))
+	if err != nil || page < 0 {
+		return 0, false
+	}
+	return page, true
+}
+
+/* ########## Callback tokens ##########*/
+/*
+Buttons sent with the functions taking a store carry a token as callback data, in place of their value:
+the ID of the user the keyboard is for, a nonce naming the keyboard and the index of the button, like "2s.Xq3_f0aB.4".
+The values are kept in the session, which only knows its last keyboard, so old buttons stop working
+*/
+var (
+	ErrStaleButton   = errors.New("button of a replaced keyboard")
+	ErrForeignButton = errors.New("button of another user's keyboard")
+)
+
+/* tokenizeKeyboard returns the keyboard with tokens as callback data, keeping the values as the session's keyboard */
+func tokenizeKeyboard(store Store, update *tgbotapi.Update, keyboard tgbotapi.InlineKeyboardMarkup) (tgbotapi.InlineKeyboardMarkup, error) {
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return keyboard, err
+	}
+	_, userID, err := GetChatUserID(update)
+	if err != nil {
+		return keyboard, err
+	}
+	nonce := make([]byte, 6)
+	if _, err := rand.Read(nonce); err != nil {
+		return keyboard, err
+	}
+	tokens := constants.Keyboard{Nonce: base64.RawURLEncoding.EncodeToString(nonce)}
+
+	// A copy, as the rows may be shared with the caller
+	rows := make([][]tgbotapi.InlineKeyboardButton, len(keyboard.InlineKeyboard))
+	for i, row := range keyboard.InlineKeyboard {
+		rows[i] = make([]tgbotapi.InlineKeyboardButton, len(row))
+		for j, button := range row {
+			if button.CallbackData != nil {
+				token := strings.Join([]string{
+					strconv.FormatInt(int64(userID), 36),
+					tokens.Nonce,
+					strconv.FormatInt(int64(len(tokens.Values)), 36),
+				}, ".")
+				tokens.Values = append(tokens.Values, *button.CallbackData)
+				button.CallbackData = &token
+			}
+			rows[i][j] = button
+		}
+	}
+	if err := store.SetKeyboard(sessionID, tokens); err != nil {
+		return keyboard, err
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...), nil
+}
+
+/* ResolveCallback returns the value of the pressed button, or ErrForeignButton or ErrStaleButton */
+func ResolveCallback(store Store, update *tgbotapi.Update) (string, error) {
+	if update.CallbackQuery == nil || update.CallbackQuery.From == nil {
+		return "", errors.New("no callback query")
+	}
+	parts := strings.Split(update.CallbackQuery.Data, ".")
+	if len(parts) != 3 {
+		return "", ErrStaleButton
+	}
+	owner, err := strconv.ParseInt(parts[0], 36, 64)
+	if err != nil {
+		return "", ErrStaleButton
+	}
+	if int(owner) != update.CallbackQuery.From.ID {
+		return "", ErrForeignButton
+	}
+
+	sessionID, err := GetSessionID(update)
+	if err != nil {
+		return "", err
+	}
+	keyboard, err := store.GetKeyboard(sessionID)
+	if err != nil {
+		return "", err
+	}
+	index, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil || parts[1] != keyboard.Nonce || index < 0 || index >= int64(len(keyboard.Values)) {
+		return "", ErrStaleButton
+	}
+	return keyboard.Values[index], nil
+}
+
+/* ########## Editing ##########*/
+/*
+ReplaceInlineKeyboard shows text and keyboard in place of the message whose button was pressed,
+so a flow keeps to one message. Sends them as a new message for other updates
+*/
+func ReplaceInlineKeyboard(store Store, update *tgbotapi.Update, text string, keyboard tgbotapi.InlineKeyboardMarkup) *tgbotapi.Message {
+	keyboard, err := tokenizeKeyboard(store, update, keyboard)
+	if err != nil {
+		log.Printf("Error tokenizing keyboard: %+v", err)
+		return nil
+	}
+	if update.CallbackQuery == nil || update.CallbackQuery.Message == nil {
+		return SendInlineKeyboard(update, text, keyboard, false)
+	}
+	return editCallbackMessage(update, text, &keyboard)
+}
+
+/* ReplaceKeyboard changes only the buttons of the pressed message, like when turning a page */
+func ReplaceKeyboard(store Store, update *tgbotapi.Update, keyboard tgbotapi.InlineKeyboardMarkup) *tgbotapi.Message {
+	if update.CallbackQuery == nil || update.CallbackQuery.Message == nil {
+		return nil
+	}
+	keyboard, err := tokenizeKeyboard(store, update, keyboard)
+	if err != nil {
+		log.Printf("Error tokenizing keyboard: %+v", err)
+		return nil
+	}
+	pressed := update.CallbackQuery.Message
+	message, err := messenger.Send(tgbotapi.NewEditMessageReplyMarkup(pressed.Chat.ID, pressed.MessageID, keyboard))
+	if err != nil {
+		if !strings.Contains(err.Error(), "message is not modified") {
+			log.Printf("Error editing keyboard: %+v", err)
+		}
+		return pressed
+	}
+	return &message
+}
+
+/* ReplaceMessage is ReplaceInlineKeyboard without a keyboard. The buttons of the pressed message are removed */
+func ReplaceMessage(update *tgbotapi.Update, text string) *tgbotapi.Message {
+	if update.CallbackQuery == nil || update.CallbackQuery.Message == nil {
+		return SendMessage(update, text, false)
+	}
+	return editCallbackMessage(update, text, nil)
+}
+
+/* EndInlineKeyboard removes the buttons of the pressed message, replacing its text unless text is empty. Other updates are ignored */
+func EndInlineKeyboard(update *tgbotapi.Update, text string) {
+	if update.CallbackQuery == nil || update.CallbackQuery.Message == nil {
+		return
+	}
+	if text == "" {
+		text = update.CallbackQuery.Message.Text
+	}
+	editCallbackMessage(update, text, nil)
+}
+
+/* editCallbackMessage edits the pressed message, falling back to a new message if it can't be edited */
+func editCallbackMessage(update *tgbotapi.Update, text string, keyboard *tgbotapi.InlineKeyboardMarkup) *tgbotapi.Message {
+	pressed := update.CallbackQuery.Message
+	edit := tgbotapi.NewEditMessageText(pressed.Chat.ID, pressed.MessageID, text)
+	// Without a keyboard, the edited message has none
+	edit.ReplyMarkup = keyboard
+	message, err := messenger.Send(edit)
+	switch {
+	case err == nil:
+		return &message
+	case strings.Contains(err.Error(), "message is not modified"):
+		return pressed
+	}
+	log.Printf("Error editing message: %+v", err)
+	if keyboard != nil {
+		return SendInlineKeyboard(update, text, *keyboard, false)
+	}
+	return SendMessage(update, text, false)
+}
+
+/* AnswerCallback stops the loading animation of the pressed button, showing text as a toast unless it is empty */
+func AnswerCallback(update *tgbotapi.Update, text string) error {
+	if update.CallbackQuery == nil {
+		return errors.New("no callback query")
+	}
+	return messenger.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, text))
+}
+
+func RemoveMarkupKeyboard(store Store, update *tgbotapi.Update, text string, markdown bool) *tgbotapi.Message {
 	chatID, _, err := GetChatUserID(update)
 	if err != nil {
 		log.Printf("Error GetChatUserID: %+v", err)
+		return nil
 	}
 	msg := tgbotapi.NewMessage(chatID, text)
 	removeKeyboard := tgbotapi.NewRemoveKeyboard(true)
@@ -276,7 +693,7 @@ func RemoveMarkupKeyboard(update *tgbotapi.Update, text string, markdown bool) *
 	if update.Message != nil {
 		messageTarget = update.Message.MessageID
 	} else {
-		messageTarget, err = GetMessageTarget(update)
+		messageTarget, err = GetMessageTarget(store, update)
 		if err != nil {
 			log.Printf("Error GetMessageTarget: %+v", err)
 		}
@@ -285,9 +702,10 @@ func RemoveMarkupKeyboard(update *tgbotapi.Update, text string, markdown bool) *
 	if markdown {
 		msg.ParseMode = "MarkdownV2"
 	}
-	message, err := bot.Send(msg)
+	message, err := messenger.Send(msg)
 	if err != nil {
 		log.Printf("Error removing markup keyboard: %+v", err)
+		return nil
 	}
 	return &message
 }
@@ -333,6 +751,34 @@ func GetChatUserIDString(update *tgbotapi.Update) (chatID, userID string, err er
 	return
 }
 
+/* SessionID identifies the conversation of a user in a chat */
+func SessionID(userID int, chatID int64) string {
+	return strconv.Itoa(userID) + "_" + strconv.FormatInt(chatID, 10)
+}
+
+/* ParseSessionID returns the user and chat of a session ID made by SessionID */
+func ParseSessionID(sessionID string) (userID int, chatID int64, err error) {
+	parts := strings.SplitN(sessionID, "_", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	if userID, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	if chatID, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	return userID, chatID, nil
+}
+
+func GetSessionID(update *tgbotapi.Update) (string, error) {
+	chatID, userID, err := GetChatUserID(update)
+	if err != nil {
+		return "", err
+	}
+	return SessionID(userID, chatID), nil
+}
+
 func GetMessage(update *tgbotapi.Update) (message string, messageID int, err error) {
 	if update.Message == nil {
 		message = ""
@@ -347,11 +793,59 @@ func GetMessage(update *tgbotapi.Update) (message string, messageID int, err err
 	return
 }
 
-func GetCallbackQueryMessage(update *tgbotapi.Update) (string, error) {
-	if update.CallbackQuery == nil {
-		return "", errors.New("invalid callback data")
+/*
+ParseCommand splits a message like "/additem@bot Ramen Keisuke" into its command and arguments.
+ok is false if the message isn't a command, or is addressed to another bot
+*/
+func ParseCommand(text string) (command, args string, ok bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+	command = text
+	if i := strings.IndexAny(text, " \n"); i >= 0 {
+		command, args = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	if i := strings.Index(command, "@"); i >= 0 {
+		if !strings.EqualFold(command[i+1:], BOT_USERNAME) {
+			return "", "", false
+		}
+		command = command[:i]
+	}
+	return command, args, true
+}
+
+/* PendingCommandOf keeps the command of the update to run later, with the document it is the caption of */
+func PendingCommandOf(update *tgbotapi.Update, text string) constants.PendingCommand {
+	command := constants.PendingCommand{Text: text}
+	if update.Message != nil && update.Message.Document != nil {
+		document := update.Message.Document
+		command.Document = &constants.Document{FileID: document.FileID, FileName: document.FileName, FileSize: document.FileSize}
 	}
-	return update.CallbackQuery.Data, nil
+	return command
+}
+
+/*
+CommandUpdate turns a pressed button into the message of a command from the user, as if it were sent in reply to the button's message.
+A command kept with a document is sent as its caption
+*/
+func CommandUpdate(update *tgbotapi.Update, command constants.PendingCommand) *tgbotapi.Update {
+	if update.CallbackQuery == nil || update.CallbackQuery.Message == nil {
+		return update
+	}
+	pressed := update.CallbackQuery.Message
+	message := &tgbotapi.Message{
+		MessageID: pressed.MessageID,
+		From:      update.CallbackQuery.From,
+		Chat:      pressed.Chat,
+		Date:      pressed.Date,
+		Text:      command.Text,
+	}
+	if document := command.Document; document != nil {
+		message.Text = ""
+		message.Caption = command.Text
+		message.Document = &tgbotapi.Document{FileID: document.FileID, FileName: document.FileName, FileSize: document.FileSize}
+	}
+	return &tgbotapi.Update{UpdateID: update.UpdateID, Message: message}
 }
 
 func GetPhotoIDs(update *tgbotapi.Update) ([]string, error) {
@@ -369,33 +863,17 @@ func GetPhotoIDs(update *tgbotapi.Update) ([]string, error) {
 	return photoIDs, nil
 }
 
-/* Check string */
-func CheckForSlash(update *tgbotapi.Update) error {
-	if update.Message != nil {
-		message, _, err := GetMessage(update)
-		if err != nil {
-			return err
-		}
-		if strings.Contains(message, "/") {
-			SendMessage(update, "Don't use / here! I will get confused :(", false)
-			SendMessage(update, "Please resend with a proper message", false)
-			return errors.New("slash in message")
-		}
-		return nil
+/* DownloadDocument returns the name and content of the document in the update */
+func DownloadDocument(update *tgbotapi.Update) (string, []byte, error) {
+	if update.Message == nil || update.Message.Document == nil {
+		return "", nil, errors.New("no document")
 	}
-	// if update.CallbackQuery != nil {
-	// 	message, err := GetCallbackQueryMessage(update)
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	if strings.Contains(message, "/") {
-	// 		SendMessage(update, "Please don't use / in your input! I will get confused :(")
-	// 		SendMessage(update, "Please resend with a proper message")
-	// 		return errors.New("slash in message")
-	// 	}
-	// 	return nil
-	// }
-	return nil
+	document := update.Message.Document
+	if document.FileSize > MaxDownloadSize {
+		return document.FileName, nil, fmt.Errorf("%s is larger than %d KB", document.FileName, MaxDownloadSize/1024)
+	}
+	content, err := messenger.DownloadFile(document.FileID)
+	return document.FileName, content, err
 }
 
 func SendToFeedbackChat(update *tgbotapi.Update) {
@@ -427,9 +905,9 @@ func SendToFeedbackChat(update *tgbotapi.Update) {
 		feedback,
 	)
 	msg := tgbotapi.NewMessage(chatID, feedbackMessage)
-	_, err = bot.Send(msg)
+	_, err = messenger.Send(msg)
 	if err != nil {
-		log.Printf("Error bot.Send: %+v", err)
+		log.Printf("Error messenger.Send: %+v", err)
 	}
 
 	// Debug
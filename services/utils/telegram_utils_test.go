@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xfated/golistbot/services/constants"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func testUpdate() *tgbotapi.Update {
+	return &tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			MessageID: 1,
+			From:      &tgbotapi.User{ID: 100},
+			Chat:      &tgbotapi.Chat{ID: -200},
+		},
+	}
+}
+
+func TestSendItemDetails(t *testing.T) {
+	tests := []struct {
+		name      string
+		itemData  constants.ItemDetails
+		sendImage bool
+		text      []string
+		keyboard  [][]string
+		photos    int
+	}{
+		{
+			name:     "name only",
+			itemData: constants.ItemDetails{Name: "Ramen"},
+			text:     []string{"Name: Ramen\n"},
+		},
+		{
+			name: "all fields",
+			itemData: constants.ItemDetails{
+				Name:    "Ramen",
+				Address: "1 Tras St",
+				Notes:   "Go early",
+				URL:     "https://ramen.example",
+				Images:  map[string]bool{"photo": true},
+				Tags:    map[string]bool{"dinner": true},
+			},
+			sendImage: true,
+			text:      []string{"Name: Ramen\n", "Address: 1 Tras St\n", "Images: 1\n", "Tags: dinner\n", "Notes: Go early"},
+			keyboard:  [][]string{{"https://ramen.example"}},
+			photos:    1,
+		},
+		{
+			name: "without images",
+			itemData: constants.ItemDetails{
+				Name:   "Ramen",
+				Images: map[string]bool{"photo": true},
+			},
+			text: []string{"Images: 1\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messenger := NewRecordingMessenger()
+			SetMessenger(messenger)
+
+			if err := SendItemDetails(testUpdate(), test.itemData, test.sendImage); err != nil {
+				t.Fatalf("SendItemDetails: %v", err)
+			}
+			sent := messenger.Take()
+			if len(sent) != 1+test.photos {
+				t.Fatalf("sent %d messages, want %d", len(sent), 1+test.photos)
+			}
+			for _, text := range test.text {
+				if !strings.Contains(sent[0].Text, text) {
+					t.Errorf("text %q missing %q", sent[0].Text, text)
+				}
+			}
+			if !reflect.DeepEqual(sent[0].Keyboard, test.keyboard) {
+				t.Errorf("keyboard = %v, want %v", sent[0].Keyboard, test.keyboard)
+			}
+			for _, photo := range sent[1:] {
+				if photo.PhotoID != "photo" || photo.ChatID != -200 {
+					t.Errorf("photo = %+v", photo)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateAndSendInlineKeyboard(t *testing.T) {
+	messenger := NewRecordingMessenger()
+	SetMessenger(messenger)
+	store := NewMemoryStore()
+
+	long := strings.Repeat("Ramen ", 20)
+	CreateAndSendInlineKeyboard(store, testUpdate(), "Pick", 2, "a", long, "/done")
+	sent := messenger.Take()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(sent))
+	}
+	want := [][]string{{"a", long}, {"/done"}}
+	if !reflect.DeepEqual(sent[0].Keyboard, want) {
+		t.Errorf("keyboard = %v, want %v", sent[0].Keyboard, want)
+	}
+
+	/* Each button resolves to its label, by the token in its callback data */
+	press := func(token string, userID int) (string, error) {
+		return ResolveCallback(store, &tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+			From:    &tgbotapi.User{ID: userID},
+			Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -200}},
+			Data:    token,
+		}})
+	}
+	tokens := sent[0].CallbackData
+	for i, row := range tokens {
+		for j, token := range row {
+			if len(token) > 64 {
+				t.Errorf("token %q is longer than 64 bytes", token)
+			}
+			if value, err := press(token, 100); err != nil || value != want[i][j] {
+				t.Errorf("button %q resolved to %q, %v", want[i][j], value, err)
+			}
+		}
+	}
+
+	if _, err := press(tokens[0][0], 101); err != ErrForeignButton {
+		t.Errorf("button of another user: err = %v, want ErrForeignButton", err)
+	}
+	if _, err := press("a", 100); err != ErrStaleButton {
+		t.Errorf("raw data: err = %v, want ErrStaleButton", err)
+	}
+	CreateAndSendInlineKeyboard(store, testUpdate(), "Pick again", 1, "a")
+	if _, err := press(tokens[0][0], 100); err != ErrStaleButton {
+		t.Errorf("button of a replaced keyboard: err = %v, want ErrStaleButton", err)
+	}
+}
+
+func TestNewPagedKeyboard(t *testing.T) {
+	choices := make([]Choice, 20)
+	for i := range choices {
+		choices[i] = Choice{Label: fmt.Sprintf("item %02d", i), Data: fmt.Sprintf("id%d", i)}
+	}
+	tests := []struct {
+		name     string
+		choices  []Choice
+		page     int
+		filtered bool
+		// Last rows of the keyboard, after the choices
+		rest    [][]string
+		first   string
+		buttons int
+	}{
+		{
+			name:    "one page",
+			choices: choices[:3],
+			rest:    [][]string{{"/done"}},
+			first:   "item 00",
+			buttons: 4,
+		},
+		{
+			name:    "first page",
+			choices: choices,
+			rest:    [][]string{{"1/3", "next »"}, {"/done"}},
+			first:   "item 00",
+			buttons: PageSize + 3,
+		},
+		{
+			name:    "middle page",
+			choices: choices,
+			page:    1,
+			rest:    [][]string{{"« prev", "2/3", "next »"}, {"/done"}},
+			first:   "item 08",
+			buttons: PageSize + 4,
+		},
+		{
+			name:    "past the last page",
+			choices: choices,
+			page:    7,
+			rest:    [][]string{{"« prev", "3/3"}, {"/done"}},
+			first:   "item 16",
+			buttons: 4 + 3,
+		},
+		{
+			name:     "filtered to nothing",
+			filtered: true,
+			rest:     [][]string{{"Show all"}, {"/done"}},
+			buttons:  2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyboard := NewPagedKeyboard(test.choices, test.page, test.filtered, "/done")
+			var recorded RecordedMessage
+			recordReplyMarkup(&recorded, keyboard)
+			rows := recorded.Keyboard
+			if len(recorded.Buttons()) != test.buttons {
+				t.Fatalf("keyboard = %v, want %d buttons", rows, test.buttons)
+			}
+			if rest := rows[len(rows)-len(test.rest):]; !reflect.DeepEqual(rest, test.rest) {
+				t.Errorf("last rows = %v, want %v", rest, test.rest)
+			}
+			if test.first != "" && rows[0][0] != test.first {
+				t.Errorf("first choice = %q, want %q", rows[0][0], test.first)
+			}
+			for _, row := range recorded.CallbackData {
+				for _, data := range row {
+					if page, ok := ParsePageData(data); ok && (page < 0 || page >= PageCount(len(test.choices))) {
+						t.Errorf("button turns to page %d of %d", page, PageCount(len(test.choices)))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFilterChoices(t *testing.T) {
+	choices := ItemChoices(map[string]string{"a": "Ramen Keisuke", "b": "Udon", "c": "Tonkotsu ramen"})
+	filtered := FilterChoices(choices, " RAMEN ")
+	want := []Choice{{Label: "Ramen Keisuke", Data: "a"}, {Label: "Tonkotsu ramen", Data: "c"}}
+	if !reflect.DeepEqual(filtered, want) {
+		t.Errorf("filtered = %v, want %v", filtered, want)
+	}
+	if len(FilterChoices(choices, "")) != 3 {
+		t.Error("empty filter dropped choices")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text    string
+		command string
+		args    string
+		ok      bool
+	}{
+		{text: "/additem", command: "/additem", ok: true},
+		{text: "/additem Ramen Keisuke", command: "/additem", args: "Ramen Keisuke", ok: true},
+		{text: "/additem@toGoListBot  Ramen ", command: "/additem", args: "Ramen", ok: true},
+		{text: "/query@togolistbot tag:dinner", command: "/query", args: "tag:dinner", ok: true},
+		{text: "/query@otherBot tag:dinner"},
+		{text: "Ramen"},
+	}
+	for _, test := range tests {
+		command, args, ok := ParseCommand(test.text)
+		if command != test.command || args != test.args || ok != test.ok {
+			t.Errorf("ParseCommand(%q) = %q, %q, %v, want %q, %q, %v", test.text, command, args, ok, test.command, test.args, test.ok)
+		}
+	}
+}
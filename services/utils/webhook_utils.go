@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* WebhookSecretHeader carries the secret_token the webhook was set with, in every delivery */
+const WebhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+/* UpdateRetention is how long processed update IDs are kept. Telegram stops redelivering an update after a day */
+const UpdateRetention = 24 * time.Hour
+
+/* WEBHOOK_SECRET is the secret_token given to setWebhook. Empty accepts any delivery */
+var WEBHOOK_SECRET = os.Getenv("WEBHOOK_SECRET")
+
+const defaultUpdateWorkers = 16
+
+/* UPDATE_WORKERS is how many updates are handled at once, each of a different session */
+var UPDATE_WORKERS = parseUpdateWorkers(os.Getenv("UPDATE_WORKERS"))
+
+func parseUpdateWorkers(value string) int {
+	if value == "" {
+		return defaultUpdateWorkers
+	}
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers < 1 {
+		log.Printf("Invalid UPDATE_WORKERS %q, using %d", value, defaultUpdateWorkers)
+		return defaultUpdateWorkers
+	}
+	return workers
+}
+
+/* ValidWebhookSecret checks the secret header of a delivery, in constant time */
+func ValidWebhookSecret(header string) bool {
+	if WEBHOOK_SECRET == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(header), []byte(WEBHOOK_SECRET)) == 1
+}
+
+/* FirstDelivery records the update as processed, reporting false if it was delivered before */
+func FirstDelivery(store Store, update *tgbotapi.Update) (bool, error) {
+	return store.MarkUpdate(update.UpdateID, time.Now())
+}
+
+/* ForgetDelivery unrecords the update, for telegram to deliver it again when it couldn't be handled */
+func ForgetDelivery(store Store, update *tgbotapi.Update) error {
+	return store.UnmarkUpdate(update.UpdateID)
+}
+
+/* RunUpdateSweeper forgets updates processed longer than UpdateRetention ago, every interval. Blocks until stop is closed (never if nil) */
+func RunUpdateSweeper(store Store, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			updates, err := store.SweepUpdates(time.Now().Add(-UpdateRetention))
+			if err != nil {
+				log.Printf("error SweepUpdates: %+v", err)
+				continue
+			}
+			if updates > 0 {
+				log.Printf("Swept %d processed update(s)", updates)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMarkUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golistbot")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	boltStore, err := NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	defer boltStore.Close()
+
+	now := time.Now()
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "bolt": boltStore} {
+		t.Run(name, func(t *testing.T) {
+			if first, err := store.MarkUpdate(1, now.Add(-2*UpdateRetention)); !first || err != nil {
+				t.Fatalf("first delivery: %v, %v", first, err)
+			}
+			if first, err := store.MarkUpdate(1, now); first || err != nil {
+				t.Fatalf("second delivery: %v, %v", first, err)
+			}
+			store.MarkUpdate(2, now)
+
+			swept, err := store.SweepUpdates(now.Add(-UpdateRetention))
+			if err != nil || swept != 1 {
+				t.Fatalf("swept %d, %v, want 1", swept, err)
+			}
+			if first, _ := store.MarkUpdate(2, now); first {
+				t.Error("recent update swept")
+			}
+			if first, _ := store.MarkUpdate(1, now); !first {
+				t.Error("old update kept")
+			}
+
+			if err := store.UnmarkUpdate(2); err != nil {
+				t.Fatalf("UnmarkUpdate: %v", err)
+			}
+			if first, _ := store.MarkUpdate(2, now); !first {
+				t.Error("unmarked update skipped")
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+/* Largest delivery read, well above telegram's updates */
+const maxUpdateSize = 1 << 20
+
+/*
+WebhookHandler receives telegram's deliveries. Deliveries without the secret are refused,
+and updates delivered again, as telegram does when unsure one arrived, are skipped.
+The others are answered at once, and handled by the dispatcher. When it has too many waiting,
+the update is refused for telegram to deliver it again later
+*/
+func WebhookHandler(store utils.Store, dispatcher *Dispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !utils.ValidWebhookSecret(r.Header.Get(utils.WebhookSecretHeader)) {
+			log.Printf("Refused delivery from %s without the webhook secret", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var update tgbotapi.Update
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxUpdateSize)).Decode(&update); err != nil {
+			log.Printf("could not decode incoming update %s", err.Error())
+			http.Error(w, "bad update", http.StatusBadRequest)
+			return
+		}
+		first, err := utils.FirstDelivery(store, &update)
+		if err != nil {
+			// Telegram delivers it again later
+			log.Printf("error FirstDelivery: %+v", err)
+			http.Error(w, "could not record update", http.StatusInternalServerError)
+			return
+		}
+		if !first {
+			log.Printf("Skipped update %d, delivered before", update.UpdateID)
+			return
+		}
+
+		if update.Message != nil {
+			log.Printf("From: %+v Text: %+v\n", update.Message.From, update.Message.Text)
+		}
+		if err := dispatcher.Submit(&update); err != nil {
+			// Telegram delivers it again later, so it mustn't be skipped then
+			log.Printf("Could not queue update %d: %+v", update.UpdateID, err)
+			if err := utils.ForgetDelivery(store, &update); err != nil {
+				log.Printf("error ForgetDelivery: %+v", err)
+			}
+			http.Error(w, "too many updates waiting", http.StatusServiceUnavailable)
+		}
+	})
+}
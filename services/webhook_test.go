@@ -0,0 +1,122 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	secret := utils.WEBHOOK_SECRET
+	utils.WEBHOOK_SECRET = "s3cret"
+	defer func() { utils.WEBHOOK_SECRET = secret }()
+
+	var handled []int
+	store := utils.NewMemoryStore()
+	dispatcher := newDispatcher(store, 1, func(store utils.Store, update *tgbotapi.Update) {
+		handled = append(handled, update.UpdateID)
+	})
+	handler := WebhookHandler(store, dispatcher)
+	deliveries := []struct {
+		name   string
+		method string
+		secret string
+		body   string
+		status int
+	}{
+		{name: "no secret", secret: "", body: `{"update_id": 1}`, status: http.StatusUnauthorized},
+		{name: "wrong secret", secret: "s3cre", body: `{"update_id": 1}`, status: http.StatusUnauthorized},
+		{name: "not an update", secret: "s3cret", body: `{"update_id": `, status: http.StatusBadRequest},
+		{name: "not a post", method: http.MethodGet, secret: "s3cret", status: http.StatusMethodNotAllowed},
+		{name: "first", secret: "s3cret", body: `{"update_id": 1}`, status: http.StatusOK},
+		{name: "redelivered", secret: "s3cret", body: `{"update_id": 1}`, status: http.StatusOK},
+		{name: "next", secret: "s3cret", body: `{"update_id": 2}`, status: http.StatusOK},
+	}
+	for _, delivery := range deliveries {
+		method := delivery.method
+		if method == "" {
+			method = http.MethodPost
+		}
+		r := httptest.NewRequest(method, "/webhook", strings.NewReader(delivery.body))
+		if delivery.secret != "" {
+			r.Header.Set(utils.WebhookSecretHeader, delivery.secret)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != delivery.status {
+			t.Errorf("%s: status = %d, want %d", delivery.name, w.Code, delivery.status)
+		}
+	}
+
+	// Waits for the updates to be handled
+	dispatcher.Close()
+	if len(handled) != 2 || handled[0] != 1 || handled[1] != 2 {
+		t.Errorf("handled %v, want [1 2]", handled)
+	}
+}
+
+func TestWebhookHandlerBusy(t *testing.T) {
+	secret := utils.WEBHOOK_SECRET
+	utils.WEBHOOK_SECRET = ""
+	defer func() { utils.WEBHOOK_SECRET = secret }()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	handled := 0
+	store := utils.NewMemoryStore()
+	dispatcher := newDispatcher(store, 1, func(store utils.Store, update *tgbotapi.Update) {
+		if update.UpdateID == 1 {
+			started <- true
+			<-release
+		}
+		handled++
+	})
+	handler := WebhookHandler(store, dispatcher)
+	deliver := func(updateID int) int {
+		body := fmt.Sprintf(`{"update_id": %d}`, updateID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// Keeps the only worker busy, while updates of no session each wait on their own
+	deliver(1)
+	<-started
+	for i := 0; i < readySessionsPerWorker; i++ {
+		if status := deliver(100 + i); status != http.StatusOK {
+			t.Fatalf("update %d: status = %d, want %d", 100+i, status, http.StatusOK)
+		}
+	}
+	refused := 100 + readySessionsPerWorker
+	if status := deliver(refused); status != http.StatusServiceUnavailable {
+		t.Errorf("update beyond the queue: status = %d, want %d", status, http.StatusServiceUnavailable)
+	}
+	if status := deliver(refused); status != http.StatusServiceUnavailable {
+		t.Errorf("refused update delivered again: status = %d, want it refused again, not skipped", status)
+	}
+
+	close(release)
+	// Waits for the queue to empty
+	for {
+		dispatcher.mu.Lock()
+		waiting := len(dispatcher.queues)
+		dispatcher.mu.Unlock()
+		if waiting == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if status := deliver(refused); status != http.StatusOK {
+		t.Errorf("refused update delivered once the queue emptied: status = %d, want %d", status, http.StatusOK)
+	}
+	dispatcher.Close()
+	if want := 1 + readySessionsPerWorker + 1; handled != want {
+		t.Errorf("handled %d updates, want %d", handled, want)
+	}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/xfated/golistbot/services/constants"
@@ -8,203 +9,317 @@ import (
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
-func HandleUserInput(update *tgbotapi.Update) {
+func HandleUserInput(store utils.Store, update *tgbotapi.Update) {
 	/* Debugging */
 	// utils.LogMessage(update)
 	// utils.LogUpdate(update)
 	// utils.LogCallbackQuery(update)
 
-	/* Check for main commands */
-	message, _, err := utils.GetMessage(update)
-	if err == nil {
-		switch message {
-		case "/start",
-			"/start@toGoListBot",
-			"/reset",
-			"/reset@toGoListBot":
-			utils.RemoveMarkupKeyboard(update, "I am ready! Use /help to see the list of available commands", false)
-			if err := utils.SetUserState(update, constants.Idle); err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			return
-		case "/start addItem":
-			if update.Message == nil {
-				utils.SendMessage(update, "Please press start", false)
-				return
-			}
-			// Add item in pm after redirect
-			targetChat, err := utils.GetChatTarget(update)
-			if err != nil {
-				log.Printf("error GetChatTarget: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			if targetChat == 0 {
-				utils.SendMessage(update, "Please send /additem back in the chat if you'd like to add a item", false)
-				return
-			}
-			utils.SendMessage(update, "Please enter the name of the item to begin", false)
-			if err := utils.SetUserState(update, constants.AddNewSetName); err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			return
-		case "/additem",
-			"/additem@toGoListBot":
-			// Check if is already private.
-			chatID, userID, err := utils.GetChatUserID(update)
-			utils.SetChatTarget(update, chatID)
-
-			if err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			// Same == same chat
-			if chatID == int64(userID) {
-				utils.SendMessage(update, "Please enter the name of the item to begin", false)
-				if err := utils.SetUserState(update, constants.AddNewSetName); err != nil {
-					log.Printf("error setting state: %+v", err)
-					utils.SendMessage(update, "Sorry, an error occured!", false)
-					return
-				}
-				return
-			}
-			// If not private, redirect
-			utils.RedirectToBotChat(update, "Click the button to start adding", "Add item", "https://t.me/toGoListBot?start=addItem")
-			return
-		case "/query",
-			"/query@toGoListBot":
-			utils.ResetQuery(update)
-			// End query if no item
-			err := checkAnyItem(update)
-			if err != nil {
-				return
-			}
-			// Record id for selective force reply
-			_, messageID, err := utils.GetMessage(update)
-			if err != nil {
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			utils.SetMessageTarget(update, messageID)
-
-			sendQuerySelectType(update, "What kind of query do you seek?")
-			if err := utils.SetUserState(update, constants.QuerySelectType); err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			return
-		case "/deleteitem",
-			"/deleteitem@toGoListBot":
-			sendItemsToDeleteResponse(update, "Which item do you want to delete?")
-			if err := utils.SetUserState(update, constants.DeleteSelect); err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			return
-		case "/start editItem":
-			if update.Message == nil {
-				utils.SendMessage(update, "Please press start", false)
-				return
-			}
-			sendItemsToEditResponse(update, "Which item would you like to edit?")
-			if err := utils.SetUserState(update, constants.GetItemToEdit); err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			return
-		case "/edititem",
-			"/edititem@toGoListBot":
-			// Check if is already private.
-			chatID, userID, err := utils.GetChatUserID(update)
-			utils.SetChatTarget(update, chatID)
-
-			if err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			// Same == same chat
-			if chatID == int64(userID) {
-				sendItemsToEditResponse(update, "Which item would you like to edit?")
-				if err := utils.SetUserState(update, constants.GetItemToEdit); err != nil {
-					log.Printf("error setting state: %+v", err)
-					utils.SendMessage(update, "Sorry, an error occured!", false)
-					return
-				}
-				return
-			}
-			// If not private, redirect
-			utils.RedirectToBotChat(update, "Click the button to start editing", "Edit item", "https://t.me/toGoListBot?start=editItem")
-			return
-		case "/feedback",
-			"/feedback@toGoListBot":
-			_, messageID, err := utils.GetMessage(update)
-			if err != nil {
-				log.Printf("error GetMessage: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			utils.SendMessageForceReply(update, "What would you like to feedback?", messageID, false)
-			if err := utils.SetUserState(update, constants.Feedback); err != nil {
-				log.Printf("error setting state: %+v", err)
-				utils.SendMessage(update, "Sorry, an error occured!", false)
-				return
-			}
-			return
-		case "/help",
-			"/help@toGoListBot":
-			helpHandler(update)
-		}
+	/* Inline queries come from any chat, outside of a session */
+	if update.InlineQuery != nil {
+		handleInlineQuery(store, update)
+		return
 	}
 
-	/* Get user state for Targeted handling */
-	userState, err := utils.GetUserState(update)
+	/* Expire abandoned flows, so a late message isn't taken as input to them */
+	expiredState, err := utils.ExpireSession(store, update, utils.SESSION_TIMEOUT)
 	if err != nil {
-		log.Printf("error getting user state: %+v", err)
-		return
+		log.Printf("error ExpireSession: %+v", err)
+	} else if expiredState != constants.Idle {
+		utils.RemoveMarkupKeyboard(store, update, expiredText(expiredState), false)
+	}
+	if err := utils.TouchSession(store, update); err != nil {
+		log.Printf("error TouchSession: %+v", err)
+	}
+	if err := utils.RecordUserChat(store, update); err != nil {
+		log.Printf("error RecordUserChat: %+v", err)
 	}
 
-	/* Idle state */
-	if userState == constants.Idle {
-		idleHandler(update)
+	workflow.handle(store, update)
+}
+
+func expiredText(state constants.State) string {
+	return fmt.Sprintf("Your %s was cancelled after %v without activity", flowName(state), utils.SESSION_TIMEOUT)
+}
+
+/* NotifyExpired tells the user of a session swept in the background that their flow was cancelled */
+func NotifyExpired(sessionID string, state constants.State) {
+	_, chatID, err := utils.ParseSessionID(sessionID)
+	if err != nil {
+		log.Printf("error ParseSessionID: %+v", err)
 		return
 	}
+	if err := utils.RemoveMarkupKeyboardTargetChat(expiredText(state), chatID); err != nil {
+		log.Printf("error notifying expired session %s: %+v", sessionID, err)
+	}
+}
 
-	/* Adding new item */
-	if constants.IsAddingNewItem(userState) {
-		addItemHandler(update, userState)
-		return
+func resetHandler(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	utils.RemoveMarkupKeyboard(store, update, "I am ready! Use /help to see the list of available commands", false)
+	return constants.Idle, nil
+}
+
+/* /start, with the deep link parameter of a flow redirected from a group */
+func start(store utils.Store, update *tgbotapi.Update, param string) (constants.State, error) {
+	switch param {
+	case "addItem":
+		return startAddItem(store, update, param)
+	case "addNamedItem":
+		return startAddNamedItem(store, update, param)
+	case "editItem":
+		return startEditItem(store, update, param)
 	}
+	return resetHandler(store, update, param)
+}
 
-	/* Querying items */
-	if constants.IsQuery(userState) {
-		queryHandler(update, userState)
-		return
+/* Add item in pm after redirect */
+func startAddItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	targetChat, err := utils.GetChatTarget(store, update)
+	if err != nil {
+		return stay, err
+	}
+	if targetChat == 0 {
+		utils.SendMessage(update, "Please send /additem back in the chat if you'd like to add a item", false)
+		return stay, nil
 	}
+	utils.SendMessage(update, "Please enter the name of the item to begin", false)
+	return constants.AddNewSetName, nil
+}
 
-	/* Delete item */
-	if constants.IsDeleteItem(userState) {
-		deleteItemHandler(update, userState)
-		return
+/* Add item named in the group's /additem, in pm after redirect */
+func startAddNamedItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	targetChat, err := utils.GetChatTarget(store, update)
+	if err != nil {
+		return stay, err
+	}
+	itemData, err := utils.GetTempItem(store, update)
+	if err != nil {
+		return stay, err
+	}
+	if targetChat == 0 || itemData.Name == "" {
+		utils.SendMessage(update, "Please send /additem back in the chat if you'd like to add a item", false)
+		return stay, nil
 	}
+	utils.SendMessage(update, fmt.Sprintf("You may start adding the details for %s", itemData.Name), false)
+	return nextAction(store, update, input)
+}
 
-	/* Edit item */
-	if constants.IsEditItem(userState) {
-		editItemHandler(update, userState)
-		return
+/* /additem, optionally with the name of the item */
+func addItem(store utils.Store, update *tgbotapi.Update, name string) (constants.State, error) {
+	chatID, userID, err := utils.GetChatUserID(update)
+	if err != nil {
+		return stay, err
+	}
+	// Item is added in the private chat session, targeting this chat
+	if err := utils.SetPrivateChatTarget(store, update, chatID); err != nil {
+		return stay, err
+	}
+	// Same == same chat
+	if chatID == int64(userID) {
+		if name != "" {
+			return setItemName(store, update, name)
+		}
+		utils.SendMessage(update, "Please enter the name of the item to begin", false)
+		return constants.AddNewSetName, nil
+	}
+	// If not private, redirect
+	if name != "" {
+		if err := utils.InitPrivateItem(store, update, name); err != nil {
+			return stay, err
+		}
+		utils.RedirectToBotChat(update, fmt.Sprintf("Click the button to start adding %s", name), "Add item", utils.BotLink("addNamedItem"))
+		return stay, nil
 	}
+	utils.RedirectToBotChat(update, "Click the button to start adding", "Add item", utils.BotLink("addItem"))
+	return stay, nil
+}
 
-	/* Feedback */
-	if constants.IsFeedback(userState) {
-		feedbackHandler(update, userState)
-		return
+/* /query, optionally with arguments to skip straight to the results */
+func query(store utils.Store, update *tgbotapi.Update, args string) (constants.State, error) {
+	if err := utils.ResetQuery(store, update); err != nil {
+		return stay, err
+	}
+	// End query if no item
+	if ok, err := checkAnyItem(store, update); !ok {
+		return stay, err
+	}
+	if args != "" {
+		return queryWithArgs(store, update, args)
+	}
+	// Record id for selective force reply
+	_, messageID, err := utils.GetMessage(update)
+	if err != nil {
+		return stay, err
+	}
+	if err := utils.SetMessageTarget(store, update, messageID); err != nil {
+		return stay, err
+	}
+
+	sendQuerySelectType(store, update, "What kind of query do you seek?")
+	return constants.QuerySelectType, nil
+}
+
+func deleteItemCommand(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	sendItemsToDeleteResponse(store, update, "Which item do you want to delete?")
+	return constants.DeleteSelect, nil
+}
+
+func startEditItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	sendItemsToEditResponse(store, update, "Which item would you like to edit?")
+	return constants.GetItemToEdit, nil
+}
+
+func editItem(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	chatID, userID, err := utils.GetChatUserID(update)
+	if err != nil {
+		return stay, err
+	}
+	// Item is edited in the private chat session, targeting this chat
+	if err := utils.SetPrivateChatTarget(store, update, chatID); err != nil {
+		return stay, err
+	}
+	// Same == same chat
+	if chatID == int64(userID) {
+		return startEditItem(store, update, input)
+	}
+	// If not private, redirect
+	utils.RedirectToBotChat(update, "Click the button to start editing", "Edit item", utils.BotLink("editItem"))
+	return stay, nil
+}
+
+func feedback(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	_, messageID, err := utils.GetMessage(update)
+	if err != nil {
+		return stay, err
+	}
+	utils.SendMessageForceReply(update, "What would you like to feedback?", messageID, false)
+	return constants.Feedback, nil
+}
+
+func rebuildIndex(store utils.Store, update *tgbotapi.Update, input string) (constants.State, error) {
+	if err := utils.RebuildIndex(store, update); err != nil {
+		return stay, err
+	}
+	list, err := utils.GetList(store, update)
+	if err != nil {
+		return constants.Idle, err
+	}
+	itemNames, _ := utils.GetItemNames(store, list.ID())
+	tags, _ := utils.GetTags(store, list.ID())
+	utils.SendMessage(update, fmt.Sprintf("Index rebuilt: %d item(s), %d tag(s)", len(itemNames), len(tags)), false)
+	return constants.Idle, nil
+}
+
+/* workflow defines every state of the bot, and the commands that can be sent in any. The README's Workflow section is generated from it */
+var workflow = stateMachine{
+	commands: []command{
+		{name: "/start",
+			doc: []string{
+				"Sends basic info",
+				"Or continues a flow redirected from a group chat, by its parameter",
+				"    addItem: Prompt for name of item to add",
+				"    addNamedItem: Prompt for next action on the item named in the group chat",
+				"    editItem: Prompt for item to edit",
+			},
+			next:   []constants.State{constants.Idle, constants.AddNewSetName, constants.ReadyForNextAction, constants.GetItemToEdit},
+			handle: start},
+		{name: "/reset", doc: []string{"Sends basic info"}, next: []constants.State{constants.Idle},
+			handle: resetHandler},
+		{name: "/help", doc: []string{"Sends info on commands"}, next: []constants.State{constants.Idle},
+			handle: helpHandler},
+		{name: "/query", args: "[tag:<tag>]... [not:<tag>]... [all] [<number>] [images]",
+			doc: []string{
+				"Without arguments",
+				"    Prompt for query type",
+				"With arguments, e.g. /query tag:dinner tag:cheap all not:spicy 3",
+				"    Send up to number (default all) items with any (or all) of the tags and none of the not: tags, with images if asked",
+			},
+			next:   []constants.State{constants.QuerySelectType, constants.Idle},
+			handle: query, list: true},
+		{name: "/search", args: "[text]",
+			doc: []string{
+				"Without arguments",
+				"    Prompt for text to search for",
+				"With the text, e.g. /search ramen tras",
+				"    Send items best matching it by name, address, notes and tags, allowing for typos",
+			},
+			next:   []constants.State{constants.QuerySearch, constants.Idle},
+			handle: searchCommand, list: true},
+		{name: "/additem", args: "[name]",
+			doc: []string{
+				"If in group chat",
+				"    Redirect to bot's chat, with \"/start addItem\" (or \"/start addNamedItem\" with a name) as default first message",
+				"If already in bot's chat",
+				"    Prompt for name of item to add, or for next action if named",
+			},
+			next:   []constants.State{constants.AddNewSetName, constants.ReadyForNextAction},
+			handle: addItem, list: true},
+		{name: "/add", args: utils.ItemSyntax,
+			doc: []string{
+				"Add the item to this chat's list in one message, or explain what can't be parsed",
+				"Fields after the name are optional and in any order",
+			},
+			handle: addItemInline, list: true},
+		{name: "/import", args: "[one item per line, as /add]",
+			doc: []string{
+				"With a CSV or JSON document (sent with /import as caption), or items after the command",
+				"    Send summary of new, duplicate and invalid items",
+				"    Prompt import confirmation",
+				"Otherwise",
+				"    Prompt for document or items",
+			},
+			next:   []constants.State{constants.ImportSetItems, constants.ImportConfirm, constants.Idle},
+			handle: importCommand, list: true},
+		{name: "/export", args: "[csv|json|md]",
+			doc: []string{
+				"Without arguments",
+				"    Prompt for format",
+				"With the format",
+				"    Send chat's items as a document, with tags, notes, URLs and image file IDs",
+			},
+			next:   []constants.State{constants.ExportSelectFormat, constants.Idle},
+			handle: exportCommand, list: true},
+		{name: "/deleteitem", doc: []string{"Prompt for item to delete"}, next: []constants.State{constants.DeleteSelect},
+			handle: deleteItemCommand, list: true},
+		{name: "/edititem",
+			doc: []string{
+				"If in group chat",
+				"    Redirect to bot's chat, with \"/start editItem\" as default first message",
+				"If already in bot's chat",
+				"    Prompt for item to edit",
+			},
+			next:   []constants.State{constants.GetItemToEdit},
+			handle: editItem, list: true},
+		{name: "/newlist", args: "[name]",
+			doc: []string{
+				"Without arguments",
+				"    Prompt for the name of the list",
+				"With the name, e.g. /newlist movies",
+				"    Create the list, and use it",
+			},
+			next:   []constants.State{constants.NewListSetName, constants.Idle},
+			handle: newListCommand},
+		{name: "/uselist", args: "[name]",
+			doc: []string{
+				"Without arguments",
+				"    Prompt for the list to use",
+				"With the name, e.g. /uselist main",
+				"    Use the list for the commands on items",
+			},
+			next:   []constants.State{constants.SelectList, constants.Idle},
+			handle: useListCommand},
+		{name: "/rebuildindex", doc: []string{"Rebuild item names and tags of the list from its items"}, next: []constants.State{constants.Idle},
+			handle: rebuildIndex, list: true},
+		{name: "/feedback", doc: []string{"Prompt for feedback"}, next: []constants.State{constants.Feedback},
+			handle: feedback},
+	},
+	flows: []flow{addItemFlow, deleteItemFlow, editItemFlow, queryFlow, importFlow, exportFlow, feedbackFlow, listsFlow},
+}
+
+/* flowName names the commands that start the flow a state belongs to */
+func flowName(state constants.State) string {
+	if flow, _ := workflow.lookup(state); flow != nil {
+		return flow.command
 	}
+	return "previous command"
 }
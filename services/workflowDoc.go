@@ -0,0 +1,91 @@
+package services
+
+//go:generate go run ../workflowdoc -readme ../README.md
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+)
+
+const workflowHeading = "# Workflow\n"
+
+/* WorkflowDoc renders the README's Workflow section from the definition of the workflow */
+func WorkflowDoc() string {
+	var doc strings.Builder
+	doc.WriteString(workflowHeading)
+	doc.WriteString("(Bolded words are user states. Generated from the definitions in services/ with `go generate ./services`)\n")
+
+	writeLine(&doc, 0, "**Any state**  ")
+	doc.WriteString(indent(1) + "<sup>(commands can also be sent as /command@bot)</sup>\n")
+	for _, cmd := range workflow.commands {
+		writeLine(&doc, 1, strings.TrimSpace(cmd.name+" "+cmd.args))
+		writeSteps(&doc, 2, cmd.doc, cmd.next)
+		if cmd.list {
+			writeSteps(&doc, 2, []string{"If the chat has several lists and none was picked, first prompt for the list"}, []constants.State{constants.SelectList})
+		}
+	}
+
+	for _, flow := range workflow.flows {
+		writeLine(&doc, 0, "*"+flow.title+"*")
+		for _, def := range flow.states {
+			// Trailing spaces break the line before the expected input
+			writeLine(&doc, 1, "**"+def.name+"**  ")
+			doc.WriteString(indent(1) + "<sup>(expects " + def.expects.doc + ")</sup>\n")
+			if def.handle != nil && len(def.options) == 0 {
+				writeSteps(&doc, 2, def.doc, def.next)
+			} else if def.handle != nil {
+				writeLine(&doc, 2, "*"+def.label+"*")
+				writeSteps(&doc, 3, def.doc, def.next)
+			}
+			for _, opt := range def.options {
+				writeLine(&doc, 2, opt.inputs[0])
+				writeSteps(&doc, 3, opt.doc, opt.next)
+			}
+			if def.picker != nil {
+				writeLine(&doc, 2, "*page buttons*")
+				writeLine(&doc, 3, fmt.Sprintf("Show another page of choices (%d a page)", utils.PageSize))
+			}
+			if def.picker != nil && def.picker.filter {
+				writeLine(&doc, 2, "*text message*")
+				writeLine(&doc, 3, "Send the choices with names containing it")
+			}
+		}
+	}
+	return doc.String()
+}
+
+/* ReplaceWorkflowDoc replaces the Workflow section at the end of the README with WorkflowDoc */
+func ReplaceWorkflowDoc(readme string) (string, error) {
+	i := strings.Index(readme, workflowHeading)
+	if i < 0 {
+		return "", fmt.Errorf("no %q heading", strings.TrimSpace(workflowHeading))
+	}
+	return readme[:i] + WorkflowDoc(), nil
+}
+
+func indent(level int) string {
+	return strings.Repeat("    ", level)
+}
+
+func writeLine(doc *strings.Builder, level int, text string) {
+	doc.WriteString(indent(level) + "- " + text + "\n")
+}
+
+/* writeSteps writes the doc lines, nested by their leading indent, and the states they may go to */
+func writeSteps(doc *strings.Builder, level int, steps []string, next []constants.State) {
+	for _, step := range steps {
+		trimmed := strings.TrimLeft(step, " ")
+		writeLine(doc, level+(len(step)-len(trimmed))/4, trimmed)
+	}
+	if len(next) == 0 {
+		return
+	}
+	names := make([]string, len(next))
+	for i, state := range next {
+		names[i] = "**" + workflow.stateName(state) + "**"
+	}
+	writeLine(doc, level, "goto "+strings.Join(names, " or "))
+}
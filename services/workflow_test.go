@@ -0,0 +1,1722 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xfated/golistbot/services/constants"
+	"github.com/xfated/golistbot/services/utils"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+const (
+	testUserID    = 100
+	testPrivateID = int64(testUserID)
+	testGroupID   = int64(-200)
+	// A second group of the same user
+	testOtherGroupID = int64(-300)
+)
+
+/* ########## Updates ##########*/
+var testUser = &tgbotapi.User{ID: testUserID, UserName: "tester"}
+
+func textUpdate(chatID int64, text string) tgbotapi.Update {
+	return tgbotapi.Update{
+		Message: &tgbotapi.Message{
+			MessageID: 1,
+			From:      testUser,
+			Chat:      &tgbotapi.Chat{ID: chatID},
+			Text:      text,
+		},
+	}
+}
+
+func photoUpdate(chatID int64, fileIDs ...string) tgbotapi.Update {
+	photos := make([]tgbotapi.PhotoSize, len(fileIDs))
+	for i, fileID := range fileIDs {
+		photos[i] = tgbotapi.PhotoSize{FileID: fileID}
+	}
+	update := textUpdate(chatID, "")
+	update.Message.Photo = &photos
+	return update
+}
+
+func documentUpdate(chatID int64, fileID, fileName, caption string) tgbotapi.Update {
+	update := textUpdate(chatID, "")
+	update.Message.Document = &tgbotapi.Document{FileID: fileID, FileName: fileName}
+	update.Message.Caption = caption
+	return update
+}
+
+func locationUpdate(chatID int64, latitude, longitude float64) tgbotapi.Update {
+	update := textUpdate(chatID, "")
+	update.Message.Location = &tgbotapi.Location{Latitude: latitude, Longitude: longitude}
+	return update
+}
+
+func venueUpdate(chatID int64, address string, latitude, longitude float64) tgbotapi.Update {
+	update := locationUpdate(chatID, latitude, longitude)
+	update.Message.Venue = &tgbotapi.Venue{Location: *update.Message.Location, Title: "Venue", Address: address}
+	return update
+}
+
+func callbackUpdate(chatID int64, data string) tgbotapi.Update {
+	return tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:   "cb",
+			From: testUser,
+			Message: &tgbotapi.Message{
+				MessageID: 2,
+				Chat:      &tgbotapi.Chat{ID: chatID},
+			},
+			Data: data,
+		},
+	}
+}
+
+/* ########## Harness ##########*/
+type step struct {
+	update tgbotapi.Update
+	// State of the user's session in the step's chat after the step
+	state constants.State
+	// Substrings that must each appear in a message sent during the step
+	replies []string
+	// Labels that must each appear on a keyboard sent during the step
+	buttons []string
+	// Substrings that must not appear in any message sent during the step
+	absent []string
+	// Substrings that must each appear in an edit of the pressed button's message
+	edits []string
+	// Answer to the pressed button, checked if set
+	toast string
+}
+
+type conversation struct {
+	name string
+	seed func(store utils.Store)
+	// Content of the documents sent in the steps, by file ID
+	files map[string]string
+	steps []step
+	check func(t *testing.T, store utils.Store)
+}
+
+/* stores returns a fresh instance of every backend the conversations run against */
+func stores(t *testing.T) (map[string]utils.Store, func()) {
+	dir, err := ioutil.TempDir("", "golistbot")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	boltStore, err := utils.NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	cleanup := func() {
+		boltStore.Close()
+		os.RemoveAll(dir)
+	}
+	return map[string]utils.Store{
+		"memory": utils.NewMemoryStore(),
+		"bolt":   boltStore,
+	}, cleanup
+}
+
+func runConversations(t *testing.T, conversations []conversation) {
+	for _, conv := range conversations {
+		conv := conv
+		t.Run(conv.name, func(t *testing.T) {
+			backends, cleanup := stores(t)
+			defer cleanup()
+			for name, store := range backends {
+				t.Run(name, func(t *testing.T) {
+					runConversation(t, store, conv)
+				})
+			}
+		})
+	}
+}
+
+func runConversation(t *testing.T, store utils.Store, conv conversation) {
+	messenger := utils.NewRecordingMessenger()
+	utils.SetMessenger(messenger)
+	for fileID, content := range conv.files {
+		messenger.AddFile(fileID, []byte(content))
+	}
+	if conv.seed != nil {
+		conv.seed(store)
+	}
+
+	// Tokens of the buttons sent so far, by chat and the value a step presses
+	tokens := make(map[buttonKey]string)
+	for i, s := range conv.steps {
+		update := s.update
+		if update.CallbackQuery != nil {
+			if token, ok := tokens[buttonKey{update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Data}]; ok {
+				// A copy, as the steps are run against every backend
+				callback := *update.CallbackQuery
+				callback.Data = token
+				update.CallbackQuery = &callback
+			}
+		}
+		HandleUserInput(store, &update)
+		sent := messenger.Take()
+		recordTokens(store, &update, sent, tokens)
+		toasts := messenger.TakeToasts()
+
+		sessionID, err := utils.GetSessionID(&update)
+		if err != nil {
+			t.Fatalf("step %d: GetSessionID: %v", i, err)
+		}
+		state, err := store.GetUserState(sessionID)
+		if err != nil {
+			t.Fatalf("step %d: GetUserState: %v", i, err)
+		}
+		if state != s.state {
+			t.Fatalf("step %d: state = %d, want %d", i, state, s.state)
+		}
+		for _, reply := range s.replies {
+			if !anyText(sent, reply) {
+				t.Fatalf("step %d: no message containing %q in %+v", i, reply, sent)
+			}
+		}
+		for _, button := range s.buttons {
+			if !anyButton(sent, button) {
+				t.Fatalf("step %d: no button %q in %+v", i, button, sent)
+			}
+		}
+		for _, text := range s.absent {
+			if anyText(sent, text) {
+				t.Fatalf("step %d: unexpected message containing %q in %+v", i, text, sent)
+			}
+		}
+		for _, text := range s.edits {
+			if !anyEdit(sent, update.CallbackQuery, text) {
+				t.Fatalf("step %d: no edit containing %q in %+v", i, text, sent)
+			}
+		}
+		// Every pressed button is answered once, so the client stops loading
+		if update.CallbackQuery != nil && len(toasts) != 1 {
+			t.Fatalf("step %d: %d callback answers, want 1", i, len(toasts))
+		}
+		if s.toast != "" && (len(toasts) == 0 || toasts[0] != s.toast) {
+			t.Fatalf("step %d: toasts = %q, want %q", i, toasts, s.toast)
+		}
+	}
+	if conv.check != nil {
+		conv.check(t, store)
+	}
+}
+
+type buttonKey struct {
+	chatID int64
+	value  string
+}
+
+/* recordTokens keeps the tokens of the sent buttons that the sender of the update can press */
+func recordTokens(store utils.Store, update *tgbotapi.Update, sent []utils.RecordedMessage, tokens map[buttonKey]string) {
+	from := testUser
+	if update.Message != nil {
+		from = update.Message.From
+	} else if update.CallbackQuery != nil {
+		from = update.CallbackQuery.From
+	}
+	for _, message := range sent {
+		for _, row := range message.CallbackData {
+			for _, token := range row {
+				press := tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+					From:    from,
+					Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: message.ChatID}},
+					Data:    token,
+				}}
+				if value, err := utils.ResolveCallback(store, &press); err == nil {
+					tokens[buttonKey{message.ChatID, value}] = token
+				}
+			}
+		}
+	}
+}
+
+func anyText(sent []utils.RecordedMessage, text string) bool {
+	for _, message := range sent {
+		if strings.Contains(message.Text, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyEdit(sent []utils.RecordedMessage, callback *tgbotapi.CallbackQuery, text string) bool {
+	if callback == nil {
+		return false
+	}
+	for _, message := range sent {
+		if message.EditedID == callback.Message.MessageID && strings.Contains(message.Text, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyButton(sent []utils.RecordedMessage, label string) bool {
+	for _, message := range sent {
+		for _, button := range message.Buttons() {
+			if button == label {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func seedRamen(store utils.Store) {
+	for _, chatID := range []int64{testPrivateID, testGroupID} {
+		store.AddItem(strconv.FormatInt(chatID, 10), constants.ItemDetails{
+			ID:      "ramen1",
+			Name:    "Ramen",
+			Address: "1 Tras St",
+			Tags:    map[string]bool{"dinner": true},
+		})
+	}
+}
+
+/* seedMeals adds items to the group to search by several tags */
+func seedMeals(store utils.Store) {
+	chatID := strconv.FormatInt(testGroupID, 10)
+	for _, itemData := range []constants.ItemDetails{
+		{ID: "ramen1", Name: "Ramen", Tags: map[string]bool{"dinner": true, "cheap": true}},
+		{ID: "steak1", Name: "Steak", Tags: map[string]bool{"dinner": true}},
+		{ID: "curry1", Name: "Curry", Tags: map[string]bool{"dinner": true, "cheap": true, "spicy": true}},
+		{ID: "salad1", Name: "Salad", Tags: map[string]bool{"lunch": true, "cheap": true}},
+	} {
+		store.AddItem(chatID, itemData)
+	}
+}
+
+/* seedPlaces adds items with locations around Tanjong Pagar, and one without, to the group */
+func seedPlaces(store utils.Store) {
+	chatID := strconv.FormatInt(testGroupID, 10)
+	for _, itemData := range []constants.ItemDetails{
+		{ID: "ramen1", Name: "Ramen", Address: "1 Tras St", Location: &constants.Location{Latitude: 1.2770, Longitude: 103.8460}},
+		{ID: "airport1", Name: "Airport Cafe", Location: &constants.Location{Latitude: 1.3644, Longitude: 103.9915}},
+		{ID: "curry1", Name: "Curry", Location: &constants.Location{Latitude: 1.3000, Longitude: 103.8500}},
+		{ID: "salad1", Name: "Salad"},
+	} {
+		store.AddItem(chatID, itemData)
+	}
+}
+
+/* getItem finds an item by name, returning an empty item if there is none */
+func getItem(t *testing.T, store utils.Store, chatID int64, name string) constants.ItemDetails {
+	t.Helper()
+	items, err := store.GetItems(strconv.FormatInt(chatID, 10))
+	if err != nil {
+		t.Fatalf("GetItems: %v", err)
+	}
+	for itemID, itemData := range items {
+		if itemData.Name == name {
+			if itemData.ID != itemID {
+				t.Errorf("item %q stored under %q", itemData.ID, itemID)
+			}
+			return itemData
+		}
+	}
+	return constants.ItemDetails{}
+}
+
+/* ########## Conversations ##########*/
+func TestAddItem(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "private chat",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/start"), state: constants.Idle, replies: []string{"I am ready!"}},
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName, replies: []string{"enter the name"}},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction, buttons: []string{"/setAddress", "/submit"}},
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress, replies: []string{"Send an address"}},
+				{update: textUpdate(testPrivateID, "1 Tras St"), state: constants.ReadyForNextAction, replies: []string{"Address set to: 1 Tras St"}},
+				{update: textUpdate(testPrivateID, "/addImage"), state: constants.AddNewSetImages},
+				{update: photoUpdate(testPrivateID, "small", "large"), state: constants.ReadyForNextAction, replies: []string{"Image added"}},
+				{update: textUpdate(testPrivateID, "/addTag"), state: constants.AddNewSetTags, buttons: []string{"/done"}},
+				{update: textUpdate(testPrivateID, "ramen.spot"), state: constants.AddNewSetTags, replies: []string{`has a .`}, absent: []string{"added"}},
+				{update: textUpdate(testPrivateID, "ramen"), state: constants.AddNewSetTags, replies: []string{`Tag "ramen" added`}},
+				{update: textUpdate(testPrivateID, "dinner"), state: constants.AddNewSetTags},
+				{update: callbackUpdate(testPrivateID, "/done"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/removeTag"), state: constants.AddNewRemoveTags, buttons: []string{"ramen", "dinner"}},
+				{update: callbackUpdate(testPrivateID, "dinner"), state: constants.AddNewRemoveTags, replies: []string{`Tag "dinner" removed`}},
+				// Typed, not taken as a filter
+				{update: textUpdate(testPrivateID, "/done"), state: constants.ReadyForNextAction, absent: []string{"matching"}},
+				{update: textUpdate(testPrivateID, "/preview"), state: constants.ReadyForNextAction, replies: []string{"Name: Ramen", "Tags: ramen"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit, buttons: []string{"yes", "no"}},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle, replies: []string{"Ramen has been added/edited!"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Address != "1 Tras St" {
+					t.Errorf("address = %q", itemData.Address)
+				}
+				if !itemData.Images["large"] || len(itemData.Images) != 1 {
+					t.Errorf("images = %v", itemData.Images)
+				}
+				if !itemData.Tags["ramen"] || itemData.Tags["dinner"] {
+					t.Errorf("tags = %v", itemData.Tags)
+				}
+			},
+		},
+		{
+			name: "redirected from group",
+			steps: []step{
+				{update: textUpdate(testGroupID, "/additem"), state: constants.Idle, buttons: []string{"Add item"}},
+				{update: textUpdate(testPrivateID, "/start addItem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "no"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle, replies: []string{"Ramen has been added/edited"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Ramen").Name != "Ramen" {
+					t.Error("item not added to group")
+				}
+				if getItem(t, store, testPrivateID, "Ramen").Name != "" {
+					t.Error("item added to private chat")
+				}
+			},
+		},
+		{
+			name: "cancel",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "something else"), state: constants.ReadyForNextAction, replies: []string{"select a response"}},
+				{update: textUpdate(testPrivateID, "/cancel"), state: constants.Idle, replies: []string{"cancelled"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testPrivateID, "Ramen").Name != "" {
+					t.Error("cancelled item was added")
+				}
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestEditItem(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "set notes",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/edititem"), state: constants.GetItemToEdit, buttons: []string{"Ramen"}},
+				{update: textUpdate(testPrivateID, "ram"), state: constants.GetItemToEdit, replies: []string{`1 matching "ram"`}, buttons: []string{"Ramen", "Show all"}},
+				{update: callbackUpdate(testPrivateID, "ramen1"), state: constants.ReadyForNextAction, replies: []string{"editing *Ramen*"}},
+				{update: textUpdate(testPrivateID, "/setNotes"), state: constants.AddNewSetNotes},
+				{update: textUpdate(testPrivateID, "Go early"), state: constants.ReadyForNextAction, replies: []string{"Notes set to: Go early"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Notes != "Go early" || itemData.Address != "1 Tras St" {
+					t.Errorf("item = %+v", itemData)
+				}
+			},
+		},
+		{
+			name: "rename",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/edititem"), state: constants.GetItemToEdit},
+				{update: callbackUpdate(testPrivateID, "ramen1"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setName"), state: constants.AddNewChangeName},
+				{update: textUpdate(testPrivateID, "Ramen / Udon"), state: constants.ReadyForNextAction, replies: []string{"Name set to: Ramen / Udon"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen / Udon")
+				if itemData.ID != "ramen1" || itemData.Address != "1 Tras St" {
+					t.Errorf("item = %+v", itemData)
+				}
+				if getItem(t, store, testPrivateID, "Ramen").Name != "" {
+					t.Error("old name still stored")
+				}
+				itemNames, _ := store.GetItemNames(strconv.FormatInt(testPrivateID, 10))
+				if len(itemNames) != 1 || itemNames["ramen1"] != "Ramen / Udon" {
+					t.Errorf("item names = %v", itemNames)
+				}
+			},
+		},
+		{
+			name: "redirected from group",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/edititem"), state: constants.Idle, buttons: []string{"Edit item"}},
+				{update: textUpdate(testPrivateID, "/start editItem"), state: constants.GetItemToEdit, buttons: []string{"Ramen"}},
+				{update: callbackUpdate(testPrivateID, "ramen1"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setURL"), state: constants.AddNewSetURL},
+				{update: textUpdate(testPrivateID, "https://ramen.example"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if url := getItem(t, store, testGroupID, "Ramen").URL; url != "https://ramen.example" {
+					t.Errorf("url = %q", url)
+				}
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestDeleteItem(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "confirm",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect, buttons: []string{"Ramen"}},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm, buttons: []string{"yes", "no"},
+					edits: []string{"Are you sure you want to delete Ramen?"}},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, edits: []string{"Ramen has been deleted"}, toast: "Deleted"},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Ramen").Name != "" {
+					t.Error("item not deleted")
+				}
+				names, _ := store.GetItemNames(strconv.FormatInt(testGroupID, 10))
+				if len(names) != 0 {
+					t.Errorf("item names = %v", names)
+				}
+			},
+		},
+		{
+			name: "cancel",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, edits: []string{"cancelled"}, toast: "Cancelled"},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Ramen").Name != "Ramen" {
+					t.Error("item deleted")
+				}
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestButtons(t *testing.T) {
+	pressedByOther := callbackUpdate(testGroupID, "ramen1")
+	pressedByOther.CallbackQuery.From = &tgbotapi.User{ID: testUserID + 1, UserName: "other"}
+	conversations := []conversation{
+		{
+			name: "invalid input is only answered",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+				{update: textUpdate(testGroupID, "yes"), state: constants.DeleteConfirm, replies: []string{"Please select from the above options"}},
+				// Not a button of the keyboard, so not a token
+				{update: callbackUpdate(testGroupID, "maybe"), state: constants.DeleteConfirm, absent: []string{"deleted"},
+					toast: "This button is no longer active"},
+			},
+		},
+		{
+			name: "button of another user",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				{update: pressedByOther, state: constants.Idle, absent: []string{"Are you sure"}, toast: "This button is for someone else"},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+			},
+		},
+		{
+			name: "button of a replaced keyboard",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				// The token of "yes" is of the first keyboard
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.DeleteSelect, toast: "This button is no longer active"},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Ramen").Name != "Ramen" {
+					t.Error("item deleted")
+				}
+			},
+		},
+		{
+			name: "button of a finished flow",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, absent: []string{"deleted"},
+					toast: "This button is no longer active"},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Ramen").Name != "Ramen" {
+					t.Error("item deleted")
+				}
+			},
+		},
+		{
+			name: "tags picked in place",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testGroupID, "/getAll"), state: constants.QuerySetTags, edits: []string{"Add the tags"}, buttons: []string{"/done"}},
+				{update: callbackUpdate(testGroupID, "dinner"), state: constants.QuerySetTags, edits: []string{"Selected tags: dinner"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestPagedKeyboard(t *testing.T) {
+	seedMany := func(store utils.Store) {
+		for i := 0; i < 20; i++ {
+			store.AddItem(strconv.FormatInt(testGroupID, 10), constants.ItemDetails{
+				ID:   "item" + strconv.Itoa(i),
+				Name: fmt.Sprintf("Item %02d", i),
+			})
+		}
+	}
+	conversations := []conversation{
+		{
+			name: "turn and filter pages",
+			seed: seedMany,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect, replies: []string{"Type part of a name"},
+					buttons: []string{"Item 00", "Item 07", "1/3", "next »"}, absent: []string{"Item 08"}},
+				{update: callbackUpdate(testGroupID, utils.PageData+"1"), state: constants.DeleteSelect,
+					buttons: []string{"Item 08", "« prev", "2/3"}, absent: []string{"Item 00"}},
+				{update: textUpdate(testGroupID, "item 1"), state: constants.DeleteSelect, replies: []string{`10 matching "item 1"`},
+					buttons: []string{"Item 10", "Show all", "next »"}, absent: []string{"Item 01"}},
+				{update: callbackUpdate(testGroupID, utils.PageData+"1"), state: constants.DeleteSelect, buttons: []string{"Item 19", "« prev"}},
+				{update: textUpdate(testGroupID, "soup"), state: constants.DeleteSelect, replies: []string{`Nothing matches "soup"`}, buttons: []string{"Show all"}},
+				{update: callbackUpdate(testGroupID, utils.ClearFilterData), state: constants.DeleteSelect,
+					edits: []string{"Which item do you want to delete?"}, buttons: []string{"Item 00", "1/3"}},
+				{update: callbackUpdate(testGroupID, "item3"), state: constants.DeleteConfirm, edits: []string{"Are you sure you want to delete Item 03?"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestQuery(t *testing.T) {
+	conversations := []conversation{
+		{
+			name:  "no items",
+			steps: []step{{update: textUpdate(testGroupID, "/query"), state: constants.Idle, replies: []string{"No items registered"}}},
+		},
+		{
+			name: "one with name",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType, buttons: []string{"/getOne", "/getFew", "/getAll"}},
+				{update: callbackUpdate(testGroupID, "/getOne"), state: constants.QueryOneTagOrName, buttons: []string{"/withTag", "/withName", "/random"}},
+				{update: callbackUpdate(testGroupID, "/withName"), state: constants.QueryOneSetName, buttons: []string{"Ramen"}},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.QueryRetrieve, buttons: []string{"yes", "no"}},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, replies: []string{"Name: Ramen", "Address: 1 Tras St"}},
+			},
+		},
+		{
+			name: "one at random",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testGroupID, "/getOne"), state: constants.QueryOneTagOrName},
+				{update: callbackUpdate(testGroupID, "/random"), state: constants.QueryRetrieve},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, replies: []string{"Name: Ramen"}},
+			},
+		},
+		{
+			name: "few",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testGroupID, "/getFew"), state: constants.QueryFewSetNum, replies: []string{"How many items"}},
+				{update: textUpdate(testGroupID, "many"), state: constants.QueryFewSetNum, replies: []string{"proper number"}},
+				{update: textUpdate(testGroupID, "5"), state: constants.QuerySetTags, replies: []string{"assume you want 1"}, buttons: []string{"dinner", "/done"}},
+				{update: textUpdate(testGroupID, "/done"), state: constants.QueryRetrieve, absent: []string{"matching", "Nothing matches"}},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, replies: []string{"Name: Ramen"}},
+			},
+		},
+		{
+			name: "all",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testGroupID, "/getAll"), state: constants.QuerySetTags, buttons: []string{"dinner"}},
+				{update: callbackUpdate(testGroupID, "/done"), state: constants.QueryRetrieve},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, replies: []string{"Name: Ramen"}},
+			},
+		},
+		{
+			name: "all tags but not one",
+			seed: seedMeals,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testGroupID, "/getAll"), state: constants.QuerySetTags, buttons: []string{"/all", "/any", "/not", "/done"}},
+				{update: callbackUpdate(testGroupID, "dinner"), state: constants.QuerySetTags, edits: []string{"Selected tags: dinner"}},
+				{update: callbackUpdate(testGroupID, "cheap"), state: constants.QuerySetTags, edits: []string{"Selected tags: cheap OR dinner"}},
+				{update: callbackUpdate(testGroupID, "/all"), state: constants.QuerySetTags, edits: []string{"Selected tags: cheap AND dinner"}, toast: "Matching all tags"},
+				{update: callbackUpdate(testGroupID, "/not"), state: constants.QueryExcludeTags, edits: []string{"leave out"}, buttons: []string{"lunch", "spicy", "/done"}},
+				{update: callbackUpdate(testGroupID, "spicy"), state: constants.QueryExcludeTags, edits: []string{"Selected tags: cheap AND dinner AND NOT spicy"}},
+				{update: callbackUpdate(testGroupID, "/done"), state: constants.QueryRetrieve},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, edits: []string{"Searching with tags: cheap AND dinner AND NOT spicy"},
+					replies: []string{"Found 1 result(s)", "Name: Ramen"}, absent: []string{"Steak", "Curry", "Salad"}},
+			},
+		},
+		{
+			name: "any tag but not one",
+			seed: seedMeals,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testGroupID, "/getAll"), state: constants.QuerySetTags},
+				{update: callbackUpdate(testGroupID, "cheap"), state: constants.QuerySetTags},
+				{update: callbackUpdate(testGroupID, "lunch"), state: constants.QuerySetTags},
+				{update: callbackUpdate(testGroupID, "/all"), state: constants.QuerySetTags, edits: []string{"cheap AND lunch"}},
+				{update: callbackUpdate(testGroupID, "/any"), state: constants.QuerySetTags, edits: []string{"cheap OR lunch"}, toast: "Matching any tag"},
+				{update: callbackUpdate(testGroupID, "/not"), state: constants.QueryExcludeTags, buttons: []string{"dinner", "spicy"}},
+				{update: callbackUpdate(testGroupID, "dinner"), state: constants.QueryExcludeTags, edits: []string{"(cheap OR lunch) AND NOT dinner"}},
+				{update: callbackUpdate(testGroupID, "/done"), state: constants.QueryRetrieve},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, replies: []string{"Name: Salad"}, absent: []string{"Ramen", "Curry", "Steak"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestLocation(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "add location",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction, buttons: []string{"/setLocation"}},
+				{update: textUpdate(testPrivateID, "/setLocation"), state: constants.AddNewSetLocation, replies: []string{"Send a location or venue"}},
+				{update: textUpdate(testPrivateID, "1 Tras St"), state: constants.AddNewSetLocation, replies: []string{"Send a location or venue"}},
+				{update: locationUpdate(testPrivateID, 1.277, 103.846), state: constants.ReadyForNextAction, replies: []string{"Location set to: 1.27700, 103.84600"}, absent: []string{"Address set"}},
+				{update: textUpdate(testPrivateID, "/preview"), state: constants.ReadyForNextAction, replies: []string{"Name: Ramen", "Ramen\n1.27700, 103.84600"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Location == nil || *itemData.Location != (constants.Location{Latitude: 1.277, Longitude: 103.846}) {
+					t.Errorf("location = %+v", itemData.Location)
+				}
+			},
+		},
+		{
+			name: "add venue",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setLocation"), state: constants.AddNewSetLocation},
+				{update: venueUpdate(testPrivateID, "1 Tras St", 1.277, 103.846), state: constants.ReadyForNextAction, replies: []string{"Location set", "Address set to: 1 Tras St"}},
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress},
+				{update: textUpdate(testPrivateID, "2 Tras St"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setLocation"), state: constants.AddNewSetLocation},
+				// The address set is kept
+				{update: venueUpdate(testPrivateID, "1 Tras St", 1.278, 103.846), state: constants.ReadyForNextAction, absent: []string{"Address set"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Address != "2 Tras St" || itemData.Location == nil || itemData.Location.Latitude != 1.278 {
+					t.Errorf("address = %q, location = %+v", itemData.Address, itemData.Location)
+				}
+			},
+		},
+		{
+			name: "near me",
+			seed: seedPlaces,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType, buttons: []string{"/nearMe"}},
+				{update: callbackUpdate(testGroupID, "/nearMe"), state: constants.QueryNearMe, edits: []string{"Searching near you"}, replies: []string{"Send your location", "📎 → Location"}},
+				{update: textUpdate(testGroupID, "here"), state: constants.QueryNearMe, replies: []string{"Send your location"}},
+				{update: locationUpdate(testGroupID, 1.2765, 103.8456), state: constants.Idle,
+					replies: []string{"Closest to you:\n1. Ramen, 71 m\n2. Curry, 2.7 km\n3. Airport Cafe, 19 km", "Name: Curry", "Airport Cafe\n1.36440, 103.99150"},
+					absent:  []string{"Salad"}},
+			},
+		},
+		{
+			name: "near me in private chat",
+			seed: func(store utils.Store) {
+				store.AddItem(strconv.FormatInt(testPrivateID, 10), constants.ItemDetails{ID: "salad1", Name: "Salad"})
+			},
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testPrivateID, "/nearMe"), state: constants.QueryNearMe, buttons: []string{"Send my location"}},
+				{update: locationUpdate(testPrivateID, 1.2765, 103.8456), state: constants.Idle, replies: []string{"None of the items have a location"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+/* seedMovies adds a movies list to the group, besides the meals of its main list */
+func seedMovies(store utils.Store) {
+	seedMeals(store)
+	chatID := strconv.FormatInt(testGroupID, 10)
+	store.AddList(chatID, "movies")
+	store.AddItem(chatID+"_movies", constants.ItemDetails{ID: "inception1", Name: "Inception", Tags: map[string]bool{"scifi": true}})
+}
+
+/* listItemNames returns the names of the items of a list of the group */
+func listItemNames(t *testing.T, store utils.Store, list string) []string {
+	t.Helper()
+	items, err := store.GetItems(utils.ItemList{ChatID: testGroupID, Name: list}.ID())
+	if err != nil {
+		t.Fatalf("GetItems: %v", err)
+	}
+	names := make([]string, 0, len(items))
+	for _, itemData := range items {
+		names = append(names, itemData.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLists(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "new list",
+			seed: seedMeals,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/newlist"), state: constants.NewListSetName, replies: []string{"What should the new list be called?"}},
+				{update: textUpdate(testGroupID, "weekend hikes"), state: constants.NewListSetName, replies: []string{"List names are up to 32 letters"}},
+				{update: textUpdate(testGroupID, "Hikes"), state: constants.Idle, replies: []string{"Created the list hikes, and switched to it"}},
+				{update: textUpdate(testGroupID, "/newlist main"), state: constants.Idle, replies: []string{"There already is a list named main"}},
+				{update: textUpdate(testGroupID, "/add MacRitchie | #easy"), state: constants.Idle, replies: []string{"MacRitchie has been added/edited in hikes"}},
+				{update: textUpdate(testGroupID, "/search ramen"), state: constants.Idle, replies: []string{`Nothing matches "ramen"`}},
+				{update: textUpdate(testGroupID, "/uselist main"), state: constants.Idle, replies: []string{"Now using the list main"}},
+				{update: textUpdate(testGroupID, "/search ramen"), state: constants.Idle, replies: []string{"Name: Ramen"}},
+				{update: textUpdate(testGroupID, "/uselist films"), state: constants.Idle, replies: []string{"There is no list named films. The lists of this chat are: main, hikes"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if names := listItemNames(t, store, "hikes"); !reflect.DeepEqual(names, []string{"MacRitchie"}) {
+					t.Errorf("hikes = %v", names)
+				}
+				if names := listItemNames(t, store, utils.MainList); len(names) != 4 {
+					t.Errorf("main = %v", names)
+				}
+			},
+		},
+		{
+			name: "picked first when ambiguous",
+			seed: seedMovies,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.SelectList,
+					replies: []string{"This chat has several lists. Which one is it for?"}, buttons: []string{"main", "movies"}},
+				{update: callbackUpdate(testGroupID, "movies"), state: constants.QuerySelectType, edits: []string{"Using the list movies"}, buttons: []string{"/getAll"}},
+				{update: textUpdate(testGroupID, "/reset"), state: constants.Idle},
+				// Picked once for the chat
+				{update: textUpdate(testGroupID, "/search inceptoin"), state: constants.Idle, replies: []string{"Name: Inception"}},
+			},
+		},
+		{
+			name: "arguments kept while picking",
+			seed: seedMovies,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/search ramen"), state: constants.SelectList},
+				{update: textUpdate(testGroupID, "mov"), state: constants.SelectList, replies: []string{`1 matching "mov"`}, absent: []string{"Name: Ramen"}},
+				{update: callbackUpdate(testGroupID, utils.ClearFilterData), state: constants.SelectList, buttons: []string{"main"}},
+				{update: callbackUpdate(testGroupID, "main"), state: constants.Idle, edits: []string{"Using the list main"}, replies: []string{"Name: Ramen"}},
+			},
+		},
+		{
+			name:  "document kept while picking",
+			seed:  seedMovies,
+			files: map[string]string{"file1": "name,tags\nDune,scifi\nInception,scifi\n"},
+			steps: []step{
+				{update: documentUpdate(testGroupID, "file1", "movies.csv", "/import"), state: constants.SelectList},
+				{update: callbackUpdate(testGroupID, "movies"), state: constants.ImportConfirm, edits: []string{"Using the list movies"},
+					replies: []string{"Read 2 item(s): 1 new, 1 duplicate"}, absent: []string{"Send a CSV or JSON file"}},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, replies: []string{"in movies"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if names := listItemNames(t, store, "movies"); !reflect.DeepEqual(names, []string{"Dune", "Inception"}) {
+					t.Errorf("movies = %v", names)
+				}
+			},
+		},
+		{
+			name: "uselist without name",
+			seed: seedMovies,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/uselist"), state: constants.SelectList, replies: []string{"Which list do you want to use?"}, buttons: []string{"main", "movies"}},
+				{update: callbackUpdate(testGroupID, "movies"), state: constants.Idle, edits: []string{"Now using the list movies"}},
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect, buttons: []string{"Inception"}, absent: []string{"Ramen"}},
+			},
+		},
+		{
+			name: "item added from group to its list",
+			seed: seedMovies,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/additem"), state: constants.SelectList},
+				{update: callbackUpdate(testGroupID, "movies"), state: constants.Idle, buttons: []string{"Add item"}},
+				{update: textUpdate(testPrivateID, "/start addItem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Dune"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle, replies: []string{"Dune has been added/edited in movies"}},
+				// The private chat has a list of its own
+				{update: textUpdate(testPrivateID, "/deleteitem"), state: constants.DeleteSelect, absent: []string{"Dune"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if names := listItemNames(t, store, "movies"); !reflect.DeepEqual(names, []string{"Dune", "Inception"}) {
+					t.Errorf("movies = %v", names)
+				}
+			},
+		},
+		{
+			name: "item edited in its list",
+			seed: seedMovies,
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/start"), state: constants.Idle},
+				{update: textUpdate(testGroupID, "/uselist movies"), state: constants.Idle},
+				{update: textUpdate(testGroupID, "/edititem"), state: constants.Idle},
+				{update: textUpdate(testPrivateID, "/start editItem"), state: constants.GetItemToEdit, buttons: []string{"Inception"}, absent: []string{"Ramen"}},
+				{update: callbackUpdate(testPrivateID, "inception1"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setNotes"), state: constants.AddNewSetNotes},
+				{update: textUpdate(testPrivateID, "Twice"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				items, _ := store.GetItems(strconv.FormatInt(testGroupID, 10) + "_movies")
+				if items["inception1"].Notes != "Twice" {
+					t.Errorf("edited item = %+v", items["inception1"])
+				}
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+/* placesGeocoder knows the addresses it maps, and can't be reached for "down" */
+type placesGeocoder map[string]constants.Location
+
+func (g placesGeocoder) Geocode(address string) (constants.Location, error) {
+	if address == "down" {
+		return constants.Location{}, errors.New("unreachable")
+	}
+	location, ok := g[address]
+	if !ok {
+		return constants.Location{}, utils.ErrAddressNotFound
+	}
+	return location, nil
+}
+
+func TestGeocoding(t *testing.T) {
+	utils.SetGeocoder(placesGeocoder{
+		"1 Tras St": {Latitude: 1.277, Longitude: 103.846},
+		"2 Tras St": {Latitude: 1.278, Longitude: 103.846},
+	})
+	defer utils.SetGeocoder(nil)
+
+	conversations := []conversation{
+		{
+			name: "address found",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress},
+				{update: textUpdate(testPrivateID, "1 Tras St"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/preview"), state: constants.ReadyForNextAction, replies: []string{"Address: 1 Tras St", "Ramen\n1 Tras St"}, absent: []string{"Couldn't place"}},
+				// A new address moves the item
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress},
+				{update: textUpdate(testPrivateID, "2 Tras St"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Location == nil || *itemData.Location != (constants.Location{Latitude: 1.278, Longitude: 103.846, Geocoded: true}) {
+					t.Errorf("location = %+v", itemData.Location)
+				}
+			},
+		},
+		{
+			name: "address not found",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress},
+				{update: textUpdate(testPrivateID, "1 Tras St"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress},
+				{update: textUpdate(testPrivateID, "Behind the market"), state: constants.ReadyForNextAction, absent: []string{"Couldn't place"}},
+				{update: textUpdate(testPrivateID, "/preview"), state: constants.ReadyForNextAction,
+					replies: []string{"Address: Behind the market", `Couldn't place "Behind the market" on the map, the address wasn't found. Send its location with /setLocation`},
+					absent:  []string{"Ramen\n1 Tras St"}},
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress},
+				{update: textUpdate(testPrivateID, "down"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/preview"), state: constants.ReadyForNextAction, replies: []string{"the map service couldn't be reached"}},
+				// A location sent in its place settles it
+				{update: textUpdate(testPrivateID, "/setLocation"), state: constants.AddNewSetLocation},
+				{update: locationUpdate(testPrivateID, 1.2765, 103.8456), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/preview"), state: constants.ReadyForNextAction, absent: []string{"Couldn't place"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Address != "down" || itemData.Location == nil || itemData.Location.Latitude != 1.2765 {
+					t.Errorf("address = %q, location = %+v", itemData.Address, itemData.Location)
+				}
+			},
+		},
+		{
+			name:  "added in one message, not imported",
+			files: map[string]string{"file1": "name,address\nCurry,2 Tras St\nLaksa,Behind the market\n"},
+			steps: []step{
+				{update: textUpdate(testGroupID, "/add Ramen | 1 Tras St | #dinner"), state: constants.Idle, replies: []string{"Ramen has been added/edited"}},
+				{update: documentUpdate(testGroupID, "file1", "places.csv", "/import"), state: constants.ImportConfirm},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, replies: []string{"2 item(s) have been imported"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				for name, want := range map[string]*constants.Location{
+					"Ramen": {Latitude: 1.277, Longitude: 103.846, Geocoded: true},
+					// Imports aren't looked up
+					"Curry": nil,
+					"Laksa": nil,
+				} {
+					if itemData := getItem(t, store, testGroupID, name); !reflect.DeepEqual(itemData.Location, want) {
+						t.Errorf("%s location = %+v, want %+v", name, itemData.Location, want)
+					}
+				}
+			},
+		},
+		{
+			name: "edited item without a location placed",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/edititem"), state: constants.GetItemToEdit},
+				{update: callbackUpdate(testPrivateID, "ramen1"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setNotes"), state: constants.AddNewSetNotes},
+				{update: textUpdate(testPrivateID, "Go early"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Location == nil || itemData.Location.Latitude != 1.277 {
+					t.Errorf("location = %+v", itemData.Location)
+				}
+			},
+		},
+		{
+			name: "sent location kept",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setLocation"), state: constants.AddNewSetLocation},
+				{update: locationUpdate(testPrivateID, 1.2765, 103.8456), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/setAddress"), state: constants.AddNewSetAddress},
+				{update: textUpdate(testPrivateID, "1 Tras St"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Ramen")
+				if itemData.Location == nil || *itemData.Location != (constants.Location{Latitude: 1.2765, Longitude: 103.8456}) {
+					t.Errorf("location = %+v", itemData.Location)
+				}
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestSearch(t *testing.T) {
+	conversations := []conversation{
+		{
+			name:  "no items",
+			steps: []step{{update: textUpdate(testGroupID, "/search ramen"), state: constants.Idle, replies: []string{"No items registered"}}},
+		},
+		{
+			name: "with text",
+			seed: seedMeals,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/search ramn"), state: constants.Idle, replies: []string{`Best 1 match(es) for "ramn"`, "Name: Ramen"}},
+				{update: textUpdate(testGroupID, "/search spicey diner"), state: constants.Idle, replies: []string{"Best 3 match(es)", "Name: Curry", "Name: Ramen", "Name: Steak"}, absent: []string{"Salad"}},
+				{update: textUpdate(testGroupID, "/search sushi"), state: constants.Idle, replies: []string{`Nothing matches "sushi"`}},
+			},
+		},
+		{
+			name: "prompted",
+			seed: seedMeals,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/search"), state: constants.QuerySearch, replies: []string{"What are you looking for?"}},
+				{update: photoUpdate(testGroupID, "photo1"), state: constants.QuerySearch, replies: []string{"Send the words to search for"}},
+				{update: textUpdate(testGroupID, "salad"), state: constants.Idle, replies: []string{"Name: Salad"}},
+			},
+		},
+		{
+			name: "from query",
+			seed: seedMeals,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType, buttons: []string{"/search"}},
+				{update: callbackUpdate(testGroupID, "/search"), state: constants.QuerySearch, edits: []string{"Searching by name"}, replies: []string{"What are you looking for?"}},
+				{update: textUpdate(testGroupID, "staek"), state: constants.Idle, replies: []string{"Name: Steak"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+/* failingStore rejects every item write, like a backend whose atomic update failed */
+type failingStore struct {
+	utils.Store
+}
+
+func (s failingStore) AddItem(chatID string, itemData constants.ItemDetails) error {
+	return errors.New("write failed")
+}
+
+func (s failingStore) DeleteItem(chatID, itemID string) error {
+	return errors.New("write failed")
+}
+
+func (s failingStore) AddItems(chatID string, items []constants.ItemDetails) error {
+	return errors.New("write failed")
+}
+
+func TestFailedWrites(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "add not announced",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.ConfirmAddItemSubmit, replies: []string{"error occured"}, absent: []string{"has been added"}},
+			},
+		},
+		{
+			name: "delete not announced",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, replies: []string{"could not delete"}, absent: []string{"has been deleted"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Ramen").Name != "Ramen" {
+					t.Error("item deleted")
+				}
+			},
+		},
+		{
+			name: "import not announced",
+			steps: []step{
+				{update: textUpdate(testGroupID, "/import Ramen\nUdon"), state: constants.ImportConfirm},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, replies: []string{"could not import"}, absent: []string{"have been imported"}},
+			},
+		},
+	}
+	for _, conv := range conversations {
+		conv := conv
+		t.Run(conv.name, func(t *testing.T) {
+			store := utils.NewMemoryStore()
+			if conv.seed != nil {
+				conv.seed(store)
+				conv.seed = nil
+			}
+			runConversation(t, failingStore{store}, conv)
+		})
+	}
+}
+
+/* failingQueryStore fails reading item names or saving the query number, like a backend that went away */
+type failingQueryStore struct {
+	utils.Store
+	failNames    bool
+	failQueryNum bool
+}
+
+func (s failingQueryStore) GetItemNames(chatID string) (map[string]string, error) {
+	if s.failNames {
+		return nil, errors.New("read failed")
+	}
+	return s.Store.GetItemNames(chatID)
+}
+
+func (s failingQueryStore) SetQueryNum(sessionID string, num int) error {
+	if s.failQueryNum {
+		return errors.New("write failed")
+	}
+	return s.Store.SetQueryNum(sessionID, num)
+}
+
+func TestFailedQueries(t *testing.T) {
+	conversations := []struct {
+		conversation
+		wrap func(utils.Store) utils.Store
+	}{
+		{
+			conversation: conversation{
+				name: "item names not read",
+				steps: []step{
+					{update: textUpdate(testGroupID, "/query"), state: constants.Idle, replies: []string{"Sorry, an error occured!"}, absent: []string{"No items registered"}},
+					{update: textUpdate(testGroupID, "/search ramen"), state: constants.Idle, replies: []string{"Sorry, an error occured!"}, absent: []string{"No items registered"}},
+				},
+			},
+			wrap: func(store utils.Store) utils.Store { return failingQueryStore{Store: store, failNames: true} },
+		},
+		{
+			conversation: conversation{
+				name: "query number not saved",
+				steps: []step{
+					{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+					{update: callbackUpdate(testGroupID, "/getOne"), state: constants.QuerySelectType, replies: []string{"Sorry, an error occured!"}},
+				},
+			},
+			wrap: func(store utils.Store) utils.Store { return failingQueryStore{Store: store, failQueryNum: true} },
+		},
+	}
+	for _, conv := range conversations {
+		conv := conv
+		t.Run(conv.name, func(t *testing.T) {
+			store := utils.NewMemoryStore()
+			seedRamen(store)
+			runConversation(t, conv.wrap(store), conv.conversation)
+		})
+	}
+}
+
+/* lostTargetStore doesn't keep the item targeted, failing with err */
+type lostTargetStore struct {
+	utils.Store
+	err error
+}
+
+func (s lostTargetStore) SetItemTarget(sessionID, itemID string) error {
+	return s.err
+}
+
+func TestLostDeleteTarget(t *testing.T) {
+	conversations := []struct {
+		conversation
+		err error
+	}{
+		{
+			conversation: conversation{
+				name: "not saved",
+				steps: []step{
+					{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+					{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteSelect, replies: []string{"Sorry, an error occured!"}},
+				},
+			},
+			err: errors.New("write failed"),
+		},
+		{
+			conversation: conversation{
+				name: "missing",
+				steps: []step{
+					{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+					{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+					{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, edits: []string{"not found"}, absent: []string{"has been deleted"}},
+				},
+			},
+		},
+	}
+	for _, conv := range conversations {
+		conv := conv
+		t.Run(conv.name, func(t *testing.T) {
+			store := utils.NewMemoryStore()
+			seedRamen(store)
+			runConversation(t, lostTargetStore{store, conv.err}, conv.conversation)
+			if getItem(t, store, testGroupID, "Ramen").Name != "Ramen" {
+				t.Error("item deleted")
+			}
+		})
+	}
+}
+
+/* failingClearStore fails clearing the items staged for an import */
+type failingClearStore struct {
+	utils.Store
+}
+
+func (s failingClearStore) SetImportItems(sessionID string, items []constants.ItemDetails) error {
+	if items == nil {
+		return errors.New("write failed")
+	}
+	return s.Store.SetImportItems(sessionID, items)
+}
+
+func TestFailedImportClear(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "confirmed",
+			steps: []step{
+				{update: textUpdate(testGroupID, "/import Ramen"), state: constants.ImportConfirm},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, replies: []string{"have been imported", "Sorry, an error occured!"}},
+			},
+		},
+		{
+			name: "cancelled",
+			steps: []step{
+				{update: textUpdate(testGroupID, "/import Ramen"), state: constants.ImportConfirm},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.ImportConfirm, replies: []string{"Sorry, an error occured!"}, absent: []string{"Import cancelled"}},
+			},
+		},
+	}
+	for _, conv := range conversations {
+		conv := conv
+		t.Run(conv.name, func(t *testing.T) {
+			runConversation(t, failingClearStore{utils.NewMemoryStore()}, conv)
+		})
+	}
+}
+
+func TestTagIndex(t *testing.T) {
+	noTags := func(chatID int64) func(t *testing.T, store utils.Store) {
+		return func(t *testing.T, store utils.Store) {
+			if tags, _ := store.GetTags(strconv.FormatInt(chatID, 10)); len(tags) != 0 {
+				t.Errorf("tags = %v", tags)
+			}
+		}
+	}
+	conversations := []conversation{
+		{
+			name: "tag removed by edit",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/edititem"), state: constants.GetItemToEdit},
+				{update: callbackUpdate(testPrivateID, "ramen1"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/removeTag"), state: constants.AddNewRemoveTags, buttons: []string{"dinner"}},
+				{update: callbackUpdate(testPrivateID, "dinner"), state: constants.AddNewRemoveTags},
+				{update: callbackUpdate(testPrivateID, "/done"), state: constants.ReadyForNextAction},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: noTags(testPrivateID),
+		},
+		{
+			name: "tag removed by delete",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/deleteitem"), state: constants.DeleteSelect},
+				{update: callbackUpdate(testGroupID, "ramen1"), state: constants.DeleteConfirm},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle},
+			},
+			check: noTags(testGroupID),
+		},
+		{
+			name: "query does not prune",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: callbackUpdate(testGroupID, "/getAll"), state: constants.QuerySetTags},
+				{update: callbackUpdate(testGroupID, "dinner"), state: constants.QuerySetTags},
+				{update: callbackUpdate(testGroupID, "/done"), state: constants.QueryRetrieve},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, replies: []string{"Name: Ramen"}, absent: []string{"delete"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if tags, _ := store.GetTags(strconv.FormatInt(testGroupID, 10)); !tags["dinner"] {
+					t.Errorf("tags = %v", tags)
+				}
+			},
+		},
+		{
+			name: "rebuild",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/rebuildindex"), state: constants.Idle, replies: []string{"1 item(s), 1 tag(s)"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestSessions(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "flows in several chats",
+			seed: func(store utils.Store) {
+				seedRamen(store)
+				store.AddItem(strconv.FormatInt(testOtherGroupID, 10), constants.ItemDetails{ID: "udon1", Name: "Udon"})
+			},
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query"), state: constants.QuerySelectType},
+				{update: textUpdate(testOtherGroupID, "/deleteitem"), state: constants.DeleteSelect, buttons: []string{"Udon"}},
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: callbackUpdate(testGroupID, "/getOne"), state: constants.QueryOneTagOrName},
+				{update: callbackUpdate(testOtherGroupID, "udon1"), state: constants.DeleteConfirm},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+				{update: callbackUpdate(testGroupID, "/random"), state: constants.QueryRetrieve},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, replies: []string{"Name: Ramen"}},
+				{update: callbackUpdate(testOtherGroupID, "yes"), state: constants.Idle, replies: []string{"Udon has been deleted"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestSessionTimeout(t *testing.T) {
+	privateSession := utils.SessionID(testUserID, testPrivateID)
+	abandoned := func(store utils.Store) {
+		store.SetTempItem(privateSession, constants.ItemDetails{Name: "Ramen"})
+		store.SetUserState(privateSession, constants.AddNewSetAddress)
+		store.TouchSession(privateSession, time.Now().Add(-utils.SESSION_TIMEOUT-time.Minute))
+	}
+	conversations := []conversation{
+		{
+			name: "expired",
+			seed: abandoned,
+			steps: []step{
+				{update: textUpdate(testPrivateID, "1 Tras St"), state: constants.Idle, replies: []string{"/additem or /edititem was cancelled"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if itemData, _ := store.GetTempItem(privateSession); itemData.Name != "" {
+					t.Errorf("temp item = %+v", itemData)
+				}
+			},
+		},
+		{
+			name: "still active",
+			seed: func(store utils.Store) {
+				abandoned(store)
+				store.TouchSession(privateSession, time.Now())
+			},
+			steps: []step{
+				{update: textUpdate(testPrivateID, "1 Tras St"), state: constants.ReadyForNextAction, replies: []string{"Address set to: 1 Tras St"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+/* Sessions swept before the user's next message are told then, as that message finds them cleared */
+func TestSweptSessionNotice(t *testing.T) {
+	privateSession := utils.SessionID(testUserID, testPrivateID)
+	groupSession := utils.SessionID(testUserID, testGroupID)
+	backends, cleanup := stores(t)
+	defer cleanup()
+	for name, store := range backends {
+		t.Run(name, func(t *testing.T) {
+			messenger := utils.NewRecordingMessenger()
+			utils.SetMessenger(messenger)
+			store.SetUserState(privateSession, constants.AddNewSetAddress)
+			store.TouchSession(privateSession, time.Now().Add(-utils.SESSION_TIMEOUT-time.Minute))
+			store.TouchSession(groupSession, time.Now().Add(-utils.SESSION_TIMEOUT-time.Minute))
+
+			sessions, err := utils.SweepSessions(store, time.Now().Add(-utils.SESSION_TIMEOUT), NotifyExpired)
+			if err != nil || sessions != 2 {
+				t.Fatalf("SweepSessions = %d, %v", sessions, err)
+			}
+			sent := messenger.Take()
+			if len(sent) != 1 || sent[0].ChatID != testPrivateID || !strings.Contains(sent[0].Text, "/additem or /edititem was cancelled") {
+				t.Fatalf("sent %+v, want one notice to the private chat", sent)
+			}
+
+			// The next message starts afresh, without a second notice
+			update := textUpdate(testPrivateID, "1 Tras St")
+			HandleUserInput(store, &update)
+			if anyText(messenger.Take(), "cancelled") {
+				t.Errorf("notified again on the next message")
+			}
+			if state, _ := store.GetUserState(privateSession); state != constants.Idle {
+				t.Errorf("state = %d, want Idle", state)
+			}
+		})
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "add named item",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem@toGoListBot Ramen Keisuke"), state: constants.ReadyForNextAction, buttons: []string{"/submit"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle, replies: []string{"Ramen Keisuke has been added/edited!"}},
+			},
+		},
+		{
+			name: "add named item from group",
+			steps: []step{
+				{update: textUpdate(testGroupID, "/additem Ramen"), state: constants.Idle, replies: []string{"start adding Ramen"}, buttons: []string{"Add item"}},
+				{update: textUpdate(testPrivateID, "/start addNamedItem"), state: constants.ReadyForNextAction, replies: []string{"details for Ramen"}},
+				{update: textUpdate(testPrivateID, "/submit"), state: constants.ConfirmAddItemSubmit},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Ramen").Name != "Ramen" {
+					t.Error("item not added to group")
+				}
+			},
+		},
+		{
+			name: "query with tag",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query tag:lunch"), state: constants.Idle, replies: []string{"Found 0 result(s)"}},
+				{update: textUpdate(testGroupID, "/query tag:dinner 1"), state: constants.Idle, replies: []string{"Name: Ramen"}},
+				{update: textUpdate(testGroupID, "/query dinner"), state: constants.Idle, replies: []string{"Usage: /query"}},
+				{update: textUpdate(testGroupID, "/query tag:v1.2"), state: constants.Idle, replies: []string{"Usage: /query"}},
+			},
+		},
+		{
+			name: "query with all and not",
+			seed: seedMeals,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query tag:dinner tag:cheap all not:spicy"), state: constants.Idle,
+					replies: []string{"Searching with tags: cheap AND dinner AND NOT spicy", "Name: Ramen"}, absent: []string{"Steak", "Curry", "Salad"}},
+				{update: textUpdate(testGroupID, "/query not:dinner"), state: constants.Idle,
+					replies: []string{"Searching with tags: NOT dinner", "Name: Salad"}, absent: []string{"Ramen", "Steak", "Curry"}},
+			},
+		},
+		{
+			name: "other bot",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/query@otherBot"), state: constants.Idle, absent: []string{"query"}},
+				{update: textUpdate(testGroupID, "/query@toGoListBot"), state: constants.QuerySelectType},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestAddInline(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "added",
+			steps: []step{
+				{update: textUpdate(testGroupID, "/add Ramen Keisuke | 1 Tras St | #ramen #dinner"), state: constants.Idle, replies: []string{"Ramen Keisuke has been added"}},
+				{update: textUpdate(testGroupID, "/add | 1 Tras St"), state: constants.Idle, replies: []string{"Could not add the item: the name is missing"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testGroupID, "Ramen Keisuke")
+				if itemData.Address != "1 Tras St" || !itemData.Tags["ramen"] || !itemData.Tags["dinner"] {
+					t.Errorf("item = %+v", itemData)
+				}
+				if tags, _ := store.GetTags(strconv.FormatInt(testGroupID, 10)); len(tags) != 2 {
+					t.Errorf("tags = %v", tags)
+				}
+			},
+		},
+		{
+			name: "wizard kept",
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/additem"), state: constants.AddNewSetName},
+				{update: textUpdate(testPrivateID, "/add Udon"), state: constants.AddNewSetName, replies: []string{"Udon has been added"}},
+				{update: textUpdate(testPrivateID, "Ramen"), state: constants.ReadyForNextAction},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestImport(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "pasted",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/import Udon | #noodles\nramen\n\n| no name\nSoba\nUdon"), state: constants.ImportConfirm,
+					replies: []string{"Read 5 item(s): 2 new, 2 duplicate, 1 invalid", "2: ramen is already in the list", "6: Udon is also on 1", "4: the name is missing"},
+					buttons: []string{"yes", "no"}},
+				{update: callbackUpdate(testGroupID, "yes"), state: constants.Idle, replies: []string{"2 item(s) have been imported"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if !getItem(t, store, testGroupID, "Udon").Tags["noodles"] || getItem(t, store, testGroupID, "Soba").Name != "Soba" {
+					t.Error("items not imported")
+				}
+				if names, _ := store.GetItemNames(strconv.FormatInt(testGroupID, 10)); len(names) != 3 {
+					t.Errorf("names = %v", names)
+				}
+			},
+		},
+		{
+			name:  "csv",
+			files: map[string]string{"file1": "Name,Address,Tags\nUdon,2 Tras St,\"noodles, lunch\"\n,3 Tras St,\n"},
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/import"), state: constants.ImportSetItems},
+				{update: photoUpdate(testPrivateID, "photo1"), state: constants.ImportSetItems, replies: []string{"Please send a CSV or JSON file"}},
+				{update: documentUpdate(testPrivateID, "file1", "places.csv", ""), state: constants.ImportConfirm,
+					replies: []string{"1 new, 0 duplicate, 1 invalid", "3: the name is missing"}},
+				{update: callbackUpdate(testPrivateID, "yes"), state: constants.Idle, replies: []string{"1 item(s) have been imported"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				itemData := getItem(t, store, testPrivateID, "Udon")
+				if itemData.Address != "2 Tras St" || !itemData.Tags["noodles"] || !itemData.Tags["lunch"] {
+					t.Errorf("item = %+v", itemData)
+				}
+			},
+		},
+		{
+			name:  "json caption",
+			files: map[string]string{"file1": `[{"name": "Udon", "tags": ["#noodles"]}, {"name": "Soba", "tags": "noodles lunch"}]`},
+			steps: []step{
+				{update: documentUpdate(testGroupID, "file1", "places.json", "/import"), state: constants.ImportConfirm, replies: []string{"2 new"}},
+				{update: callbackUpdate(testGroupID, "no"), state: constants.Idle, replies: []string{"Import cancelled"}},
+			},
+			check: func(t *testing.T, store utils.Store) {
+				if getItem(t, store, testGroupID, "Udon").Name != "" {
+					t.Error("cancelled import added items")
+				}
+			},
+		},
+		{
+			name:  "unsupported file",
+			files: map[string]string{"file1": "Udon"},
+			steps: []step{
+				{update: documentUpdate(testGroupID, "file1", "places.txt", "/import"), state: constants.Idle, replies: []string{"only .csv and .json files"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestExport(t *testing.T) {
+	conversations := []conversation{
+		{
+			name: "selected",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testGroupID, "/export"), state: constants.ExportSelectFormat, buttons: []string{"csv", "json", "md"}},
+				{update: textUpdate(testGroupID, "csv"), state: constants.ExportSelectFormat, replies: []string{"Please select"}},
+				{update: callbackUpdate(testGroupID, "json"), state: constants.Idle, replies: []string{"1 item(s) exported"}},
+			},
+		},
+		{
+			name: "with format",
+			seed: seedRamen,
+			steps: []step{
+				{update: textUpdate(testPrivateID, "/export md"), state: constants.Idle, replies: []string{"1 item(s) exported"}},
+				{update: textUpdate(testPrivateID, "/export pdf"), state: constants.Idle, replies: []string{"Usage: /export"}},
+			},
+		},
+		{
+			name: "no items",
+			steps: []step{
+				{update: textUpdate(testGroupID, "/export csv"), state: constants.Idle, replies: []string{"No items registered"}, absent: []string{"exported"}},
+			},
+		},
+	}
+	runConversations(t, conversations)
+}
+
+func TestInlineQuery(t *testing.T) {
+	store := utils.NewMemoryStore()
+	messenger := utils.NewRecordingMessenger()
+	utils.SetMessenger(messenger)
+	seedRamen(store)
+	store.AddItem(strconv.FormatInt(testGroupID, 10), constants.ItemDetails{
+		ID:     "udon1",
+		Name:   "Udon",
+		URL:    "https://udon.example",
+		Images: map[string]bool{"photo1": true},
+		Tags:   map[string]bool{"noodles": true},
+	})
+	// Lists of other users aren't searched
+	store.AddItem(strconv.FormatInt(testOtherGroupID, 10), constants.ItemDetails{ID: "ramen2", Name: "Ramen Nagi"})
+
+	inline := func(query string) []interface{} {
+		t.Helper()
+		update := tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{ID: "iq", From: testUser, Query: query}}
+		HandleUserInput(store, &update)
+		answers := messenger.TakeInlineAnswers()
+		if len(answers) != 1 || answers[0].InlineQueryID != "iq" || !answers[0].IsPersonal {
+			t.Fatalf("answers = %+v", answers)
+		}
+		return answers[0].Results
+	}
+
+	if results := inline("ramen"); len(results) != 0 {
+		t.Errorf("results before using the bot = %+v", results)
+	}
+
+	group := textUpdate(testGroupID, "/help")
+	group.Message.Chat.Title = "Food"
+	for _, update := range []tgbotapi.Update{group, textUpdate(testPrivateID, "/help")} {
+		HandleUserInput(store, &update)
+	}
+	messenger.Take()
+
+	results := inline("RAMEN")
+	if len(results) != 2 {
+		t.Fatalf("results = %+v", results)
+	}
+	for _, result := range results {
+		article, ok := result.(tgbotapi.InlineQueryResultArticle)
+		if !ok || article.Title != "Ramen" || !strings.Contains(article.Description, "1 Tras St") {
+			t.Errorf("result = %+v", result)
+		}
+	}
+
+	// By tag, shared with its image and URL
+	results = inline("noodle")
+	if len(results) != 1 {
+		t.Fatalf("results = %+v", results)
+	}
+	photo, ok := results[0].(utils.InlineQueryResultCachedPhoto)
+	if !ok || photo.PhotoFileID != "photo1" || photo.Description != "Food" || !strings.Contains(photo.Caption, "Name: Udon") || photo.ReplyMarkup == nil {
+		t.Errorf("result = %+v", results[0])
+	}
+
+	if results := inline("ramen noodles"); len(results) != 0 {
+		t.Errorf("results = %+v", results)
+	}
+	if results := inline(""); len(results) != 3 {
+		t.Errorf("results = %+v", results)
+	}
+
+	// Result IDs stay within Telegram's 64 bytes for the longest list names, and apart for the same item ID
+	longName := strings.Repeat("食", utils.MaxListName)
+	if _, err := utils.ListName(longName); err != nil {
+		t.Fatalf("ListName: %v", err)
+	}
+	longList := utils.ItemList{ChatID: testGroupID, Name: longName}
+	store.AddList(strconv.FormatInt(testGroupID, 10), longName)
+	store.AddItem(longList.ID(), constants.ItemDetails{ID: "ramen1", Name: "Ramen Keisuke"})
+	results = inline("ramen")
+	if len(results) != 3 {
+		t.Fatalf("results = %+v", results)
+	}
+	resultIDs := make(map[string]bool)
+	for _, result := range results {
+		var resultID string
+		switch result := result.(type) {
+		case tgbotapi.InlineQueryResultArticle:
+			resultID = result.ID
+		case utils.InlineQueryResultCachedPhoto:
+			resultID = result.ID
+		}
+		if resultID == "" || len(resultID) > 64 || resultIDs[resultID] {
+			t.Errorf("result ID %q of %+v", resultID, result)
+		}
+		resultIDs[resultID] = true
+	}
+}
+
+func TestHelpBotUsername(t *testing.T) {
+	username := utils.BOT_USERNAME
+	utils.BOT_USERNAME = "myListBot"
+	defer func() { utils.BOT_USERNAME = username }()
+
+	runConversations(t, []conversation{{
+		name:  "inline mode",
+		steps: []step{{update: textUpdate(testGroupID, "/help"), state: constants.Idle, replies: []string{"@myListBot <words>"}, absent: []string{"@toGoListBot"}}},
+	}})
+}
@@ -0,0 +1,30 @@
+// Command workflowdoc regenerates the Workflow section of the README from the
+// bot's state definitions, so the documented states never drift from the code.
+// Run from the repository root, or through go generate in services.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+
+	"github.com/xfated/golistbot/services"
+)
+
+func main() {
+	readmePath := flag.String("readme", "README.md", "path of the README to update")
+	flag.Parse()
+
+	readme, err := ioutil.ReadFile(*readmePath)
+	if err != nil {
+		log.Fatalln("Error reading README:", err)
+	}
+	updated, err := services.ReplaceWorkflowDoc(string(readme))
+	if err != nil {
+		log.Fatalln("Error updating README:", err)
+	}
+	if err := ioutil.WriteFile(*readmePath, []byte(updated), 0644); err != nil {
+		log.Fatalln("Error writing README:", err)
+	}
+	log.Printf("Updated %s", *readmePath)
+}